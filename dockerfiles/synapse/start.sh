@@ -17,12 +17,54 @@ done
 # Remove the AS_REGISTRATION_FILES entry
 sed -i "s/AS_REGISTRATION_FILES//g" /conf/homeserver.yaml
 
-# generate an ssl cert for the server, signed by our dummy CA
-openssl req -new -key /conf/server.tls.key -out /conf/server.tls.csr \
-  -subj "/CN=${SERVER_NAME}"
-openssl x509 -req -in /conf/server.tls.csr \
-  -CA /ca/ca.crt -CAkey /ca/ca.key -set_serial 1 \
-  -out /conf/server.tls.crt
+# An empty federation whitelist disables federation entirely
+if [ "$COMPLEMENT_FEDERATION_DISABLED" = "1" ] && ! grep -q "^federation_domain_whitelist:" /conf/homeserver.yaml; then
+  echo "federation_domain_whitelist: []" >> /conf/homeserver.yaml
+fi
+
+# Deep-merge any config overrides provided by the blueprint into the homeserver.yaml config
+if [ -f /complement/config_overrides.json ]; then
+  python - <<'EOF'
+import json
+import yaml
+
+def merge(base, overrides):
+    for key, value in overrides.items():
+        if isinstance(value, dict) and isinstance(base.get(key), dict):
+            merge(base[key], value)
+        else:
+            base[key] = value
+
+with open("/conf/homeserver.yaml") as f:
+    config = yaml.safe_load(f)
+with open("/complement/config_overrides.json") as f:
+    merge(config, json.load(f))
+with open("/conf/homeserver.yaml", "w") as f:
+    yaml.safe_dump(config, f)
+EOF
+fi
+
+if [ -f /complement/tls/server.tls.crt ]; then
+  # use the ssl cert the blueprint asked for
+  cp /complement/tls/server.tls.crt /conf/server.tls.crt
+  cp /complement/tls/server.tls.key /conf/server.tls.key
+else
+  # generate an ssl cert for the server, signed by our dummy CA
+  openssl req -new -key /conf/server.tls.key -out /conf/server.tls.csr \
+    -subj "/CN=${SERVER_NAME}"
+  openssl x509 -req -in /conf/server.tls.csr \
+    -CA /ca/ca.crt -CAkey /ca/ca.key -set_serial 1 \
+    -out /conf/server.tls.crt
+fi
+
+# Run the homeserver with libfaketime if the blueprint asked for it, so that Complement can shift its clock by
+# writing to /complement/faketime
+FAKETIME_LIB=$(find /usr/lib -name libfaketime.so.1 | head -n 1)
+if [ "$COMPLEMENT_CLOCK_OFFSET_ENABLED" = "1" ] && [ -n "$FAKETIME_LIB" ]; then
+  mkdir -p /complement
+  [ -f /complement/faketime ] || echo "+0" > /complement/faketime
+  export LD_PRELOAD="$FAKETIME_LIB" FAKETIME_TIMESTAMP_FILE=/complement/faketime FAKETIME_NO_CACHE=1
+fi
 
 exec python -m synapse.app.homeserver -c /conf/homeserver.yaml "$@"
 
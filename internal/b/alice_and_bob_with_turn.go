@@ -0,0 +1,32 @@
+package b
+
+// BlueprintAliceAndBobWithTURN contains two homeservers with 1 user in each, where only hs2 has a TURN server
+// configured
+var BlueprintAliceAndBobWithTURN = MustValidate(Blueprint{
+	Name: "alice_and_bob_with_turn",
+	Homeservers: []Homeserver{
+		{
+			Name: "hs1",
+			Users: []User{
+				{
+					Localpart:   "@alice",
+					DisplayName: "Alice",
+				},
+			},
+		},
+		{
+			Name: "hs2",
+			Users: []User{
+				{
+					Localpart:   "@bob",
+					DisplayName: "Bob",
+				},
+			},
+			ConfigOverrides: map[string]interface{}{
+				"turn_uris":          []string{"turn:turn.hs2:3478?transport=udp"},
+				"turn_shared_secret": "complement_turn_secret",
+				"turn_user_lifetime": "1h",
+			},
+		},
+	},
+})
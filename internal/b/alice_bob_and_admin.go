@@ -0,0 +1,26 @@
+package b
+
+// BlueprintAliceBobAndAdmin is a homeserver with 2 users and a server admin
+var BlueprintAliceBobAndAdmin = MustValidate(Blueprint{
+	Name: "alice_bob_and_admin",
+	Homeservers: []Homeserver{
+		{
+			Name: "hs1",
+			Users: []User{
+				{
+					Localpart:   "@alice",
+					DisplayName: "Alice",
+				},
+				{
+					Localpart:   "@bob",
+					DisplayName: "Bob",
+				},
+				{
+					Localpart:   "@admin",
+					DisplayName: "Admin",
+					IsAdmin:     true,
+				},
+			},
+		},
+	},
+})
@@ -0,0 +1,26 @@
+package b
+
+// BlueprintAliceBobInsecureIdentityServer is a homeserver with 2 users, which trusts identity servers with
+// self-signed certificates such as Deployment.IdentityServer
+var BlueprintAliceBobInsecureIdentityServer = MustValidate(Blueprint{
+	Name: "alice_bob_insecure_identity_server",
+	Homeservers: []Homeserver{
+		{
+			Name: "hs1",
+			Users: []User{
+				{
+					Localpart:   "@alice",
+					DisplayName: "Alice",
+				},
+				{
+					Localpart:   "@bob",
+					DisplayName: "Bob",
+				},
+			},
+			// the mock identity server has a self-signed certificate
+			ConfigOverrides: map[string]interface{}{
+				"use_insecure_ssl_client_just_for_testing_do_not_use": true,
+			},
+		},
+	},
+})
@@ -0,0 +1,18 @@
+package b
+
+// BlueprintAliceClockOffset is a single user homeserver whose clock can be changed with Deployment.SetClockOffset
+var BlueprintAliceClockOffset = MustValidate(Blueprint{
+	Name: "alice_clock_offset",
+	Homeservers: []Homeserver{
+		{
+			Name: "hs1",
+			Users: []User{
+				{
+					Localpart:   "@alice",
+					DisplayName: "Alice",
+				},
+			},
+			ClockOffsetEnabled: true,
+		},
+	},
+})
@@ -0,0 +1,20 @@
+package b
+
+// BlueprintAliceGuestAccess is a single user homeserver which allows guest users to register
+var BlueprintAliceGuestAccess = MustValidate(Blueprint{
+	Name: "alice_guest_access",
+	Homeservers: []Homeserver{
+		{
+			Name: "hs1",
+			Users: []User{
+				{
+					Localpart:   "@alice",
+					DisplayName: "Alice",
+				},
+			},
+			ConfigOverrides: map[string]interface{}{
+				"allow_guest_access": true,
+			},
+		},
+	},
+})
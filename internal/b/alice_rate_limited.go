@@ -0,0 +1,23 @@
+package b
+
+// BlueprintAliceRateLimited is a single user homeserver which rate limits messages to 1 every 10 seconds
+var BlueprintAliceRateLimited = MustValidate(Blueprint{
+	Name: "alice_rate_limited",
+	Homeservers: []Homeserver{
+		{
+			Name: "hs1",
+			Users: []User{
+				{
+					Localpart:   "@alice",
+					DisplayName: "Alice",
+				},
+			},
+			ConfigOverrides: map[string]interface{}{
+				"rc_message": map[string]interface{}{
+					"per_second":  0.1,
+					"burst_count": 1,
+				},
+			},
+		},
+	},
+})
@@ -0,0 +1,19 @@
+package b
+
+// BlueprintAliceResourceLimited is a single user homeserver whose container is limited to 1GB of memory and half a CPU
+var BlueprintAliceResourceLimited = MustValidate(Blueprint{
+	Name: "alice_resource_limited",
+	Homeservers: []Homeserver{
+		{
+			Name: "hs1",
+			Users: []User{
+				{
+					Localpart:   "@alice",
+					DisplayName: "Alice",
+				},
+			},
+			MemoryLimitBytes: 1024 * 1024 * 1024,
+			CPULimit:         0.5,
+		},
+	},
+})
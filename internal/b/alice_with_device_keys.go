@@ -0,0 +1,33 @@
+package b
+
+// BlueprintAliceWithDeviceKeys is a homeserver with 2 users, where Alice has uploaded device keys and a one-time key
+var BlueprintAliceWithDeviceKeys = MustValidate(Blueprint{
+	Name: "alice_with_device_keys",
+	Homeservers: []Homeserver{
+		{
+			Name: "hs1",
+			Users: []User{
+				{
+					Localpart:   "@alice",
+					DisplayName: "Alice",
+					DeviceID:    Ptr("ALICEDEVICE"),
+					DeviceKeys: &DeviceKeys{
+						Keys: map[string]string{
+							"curve25519:ALICEDEVICE": "curve25519+key",
+							"ed25519:ALICEDEVICE":    "ed25519+key",
+						},
+						OneTimeKeys: map[string]interface{}{
+							"signed_curve25519:AAAAHQ": map[string]interface{}{
+								"key": "one+time+key",
+							},
+						},
+					},
+				},
+				{
+					Localpart:   "@bob",
+					DisplayName: "Bob",
+				},
+			},
+		},
+	},
+})
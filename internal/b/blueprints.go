@@ -15,7 +15,7 @@
 package b
 
 import (
-	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"strconv"
@@ -24,15 +24,24 @@ import (
 
 // KnownBlueprints lists static blueprints
 var KnownBlueprints = map[string]*Blueprint{
-	BlueprintCleanHS.Name:                     &BlueprintCleanHS,
-	BlueprintAlice.Name:                       &BlueprintAlice,
-	BlueprintFederationOneToOneRoom.Name:      &BlueprintFederationOneToOneRoom,
-	BlueprintFederationTwoLocalOneRemote.Name: &BlueprintFederationTwoLocalOneRemote,
-	BlueprintHSWithApplicationService.Name:    &BlueprintHSWithApplicationService,
-	BlueprintOneToOneRoom.Name:                &BlueprintOneToOneRoom,
-	BlueprintPerfManyMessages.Name:            &BlueprintPerfManyMessages,
-	BlueprintPerfManyRooms.Name:               &BlueprintPerfManyRooms,
-	BlueprintPerfE2EERoom.Name:                &BlueprintPerfE2EERoom,
+	BlueprintCleanHS.Name:                        &BlueprintCleanHS,
+	BlueprintAlice.Name:                          &BlueprintAlice,
+	BlueprintFederationOneToOneRoom.Name:         &BlueprintFederationOneToOneRoom,
+	BlueprintFederationTwoLocalOneRemote.Name:    &BlueprintFederationTwoLocalOneRemote,
+	BlueprintHSWithApplicationService.Name:       &BlueprintHSWithApplicationService,
+	BlueprintOneToOneRoom.Name:                   &BlueprintOneToOneRoom,
+	BlueprintPerfManyMessages.Name:               &BlueprintPerfManyMessages,
+	BlueprintPerfManyRooms.Name:                  &BlueprintPerfManyRooms,
+	BlueprintPerfE2EERoom.Name:                   &BlueprintPerfE2EERoom,
+	BlueprintAliceResourceLimited.Name:           &BlueprintAliceResourceLimited,
+	BlueprintAliceClockOffset.Name:               &BlueprintAliceClockOffset,
+	BlueprintAliceRateLimited.Name:               &BlueprintAliceRateLimited,
+	BlueprintAliceGuestAccess.Name:               &BlueprintAliceGuestAccess,
+	BlueprintAliceBobInsecureIdentityServer.Name: &BlueprintAliceBobInsecureIdentityServer,
+	BlueprintAliceAndBobWithTURN.Name:            &BlueprintAliceAndBobWithTURN,
+	BlueprintAliceWithDeviceKeys.Name:            &BlueprintAliceWithDeviceKeys,
+	BlueprintAliceBobAndAdmin.Name:               &BlueprintAliceBobAndAdmin,
+	BlueprintFederationDisabled.Name:             &BlueprintFederationDisabled,
 }
 
 // Blueprint represents an entire deployment to make.
@@ -54,6 +63,25 @@ type Homeserver struct {
 	Rooms []Room
 	// The list of application services to create on the homeserver
 	ApplicationServices []ApplicationService
+	// Config keys to deep-merge into the homeserver config before it starts. Only the keys which need
+	// changing should be set e.g { "rc_message": { "per_second": 1000 } }. Requires the homeserver image
+	// to apply the overrides, see the README.
+	ConfigOverrides map[string]interface{}
+	// True to run this homeserver with federation disabled, so that it neither sends nor accepts federation
+	// traffic. Requires the homeserver image to support this, see the README.
+	FederationDisabled bool
+	// True to run this homeserver under libfaketime, so that tests can shift its clock with
+	// Deployment.SetClockOffset. Requires the homeserver image to support this, see the README.
+	ClockOffsetEnabled bool
+	// The name of the docker.HomeserverRuntime to run this homeserver with, which runs the runtime's default image
+	// e.g "dendrite". If empty, the homeserver runs with the runtime and image selected for the whole run.
+	Runtime string
+	// The maximum amount of memory in bytes the homeserver container may use when deployed, or 0 for no limit.
+	// The limit does not apply while the blueprint is being built.
+	MemoryLimitBytes int64
+	// The maximum number of CPUs the homeserver container may use when deployed e.g 0.5, or 0 for no limit.
+	// The limit does not apply while the blueprint is being built.
+	CPULimit float64
 }
 
 type User struct {
@@ -66,6 +94,22 @@ type User struct {
 	// amount of one-time keys. This requires the DeviceId to be set as
 	// well.
 	OneTimeKeys uint
+	// Upload these known keys for this user's device, rather than generating
+	// random keys with OneTimeKeys. This requires the DeviceId to be set as
+	// well.
+	DeviceKeys *DeviceKeys
+	// Register this user as a server admin, with shared-secret registration. This requires the
+	// homeserver image to support it, see the README. Admins cannot have a DeviceID.
+	IsAdmin bool
+}
+
+// DeviceKeys are keys to upload for a device. Keys are opaque to the homeserver,
+// so they need not be real olm keys.
+type DeviceKeys struct {
+	// The identity keys of the device, keyed by key ID e.g { "ed25519:DEVICEID": "..." }
+	Keys map[string]string
+	// The one-time keys of the device, keyed by key ID e.g { "signed_curve25519:AAAAHQ": { "key": "..." } }
+	OneTimeKeys map[string]interface{}
 }
 
 type AccountData struct {
@@ -82,12 +126,30 @@ type Room struct {
 }
 
 type ApplicationService struct {
-	ID              string
-	HSToken         string
-	ASToken         string
+	ID string
+	// The tokens used to authenticate the homeserver and application service to each other.
+	// Tokens are generated from the blueprint, homeserver and application service names if these are not set.
+	HSToken string
+	ASToken string
+	// The URL the homeserver pushes transactions to. If the host is host.docker.internal, the port is replaced
+	// when the blueprint is deployed with one which docker.Deployment.AppServiceInbox listens on.
 	URL             string
 	SenderLocalpart string
 	RateLimited     bool
+	// The users, rooms and aliases this application service is interested in. If no namespaces
+	// are set, the application service is interested in all users.
+	Namespaces Namespaces
+}
+
+type Namespaces struct {
+	Users   []Namespace
+	Rooms   []Namespace
+	Aliases []Namespace
+}
+
+type Namespace struct {
+	Exclusive bool
+	Regex     string
 }
 
 type Event struct {
@@ -120,6 +182,15 @@ func Validate(bp Blueprint) (Blueprint, error) {
 			if strings.Contains(u.Localpart, ":") {
 				return bp, fmt.Errorf("HS %s user localpart '%s' must not contain a domain", hs.Name, u.Localpart)
 			}
+			if (u.OneTimeKeys > 0 || u.DeviceKeys != nil) && u.DeviceID == nil {
+				return bp, fmt.Errorf("HS %s user '%s' must have a DeviceID to upload keys", hs.Name, u.Localpart)
+			}
+			if u.IsAdmin && u.DeviceID != nil {
+				return bp, fmt.Errorf("HS %s user '%s' must not set a DeviceID as it is an admin", hs.Name, u.Localpart)
+			}
+			if u.OneTimeKeys > 0 && u.DeviceKeys != nil {
+				return bp, fmt.Errorf("HS %s user '%s' must not set both OneTimeKeys and DeviceKeys", hs.Name, u.Localpart)
+			}
 			// strip the @
 			hs.Users[i].Localpart = hs.Users[i].Localpart[1:]
 		}
@@ -130,10 +201,7 @@ func Validate(bp Blueprint) (Blueprint, error) {
 			}
 		}
 		for i, as := range hs.ApplicationServices {
-			hs.ApplicationServices[i], err = normalizeApplicationService(as)
-			if err != nil {
-				return bp, err
-			}
+			hs.ApplicationServices[i] = normalizeApplicationService(bp.Name, hs.Name, as)
 		}
 	}
 
@@ -181,23 +249,31 @@ func normaliseUser(u string, hsName string) (string, error) {
 	return u, nil
 }
 
-func normalizeApplicationService(as ApplicationService) (ApplicationService, error) {
-	hsToken := make([]byte, 32)
-	_, err := rand.Read(hsToken)
-	if err != nil {
-		return as, err
+func normalizeApplicationService(bpName, hsName string, as ApplicationService) ApplicationService {
+	if as.HSToken == "" {
+		as.HSToken = generatedToken(bpName, hsName, as.ID, "hs_token")
 	}
-
-	asToken := make([]byte, 32)
-	_, err = rand.Read(asToken)
-	if err != nil {
-		return as, err
+	if as.ASToken == "" {
+		as.ASToken = generatedToken(bpName, hsName, as.ID, "as_token")
+	}
+	if len(as.Namespaces.Users) == 0 && len(as.Namespaces.Rooms) == 0 && len(as.Namespaces.Aliases) == 0 {
+		as.Namespaces.Users = []Namespace{
+			{
+				Exclusive: false,
+				Regex:     ".*",
+			},
+		}
 	}
 
-	as.HSToken = hex.EncodeToString(hsToken)
-	as.ASToken = hex.EncodeToString(asToken)
+	return as
+}
 
-	return as, err
+// generatedToken returns a token for an application service which did not set one. The token is derived from the
+// names rather than random, so that the blueprint hashes the same every time it is validated and images built from
+// it are not needlessly rebuilt.
+func generatedToken(bpName, hsName, asID, tokenName string) string {
+	token := sha256.Sum256([]byte(strings.Join([]string{bpName, hsName, asID, tokenName}, "/")))
+	return hex.EncodeToString(token[:])
 }
 
 // Ptr returns a pointer to `in`, because Go doesn't allow you to inline this.
@@ -0,0 +1,32 @@
+package b
+
+// BlueprintFederationDisabled contains two homeservers, where hs1 has 2 users and federation disabled, and hs2 has
+// 1 user
+var BlueprintFederationDisabled = MustValidate(Blueprint{
+	Name: "federation_disabled",
+	Homeservers: []Homeserver{
+		{
+			Name: "hs1",
+			Users: []User{
+				{
+					Localpart:   "@alice",
+					DisplayName: "Alice",
+				},
+				{
+					Localpart:   "@charlie",
+					DisplayName: "Charlie",
+				},
+			},
+			FederationDisabled: true,
+		},
+		{
+			Name: "hs2",
+			Users: []User{
+				{
+					Localpart:   "@bob",
+					DisplayName: "Bob",
+				},
+			},
+		},
+	},
+})
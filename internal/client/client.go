@@ -2,7 +2,10 @@ package client
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httputil"
@@ -13,6 +16,8 @@ import (
 	"time"
 
 	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"golang.org/x/net/websocket"
 
 	"github.com/matrix-org/complement/internal/b"
 )
@@ -30,6 +35,15 @@ type CSAPI struct {
 	SyncUntilTimeout time.Duration
 	// True to enable verbose logging
 	Debug bool
+	// The name of the homeserver this client targets, used to tag debug logs
+	HSName string
+	// The user ID to masquerade as, when authenticated as an application service. Sent as the `user_id` query parameter.
+	MasqueradeUserID string
+	// The admin API used by the Admin... methods, when authenticated as a server admin. Set by Deployment.AdminClient.
+	AdminAPI AdminAPI
+	// The room version for CreateRoom and CreateRoomError to use when the request body does not set `room_version`,
+	// or "" to use the server's default.
+	DefaultRoomVersion string
 
 	txnID int
 }
@@ -67,76 +81,1876 @@ func (c *CSAPI) DownloadContent(t *testing.T, mxcUri string) ([]byte, string) {
 // CreateRoom creates a room with an optional HTTP request body. Fails the test on error. Returns the room ID.
 func (c *CSAPI) CreateRoom(t *testing.T, creationContent interface{}) string {
 	t.Helper()
-	res := c.MustDo(t, "POST", []string{"_matrix", "client", "r0", "createRoom"}, creationContent)
+	res := c.MustDo(t, "POST", []string{"_matrix", "client", "r0", "createRoom"}, c.withDefaultRoomVersion(t, creationContent))
 	body := ParseJSON(t, res)
 	return GetJSONFieldStr(t, body, "room_id")
 }
 
+// CreateRoomError makes the /createRoom request and returns the response without checking it, for testing
+// rooms which should not be created.
+func (c *CSAPI) CreateRoomError(t *testing.T, creationContent interface{}) *http.Response {
+	t.Helper()
+	return c.DoFunc(t, "POST", []string{"_matrix", "client", "r0", "createRoom"}, WithJSONBody(t, c.withDefaultRoomVersion(t, creationContent)))
+}
+
+// withDefaultRoomVersion returns the /createRoom body with `room_version` set to CSAPI.DefaultRoomVersion, unless
+// the body already sets one. The body may be anything which marshals to a JSON object. Fails the test if it does not.
+func (c *CSAPI) withDefaultRoomVersion(t *testing.T, creationContent interface{}) interface{} {
+	t.Helper()
+	if c.DefaultRoomVersion == "" {
+		return creationContent
+	}
+	content, err := json.Marshal(creationContent)
+	if err != nil {
+		t.Fatalf("CSAPI.CreateRoom failed to marshal body: %s", err)
+	}
+	if string(content) == "null" {
+		content = []byte("{}")
+	}
+	if !gjson.ParseBytes(content).IsObject() {
+		t.Fatalf("CSAPI.CreateRoom body is not a JSON object: %s", string(content))
+	}
+	if gjson.GetBytes(content, "room_version").Exists() {
+		return json.RawMessage(content)
+	}
+	content, err = sjson.SetBytes(content, "room_version", c.DefaultRoomVersion)
+	if err != nil {
+		t.Fatalf("CSAPI.CreateRoom failed to set room_version: %s", err)
+	}
+	return json.RawMessage(content)
+}
+
 // JoinRoom joins the room ID or alias given, else fails the test. Returns the room ID.
 func (c *CSAPI) JoinRoom(t *testing.T, roomIDOrAlias string, serverNames []string) string {
 	t.Helper()
-	// construct URL query parameters
-	query := make(url.Values, len(serverNames))
-	for _, serverName := range serverNames {
-		query.Add("server_name", serverName)
-	}
-	// join the room
-	res := c.MustDoFunc(t, "POST", []string{"_matrix", "client", "r0", "join", roomIDOrAlias}, WithQueries(query))
-	// return the room ID if we joined with it
-	if roomIDOrAlias[0] == '!' {
-		return roomIDOrAlias
+	// construct URL query parameters
+	query := make(url.Values, len(serverNames))
+	for _, serverName := range serverNames {
+		query.Add("server_name", serverName)
+	}
+	// join the room
+	res := c.MustDoFunc(t, "POST", []string{"_matrix", "client", "r0", "join", roomIDOrAlias}, WithQueries(query))
+	// return the room ID if we joined with it
+	if roomIDOrAlias[0] == '!' {
+		return roomIDOrAlias
+	}
+	// otherwise we should be told the room ID if we joined via an alias
+	body := ParseJSON(t, res)
+	return GetJSONFieldStr(t, body, "room_id")
+}
+
+// BanUser bans the user from the room, with an optional reason, else fails the test.
+// Returns the event ID of the resulting membership event.
+func (c *CSAPI) BanUser(t *testing.T, roomID, userID, reason string) string {
+	t.Helper()
+	return c.changeMembership(t, roomID, "ban", userID, reason)
+}
+
+// UnbanUser unbans the user from the room, with an optional reason, else fails the test.
+// Returns the event ID of the resulting membership event.
+func (c *CSAPI) UnbanUser(t *testing.T, roomID, userID, reason string) string {
+	t.Helper()
+	return c.changeMembership(t, roomID, "unban", userID, reason)
+}
+
+// KickUser kicks the user from the room, with an optional reason, else fails the test.
+// Returns the event ID of the resulting membership event.
+func (c *CSAPI) KickUser(t *testing.T, roomID, userID, reason string) string {
+	t.Helper()
+	return c.changeMembership(t, roomID, "kick", userID, reason)
+}
+
+// changeMembership calls the /ban, /unban or /kick endpoint, then looks up the resulting membership event as
+// these endpoints do not return it.
+func (c *CSAPI) changeMembership(t *testing.T, roomID, action, userID, reason string) string {
+	t.Helper()
+	reqBody := map[string]interface{}{
+		"user_id": userID,
+	}
+	if reason != "" {
+		reqBody["reason"] = reason
+	}
+	c.MustDoFunc(t, "POST", []string{"_matrix", "client", "r0", "rooms", roomID, action}, WithJSONBody(t, reqBody))
+	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "r0", "rooms", roomID, "state"})
+	body := ParseJSON(t, res)
+	for _, ev := range gjson.ParseBytes(body).Array() {
+		if ev.Get("type").Str == "m.room.member" && ev.Get("state_key").Str == userID {
+			return ev.Get("event_id").Str
+		}
+	}
+	t.Fatalf("CSAPI.%s: no membership event for %s in room %s", action, userID, roomID)
+	return ""
+}
+
+// Knock knocks on the room ID or alias given, with an optional reason, else fails the test. Returns the room ID.
+func (c *CSAPI) Knock(t *testing.T, roomIDOrAlias string, serverNames []string, reason string) string {
+	t.Helper()
+	res := c.KnockError(t, roomIDOrAlias, serverNames, reason)
+	body := ParseJSON(t, res)
+	if res.StatusCode != 200 {
+		t.Fatalf("CSAPI.Knock response return non-200 code: %s - body: %s", res.Status, string(body))
+	}
+	return GetJSONFieldStr(t, body, "room_id")
+}
+
+// KnockError is the same as Knock but returns the response without checking the status code, for
+// testing knocks which should fail.
+func (c *CSAPI) KnockError(t *testing.T, roomIDOrAlias string, serverNames []string, reason string) *http.Response {
+	t.Helper()
+	query := make(url.Values, len(serverNames))
+	for _, serverName := range serverNames {
+		query.Add("server_name", serverName)
+	}
+	reqBody := map[string]interface{}{}
+	if reason != "" {
+		reqBody["reason"] = reason
+	}
+	return c.DoFunc(t, "POST", []string{"_matrix", "client", "r0", "knock", roomIDOrAlias}, WithQueries(query), WithJSONBody(t, reqBody))
+}
+
+// JoinedRooms returns the IDs of the rooms the user is joined to, else fails the test.
+func (c *CSAPI) JoinedRooms(t *testing.T) []string {
+	t.Helper()
+	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "r0", "joined_rooms"})
+	body := ParseJSON(t, res)
+	var roomIDs []string
+	for _, roomID := range gjson.GetBytes(body, "joined_rooms").Array() {
+		roomIDs = append(roomIDs, roomID.Str)
+	}
+	return roomIDs
+}
+
+// JoinedMembers returns the users joined to the room, keyed by user ID, along with their `display_name` and
+// `avatar_url`. The user must be joined to the room, else fails the test.
+func (c *CSAPI) JoinedMembers(t *testing.T, roomID string) map[string]gjson.Result {
+	t.Helper()
+	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "r0", "rooms", roomID, "joined_members"})
+	body := ParseJSON(t, res)
+	members := make(map[string]gjson.Result)
+	gjson.GetBytes(body, "joined").ForEach(func(userID, member gjson.Result) bool {
+		members[userID.Str] = member
+		return true
+	})
+	return members
+}
+
+// ForgetRoom forgets the room ID, which the user must have left, else fails the test.
+func (c *CSAPI) ForgetRoom(t *testing.T, roomID string) {
+	t.Helper()
+	c.MustDo(t, "POST", []string{"_matrix", "client", "r0", "rooms", roomID, "forget"}, struct{}{})
+}
+
+// MustHaveForgottenRoom fails the test if the room ID appears in an initial /sync, including left rooms,
+// or in /joined_rooms. Use this after ForgetRoom to check that the room is no longer shown to the user.
+func (c *CSAPI) MustHaveForgottenRoom(t *testing.T, roomID string) {
+	t.Helper()
+	res, _ := c.MustSync(t, SyncReq{
+		Filter: `{"room":{"include_leave":true}}`,
+	})
+	roomKey := GjsonEscape(roomID)
+	for _, section := range []string{"join", "invite", "leave"} {
+		if res.Get("rooms." + section + "." + roomKey).Exists() {
+			t.Fatalf("MustHaveForgottenRoom: room %s is in the %s section of /sync", roomID, section)
+		}
+	}
+	for _, joinedRoomID := range c.JoinedRooms(t) {
+		if joinedRoomID == roomID {
+			t.Fatalf("MustHaveForgottenRoom: room %s is in /joined_rooms", roomID)
+		}
+	}
+}
+
+// LeaveRoom joins the room ID, else fails the test.
+func (c *CSAPI) LeaveRoom(t *testing.T, roomID string) {
+	t.Helper()
+	// leave the room
+	c.MustDoFunc(t, "POST", []string{"_matrix", "client", "r0", "rooms", roomID, "leave"})
+}
+
+// InviteRoom invites userID to the room ID, else fails the test.
+func (c *CSAPI) InviteRoom(t *testing.T, roomID string, userID string) {
+	t.Helper()
+	// Invite the user to the room
+	body := map[string]interface{}{
+		"user_id": userID,
+	}
+	c.MustDo(t, "POST", []string{"_matrix", "client", "r0", "rooms", roomID, "invite"}, body)
+}
+
+// InviteRoomError is the same as InviteRoom but returns the response without checking the status code, for
+// testing invites which should fail, e.g because the inviter is below the room's invite power level.
+func (c *CSAPI) InviteRoomError(t *testing.T, roomID string, userID string) *http.Response {
+	t.Helper()
+	body := map[string]interface{}{
+		"user_id": userID,
+	}
+	return c.DoFunc(t, "POST", []string{"_matrix", "client", "r0", "rooms", roomID, "invite"}, WithJSONBody(t, body))
+}
+
+// WhoAmI returns the user ID and device ID which the client's access token belongs to, else fails the test.
+func (c *CSAPI) WhoAmI(t *testing.T) (userID, deviceID string) {
+	t.Helper()
+	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "r0", "account", "whoami"})
+	body := ParseJSON(t, res)
+	return GetJSONFieldStr(t, body, "user_id"), gjson.GetBytes(body, "device_id").Str
+}
+
+// WhoAmIError is the same as WhoAmI but returns the response without checking the status code, for
+// asserting that an access token has been invalidated.
+func (c *CSAPI) WhoAmIError(t *testing.T) *http.Response {
+	t.Helper()
+	return c.DoFunc(t, "GET", []string{"_matrix", "client", "r0", "account", "whoami"})
+}
+
+// Logout invalidates the client's access token, else fails the test. The access token is cleared from
+// the client so that it cannot be accidentally reused.
+func (c *CSAPI) Logout(t *testing.T) {
+	t.Helper()
+	c.MustDo(t, "POST", []string{"_matrix", "client", "r0", "logout"}, struct{}{})
+	c.AccessToken = ""
+}
+
+// LogoutAll invalidates all access tokens for the user, including the client's own, else fails the test.
+// The access token is cleared from the client so that it cannot be accidentally reused.
+func (c *CSAPI) LogoutAll(t *testing.T) {
+	t.Helper()
+	c.MustDo(t, "POST", []string{"_matrix", "client", "r0", "logout", "all"}, struct{}{})
+	c.AccessToken = ""
+}
+
+// GetDevices returns all of the user's devices, else fails the test.
+func (c *CSAPI) GetDevices(t *testing.T) []gjson.Result {
+	t.Helper()
+	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "r0", "devices"})
+	body := ParseJSON(t, res)
+	return gjson.GetBytes(body, "devices").Array()
+}
+
+// GetDevice returns the user's device with the given ID, else fails the test.
+func (c *CSAPI) GetDevice(t *testing.T, deviceID string) gjson.Result {
+	t.Helper()
+	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "r0", "devices", deviceID})
+	body := ParseJSON(t, res)
+	return gjson.ParseBytes(body)
+}
+
+// UpdateDevice sets the display name of the user's device, else fails the test.
+func (c *CSAPI) UpdateDevice(t *testing.T, deviceID, displayName string) {
+	t.Helper()
+	c.MustDo(t, "PUT", []string{"_matrix", "client", "r0", "devices", deviceID}, map[string]interface{}{
+		"display_name": displayName,
+	})
+}
+
+// DeleteDevice deletes the user's device, completing user-interactive authentication with the user's
+// password. Fails the test if the device could not be deleted.
+func (c *CSAPI) DeleteDevice(t *testing.T, deviceID, authPassword string) {
+	t.Helper()
+	paths := []string{"_matrix", "client", "r0", "devices", deviceID}
+	// the first request returns a 401 with the UIA session to authenticate
+	res := c.DoFunc(t, "DELETE", paths, WithJSONBody(t, struct{}{}))
+	if res.StatusCode != 401 {
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		t.Fatalf("CSAPI.DeleteDevice expected 401 to start user-interactive auth, got %s - body: %s", res.Status, string(body))
+	}
+	body := ParseJSON(t, res)
+	c.MustDoFunc(t, "DELETE", paths, WithJSONBody(t, map[string]interface{}{
+		"auth": map[string]interface{}{
+			"type": "m.login.password",
+			"identifier": map[string]interface{}{
+				"type": "m.id.user",
+				"user": c.UserID,
+			},
+			"password": authPassword,
+			"session":  gjson.GetBytes(body, "session").Str,
+		},
+	}))
+}
+
+// DeactivateAccount deactivates the user's account, completing user-interactive authentication with the user's
+// password. If `erase` is true the homeserver is also asked to forget the user's messages, as in a GDPR erasure
+// request. The client's access token no longer works afterwards. Fails the test if the account could not be
+// deactivated.
+func (c *CSAPI) DeactivateAccount(t *testing.T, authPassword string, erase bool) {
+	t.Helper()
+	res := c.DoDeactivateAccount(t, authPassword, erase)
+	if res.StatusCode != 200 {
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		t.Fatalf("CSAPI.DeactivateAccount returned %s - body: %s", res.Status, string(body))
+	}
+}
+
+// DoDeactivateAccount is like DeactivateAccount but returns the response to the authenticated request, rather than
+// failing the test if the account could not be deactivated e.g because the password is wrong.
+func (c *CSAPI) DoDeactivateAccount(t *testing.T, authPassword string, erase bool) *http.Response {
+	t.Helper()
+	paths := []string{"_matrix", "client", "r0", "account", "deactivate"}
+	// the first request returns a 401 with the UIA session to authenticate
+	res := c.DoFunc(t, "POST", paths, WithJSONBody(t, map[string]interface{}{
+		"erase": erase,
+	}))
+	if res.StatusCode != 401 {
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		t.Fatalf("CSAPI.DoDeactivateAccount expected 401 to start user-interactive auth, got %s - body: %s", res.Status, string(body))
+	}
+	body := ParseJSON(t, res)
+	return c.DoFunc(t, "POST", paths, WithJSONBody(t, map[string]interface{}{
+		"auth": map[string]interface{}{
+			"type": "m.login.password",
+			"identifier": map[string]interface{}{
+				"type": "m.id.user",
+				"user": c.UserID,
+			},
+			"password": authPassword,
+			"session":  gjson.GetBytes(body, "session").Str,
+		},
+		"erase": erase,
+	}))
+}
+
+// UploadKeys uploads the device keys and one-time keys for the client's device, else fails the test.
+// Either may be nil to omit it from the request. Returns the response, which contains `one_time_key_counts`.
+func (c *CSAPI) UploadKeys(t *testing.T, deviceKeys, oneTimeKeys interface{}) gjson.Result {
+	t.Helper()
+	reqBody := map[string]interface{}{}
+	if deviceKeys != nil {
+		reqBody["device_keys"] = deviceKeys
+	}
+	if oneTimeKeys != nil {
+		reqBody["one_time_keys"] = oneTimeKeys
+	}
+	res := c.MustDo(t, "POST", []string{"_matrix", "client", "r0", "keys", "upload"}, reqBody)
+	body := ParseJSON(t, res)
+	return gjson.ParseBytes(body)
+}
+
+// QueryKeys queries the device keys for all devices of the given users, who may be on remote servers,
+// else fails the test. Returns the response, which contains `device_keys` and `failures`.
+func (c *CSAPI) QueryKeys(t *testing.T, userIDs []string) gjson.Result {
+	t.Helper()
+	deviceKeys := map[string][]string{}
+	for _, userID := range userIDs {
+		deviceKeys[userID] = []string{}
+	}
+	res := c.MustDo(t, "POST", []string{"_matrix", "client", "r0", "keys", "query"}, map[string]interface{}{
+		"device_keys": deviceKeys,
+	})
+	body := ParseJSON(t, res)
+	return gjson.ParseBytes(body)
+}
+
+// ClaimKeys claims one-time keys, given as a map of user ID to device ID to key algorithm, else fails the test.
+// Returns the response, which contains `one_time_keys` and `failures`.
+func (c *CSAPI) ClaimKeys(t *testing.T, claims map[string]map[string]string) gjson.Result {
+	t.Helper()
+	res := c.MustDo(t, "POST", []string{"_matrix", "client", "r0", "keys", "claim"}, map[string]interface{}{
+		"one_time_keys": claims,
+	})
+	body := ParseJSON(t, res)
+	return gjson.ParseBytes(body)
+}
+
+// UploadCrossSigningKeys uploads the user's cross-signing keys, as defined by MSC1756, else fails the test. Any of
+// the keys may be nil to omit it from the request. If the server requires user-interactive authentication, the
+// request is retried with `auth` e.g { "type": "m.login.password", "identifier": {...}, "password": "..." }, to which
+// the UIA session is added. If `auth` is nil, the upload must succeed without authentication.
+func (c *CSAPI) UploadCrossSigningKeys(t *testing.T, master, selfSigning, userSigning interface{}, auth map[string]interface{}) {
+	t.Helper()
+	reqBody := map[string]interface{}{}
+	if master != nil {
+		reqBody["master_key"] = master
+	}
+	if selfSigning != nil {
+		reqBody["self_signing_key"] = selfSigning
+	}
+	if userSigning != nil {
+		reqBody["user_signing_key"] = userSigning
+	}
+	paths := []string{"_matrix", "client", "unstable", "keys", "device_signing", "upload"}
+	res := c.DoFunc(t, "POST", paths, WithJSONBody(t, reqBody))
+	if res.StatusCode == 401 && auth != nil {
+		body := ParseJSON(t, res)
+		authWithSession := map[string]interface{}{
+			"session": gjson.GetBytes(body, "session").Str,
+		}
+		for k, v := range auth {
+			authWithSession[k] = v
+		}
+		reqBody["auth"] = authWithSession
+		res = c.DoFunc(t, "POST", paths, WithJSONBody(t, reqBody))
+	}
+	if res.StatusCode != 200 {
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		t.Fatalf("CSAPI.UploadCrossSigningKeys returned %s - body: %s", res.Status, string(body))
+	}
+}
+
+// UploadSignatures uploads signatures of devices and cross-signing keys, given as a map of user ID to key ID to
+// the signed object, else fails the test. Returns the response, which contains any `failures`.
+func (c *CSAPI) UploadSignatures(t *testing.T, sigs interface{}) gjson.Result {
+	t.Helper()
+	res := c.MustDoFunc(t, "POST", []string{"_matrix", "client", "unstable", "keys", "signatures", "upload"}, WithJSONBody(t, sigs))
+	body := ParseJSON(t, res)
+	return gjson.ParseBytes(body)
+}
+
+// QueryKeysUntilCrossSigning blocks and continually queries the keys of `userID`, who may be on a remote server,
+// until the response contains their master and self-signing keys and `check` returns true for it.
+// Returns the last response. Will time out after CSAPI.SyncUntilTimeout.
+func (c *CSAPI) QueryKeysUntilCrossSigning(t *testing.T, userID string, check func(gjson.Result) bool) gjson.Result {
+	t.Helper()
+	start := time.Now()
+	var res gjson.Result
+	for time.Since(start) < c.SyncUntilTimeout {
+		res = c.QueryKeys(t, []string{userID})
+		userKey := GjsonEscape(userID)
+		if res.Get("master_keys."+userKey).Exists() && res.Get("self_signing_keys."+userKey).Exists() && check(res) {
+			return res
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("QueryKeysUntilCrossSigning: timed out waiting for cross-signing keys of %s, last response: %s", userID, res.Raw)
+	return res
+}
+
+// CreateKeyBackupVersion creates a new version of the user's server-side key backup, which becomes the current
+// version, else fails the test. Returns the version.
+func (c *CSAPI) CreateKeyBackupVersion(t *testing.T, algorithm string, authData interface{}) string {
+	t.Helper()
+	res := c.MustDoFunc(t, "POST", []string{"_matrix", "client", "r0", "room_keys", "version"}, WithJSONBody(t, map[string]interface{}{
+		"algorithm": algorithm,
+		"auth_data": authData,
+	}))
+	body := ParseJSON(t, res)
+	return GetJSONFieldStr(t, body, "version")
+}
+
+// PutBackupKeys stores the key for the given room and session in the given version of the user's key backup, else
+// fails the test. See the /room_keys/keys API for the format of `keyData`.
+func (c *CSAPI) PutBackupKeys(t *testing.T, version, roomID, sessionID string, keyData interface{}) {
+	t.Helper()
+	c.MustDoFunc(t, "PUT", []string{"_matrix", "client", "r0", "room_keys", "keys", roomID, sessionID},
+		WithQueries(url.Values{"version": []string{version}}), WithJSONBody(t, keyData))
+}
+
+// GetBackupKeys returns all the keys stored in the given version of the user's key backup, else fails the test.
+// Returns the response, which contains the keys in `rooms`, keyed by room ID then session ID.
+func (c *CSAPI) GetBackupKeys(t *testing.T, version string) gjson.Result {
+	t.Helper()
+	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "r0", "room_keys", "keys"},
+		WithQueries(url.Values{"version": []string{version}}))
+	body := ParseJSON(t, res)
+	return gjson.ParseBytes(body)
+}
+
+// RequestOpenIDToken requests an OpenID token which third parties can use to verify the user's identity with the
+// homeserver, else fails the test. Returns the response, which contains the `access_token`, `token_type`,
+// `matrix_server_name` and `expires_in`.
+func (c *CSAPI) RequestOpenIDToken(t *testing.T) gjson.Result {
+	t.Helper()
+	res := c.MustDoFunc(t, "POST", []string{"_matrix", "client", "r0", "user", c.UserID, "openid", "request_token"}, WithJSONBody(t, struct{}{}))
+	body := ParseJSON(t, res)
+	return gjson.ParseBytes(body)
+}
+
+// SetPusher creates, updates or deletes a pusher, else fails the test. See the /pushers/set API for the
+// format of `pusher`.
+func (c *CSAPI) SetPusher(t *testing.T, pusher interface{}) {
+	t.Helper()
+	c.MustDoFunc(t, "POST", []string{"_matrix", "client", "r0", "pushers", "set"}, WithJSONBody(t, pusher))
+}
+
+// NotificationsReq contains the /notifications request configuration options. Empty values are omitted from the request.
+type NotificationsReq struct {
+	// A pagination token from a previous request.
+	From string
+	// The maximum number of notifications to return.
+	Limit int
+	// Set to "highlight" to only return notifications which were highlighted.
+	Only string
+}
+
+// GetNotifications returns the user's notifications, else fails the test.
+func (c *CSAPI) GetNotifications(t *testing.T, opts NotificationsReq) gjson.Result {
+	t.Helper()
+	query := url.Values{}
+	if opts.From != "" {
+		query.Set("from", opts.From)
+	}
+	if opts.Limit > 0 {
+		query.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if opts.Only != "" {
+		query.Set("only", opts.Only)
+	}
+	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "r0", "notifications"}, WithQueries(query))
+	body := ParseJSON(t, res)
+	return gjson.ParseBytes(body)
+}
+
+// SetPresence sets the user's presence, e.g "online", and status message, else fails the test.
+// The status message is omitted if it is "".
+func (c *CSAPI) SetPresence(t *testing.T, presence, statusMsg string) {
+	t.Helper()
+	reqBody := map[string]interface{}{
+		"presence": presence,
+	}
+	if statusMsg != "" {
+		reqBody["status_msg"] = statusMsg
+	}
+	c.MustDoFunc(t, "PUT", []string{"_matrix", "client", "r0", "presence", c.UserID, "status"}, WithJSONBody(t, reqBody))
+}
+
+// GetPresence returns the presence of the given user, else fails the test.
+func (c *CSAPI) GetPresence(t *testing.T, userID string) gjson.Result {
+	t.Helper()
+	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "r0", "presence", userID, "status"})
+	body := ParseJSON(t, res)
+	return gjson.ParseBytes(body)
+}
+
+// GetPushRules returns all of the user's push rules, else fails the test.
+func (c *CSAPI) GetPushRules(t *testing.T) gjson.Result {
+	t.Helper()
+	// the trailing slash is required by the spec
+	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "r0", "pushrules", ""})
+	body := ParseJSON(t, res)
+	return gjson.ParseBytes(body)
+}
+
+// SetPushRule creates or updates the push rule, e.g scope "global" and kind "override", else fails the test.
+func (c *CSAPI) SetPushRule(t *testing.T, scope, kind, ruleID string, body interface{}) {
+	t.Helper()
+	c.MustDoFunc(t, "PUT", []string{"_matrix", "client", "r0", "pushrules", scope, kind, ruleID}, WithJSONBody(t, body))
+}
+
+// DeletePushRule deletes the push rule, else fails the test.
+func (c *CSAPI) DeletePushRule(t *testing.T, scope, kind, ruleID string) {
+	t.Helper()
+	c.MustDoFunc(t, "DELETE", []string{"_matrix", "client", "r0", "pushrules", scope, kind, ruleID})
+}
+
+// SetPushRuleEnabled enables or disables the push rule, else fails the test.
+func (c *CSAPI) SetPushRuleEnabled(t *testing.T, scope, kind, ruleID string, enabled bool) {
+	t.Helper()
+	c.MustDoFunc(t, "PUT", []string{"_matrix", "client", "r0", "pushrules", scope, kind, ruleID, "enabled"}, WithJSONBody(t, map[string]interface{}{
+		"enabled": enabled,
+	}))
+}
+
+// SetPushRuleActions sets the actions of the push rule, e.g []interface{}{"notify"}, else fails the test.
+func (c *CSAPI) SetPushRuleActions(t *testing.T, scope, kind, ruleID string, actions []interface{}) {
+	t.Helper()
+	c.MustDoFunc(t, "PUT", []string{"_matrix", "client", "r0", "pushrules", scope, kind, ruleID, "actions"}, WithJSONBody(t, map[string]interface{}{
+		"actions": actions,
+	}))
+}
+
+// InviteByThreePID invites the third-party identifier, e.g medium "email" and an email address, to the room,
+// storing the invite on the given identity server, else fails the test.
+func (c *CSAPI) InviteByThreePID(t *testing.T, roomID, idServer, medium, address string) {
+	t.Helper()
+	c.MustDoFunc(t, "POST", []string{"_matrix", "client", "r0", "rooms", roomID, "invite"}, WithJSONBody(t, map[string]interface{}{
+		"id_server":       idServer,
+		"id_access_token": "complement_identity_token",
+		"medium":          medium,
+		"address":         address,
+	}))
+}
+
+// SetDisplayName sets the display name of this user, else fails the test.
+func (c *CSAPI) SetDisplayName(t *testing.T, displayName string) {
+	t.Helper()
+	reqBody := map[string]interface{}{
+		"displayname": displayName,
+	}
+	c.MustDo(t, "PUT", []string{"_matrix", "client", "r0", "profile", c.UserID, "displayname"}, reqBody)
+}
+
+// SetAvatarURL sets the avatar URL of this user to the given MXC URI, else fails the test.
+func (c *CSAPI) SetAvatarURL(t *testing.T, mxcURI string) {
+	t.Helper()
+	reqBody := map[string]interface{}{
+		"avatar_url": mxcURI,
+	}
+	c.MustDo(t, "PUT", []string{"_matrix", "client", "r0", "profile", c.UserID, "avatar_url"}, reqBody)
+}
+
+// GetProfile returns the profile of the given user ID, which may be on a remote server, else fails the test.
+// The `displayname` and `avatar_url` keys are present if they have been set.
+func (c *CSAPI) GetProfile(t *testing.T, userID string) gjson.Result {
+	t.Helper()
+	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "r0", "profile", userID})
+	body := ParseJSON(t, res)
+	return gjson.ParseBytes(body)
+}
+
+// PeekMethod is the API used to peek into a room. See CSAPI.Peek.
+type PeekMethod string
+
+const (
+	// PeekInitialSync peeks using the /rooms/{roomID}/initialSync API. There is no peeking state on the server,
+	// so StopPeeking does nothing.
+	PeekInitialSync PeekMethod = "initialSync"
+	// PeekMSC2753 peeks using the /peek API from MSC2753, after which the room appears in the `peek`
+	// section of /sync until StopPeeking is called.
+	PeekMSC2753 PeekMethod = "msc2753"
+)
+
+// Peek starts peeking into a room which the user is not joined to, which must have world_readable history
+// visibility, else fails the test. Returns the room's most recent timeline events.
+func (c *CSAPI) Peek(t *testing.T, roomID string, method PeekMethod) []gjson.Result {
+	t.Helper()
+	switch method {
+	case PeekInitialSync:
+		res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "r0", "rooms", roomID, "initialSync"})
+		body := ParseJSON(t, res)
+		return gjson.GetBytes(body, "messages.chunk").Array()
+	case PeekMSC2753:
+		c.MustDo(t, "POST", []string{"_matrix", "client", "r0", "peek", roomID}, struct{}{})
+		res, _ := c.MustSync(t, SyncReq{})
+		return res.Get("rooms.peek." + GjsonEscape(roomID) + ".timeline.events").Array()
+	}
+	t.Fatalf("CSAPI.Peek: unknown peek method '%s'", method)
+	return nil
+}
+
+// StopPeeking stops peeking into a room, else fails the test.
+func (c *CSAPI) StopPeeking(t *testing.T, roomID string, method PeekMethod) {
+	t.Helper()
+	if method == PeekMSC2753 {
+		c.MustDo(t, "POST", []string{"_matrix", "client", "r0", "rooms", roomID, "unpeek"}, struct{}{})
+	}
+}
+
+// SyncUntilPeekedTimelineHas is like SyncUntilTimelineHas but for a room which is being peeked into
+// with PeekMSC2753.
+// Will time out after CSAPI.SyncUntilTimeout.
+func (c *CSAPI) SyncUntilPeekedTimelineHas(t *testing.T, roomID string, check func(gjson.Result) bool) {
+	t.Helper()
+	c.SyncUntil(t, "", "", "rooms.peek."+GjsonEscape(roomID)+".timeline.events", check)
+}
+
+// SetServerACL replaces the room's m.room.server_acl state event, which controls which servers may
+// participate in the room, else fails the test. Returns the event ID of the new state event.
+func (c *CSAPI) SetServerACL(t *testing.T, roomID string, allow, deny []string, allowIPLiterals bool) string {
+	t.Helper()
+	if allow == nil {
+		allow = []string{}
+	}
+	if deny == nil {
+		deny = []string{}
+	}
+	return c.SendStateEvent(t, roomID, "m.room.server_acl", "", map[string]interface{}{
+		"allow":             allow,
+		"deny":              deny,
+		"allow_ip_literals": allowIPLiterals,
+	})
+}
+
+// ReportEvent reports the event to the homeserver administrators with the given score, from -100 (most
+// offensive) to 0 (inoffensive), and optional reason, else fails the test.
+func (c *CSAPI) ReportEvent(t *testing.T, roomID, eventID string, score int, reason string) {
+	t.Helper()
+	res := c.ReportEventError(t, roomID, eventID, score, reason)
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(res.Body)
+		t.Fatalf("CSAPI.ReportEvent returned %s - body: %s", res.Status, string(body))
+	}
+}
+
+// ReportEventError is the same as ReportEvent but returns the response without checking the status code, for
+// testing reports which should fail.
+func (c *CSAPI) ReportEventError(t *testing.T, roomID, eventID string, score int, reason string) *http.Response {
+	t.Helper()
+	reqBody := map[string]interface{}{
+		"score": score,
+	}
+	if reason != "" {
+		reqBody["reason"] = reason
+	}
+	return c.DoFunc(t, "POST", []string{"_matrix", "client", "r0", "rooms", roomID, "report", eventID}, WithJSONBody(t, reqBody))
+}
+
+// GetEventReports returns the event reports in the room, newest first, from the Synapse-style admin API at
+// /_synapse/admin/v1/event_reports. The client must be a server admin. Returns false if the server does not
+// expose the admin API, else fails the test on error.
+func (c *CSAPI) GetEventReports(t *testing.T, roomID string) ([]gjson.Result, bool) {
+	t.Helper()
+	res := c.DoFunc(t, "GET", []string{"_synapse", "admin", "v1", "event_reports"}, WithQueries(url.Values{
+		"room_id": []string{roomID},
+		"dir":     []string{"b"},
+	}))
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("CSAPI.GetEventReports failed to read response body: %s", err)
+	}
+	if res.StatusCode == 404 || (res.StatusCode == 400 && gjson.GetBytes(body, "errcode").Str == "M_UNRECOGNIZED") {
+		return nil, false
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("CSAPI.GetEventReports returned %s - body: %s", res.Status, string(body))
+	}
+	return gjson.GetBytes(body, "event_reports").Array(), true
+}
+
+// AddSpaceChildWithOptions links the child room into the space with an m.space.child event, else fails the test.
+// The `suggested` flag and `order` string affect how the space hierarchy is presented: `order` is omitted if it is
+// "". Returns the event ID of the new state event.
+func (c *CSAPI) AddSpaceChildWithOptions(t *testing.T, spaceID, childID string, via []string, suggested bool, order string) string {
+	t.Helper()
+	content := map[string]interface{}{
+		"via": via,
+	}
+	if suggested {
+		content["suggested"] = true
+	}
+	if order != "" {
+		content["order"] = order
+	}
+	return c.SendStateEvent(t, spaceID, "m.space.child", childID, content)
+}
+
+// GetSpaceChild returns the content of the m.space.child event linking the child room into the space, which does
+// not exist if there is no such event, else fails the test.
+func (c *CSAPI) GetSpaceChild(t *testing.T, spaceID, childID string) gjson.Result {
+	t.Helper()
+	res := c.DoFunc(t, "GET", []string{"_matrix", "client", "r0", "rooms", spaceID, "state", "m.space.child", childID})
+	if res.StatusCode == 404 {
+		res.Body.Close()
+		return gjson.Result{}
+	}
+	if res.StatusCode != 200 {
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		t.Fatalf("CSAPI.GetSpaceChild returned %s - body: %s", res.Status, string(body))
+	}
+	return gjson.ParseBytes(ParseJSON(t, res))
+}
+
+// GetTurnServer returns the TURN server credentials for the user, with the `username`, `password`, `uris` and
+// `ttl` in seconds for which the credentials are valid. Fails the test if the request fails or the server does
+// not have TURN configured.
+func (c *CSAPI) GetTurnServer(t *testing.T) gjson.Result {
+	t.Helper()
+	turnServer, ok := c.GetTurnServerOptional(t)
+	if !ok {
+		t.Fatalf("CSAPI.GetTurnServer: the server does not have a TURN server configured: %s", turnServer.Raw)
+	}
+	return turnServer
+}
+
+// GetTurnServerOptional is the same as GetTurnServer but returns false, rather than failing the test, if the server
+// does not have TURN configured, which it signals with an empty response.
+func (c *CSAPI) GetTurnServerOptional(t *testing.T) (gjson.Result, bool) {
+	t.Helper()
+	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "r0", "voip", "turnServer"})
+	turnServer := gjson.ParseBytes(ParseJSON(t, res))
+	return turnServer, len(turnServer.Get("uris").Array()) > 0
+}
+
+// SetRoomName sets the room's m.room.name, else fails the test. Returns the event ID of the new state event.
+func (c *CSAPI) SetRoomName(t *testing.T, roomID, name string) string {
+	t.Helper()
+	return c.setRoomMetadata(t, roomID, "m.room.name", "name", name)
+}
+
+// SetRoomTopic sets the room's m.room.topic, else fails the test. Returns the event ID of the new state event.
+func (c *CSAPI) SetRoomTopic(t *testing.T, roomID, topic string) string {
+	t.Helper()
+	return c.setRoomMetadata(t, roomID, "m.room.topic", "topic", topic)
+}
+
+// SetRoomAvatar sets the room's m.room.avatar to the given mxc:// URL, else fails the test. Returns the
+// event ID of the new state event.
+func (c *CSAPI) SetRoomAvatar(t *testing.T, roomID, avatarURL string) string {
+	t.Helper()
+	return c.setRoomMetadata(t, roomID, "m.room.avatar", "url", avatarURL)
+}
+
+// GetRoomName returns the room's current name, or "" if the room has no m.room.name.
+func (c *CSAPI) GetRoomName(t *testing.T, roomID string) string {
+	t.Helper()
+	return c.getRoomMetadata(t, roomID, "m.room.name", "name")
+}
+
+// GetRoomTopic returns the room's current topic, or "" if the room has no m.room.topic.
+func (c *CSAPI) GetRoomTopic(t *testing.T, roomID string) string {
+	t.Helper()
+	return c.getRoomMetadata(t, roomID, "m.room.topic", "topic")
+}
+
+// GetRoomAvatar returns the room's current avatar URL, or "" if the room has no m.room.avatar.
+func (c *CSAPI) GetRoomAvatar(t *testing.T, roomID string) string {
+	t.Helper()
+	return c.getRoomMetadata(t, roomID, "m.room.avatar", "url")
+}
+
+func (c *CSAPI) setRoomMetadata(t *testing.T, roomID, eventType, key, value string) string {
+	t.Helper()
+	return c.SendStateEvent(t, roomID, eventType, "", map[string]interface{}{
+		key: value,
+	})
+}
+
+func (c *CSAPI) getRoomMetadata(t *testing.T, roomID, eventType, key string) string {
+	t.Helper()
+	res := c.DoFunc(t, "GET", []string{"_matrix", "client", "r0", "rooms", roomID, "state", eventType})
+	defer res.Body.Close()
+	if res.StatusCode == 404 {
+		return ""
+	}
+	if res.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(res.Body)
+		t.Fatalf("CSAPI: getting %s in room %s returned HTTP %d: %s", eventType, roomID, res.StatusCode, string(body))
+	}
+	body := ParseJSON(t, res)
+	return gjson.GetBytes(body, key).Str
+}
+
+// UpgradeRoom upgrades the room to the given room version, else fails the test.
+// Returns the room ID of the replacement room.
+func (c *CSAPI) UpgradeRoom(t *testing.T, roomID, newVersion string) string {
+	t.Helper()
+	res := c.MustDo(t, "POST", []string{"_matrix", "client", "r0", "rooms", roomID, "upgrade"}, map[string]interface{}{
+		"new_version": newVersion,
+	})
+	body := ParseJSON(t, res)
+	return GetJSONFieldStr(t, body, "replacement_room")
+}
+
+// FollowTombstone returns the replacement room ID in the m.room.tombstone state event of the room.
+// Fails the test if the room has no tombstone.
+func (c *CSAPI) FollowTombstone(t *testing.T, roomID string) string {
+	t.Helper()
+	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "r0", "rooms", roomID, "state", "m.room.tombstone"})
+	body := ParseJSON(t, res)
+	return GetJSONFieldStr(t, body, "replacement_room")
+}
+
+// SetRoomAlias maps the alias to the room in the room directory, else fails the test.
+func (c *CSAPI) SetRoomAlias(t *testing.T, alias, roomID string) {
+	t.Helper()
+	c.MustDo(t, "PUT", []string{"_matrix", "client", "r0", "directory", "room", alias}, map[string]interface{}{
+		"room_id": roomID,
+	})
+}
+
+// ResolveAlias looks up the alias in the room directory, which may be on a remote server, else fails the test.
+// Returns the room ID and the servers which can be used to join the room.
+func (c *CSAPI) ResolveAlias(t *testing.T, alias string) (roomID string, servers []string) {
+	t.Helper()
+	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "r0", "directory", "room", alias})
+	body := ParseJSON(t, res)
+	for _, server := range gjson.GetBytes(body, "servers").Array() {
+		servers = append(servers, server.Str)
+	}
+	return GetJSONFieldStr(t, body, "room_id"), servers
+}
+
+// DeleteRoomAlias removes the alias from the room directory, else fails the test.
+func (c *CSAPI) DeleteRoomAlias(t *testing.T, alias string) {
+	t.Helper()
+	c.MustDoFunc(t, "DELETE", []string{"_matrix", "client", "r0", "directory", "room", alias})
+}
+
+// SetCanonicalAlias sets the m.room.canonical_alias state event of the room, else fails the test.
+// The alias and all the alt aliases must already be mapped to the room in the room directory.
+// Returns the event ID of the state event.
+func (c *CSAPI) SetCanonicalAlias(t *testing.T, roomID, alias string, altAliases []string) string {
+	t.Helper()
+	for _, a := range append([]string{alias}, altAliases...) {
+		if gotRoomID := c.resolveAliasOrEmpty(t, a); gotRoomID != roomID {
+			t.Fatalf("CSAPI.SetCanonicalAlias alias %s resolved to %q, want %s", a, gotRoomID, roomID)
+		}
+	}
+	content := map[string]interface{}{
+		"alias": alias,
+	}
+	if len(altAliases) > 0 {
+		content["alt_aliases"] = altAliases
+	}
+	return c.SendStateEvent(t, roomID, "m.room.canonical_alias", "", content)
+}
+
+// AssertCanonicalAliasResolves checks that the alias and every alt alias in the m.room.canonical_alias
+// state event of the room resolve to the room in the room directory, else fails the test.
+func (c *CSAPI) AssertCanonicalAliasResolves(t *testing.T, roomID string) {
+	t.Helper()
+	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "r0", "rooms", roomID, "state", "m.room.canonical_alias"})
+	body := ParseJSON(t, res)
+	aliases := []string{GetJSONFieldStr(t, body, "alias")}
+	for _, a := range gjson.GetBytes(body, "alt_aliases").Array() {
+		aliases = append(aliases, a.Str)
+	}
+	for _, a := range aliases {
+		if gotRoomID := c.resolveAliasOrEmpty(t, a); gotRoomID != roomID {
+			t.Errorf("CSAPI.AssertCanonicalAliasResolves canonical alias %s of %s resolved to %q", a, roomID, gotRoomID)
+		}
+	}
+}
+
+// resolveAliasOrEmpty returns the room ID the alias maps to, or "" if the alias cannot be resolved.
+func (c *CSAPI) resolveAliasOrEmpty(t *testing.T, alias string) string {
+	t.Helper()
+	res := c.DoFunc(t, "GET", []string{"_matrix", "client", "r0", "directory", "room", alias})
+	if res.StatusCode != 200 {
+		res.Body.Close()
+		return ""
+	}
+	return gjson.GetBytes(ParseJSON(t, res), "room_id").Str
+}
+
+// PublicRoomsReq contains the /publicRooms request configuration options. Empty values are omitted from the request.
+type PublicRoomsReq struct {
+	// The server to fetch the public room directory from. Defaults to the local server.
+	Server string
+	// The maximum number of rooms to return.
+	Limit int
+	// A pagination token from a previous request.
+	Since string
+	// The filter to apply to the results, e.g map[string]interface{}{"generic_search_term": "foo"}.
+	// If set, the request is made with POST rather than GET.
+	Filter interface{}
+}
+
+// PublicRooms fetches the public room directory, else fails the test.
+func (c *CSAPI) PublicRooms(t *testing.T, opts PublicRoomsReq) gjson.Result {
+	t.Helper()
+	paths := []string{"_matrix", "client", "r0", "publicRooms"}
+	query := url.Values{}
+	if opts.Server != "" {
+		query.Set("server", opts.Server)
+	}
+	var res *http.Response
+	if opts.Filter == nil {
+		if opts.Limit > 0 {
+			query.Set("limit", strconv.Itoa(opts.Limit))
+		}
+		if opts.Since != "" {
+			query.Set("since", opts.Since)
+		}
+		res = c.MustDoFunc(t, "GET", paths, WithQueries(query))
+	} else {
+		reqBody := map[string]interface{}{
+			"filter": opts.Filter,
+		}
+		if opts.Limit > 0 {
+			reqBody["limit"] = opts.Limit
+		}
+		if opts.Since != "" {
+			reqBody["since"] = opts.Since
+		}
+		res = c.MustDoFunc(t, "POST", paths, WithQueries(query), WithJSONBody(t, reqBody))
+	}
+	body := ParseJSON(t, res)
+	return gjson.ParseBytes(body)
+}
+
+// SetRoomDirectoryVisibility publishes the room to, or removes it from, the public room directory,
+// depending on whether `visibility` is "public" or "private". Fails the test on error.
+func (c *CSAPI) SetRoomDirectoryVisibility(t *testing.T, roomID, visibility string) {
+	t.Helper()
+	c.MustDo(t, "PUT", []string{"_matrix", "client", "r0", "directory", "list", "room", roomID}, map[string]interface{}{
+		"visibility": visibility,
+	})
+}
+
+// SearchUserDirectory searches the user directory for up to `limit` users matching the search term, else fails the test.
+// Returns the response, which contains the `results` array and the `limited` flag.
+func (c *CSAPI) SearchUserDirectory(t *testing.T, searchTerm string, limit int) gjson.Result {
+	t.Helper()
+	res := c.MustDo(t, "POST", []string{"_matrix", "client", "r0", "user_directory", "search"}, map[string]interface{}{
+		"search_term": searchTerm,
+		"limit":       limit,
+	})
+	body := ParseJSON(t, res)
+	return gjson.ParseBytes(body)
+}
+
+// GetCapabilities fetches the server's capabilities, else fails the test. Returns the `capabilities` object of the
+// response e.g { "m.room_versions": { "default": "6", "available": { ... } } }.
+func (c *CSAPI) GetCapabilities(t *testing.T) gjson.Result {
+	t.Helper()
+	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "r0", "capabilities"})
+	body := ParseJSON(t, res)
+	return gjson.GetBytes(body, "capabilities")
+}
+
+// minRoomVersionForCapability is the first room version to support each room capability, for servers which do not
+// advertise the room versions for each capability with MSC3244.
+var minRoomVersionForCapability = map[string]int{
+	"knock":      7,
+	"restricted": 8,
+}
+
+// GetRoomVersionCapability returns the room version to create rooms with to use a feature, such as "knock" or
+// "restricted" join rules, else fails the test. This is the server's preferred room version for the feature if it
+// advertises one with MSC3244, else the newest available room version which supports the feature.
+func (c *CSAPI) GetRoomVersionCapability(t *testing.T, capability string) string {
+	t.Helper()
+	roomVersions := c.GetCapabilities(t).Get(GjsonEscape("m.room_versions"))
+	available := roomVersions.Get("available")
+	preferred := roomVersions.Get(GjsonEscape("org.matrix.msc3244.room_capabilities") + "." + capability + ".preferred").Str
+	if preferred != "" && available.Get(GjsonEscape(preferred)).Exists() {
+		return preferred
+	}
+	minVersion, ok := minRoomVersionForCapability[capability]
+	if !ok {
+		t.Fatalf("CSAPI.GetRoomVersionCapability: unknown capability '%s' and the server does not advertise it: %s", capability, roomVersions.Raw)
+	}
+	newest := 0
+	available.ForEach(func(k, _ gjson.Result) bool {
+		// unstable room versions such as org.matrix.msc2716 are not numbers, so are skipped
+		if v, err := strconv.Atoi(k.Str); err == nil && v >= minVersion && v > newest {
+			newest = v
+		}
+		return true
+	})
+	if newest == 0 {
+		t.Fatalf("CSAPI.GetRoomVersionCapability: no available room version supports '%s': %s", capability, roomVersions.Raw)
+	}
+	return strconv.Itoa(newest)
+}
+
+// SpaceHierarchyReq contains the /hierarchy request configuration options. Empty values are omitted from the request.
+type SpaceHierarchyReq struct {
+	// The maximum number of rooms to return per page.
+	Limit int
+	// The maximum depth of the hierarchy to return, where the room itself is depth 0.
+	MaxDepth int
+	// Only return rooms linked by suggested m.space.child events.
+	SuggestedOnly bool
+	// A pagination token from the `next_batch` of a previous request.
+	From string
+}
+
+// SpaceHierarchy fetches a page of the space hierarchy below the room, else fails the test. This uses the stable
+// /_matrix/client/v1 endpoint, falling back to the unstable MSC2946 endpoint if the server does not recognise it.
+// Returns the response, which contains the `rooms` array and the `next_batch` token if there are more rooms. Both
+// endpoints return the same shape of response, but `next_batch` tokens from one cannot be used with the other.
+func (c *CSAPI) SpaceHierarchy(t *testing.T, roomID string, opts SpaceHierarchyReq) gjson.Result {
+	t.Helper()
+	query := url.Values{}
+	if opts.Limit > 0 {
+		query.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if opts.MaxDepth > 0 {
+		query.Set("max_depth", strconv.Itoa(opts.MaxDepth))
+	}
+	if opts.SuggestedOnly {
+		query.Set("suggested_only", "true")
+	}
+	if opts.From != "" {
+		query.Set("from", opts.From)
+	}
+	res := c.DoFunc(t, "GET", []string{"_matrix", "client", "v1", "rooms", roomID, "hierarchy"}, WithQueries(query))
+	if res.StatusCode == 404 || res.StatusCode == 405 || res.StatusCode == 400 {
+		// servers which do not know the endpoint may not return a JSON body at all
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		errcode := gjson.GetBytes(body, "errcode").Str
+		if errcode != "" && errcode != "M_UNRECOGNIZED" {
+			t.Fatalf("CSAPI.SpaceHierarchy returned HTTP %d for room %s: %s", res.StatusCode, roomID, string(body))
+		}
+		res = c.MustDoFunc(t, "GET", []string{"_matrix", "client", "unstable", "org.matrix.msc2946", "rooms", roomID, "hierarchy"}, WithQueries(query))
+	}
+	body := ParseJSON(t, res)
+	if res.StatusCode != 200 {
+		t.Fatalf("CSAPI.SpaceHierarchy returned HTTP %d for room %s: %s", res.StatusCode, roomID, string(body))
+	}
+	return gjson.ParseBytes(body)
+}
+
+// PowerLevelChanges are the changes to make to a room's power levels with CSAPI.SetPowerLevels.
+// Only the given keys are changed: all other power levels are left as they are.
+type PowerLevelChanges struct {
+	// The power levels of users, keyed by user ID.
+	Users map[string]int
+	// The power levels required to send events, keyed by event type.
+	Events map[string]int
+	// The power levels required for actions and defaults, keyed by the top-level power level key, e.g
+	// "invite", "kick", "ban", "redact", "state_default", "events_default" or "users_default".
+	Actions map[string]int
+}
+
+// SetPowerLevels reads the room's current power levels, applies the changes and sends the result, waiting for
+// the new m.room.power_levels event to come down /sync. Fails the test on error. Returns the event ID.
+func (c *CSAPI) SetPowerLevels(t *testing.T, roomID string, changes PowerLevelChanges) string {
+	t.Helper()
+	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "r0", "rooms", roomID, "state", "m.room.power_levels"})
+	body := ParseJSON(t, res)
+	content := map[string]interface{}{}
+	if err := json.Unmarshal(body, &content); err != nil {
+		t.Fatalf("CSAPI.SetPowerLevels failed to unmarshal power levels: %s", err)
+	}
+	for action, level := range changes.Actions {
+		content[action] = level
+	}
+	for key, levels := range map[string]map[string]int{"users": changes.Users, "events": changes.Events} {
+		if len(levels) == 0 {
+			continue
+		}
+		merged, _ := content[key].(map[string]interface{})
+		if merged == nil {
+			merged = map[string]interface{}{}
+		}
+		for k, level := range levels {
+			merged[k] = level
+		}
+		content[key] = merged
+	}
+	return c.SendEventSynced(t, roomID, b.Event{
+		Type:     "m.room.power_levels",
+		StateKey: b.Ptr(""),
+		Content:  content,
+	})
+}
+
+// SendStateEvent sets the state event with the given type and state key in the room, else fails the test.
+// `stateKey` may be "" for state events like m.room.name which only have one instance per room. Returns the
+// event ID of the new state event.
+func (c *CSAPI) SendStateEvent(t *testing.T, roomID, eventType, stateKey string, content interface{}) string {
+	t.Helper()
+	paths := []string{"_matrix", "client", "r0", "rooms", roomID, "state", eventType}
+	if stateKey != "" {
+		paths = append(paths, stateKey)
+	}
+	res := c.MustDo(t, "PUT", paths, content)
+	body := ParseJSON(t, res)
+	eventID := GetJSONFieldStr(t, body, "event_id")
+	if eventID == "" {
+		t.Fatalf("CSAPI.SendStateEvent: setting %s with state key '%s' in room %s returned an empty event ID: %s", eventType, stateKey, roomID, string(body))
+	}
+	return eventID
+}
+
+// SendEventSynced sends `e` into the room and waits for its event ID to come down /sync.
+// Returns the event ID of the sent event. Use WithTxnID to choose the transaction ID.
+func (c *CSAPI) SendEventSynced(t *testing.T, roomID string, e b.Event, opts ...RequestOpt) string {
+	t.Helper()
+	eventID := c.sendEvent(t, roomID, e, opts...)
+	t.Logf("SendEventSynced waiting for event ID %s", eventID)
+	c.SyncUntilTimelineHas(t, roomID, func(r gjson.Result) bool {
+		return r.Get("event_id").Str == eventID
+	})
+	return eventID
+}
+
+// SendEventsSynced sends the events into the room in order, waiting for each to be accepted by the server
+// before sending the next, then waits for the last event to come down /sync. This is quicker than calling
+// SendEventSynced for each event, as there is only one wait for /sync. Fails the test on error.
+// Returns the event IDs in the same order as the events.
+func (c *CSAPI) SendEventsSynced(t *testing.T, roomID string, events []b.Event) []string {
+	t.Helper()
+	if len(events) == 0 {
+		return nil
+	}
+	eventIDs := make([]string, len(events))
+	for i, e := range events {
+		eventIDs[i] = c.sendEvent(t, roomID, e)
+	}
+	lastEventID := eventIDs[len(eventIDs)-1]
+	t.Logf("SendEventsSynced waiting for event ID %s", lastEventID)
+	c.SyncUntilTimelineHas(t, roomID, func(r gjson.Result) bool {
+		return r.Get("event_id").Str == lastEventID
+	})
+	return eventIDs
+}
+
+// SendEventError is the same as SendEventSynced but returns the response without checking the status code or
+// waiting for /sync, for testing events which the server should reject, e.g because their content is invalid.
+func (c *CSAPI) SendEventError(t *testing.T, roomID string, e b.Event) *http.Response {
+	t.Helper()
+	return c.DoFunc(t, "PUT", c.sendEventPaths(roomID, e), WithJSONBody(t, e.Content))
+}
+
+// sendEvent sends the event into the room, as a state event if it has a state key, else fails the test.
+// Returns the event ID.
+func (c *CSAPI) sendEvent(t *testing.T, roomID string, e b.Event, opts ...RequestOpt) string {
+	t.Helper()
+	res := c.MustDoFunc(t, "PUT", c.sendEventPaths(roomID, e), append([]RequestOpt{WithJSONBody(t, e.Content)}, opts...)...)
+	body := ParseJSON(t, res)
+	return GetJSONFieldStr(t, body, "event_id")
+}
+
+// sendEventPaths returns the path to send the event to: /state for state events, else /send with a new
+// transaction ID.
+func (c *CSAPI) sendEventPaths(roomID string, e b.Event) []string {
+	if e.StateKey != nil {
+		return []string{"_matrix", "client", "r0", "rooms", roomID, "state", e.Type, *e.StateKey}
+	}
+	c.txnID++
+	return []string{"_matrix", "client", "r0", "rooms", roomID, "send", e.Type, strconv.Itoa(c.txnID)}
+}
+
+// SendRedaction redacts the event ID in the given room with an optional reason, failing the test on error.
+// Returns the event ID of the redaction event. Use WithTxnID to choose the transaction ID.
+func (c *CSAPI) SendRedaction(t *testing.T, roomID, eventID, reason string, opts ...RequestOpt) string {
+	t.Helper()
+	c.txnID++
+	reqBody := map[string]interface{}{}
+	if reason != "" {
+		reqBody["reason"] = reason
+	}
+	paths := []string{"_matrix", "client", "r0", "rooms", roomID, "redact", eventID, strconv.Itoa(c.txnID)}
+	res := c.MustDoFunc(t, "PUT", paths, append([]RequestOpt{WithJSONBody(t, reqBody)}, opts...)...)
+	body := ParseJSON(t, res)
+	return GetJSONFieldStr(t, body, "event_id")
+}
+
+// SyncUntilRedacted blocks and continually calls /sync until the event ID is returned in the room's timeline or
+// state with `unsigned.redacted_because` set. Each /sync is an initial sync, so the event is seen whether the
+// redaction arrived in the timeline or via a change in the room state. Fails the test if the redacted event is
+// a non-state event which still has content. Will time out after CSAPI.SyncUntilTimeout.
+func (c *CSAPI) SyncUntilRedacted(t *testing.T, roomID, eventID string) {
+	t.Helper()
+	start := time.Now()
+	roomKey := "rooms.join." + GjsonEscape(roomID)
+	filter := `{"room":{"timeline":{"limit":50}}}`
+	for {
+		if time.Since(start) > c.SyncUntilTimeout {
+			t.Fatalf("SyncUntilRedacted: timed out waiting for event %s in room %s to be redacted", eventID, roomID)
+		}
+		res, _ := c.MustSync(t, SyncReq{Filter: filter})
+		var redactedEvent *gjson.Result
+		for _, section := range []string{"timeline", "state"} {
+			events := res.Get(roomKey + "." + section + ".events").Array()
+			for i := range events {
+				if events[i].Get("event_id").Str == eventID && events[i].Get("unsigned.redacted_because").Exists() {
+					redactedEvent = &events[i]
+					break
+				}
+			}
+			if redactedEvent != nil {
+				break
+			}
+		}
+		if redactedEvent != nil {
+			if !redactedEvent.Get("state_key").Exists() && len(redactedEvent.Get("content").Map()) > 0 {
+				t.Fatalf("SyncUntilRedacted: event %s has redacted_because but its content was not stripped: %s", eventID, redactedEvent.Raw)
+			}
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// SyncUntilTimelineHas blocks and continually calls /sync until the `check` function returns true.
+// If the `check` function fails the test, the failing event will be automatically logged.
+// Will time out after CSAPI.SyncUntilTimeout.
+func (c *CSAPI) SyncUntilTimelineHas(t *testing.T, roomID string, check func(gjson.Result) bool) {
+	t.Helper()
+	c.SyncUntil(t, "", "", "rooms.join."+GjsonEscape(roomID)+".timeline.events", check)
+}
+
+// SendTyping sets whether this user is typing in the room, else fails the test. If `typing` is true, the
+// server will stop showing the user as typing after `timeoutMs` milliseconds.
+func (c *CSAPI) SendTyping(t *testing.T, roomID string, typing bool, timeoutMs int) {
+	t.Helper()
+	reqBody := map[string]interface{}{
+		"typing": typing,
+	}
+	if typing {
+		reqBody["timeout"] = timeoutMs
+	}
+	c.MustDo(t, "PUT", []string{"_matrix", "client", "r0", "rooms", roomID, "typing", c.UserID}, reqBody)
+}
+
+// SyncUntilTypingHas blocks and continually calls /sync until the `check` function returns true for an
+// ephemeral event in the room, such as the m.typing event.
+// If the `check` function fails the test, the failing event will be automatically logged.
+// Will time out after CSAPI.SyncUntilTimeout.
+func (c *CSAPI) SyncUntilTypingHas(t *testing.T, roomID string, check func(gjson.Result) bool) {
+	t.Helper()
+	c.SyncUntil(t, "", "", "rooms.join."+GjsonEscape(roomID)+".ephemeral.events", check)
+}
+
+// SendReceipt sends a receipt of the given type, e.g "m.read", for the event in the room, else fails the test.
+func (c *CSAPI) SendReceipt(t *testing.T, roomID, receiptType, eventID string) {
+	t.Helper()
+	c.MustDo(t, "POST", []string{"_matrix", "client", "r0", "rooms", roomID, "receipt", receiptType, eventID}, struct{}{})
+}
+
+// SetReadMarker sets the fully read marker and/or the read receipt for the room, else fails the test.
+// Either event ID can be "" to leave it unchanged.
+func (c *CSAPI) SetReadMarker(t *testing.T, roomID, fullyReadEventID, readEventID string) {
+	t.Helper()
+	reqBody := map[string]interface{}{}
+	if fullyReadEventID != "" {
+		reqBody["m.fully_read"] = fullyReadEventID
+	}
+	if readEventID != "" {
+		reqBody["m.read"] = readEventID
+	}
+	c.MustDo(t, "POST", []string{"_matrix", "client", "r0", "rooms", roomID, "read_markers"}, reqBody)
+}
+
+// SyncUntilReadReceipt blocks and continually calls /sync until an m.receipt ephemeral event in the room
+// contains an m.read receipt from `userID` for `eventID`.
+// Will time out after CSAPI.SyncUntilTimeout.
+func (c *CSAPI) SyncUntilReadReceipt(t *testing.T, roomID, eventID, userID string) {
+	t.Helper()
+	c.SyncUntil(t, "", "", "rooms.join."+GjsonEscape(roomID)+".ephemeral.events", func(ev gjson.Result) bool {
+		if ev.Get("type").Str != "m.receipt" {
+			return false
+		}
+		return ev.Get("content").Get(GjsonEscape(eventID)).Get(`m\.read`).Get(GjsonEscape(userID)).Exists()
+	})
+}
+
+// GetEventContext returns the /context response for the event, containing up to `limit` events in total in
+// `events_before` and `events_after`, along with `event` and `state`, else fails the test.
+// Use WithFilter to filter the surrounding events.
+func (c *CSAPI) GetEventContext(t *testing.T, roomID, eventID string, limit int, opts ...RequestOpt) gjson.Result {
+	t.Helper()
+	opts = append(opts, func(req *http.Request) {
+		query := req.URL.Query()
+		query.Set("limit", strconv.Itoa(limit))
+		req.URL.RawQuery = query.Encode()
+	})
+	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "r0", "rooms", roomID, "context", eventID}, opts...)
+	body := ParseJSON(t, res)
+	return gjson.ParseBytes(body)
+}
+
+// MessagesIterator pages through a room's /messages, one batch at a time. See CSAPI.MustPaginateMessages.
+type MessagesIterator struct {
+	c      *CSAPI
+	roomID string
+	dir    string
+	limit  int
+	from   string
+	done   bool
+}
+
+// MustPaginateMessages returns an iterator over the room's /messages in the direction `dir`, which is "b" or "f",
+// requesting up to `limit` events per batch. Backwards pagination starts from the latest event in the room.
+// Forwards pagination omits the `from` token, which some servers treat as the latest event in the room and so
+// return nothing: to see the whole room in order, paginate backwards and reverse the events.
+func (c *CSAPI) MustPaginateMessages(t *testing.T, roomID, dir string, limit int) *MessagesIterator {
+	t.Helper()
+	it := &MessagesIterator{
+		c:      c,
+		roomID: roomID,
+		dir:    dir,
+		limit:  limit,
+	}
+	if dir == "b" {
+		_, it.from = c.MustSync(t, SyncReq{Filter: `{"room":{"timeline":{"limit":1}}}`})
+	}
+	return it
+}
+
+// Next requests the next batch of events, returning false once the end of the room has been reached.
+// Fails the test if the request fails.
+func (it *MessagesIterator) Next(t *testing.T) ([]gjson.Result, bool) {
+	t.Helper()
+	if it.done {
+		return nil, false
+	}
+	query := url.Values{
+		"dir":   []string{it.dir},
+		"limit": []string{strconv.Itoa(it.limit)},
+	}
+	if it.from != "" {
+		query.Set("from", it.from)
+	}
+	res := it.c.MustDoFunc(t, "GET", []string{"_matrix", "client", "r0", "rooms", it.roomID, "messages"}, WithQueries(query))
+	body := gjson.ParseBytes(ParseJSON(t, res))
+	chunk := body.Get("chunk").Array()
+	end := body.Get("end").Str
+	// servers signal the end of the room with an empty chunk, a missing end token or an unchanged token
+	if end == "" || end == it.from || len(chunk) == 0 {
+		it.done = true
+	}
+	it.from = end
+	if len(chunk) == 0 {
+		return nil, false
+	}
+	return chunk, true
+}
+
+// GetNext returns the token which the next batch will be requested from.
+func (it *MessagesIterator) GetNext() string {
+	return it.from
+}
+
+// AllMessages pages through the room's /messages in the direction `dir` until the end of the room,
+// returning every event in the order they were returned. Fails the test if a request fails.
+func (c *CSAPI) AllMessages(t *testing.T, roomID, dir string) []gjson.Result {
+	t.Helper()
+	var events []gjson.Result
+	it := c.MustPaginateMessages(t, roomID, dir, 100)
+	for {
+		chunk, ok := it.Next(t)
+		if !ok {
+			return events
+		}
+		events = append(events, chunk...)
+	}
+}
+
+// AssertSyncTimelineContinues checks that the room's timeline in `second`, a /sync response requested with the
+// next_batch of `first`, continues on from the room's timeline in `first`. It pages back through /messages from
+// the prev_batch of the second timeline until it reaches the last event of the first timeline. If the second
+// timeline is not limited, there must be no events in between: an unmarked gap means clients silently miss
+// events. Also checks that no event is in both timelines. Does nothing if either timeline has no events.
+func (c *CSAPI) AssertSyncTimelineContinues(t *testing.T, roomID string, first, second gjson.Result) {
+	t.Helper()
+	timelineKey := "rooms.join." + GjsonEscape(roomID) + ".timeline"
+	firstEvents := first.Get(timelineKey + ".events").Array()
+	secondTimeline := second.Get(timelineKey)
+	secondEvents := secondTimeline.Get("events").Array()
+	if len(firstEvents) == 0 || len(secondEvents) == 0 {
+		return
+	}
+	lastFirstEventID := firstEvents[len(firstEvents)-1].Get("event_id").Str
+	firstEventIDs := make(map[string]bool, len(firstEvents))
+	for _, ev := range firstEvents {
+		firstEventIDs[ev.Get("event_id").Str] = true
+	}
+	for _, ev := range secondEvents {
+		if firstEventIDs[ev.Get("event_id").Str] {
+			t.Errorf("CSAPI.AssertSyncTimelineContinues: event %s is in both timelines", ev.Get("event_id").Str)
+		}
+	}
+
+	prevBatch := secondTimeline.Get("prev_batch").Str
+	if prevBatch == "" {
+		t.Fatalf("CSAPI.AssertSyncTimelineContinues: second timeline has no prev_batch: %s", secondTimeline.Raw)
+	}
+	it := &MessagesIterator{
+		c:      c,
+		roomID: roomID,
+		dir:    "b",
+		limit:  50,
+		from:   prevBatch,
+	}
+	var gap []string
+	for {
+		chunk, ok := it.Next(t)
+		if !ok {
+			t.Fatalf("CSAPI.AssertSyncTimelineContinues: paginating back from prev_batch %s never reached the last event %s of the first timeline", prevBatch, lastFirstEventID)
+		}
+		for _, ev := range chunk {
+			if ev.Get("event_id").Str == lastFirstEventID {
+				if len(gap) > 0 && !secondTimeline.Get("limited").Bool() {
+					t.Errorf("CSAPI.AssertSyncTimelineContinues: second timeline is not limited but %d events are missing between the timelines: %v", len(gap), gap)
+				}
+				return
+			}
+			gap = append(gap, ev.Get("event_id").Str)
+		}
+	}
+}
+
+// GetRelations returns the events which relate to the given event, as defined by MSC2675, else fails the test.
+// `relType` and `eventType` filter the relations and may be "", though `eventType` can only be set if `relType`
+// is set. Use WithQueries to paginate with `from` and `to`, and `limit`. Returns the response, which contains
+// the `chunk` of related events and the `next_batch` token.
+func (c *CSAPI) GetRelations(t *testing.T, roomID, eventID, relType, eventType string, opts ...RequestOpt) gjson.Result {
+	t.Helper()
+	paths := []string{"_matrix", "client", "v1", "rooms", roomID, "relations", eventID}
+	if relType != "" {
+		paths = append(paths, relType)
+		if eventType != "" {
+			paths = append(paths, eventType)
+		}
+	} else if eventType != "" {
+		t.Fatalf("CSAPI.GetRelations: eventType '%s' given without a relType", eventType)
+	}
+	res := c.MustDoFunc(t, "GET", paths, opts...)
+	body := ParseJSON(t, res)
+	return gjson.ParseBytes(body)
+}
+
+// SendReaction annotates the target event with the reaction `key`, e.g an emoji, else fails the test.
+// Returns the event ID of the m.reaction event. Use WithTxnID to choose the transaction ID.
+func (c *CSAPI) SendReaction(t *testing.T, roomID, targetEventID, key string, opts ...RequestOpt) string {
+	t.Helper()
+	return c.sendEvent(t, roomID, b.Event{
+		Type: "m.reaction",
+		Content: map[string]interface{}{
+			"m.relates_to": map[string]interface{}{
+				"rel_type": "m.annotation",
+				"event_id": targetEventID,
+				"key":      key,
+			},
+		},
+	}, opts...)
+}
+
+// EditMessage replaces the body of the target text message with `newBody`, else fails the test.
+// Returns the event ID of the edit. Use WithTxnID to choose the transaction ID.
+func (c *CSAPI) EditMessage(t *testing.T, roomID, targetEventID, newBody string, opts ...RequestOpt) string {
+	t.Helper()
+	return c.sendEvent(t, roomID, b.Event{
+		Type: "m.room.message",
+		Content: map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    "* " + newBody,
+			"m.new_content": map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    newBody,
+			},
+			"m.relates_to": map[string]interface{}{
+				"rel_type": "m.replace",
+				"event_id": targetEventID,
+			},
+		},
+	}, opts...)
+}
+
+// GetEvent returns the event in the room, including any bundled aggregations in its `unsigned` section,
+// else fails the test.
+func (c *CSAPI) GetEvent(t *testing.T, roomID, eventID string) gjson.Result {
+	t.Helper()
+	ev, ok := c.getEventIfExists(t, roomID, eventID)
+	if !ok {
+		t.Fatalf("CSAPI.GetEvent: event %s not found in room %s", eventID, roomID)
+	}
+	return ev
+}
+
+// getEventIfExists returns the event in the room, or false if the homeserver returns a 404 for it. Fails the test
+// on any other error.
+func (c *CSAPI) getEventIfExists(t *testing.T, roomID, eventID string) (gjson.Result, bool) {
+	t.Helper()
+	res := c.DoFunc(t, "GET", []string{"_matrix", "client", "r0", "rooms", roomID, "event", eventID})
+	defer res.Body.Close()
+	if res.StatusCode == 404 {
+		return gjson.Result{}, false
+	}
+	if res.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(res.Body)
+		t.Fatalf("CSAPI.GetEvent returned HTTP %d for event %s: %s", res.StatusCode, eventID, string(body))
+	}
+	return gjson.ParseBytes(ParseJSON(t, res)), true
+}
+
+// EventOutcome is how a homeserver handled an event it received over federation.
+type EventOutcome string
+
+const (
+	// EventAccepted means the event passed auth checks and is part of the room's visible history.
+	EventAccepted EventOutcome = "accepted"
+	// EventSoftFailed means the event passed auth checks against the state before it, but not against the
+	// room's current state, so it is stored but not shown to clients.
+	EventSoftFailed EventOutcome = "soft-failed"
+	// EventRejected means the event failed auth checks, or was never received.
+	EventRejected EventOutcome = "rejected"
+)
+
+// GetEventOutcome returns how the homeserver handled the event, else fails the test. As the client-server API
+// does not expose this, it is worked out as follows:
+//   - if GetEvent cannot find the event, i.e /rooms/{roomID}/event/{eventID} returns a 404, the event is rejected.
+//   - if /event returns the event and it appears when paginating the room with /messages, the event is accepted.
+//   - if /event returns the event but it does not appear in /messages, the event is soft-failed. Homeservers
+//     keep soft-failed events out of /sync and /messages, but can still serve them by event ID.
+//
+// A 404 cannot tell a rejected event apart from one which has not been received yet, so only call this once the
+// homeserver has processed the event, e.g after the /send transaction containing it has returned.
+func (c *CSAPI) GetEventOutcome(t *testing.T, roomID, eventID string) EventOutcome {
+	t.Helper()
+	if _, ok := c.getEventIfExists(t, roomID, eventID); !ok {
+		return EventRejected
+	}
+	for _, ev := range c.AllMessages(t, roomID, "b") {
+		if ev.Get("event_id").Str == eventID {
+			return EventAccepted
+		}
+	}
+	return EventSoftFailed
+}
+
+// SendThreadedMessage sends a text message into the thread rooted at `rootEventID`, else fails the test.
+// Returns the event ID of the sent event. Use WithTxnID to choose the transaction ID.
+func (c *CSAPI) SendThreadedMessage(t *testing.T, roomID, rootEventID, body string, opts ...RequestOpt) string {
+	t.Helper()
+	return c.sendEvent(t, roomID, b.Event{
+		Type: "m.room.message",
+		Content: map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    body,
+			"m.relates_to": map[string]interface{}{
+				"rel_type": "m.thread",
+				"event_id": rootEventID,
+			},
+		},
+	}, opts...)
+}
+
+// GetThreads returns the thread roots in the room, else fails the test. Use WithQueries to paginate with
+// `from` and `limit`, or to filter with `include`. Returns the response, which contains the `chunk` of
+// thread roots and the `next_batch` token.
+func (c *CSAPI) GetThreads(t *testing.T, roomID string, opts ...RequestOpt) gjson.Result {
+	t.Helper()
+	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "v1", "rooms", roomID, "threads"}, opts...)
+	body := ParseJSON(t, res)
+	return gjson.ParseBytes(body)
+}
+
+// SyncUntilThreadSummary blocks and continually calls /sync until the thread root event is returned in the room's
+// timeline and the `check` function returns true for its bundled m.thread aggregation, which contains
+// `latest_event`, `count` and `current_user_participated`. Each /sync is an initial sync, as the root event is not
+// sent again when the thread changes. Will time out after CSAPI.SyncUntilTimeout.
+func (c *CSAPI) SyncUntilThreadSummary(t *testing.T, roomID, rootEventID string, check func(gjson.Result) bool) {
+	t.Helper()
+	start := time.Now()
+	filter := `{"room":{"timeline":{"limit":50}}}`
+	var lastSummary string
+	for {
+		if time.Since(start) > c.SyncUntilTimeout {
+			t.Fatalf("SyncUntilThreadSummary: timed out waiting for thread %s in room %s, last summary: %s", rootEventID, roomID, lastSummary)
+		}
+		res, _ := c.MustSync(t, SyncReq{Filter: filter})
+		for _, ev := range res.Get("rooms.join." + GjsonEscape(roomID) + ".timeline.events").Array() {
+			if ev.Get("event_id").Str != rootEventID {
+				continue
+			}
+			summary := ev.Get(`unsigned.m\.relations.m\.thread`)
+			if summary.Exists() {
+				lastSummary = summary.Raw
+				if check(summary) {
+					return
+				}
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// SetGlobalAccountData sets the global account data of the given type to `content`, else fails the test.
+func (c *CSAPI) SetGlobalAccountData(t *testing.T, eventType string, content interface{}) {
+	t.Helper()
+	c.MustDo(t, "PUT", []string{"_matrix", "client", "r0", "user", c.UserID, "account_data", eventType}, content)
+}
+
+// SetRoomAccountData sets the account data of the given type for the room to `content`, else fails the test.
+func (c *CSAPI) SetRoomAccountData(t *testing.T, roomID, eventType string, content interface{}) {
+	t.Helper()
+	c.MustDo(t, "PUT", []string{"_matrix", "client", "r0", "user", c.UserID, "rooms", roomID, "account_data", eventType}, content)
+}
+
+// GetGlobalAccountData returns the content of the global account data of the given type, else fails the test.
+func (c *CSAPI) GetGlobalAccountData(t *testing.T, eventType string) gjson.Result {
+	t.Helper()
+	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "r0", "user", c.UserID, "account_data", eventType})
+	body := ParseJSON(t, res)
+	return gjson.ParseBytes(body)
+}
+
+// GetRoomAccountData returns the content of the account data of the given type for the room, else fails the test.
+func (c *CSAPI) GetRoomAccountData(t *testing.T, roomID, eventType string) gjson.Result {
+	t.Helper()
+	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "r0", "user", c.UserID, "rooms", roomID, "account_data", eventType})
+	body := ParseJSON(t, res)
+	return gjson.ParseBytes(body)
+}
+
+// SyncUntilAccountData blocks and continually calls /sync until the `check` function returns true for a
+// global account data event of the given type.
+// Will time out after CSAPI.SyncUntilTimeout.
+func (c *CSAPI) SyncUntilAccountData(t *testing.T, eventType string, check func(gjson.Result) bool) {
+	t.Helper()
+	c.SyncUntil(t, "", "", "account_data.events", accountDataCheck(eventType, check))
+}
+
+// SyncUntilRoomAccountData is like SyncUntilAccountData but checks the account data of the given room.
+// Will time out after CSAPI.SyncUntilTimeout.
+func (c *CSAPI) SyncUntilRoomAccountData(t *testing.T, roomID, eventType string, check func(gjson.Result) bool) {
+	t.Helper()
+	c.SyncUntil(t, "", "", "rooms.join."+GjsonEscape(roomID)+".account_data.events", accountDataCheck(eventType, check))
+}
+
+func accountDataCheck(eventType string, check func(gjson.Result) bool) func(gjson.Result) bool {
+	return func(ev gjson.Result) bool {
+		if ev.Get("type").Str != eventType {
+			return false
+		}
+		return check(ev)
 	}
-	// otherwise we should be told the room ID if we joined via an alias
-	body := ParseJSON(t, res)
-	return GetJSONFieldStr(t, body, "room_id")
 }
 
-// LeaveRoom joins the room ID, else fails the test.
-func (c *CSAPI) LeaveRoom(t *testing.T, roomID string) {
+// SyncUntilDeviceListChanged blocks and continually calls /sync, starting from `since`, until `userID` appears in
+// device_lists.changed. `since` should be a next_batch token from MustSync taken before the device list change,
+// as device list changes are only reported in incremental syncs.
+// Will time out after CSAPI.SyncUntilTimeout.
+func (c *CSAPI) SyncUntilDeviceListChanged(t *testing.T, since, userID string) {
 	t.Helper()
-	// leave the room
-	c.MustDoFunc(t, "POST", []string{"_matrix", "client", "r0", "rooms", roomID, "leave"})
+	c.SyncUntil(t, since, "", "device_lists.changed", func(changed gjson.Result) bool {
+		return changed.Str == userID
+	})
 }
 
-// InviteRoom invites userID to the room ID, else fails the test.
-func (c *CSAPI) InviteRoom(t *testing.T, roomID string, userID string) {
+// SyncUntilPresence blocks and continually calls /sync until the `check` function returns true for an
+// m.presence event sent by `userID`, who may be on a remote server.
+// Will time out after CSAPI.SyncUntilTimeout.
+func (c *CSAPI) SyncUntilPresence(t *testing.T, userID string, check func(gjson.Result) bool) {
 	t.Helper()
-	// Invite the user to the room
-	body := map[string]interface{}{
-		"user_id": userID,
+	c.SyncUntil(t, "", "", "presence.events", func(ev gjson.Result) bool {
+		if ev.Get("type").Str != "m.presence" || ev.Get("sender").Str != userID {
+			return false
+		}
+		return check(ev)
+	})
+}
+
+// SyncUntilHasState polls /rooms/{roomID}/state with DoRetryUntil, not /sync, until the room's current state has
+// a state event with the given type and state key for which the `check` function returns true. Use this to wait
+// for state to reach a server which has just joined the room over federation: polling the state sees the event
+// however it reached the server. Will time out after CSAPI.SyncUntilTimeout.
+func (c *CSAPI) SyncUntilHasState(t *testing.T, roomID, eventType, stateKey string, check func(gjson.Result) bool) {
+	t.Helper()
+	c.DoRetryUntil(t, c.SyncUntilTimeout, "GET", []string{"_matrix", "client", "r0", "rooms", roomID, "state"}, func(res *http.Response) bool {
+		if res.StatusCode != 200 {
+			return false
+		}
+		for _, ev := range gjson.ParseBytes(ParseJSON(t, res)).Array() {
+			if ev.Get("type").Str == eventType && ev.Get("state_key").Str == stateKey {
+				return check(ev)
+			}
+		}
+		return false
+	})
+}
+
+// AssertStateConverged blocks and continually fetches the room's current state from every client until they all
+// report the same state event, by event ID, for the given type and state key. Use this with a client on each server
+// in the room to check that the servers resolved the room's state in the same way, e.g after concurrent state
+// changes. Polls with the same backoff as DoRetryUntil, but across every client. Will time out after the
+// SyncUntilTimeout of the first client, listing what each client last saw.
+func AssertStateConverged(t *testing.T, roomID string, servers []*CSAPI, eventType, stateKey string) {
+	t.Helper()
+	if len(servers) == 0 {
+		t.Fatalf("AssertStateConverged: no clients given")
+	}
+	seen := make([]string, len(servers))
+	converged := retryUntil(servers[0].SyncUntilTimeout, func() bool {
+		converged := true
+		var wantEventID string
+		for i, c := range servers {
+			var eventID string
+			eventID, seen[i] = c.currentStateEvent(t, roomID, eventType, stateKey)
+			if i == 0 {
+				wantEventID = eventID
+			}
+			if eventID == "" || eventID != wantEventID {
+				converged = false
+			}
+		}
+		return converged
+	})
+	if !converged {
+		lines := make([]string, len(servers))
+		for i, c := range servers {
+			lines[i] = "  " + c.HSName + " (" + c.UserID + "): " + seen[i]
+		}
+		t.Fatalf("AssertStateConverged: timed out waiting for %s state event with state key '%s' in %s to converge:\n%s",
+			eventType, stateKey, roomID, strings.Join(lines, "\n"))
 	}
-	c.MustDo(t, "POST", []string{"_matrix", "client", "r0", "rooms", roomID, "invite"}, body)
 }
 
-// SendEventSynced sends `e` into the room and waits for its event ID to come down /sync.
-// Returns the event ID of the sent event.
-func (c *CSAPI) SendEventSynced(t *testing.T, roomID string, e b.Event) string {
+// currentStateEvent returns the event ID of the state event with the given type and state key in the room's current
+// state, or "" if there is none, along with a description of what was seen for AssertStateConverged to report.
+func (c *CSAPI) currentStateEvent(t *testing.T, roomID, eventType, stateKey string) (eventID, desc string) {
 	t.Helper()
-	c.txnID++
-	paths := []string{"_matrix", "client", "r0", "rooms", roomID, "send", e.Type, strconv.Itoa(c.txnID)}
-	if e.StateKey != nil {
-		paths = []string{"_matrix", "client", "r0", "rooms", roomID, "state", e.Type, *e.StateKey}
+	res := c.DoFunc(t, "GET", []string{"_matrix", "client", "r0", "rooms", roomID, "state"})
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		return "", "HTTP " + strconv.Itoa(res.StatusCode) + " " + string(body)
 	}
-	res := c.MustDo(t, "PUT", paths, e.Content)
-	body := ParseJSON(t, res)
-	eventID := GetJSONFieldStr(t, body, "event_id")
-	t.Logf("SendEventSynced waiting for event ID %s", eventID)
-	c.SyncUntilTimelineHas(t, roomID, func(r gjson.Result) bool {
-		return r.Get("event_id").Str == eventID
+	for _, ev := range gjson.ParseBytes(body).Array() {
+		if ev.Get("type").Str == eventType && ev.Get("state_key").Str == stateKey {
+			return ev.Get("event_id").Str, ev.Get("event_id").Str + " " + ev.Get("content").Raw
+		}
+	}
+	return "", "no such state event"
+}
+
+// SyncUntilInviteState blocks and continually calls /sync until the room appears in the invite section of the
+// invited user's sync and the `check` function returns true for its stripped state events, read from
+// rooms.invite.{roomID}.invite_state.events. Will time out after CSAPI.SyncUntilTimeout.
+func (c *CSAPI) SyncUntilInviteState(t *testing.T, roomID string, check func([]gjson.Result) bool) {
+	t.Helper()
+	start := time.Now()
+	since := ""
+	var lastInviteState gjson.Result
+	for time.Since(start) < c.SyncUntilTimeout {
+		var res gjson.Result
+		res, since = c.MustSync(t, SyncReq{
+			Since:         since,
+			TimeoutMillis: "1000",
+		})
+		inviteState := res.Get("rooms.invite." + GjsonEscape(roomID) + ".invite_state.events")
+		if !inviteState.Exists() {
+			continue
+		}
+		lastInviteState = inviteState
+		if check(inviteState.Array()) {
+			return
+		}
+	}
+	t.Fatalf("CSAPI.SyncUntilInviteState: timed out waiting for the invite state of %s, last seen: %s", roomID, lastInviteState.Raw)
+}
+
+// SyncUntilKnock blocks and continually calls /sync until the room appears in the knock section of the
+// knocking user's sync. Users in the room see the knock as a membership event instead: see SyncUntilMembership.
+// Will time out after CSAPI.SyncUntilTimeout.
+func (c *CSAPI) SyncUntilKnock(t *testing.T, roomID string) {
+	t.Helper()
+	c.SyncUntil(t, "", "", "rooms.knock."+GjsonEscape(roomID)+".knock_state.events", func(ev gjson.Result) bool {
+		// no state events are required to be in the knock state, so finding an entry for the room is enough
+		return true
 	})
-	return eventID
 }
 
-// SyncUntilTimelineHas blocks and continually calls /sync until the `check` function returns true.
-// If the `check` function fails the test, the failing event will be automatically logged.
+// SyncUntilMembership blocks and continually calls /sync until the room's timeline has an m.room.member event
+// for `userID` with the given `membership`, e.g "join" or "leave".
 // Will time out after CSAPI.SyncUntilTimeout.
-func (c *CSAPI) SyncUntilTimelineHas(t *testing.T, roomID string, check func(gjson.Result) bool) {
+func (c *CSAPI) SyncUntilMembership(t *testing.T, roomID, userID, membership string) {
 	t.Helper()
-	c.SyncUntil(t, "", "", "rooms.join."+GjsonEscape(roomID)+".timeline.events", check)
+	c.SyncUntilTimelineHas(t, roomID, func(ev gjson.Result) bool {
+		if ev.Get("type").Str != "m.room.member" || ev.Get("state_key").Str != userID {
+			return false
+		}
+		return ev.Get("content.membership").Str == membership
+	})
 }
 
-// SyncUntil blocks and continually calls /sync until the `check` function returns true.
-// If the `check` function fails the test, the failing event will be automatically logged.
+// SyncUntilMemberHasField blocks and continually fetches the room's current state until the m.room.member event
+// for `userID` has `field` in its content equal to `want` e.g "displayname" or "avatar_url". Use this to wait for a
+// profile change to reach the room, which for remote users happens over federation.
+// Will time out after CSAPI.SyncUntilTimeout.
+func (c *CSAPI) SyncUntilMemberHasField(t *testing.T, roomID, userID, field, want string) {
+	t.Helper()
+	c.SyncUntilHasState(t, roomID, "m.room.member", userID, func(ev gjson.Result) bool {
+		return ev.Get("content."+GjsonEscape(field)).Str == want
+	})
+}
+
+// SyncUntilLeftRooms blocks and continually fetches the current state of each room until `userID` has left it,
+// e.g after deactivating their account. Will time out after CSAPI.SyncUntilTimeout for each room.
+func (c *CSAPI) SyncUntilLeftRooms(t *testing.T, userID string, roomIDs []string) {
+	t.Helper()
+	for _, roomID := range roomIDs {
+		c.SyncUntilHasState(t, roomID, "m.room.member", userID, func(ev gjson.Result) bool {
+			return ev.Get("content.membership").Str == "leave"
+		})
+	}
+}
+
+// SyncUntil blocks and continually calls /sync until the `check` function returns true for an element of the
+// array at `key`. `filter` may be a filter ID from CreateFilter, a JSON-encoded filter definition or "" for no
+// filter. If the `check` function fails the test, the failing event will be automatically logged.
 // Will time out after CSAPI.SyncUntilTimeout.
 func (c *CSAPI) SyncUntil(t *testing.T, since, filter, key string, check func(gjson.Result) bool) {
 	t.Helper()
@@ -162,19 +1976,13 @@ func (c *CSAPI) SyncUntil(t *testing.T, since, filter, key string, check func(gj
 			timedOut = true
 			t.Fatalf("SyncUntil: timed out. Called check function %d times", checkCounter)
 		}
-		query := url.Values{
-			"timeout": []string{"1000"},
-		}
-		if since != "" {
-			query["since"] = []string{since}
-		}
-		if filter != "" {
-			query["filter"] = []string{filter}
-		}
-		res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "r0", "sync"}, WithQueries(query))
-		body := ParseJSON(t, res)
-		since = GetJSONFieldStr(t, body, "next_batch")
-		keyRes := gjson.GetBytes(body, key)
+		var res gjson.Result
+		res, since = c.MustSync(t, SyncReq{
+			Since:         since,
+			Filter:        filter,
+			TimeoutMillis: "1000",
+		})
+		keyRes := res.Get(key)
 		if keyRes.IsArray() {
 			events := keyRes.Array()
 			for i, ev := range events {
@@ -189,6 +1997,87 @@ func (c *CSAPI) SyncUntil(t *testing.T, since, filter, key string, check func(gj
 	}
 }
 
+// MustNotSyncUntil continually calls /sync, starting with an initial sync, for the whole of `timeout` and
+// fails the test if the `check` function returns true for any sync response. Use this to assert that something
+// does not happen, e.g that a room does not appear in the sync of a user who cannot see it. `filter` may be a
+// filter ID from CreateFilter, a JSON-encoded filter definition or "" for no filter.
+func (c *CSAPI) MustNotSyncUntil(t *testing.T, timeout time.Duration, filter string, check func(gjson.Result) bool) {
+	t.Helper()
+	start := time.Now()
+	since := ""
+	for time.Since(start) < timeout {
+		remaining := timeout - time.Since(start)
+		if remaining > time.Second {
+			remaining = time.Second
+		}
+		var res gjson.Result
+		res, since = c.MustSync(t, SyncReq{
+			Since:         since,
+			Filter:        filter,
+			TimeoutMillis: strconv.FormatInt(remaining.Milliseconds(), 10),
+		})
+		if check(res) {
+			t.Fatalf("MustNotSyncUntil: check function returned true after %v for sync response: %s", time.Since(start), res.Raw)
+		}
+	}
+}
+
+// CreateFilter uploads the filter definition for the client's user, else fails the test. Returns the filter ID,
+// which can be passed as SyncReq.Filter or as the `filter` of the sync helpers.
+func (c *CSAPI) CreateFilter(t *testing.T, filter interface{}) string {
+	t.Helper()
+	res := c.MustDo(t, "POST", []string{"_matrix", "client", "r0", "user", c.UserID, "filter"}, filter)
+	body := ParseJSON(t, res)
+	filterID := gjson.GetBytes(body, "filter_id")
+	if filterID.Str == "" {
+		t.Fatalf("CreateFilter: response did not contain a filter_id: %s", string(body))
+	}
+	return filterID.Str
+}
+
+// SyncReq contains all the /sync request configuration options. Empty values are omitted from the request.
+type SyncReq struct {
+	// A point in time to continue a sync from. This should be the next_batch token returned by an
+	// earlier call to this endpoint.
+	Since string
+	// The ID of a filter created using the filter API or a filter JSON object encoded as a string.
+	Filter string
+	// Controls whether to include the full state for all rooms the user is a member of.
+	FullState bool
+	// Controls whether the client is automatically marked as online by polling this API. One of
+	// "offline", "online" or "unavailable".
+	SetPresence string
+	// The maximum time to wait, in milliseconds, before returning this request.
+	TimeoutMillis string
+}
+
+// MustSync performs a single /sync request with the given request options, failing the test on error.
+// Returns the parsed response body and the next_batch token, which can be passed as SyncReq.Since
+// in a subsequent call to continue syncing from where this response left off.
+func (c *CSAPI) MustSync(t *testing.T, syncReq SyncReq) (gjson.Result, string) {
+	t.Helper()
+	query := url.Values{}
+	if syncReq.Since != "" {
+		query.Set("since", syncReq.Since)
+	}
+	if syncReq.Filter != "" {
+		query.Set("filter", syncReq.Filter)
+	}
+	if syncReq.FullState {
+		query.Set("full_state", "true")
+	}
+	if syncReq.SetPresence != "" {
+		query.Set("set_presence", syncReq.SetPresence)
+	}
+	if syncReq.TimeoutMillis != "" {
+		query.Set("timeout", syncReq.TimeoutMillis)
+	}
+	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "r0", "sync"}, WithQueries(query))
+	body := ParseJSON(t, res)
+	nextBatch := GetJSONFieldStr(t, body, "next_batch")
+	return gjson.ParseBytes(body), nextBatch
+}
+
 //RegisterUser will register the user with given parameters and
 // return user ID & access token, and fail the test on network error
 func (c *CSAPI) RegisterUser(t *testing.T, localpart, password string) (userID, accessToken string) {
@@ -212,6 +2101,17 @@ func (c *CSAPI) RegisterUser(t *testing.T, localpart, password string) (userID,
 	return userID, accessToken
 }
 
+// RegisterGuest will register a guest user and return the user ID & access token. Fails the test with
+// the server's error if guest access is disabled.
+func (c *CSAPI) RegisterGuest(t *testing.T) (userID, accessToken string) {
+	t.Helper()
+	query := url.Values{}
+	query.Set("kind", "guest")
+	res := c.MustDoFunc(t, "POST", []string{"_matrix", "client", "r0", "register"}, WithQueries(query), WithJSONBody(t, struct{}{}))
+	body := ParseJSON(t, res)
+	return GetJSONFieldStr(t, body, "user_id"), GetJSONFieldStr(t, body, "access_token")
+}
+
 // MustDo will do the HTTP request and fail the test if the response is not 2xx
 func (c *CSAPI) MustDo(t *testing.T, method string, paths []string, jsonBody interface{}) *http.Response {
 	t.Helper()
@@ -222,6 +2122,58 @@ func (c *CSAPI) MustDo(t *testing.T, method string, paths []string, jsonBody int
 	return res
 }
 
+// MustGetRateLimited repeatedly performs the HTTP request until the server responds with HTTP 429, then
+// returns how long the server asked us to wait before retrying. The wait is taken from `retry_after_ms` in the
+// response body if present, else the Retry-After header, which may be a number of seconds or an HTTP date.
+// Fails the test if the request is not rate limited after 100 attempts, or if a non-2xx response other than
+// 429 is returned. See DoUntilRateLimited for requests which take a transaction ID.
+func (c *CSAPI) MustGetRateLimited(t *testing.T, method string, paths []string, opts ...RequestOpt) time.Duration {
+	t.Helper()
+	res := c.DoUntilRateLimited(t, method, paths, opts...)
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("CSAPI.MustGetRateLimited: reading HTTP response body returned %s", err)
+	}
+	if retryAfterMs := gjson.GetBytes(body, "retry_after_ms"); retryAfterMs.Exists() {
+		return time.Duration(retryAfterMs.Int()) * time.Millisecond
+	}
+	header := res.Header.Get("Retry-After")
+	if retryAfterSecs, err := strconv.Atoi(header); err == nil {
+		return time.Duration(retryAfterSecs) * time.Second
+	}
+	if retryAt, err := http.ParseTime(header); err == nil {
+		return time.Until(retryAt)
+	}
+	t.Fatalf("CSAPI.MustGetRateLimited: 429 response has no retry_after_ms or valid Retry-After header - body: %s", string(body))
+	return 0
+}
+
+// DoUntilRateLimited repeatedly performs the HTTP request until the server responds with HTTP 429, then returns
+// that response. Fails the test if the request is not rate limited after 100 attempts, or if a non-2xx response
+// other than 429 is returned. Servers deduplicate requests with the same transaction ID rather than rate limiting
+// them, so pass an option which changes the transaction ID on every request, e.g a RequestOpt which calls
+// WithTxnID with a counter.
+func (c *CSAPI) DoUntilRateLimited(t *testing.T, method string, paths []string, opts ...RequestOpt) *http.Response {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		res := c.DoFunc(t, method, paths, opts...)
+		if res.StatusCode == http.StatusTooManyRequests {
+			return res
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatalf("CSAPI.DoUntilRateLimited: reading HTTP response body returned %s", err)
+		}
+		if res.StatusCode < 200 || res.StatusCode >= 300 {
+			t.Fatalf("CSAPI.DoUntilRateLimited %s %s returned HTTP %d - body: %s", method, res.Request.URL.String(), res.StatusCode, string(body))
+		}
+	}
+	t.Fatalf("CSAPI.DoUntilRateLimited: %s %v was not rate limited after 100 requests", method, paths)
+	return nil
+}
+
 // WithRawBody sets the HTTP request body to `body`
 func WithRawBody(body []byte) RequestOpt {
 	return func(req *http.Request) {
@@ -261,6 +2213,48 @@ func WithQueries(q url.Values) RequestOpt {
 	}
 }
 
+// WithFilter sets the "filter" query parameter on the request, leaving any other query parameters intact.
+// `filter` may be a filter ID or a JSON-encoded filter definition.
+func WithFilter(filter string) RequestOpt {
+	return func(req *http.Request) {
+		query := req.URL.Query()
+		query.Set("filter", filter)
+		req.URL.RawQuery = query.Encode()
+	}
+}
+
+// WithTxnID sets the transaction ID of a request to an endpoint which takes one, e.g
+// /rooms/{roomID}/send/{eventType}/{txnID}, replacing the one generated by the send helpers. Use this to make the
+// same request twice, e.g to test that the server deduplicates a retried request. Has no effect on other requests,
+// such as sending state events, which have no transaction ID.
+func WithTxnID(txnID string) RequestOpt {
+	return func(req *http.Request) {
+		segments := strings.Split(req.URL.EscapedPath(), "/")
+		i := txnIDSegment(segments)
+		if i < 0 {
+			return
+		}
+		segments[i] = url.PathEscape(txnID)
+		req.URL.RawPath = strings.Join(segments, "/")
+		req.URL.Path, _ = url.PathUnescape(req.URL.RawPath)
+	}
+}
+
+// txnIDSegment returns the index of the transaction ID in the path segments of a request, or -1 if the endpoint
+// does not take one. Transaction IDs are the last path segment of /send/{eventType}/{txnID},
+// /sendToDevice/{eventType}/{txnID} and /redact/{eventID}/{txnID}.
+func txnIDSegment(segments []string) int {
+	n := len(segments)
+	if n < 3 {
+		return -1
+	}
+	switch segments[n-3] {
+	case "send", "sendToDevice", "redact":
+		return n - 1
+	}
+	return -1
+}
+
 // MustDoFunc is the same as DoFunc but fails the test if the returned HTTP response code is not 2xx.
 func (c *CSAPI) MustDoFunc(t *testing.T, method string, paths []string, opts ...RequestOpt) *http.Response {
 	t.Helper()
@@ -273,6 +2267,50 @@ func (c *CSAPI) MustDoFunc(t *testing.T, method string, paths []string, opts ...
 	return res
 }
 
+// DoRetryUntil performs the HTTP request repeatedly until `check` returns true, for endpoints which are
+// eventually consistent but not observable via /sync. Waits between attempts, backing off from 100ms up to 1s.
+// `check` may read the response body. Fails the test with the last response if `check` does not pass before
+// the timeout, or if an HTTP request could not be made.
+func (c *CSAPI) DoRetryUntil(t *testing.T, timeout time.Duration, method string, paths []string, check func(res *http.Response) bool, opts ...RequestOpt) {
+	t.Helper()
+	var lastStatus int
+	var lastBody []byte
+	passed := retryUntil(timeout, func() bool {
+		res := c.DoFunc(t, method, paths, opts...)
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatalf("CSAPI.DoRetryUntil failed to read response body: %s", err)
+		}
+		lastStatus, lastBody = res.StatusCode, body
+		res.Body = ioutil.NopCloser(bytes.NewBuffer(body))
+		return check(res)
+	})
+	if !passed {
+		t.Fatalf("CSAPI.DoRetryUntil: %s %s did not pass the check after %v, last response was HTTP %d: %s",
+			method, strings.Join(paths, "/"), timeout, lastStatus, string(lastBody))
+	}
+}
+
+// retryUntil calls `check` until it returns true, waiting between attempts and backing off from 100ms up to 1s.
+// Returns false if `check` does not pass before the timeout.
+func retryUntil(timeout time.Duration, check func() bool) bool {
+	start := time.Now()
+	wait := 100 * time.Millisecond
+	for {
+		if check() {
+			return true
+		}
+		if time.Since(start) > timeout {
+			return false
+		}
+		time.Sleep(wait)
+		if wait *= 2; wait > time.Second {
+			wait = time.Second
+		}
+	}
+}
+
 // DoFunc performs an arbitrary HTTP request to the server. This function supports RequestOpts to set
 // extra information on the request such as an HTTP request body, query parameters and content-type.
 // See all functions in this package starting with `With...`.
@@ -287,10 +2325,12 @@ func (c *CSAPI) MustDoFunc(t *testing.T, method string, paths []string, opts ...
 //    })
 func (c *CSAPI) DoFunc(t *testing.T, method string, paths []string, opts ...RequestOpt) *http.Response {
 	t.Helper()
+	// escape into a new slice so callers can safely reuse `paths` across requests
+	escapedPaths := make([]string, len(paths))
 	for i := range paths {
-		paths[i] = url.PathEscape(paths[i])
+		escapedPaths[i] = url.PathEscape(paths[i])
 	}
-	reqURL := c.BaseURL + "/" + strings.Join(paths, "/")
+	reqURL := c.BaseURL + "/" + strings.Join(escapedPaths, "/")
 	req, err := http.NewRequest(method, reqURL, nil)
 	if err != nil {
 		t.Fatalf("CSAPI.DoFunc failed to create http.NewRequest: %s", err)
@@ -304,10 +2344,18 @@ func (c *CSAPI) DoFunc(t *testing.T, method string, paths []string, opts ...Requ
 	for _, o := range opts {
 		o(req)
 	}
+	// set the masquerading user after RequestOpts so WithQueries doesn't clobber it
+	if c.MasqueradeUserID != "" {
+		query := req.URL.Query()
+		query.Set("user_id", c.MasqueradeUserID)
+		req.URL.RawQuery = query.Encode()
+	}
 	// set defaults after RequestOpts
 	if req.Header.Get("Content-Type") == "" {
 		req.Header.Set("Content-Type", "application/json")
 	}
+	// tag the request with the user, for the request log line
+	req = req.WithContext(context.WithValue(req.Context(), loggedUserIDKey{}, c.UserID))
 	// debug log the request
 	if c.Debug {
 		t.Logf("Making %s request to %s", method, reqURL)
@@ -339,8 +2387,180 @@ func (c *CSAPI) DoFunc(t *testing.T, method string, paths []string, opts ...Requ
 	return res
 }
 
-// NewLoggedClient returns an http.Client which logs requests/responses
-func NewLoggedClient(t *testing.T, hsName string, cli *http.Client) *http.Client {
+// AdminAPI maps server administration operations, which are not part of the client-server API, onto a homeserver
+// implementation's admin endpoints. The `admin` client passed to each method is authenticated as a server admin.
+// Methods fail the test on error.
+type AdminAPI interface {
+	// DeactivateUser deactivates the user's account.
+	DeactivateUser(t *testing.T, admin *CSAPI, userID string)
+	// PurgeRoom removes every local user from the room and deletes it from the server's database.
+	PurgeRoom(t *testing.T, admin *CSAPI, roomID string)
+	// ListRoomMedia returns the MXC URIs of the media sent in the room.
+	ListRoomMedia(t *testing.T, admin *CSAPI, roomID string) []string
+}
+
+// SynapseAdminAPI implements AdminAPI with the /_synapse/admin endpoints.
+type SynapseAdminAPI struct{}
+
+func (SynapseAdminAPI) DeactivateUser(t *testing.T, admin *CSAPI, userID string) {
+	t.Helper()
+	admin.MustDo(t, "POST", []string{"_synapse", "admin", "v1", "deactivate", userID}, map[string]interface{}{
+		"erase": false,
+	})
+}
+
+func (SynapseAdminAPI) PurgeRoom(t *testing.T, admin *CSAPI, roomID string) {
+	t.Helper()
+	admin.MustDo(t, "DELETE", []string{"_synapse", "admin", "v1", "rooms", roomID}, map[string]interface{}{
+		"purge": true,
+	})
+}
+
+func (SynapseAdminAPI) ListRoomMedia(t *testing.T, admin *CSAPI, roomID string) []string {
+	t.Helper()
+	res := admin.MustDoFunc(t, "GET", []string{"_synapse", "admin", "v1", "room", roomID, "media"})
+	body := ParseJSON(t, res)
+	var mxcURIs []string
+	for _, key := range []string{"local", "remote"} {
+		for _, uri := range gjson.GetBytes(body, key).Array() {
+			mxcURIs = append(mxcURIs, uri.Str)
+		}
+	}
+	return mxcURIs
+}
+
+// AdminDeactivateUser deactivates the user's account with the admin API, else fails the test.
+func (c *CSAPI) AdminDeactivateUser(t *testing.T, userID string) {
+	t.Helper()
+	c.mustAdminAPI(t).DeactivateUser(t, c, userID)
+}
+
+// AdminPurgeRoom removes every local user from the room and deletes it with the admin API, else fails the test.
+func (c *CSAPI) AdminPurgeRoom(t *testing.T, roomID string) {
+	t.Helper()
+	c.mustAdminAPI(t).PurgeRoom(t, c, roomID)
+}
+
+// AdminListRoomMedia returns the MXC URIs of the media sent in the room with the admin API, else fails the test.
+func (c *CSAPI) AdminListRoomMedia(t *testing.T, roomID string) []string {
+	t.Helper()
+	return c.mustAdminAPI(t).ListRoomMedia(t, c, roomID)
+}
+
+func (c *CSAPI) mustAdminAPI(t *testing.T) AdminAPI {
+	t.Helper()
+	if c.AdminAPI == nil {
+		t.Fatalf("CSAPI: %s has no AdminAPI, use Deployment.AdminClient", c.UserID)
+	}
+	return c.AdminAPI
+}
+
+// WebSocket is a WebSocket connection opened with CSAPI.OpenWebSocket. Its methods fail the test on error.
+type WebSocket struct {
+	conn    *websocket.Conn
+	timeout time.Duration
+}
+
+// OpenWebSocket opens a WebSocket connection to the given path, authenticated as this user, else fails the test.
+// The connection uses the same base URL and TLS config as DoFunc, and the RequestOpts are applied to the
+// handshake request e.g to add query parameters. Reads time out after CSAPI.SyncUntilTimeout. The caller must
+// Close the connection.
+func (c *CSAPI) OpenWebSocket(t *testing.T, paths []string, opts ...RequestOpt) *WebSocket {
+	t.Helper()
+	escapedPaths := make([]string, len(paths))
+	for i := range paths {
+		escapedPaths[i] = url.PathEscape(paths[i])
+	}
+	// build the handshake as a normal request so that RequestOpts work the same way as with DoFunc
+	req, err := http.NewRequest("GET", c.BaseURL+"/"+strings.Join(escapedPaths, "/"), nil)
+	if err != nil {
+		t.Fatalf("CSAPI.OpenWebSocket failed to create http.NewRequest: %s", err)
+	}
+	if c.AccessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.AccessToken)
+	}
+	for _, o := range opts {
+		o(req)
+	}
+	if c.MasqueradeUserID != "" {
+		query := req.URL.Query()
+		query.Set("user_id", c.MasqueradeUserID)
+		req.URL.RawQuery = query.Encode()
+	}
+	switch req.URL.Scheme {
+	case "https":
+		req.URL.Scheme = "wss"
+	default:
+		req.URL.Scheme = "ws"
+	}
+	config, err := websocket.NewConfig(req.URL.String(), c.BaseURL)
+	if err != nil {
+		t.Fatalf("CSAPI.OpenWebSocket failed to create config for %s: %s", req.URL.String(), err)
+	}
+	config.Header = req.Header
+	config.TlsConfig = clientTLSConfig(c.Client)
+	conn, err := websocket.DialConfig(config)
+	if err != nil {
+		t.Fatalf("CSAPI.OpenWebSocket failed to connect to %s: %s", req.URL.String(), err)
+	}
+	t.Logf("WS %s%s => connected", c.HSName, req.URL.Path)
+	return &WebSocket{
+		conn:    conn,
+		timeout: c.SyncUntilTimeout,
+	}
+}
+
+// ReadJSON reads the next message, which must be JSON, else fails the test.
+func (ws *WebSocket) ReadJSON(t *testing.T) gjson.Result {
+	t.Helper()
+	if err := ws.conn.SetReadDeadline(time.Now().Add(ws.timeout)); err != nil {
+		t.Fatalf("WebSocket.ReadJSON failed to set read deadline: %s", err)
+	}
+	var msg []byte
+	if err := websocket.Message.Receive(ws.conn, &msg); err != nil {
+		t.Fatalf("WebSocket.ReadJSON failed to read message: %s", err)
+	}
+	if !gjson.ValidBytes(msg) {
+		t.Fatalf("WebSocket.ReadJSON message is not valid JSON: %s", string(msg))
+	}
+	return gjson.ParseBytes(msg)
+}
+
+// WriteJSON sends `v` encoded as JSON, else fails the test.
+func (ws *WebSocket) WriteJSON(t *testing.T, v interface{}) {
+	t.Helper()
+	if err := websocket.JSON.Send(ws.conn, v); err != nil {
+		t.Fatalf("WebSocket.WriteJSON failed to send message: %s", err)
+	}
+}
+
+// Close closes the connection.
+func (ws *WebSocket) Close() error {
+	return ws.conn.Close()
+}
+
+// clientTLSConfig returns the TLS config used by the HTTP client, or nil to use the defaults.
+func clientTLSConfig(cli *http.Client) *tls.Config {
+	if cli == nil {
+		return nil
+	}
+	transport := cli.Transport
+	if logged, ok := transport.(*loggedRoundTripper); ok {
+		transport = logged.wrap
+	}
+	if httpTransport, ok := transport.(*http.Transport); ok {
+		return httpTransport.TLSClientConfig
+	}
+	return nil
+}
+
+// RequestLogger logs a line summarising a request made by a client returned by NewLoggedClient, and its response.
+type RequestLogger func(t *testing.T, line string)
+
+// NewLoggedClient returns an http.Client which logs requests/responses. If the logger is nil, each request is
+// logged with t.Logf as its method, homeserver, path, response status and duration. Otherwise, each request is
+// logged with the logger, adding the user and transaction ID (if any), and the response body if the request failed.
+func NewLoggedClient(t *testing.T, hsName string, cli *http.Client, logger RequestLogger) *http.Client {
 	t.Helper()
 	if cli == nil {
 		cli = &http.Client{
@@ -351,25 +2571,59 @@ func NewLoggedClient(t *testing.T, hsName string, cli *http.Client) *http.Client
 	if transport == nil {
 		transport = http.DefaultTransport
 	}
-	cli.Transport = &loggedRoundTripper{t, hsName, transport}
+	cli.Transport = &loggedRoundTripper{t, hsName, transport, logger}
 	return cli
 }
 
+// loggedUserIDKey is the request context key for the user ID making the request, which CSAPI.DoFunc sets.
+type loggedUserIDKey struct{}
+
 type loggedRoundTripper struct {
 	t      *testing.T
 	hsName string
 	wrap   http.RoundTripper
+	logger RequestLogger
 }
 
 func (t *loggedRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
 	start := time.Now()
 	res, err := t.wrap.RoundTrip(req)
+	if t.logger == nil {
+		if err != nil {
+			t.t.Logf("%s %s%s => error: %s (%s)", req.Method, t.hsName, req.URL.Path, err, time.Since(start))
+		} else {
+			t.t.Logf("%s %s%s => %s (%s)", req.Method, t.hsName, req.URL.Path, res.Status, time.Since(start))
+		}
+		return res, err
+	}
+	request := req.Method + " " + t.hsName + req.URL.Path
+	if userID, _ := req.Context().Value(loggedUserIDKey{}).(string); userID != "" {
+		request += " user=" + userID
+	}
+	// use the request URL rather than the paths given to DoFunc, as WithTxnID may have changed the transaction ID
+	segments := strings.Split(req.URL.EscapedPath(), "/")
+	if i := txnIDSegment(segments); i >= 0 {
+		request += " txn=" + segments[i]
+	}
 	if err != nil {
-		t.t.Logf("%s %s%s => error: %s (%s)", req.Method, t.hsName, req.URL.Path, err, time.Since(start))
+		t.logger(t.t, fmt.Sprintf("%s => error: %s (%s)", request, err, time.Since(start)))
+		return res, err
+	}
+	duration := time.Since(start)
+	if res.StatusCode < 400 {
+		t.logger(t.t, fmt.Sprintf("%s => %s (%s)", request, res.Status, duration))
+		return res, nil
+	}
+	// log why the request failed, then put the body back for the caller to read
+	body, readErr := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if readErr != nil {
+		t.logger(t.t, fmt.Sprintf("%s => %s (%s) failed to read response body: %s", request, res.Status, duration, readErr))
 	} else {
-		t.t.Logf("%s %s%s => %s (%s)", req.Method, t.hsName, req.URL.Path, res.Status, time.Since(start))
+		t.logger(t.t, fmt.Sprintf("%s => %s (%s) %s", request, res.Status, duration, string(body)))
 	}
-	return res, err
+	return res, nil
 }
 
 // GetJSONFieldStr extracts a value from a byte-encoded JSON body given a search key
@@ -422,6 +2676,23 @@ func ParseJSON(t *testing.T, res *http.Response) []byte {
 	return body
 }
 
+// AnnotationCount returns the number of reactions with the given key in the event's bundled m.annotation
+// aggregation. Returns 0 if the event has no aggregation for the key.
+func AnnotationCount(ev gjson.Result, key string) int64 {
+	for _, annotation := range ev.Get(`unsigned.m\.relations.m\.annotation.chunk`).Array() {
+		if annotation.Get("key").Str == key {
+			return annotation.Get("count").Int()
+		}
+	}
+	return 0
+}
+
+// LatestEdit returns the event's bundled m.replace aggregation, which identifies the latest edit of the event,
+// or a non-existent result if the event has not been edited.
+func LatestEdit(ev gjson.Result) gjson.Result {
+	return ev.Get(`unsigned.m\.relations.m\.replace`)
+}
+
 // GjsonEscape escapes . and * from the input so it can be used with gjson.Get
 func GjsonEscape(in string) string {
 	in = strings.ReplaceAll(in, ".", `\.`)
@@ -0,0 +1,133 @@
+package client
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// Test that the logger is given the user, transaction ID and the body of failed requests, and that the caller can
+// still read the body.
+func TestLoggedClientLogsFailedResponseBodies(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(403)
+		w.Write([]byte(`{"errcode":"M_FORBIDDEN"}`))
+	}))
+	defer srv.Close()
+
+	var lines []string
+	c := &CSAPI{
+		UserID:  "@alice:hs1",
+		BaseURL: srv.URL,
+		Client: NewLoggedClient(t, "hs1", nil, func(t *testing.T, line string) {
+			lines = append(lines, line)
+		}),
+	}
+	res := c.DoFunc(t, "PUT", []string{"_matrix", "client", "r0", "rooms", "!room:hs1", "send", "m.room.message", "txn1"})
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatalf("failed to read response body: %s", err)
+	}
+	if string(body) != `{"errcode":"M_FORBIDDEN"}` {
+		t.Fatalf("response body was %s after logging it, want it unchanged", string(body))
+	}
+	if len(lines) != 1 {
+		t.Fatalf("logged %d lines, want 1: %v", len(lines), lines)
+	}
+	for _, want := range []string{"PUT hs1/", "user=@alice:hs1", "txn=txn1", "403 Forbidden", `{"errcode":"M_FORBIDDEN"}`} {
+		if !strings.Contains(lines[0], want) {
+			t.Errorf("logged line %q does not contain %q", lines[0], want)
+		}
+	}
+}
+
+// newWebSocketEchoServer starts a WebSocket server which echoes every message back, and returns a client for it
+// along with the handshake requests the server received.
+func newWebSocketEchoServer() (*CSAPI, <-chan *http.Request, func()) {
+	handshakes := make(chan *http.Request, 1)
+	srv := httptest.NewServer(websocket.Handler(func(conn *websocket.Conn) {
+		handshakes <- conn.Request()
+		for {
+			var msg []byte
+			if err := websocket.Message.Receive(conn, &msg); err != nil {
+				return
+			}
+			if err := websocket.Message.Send(conn, string(msg)); err != nil {
+				return
+			}
+		}
+	}))
+	c := &CSAPI{
+		UserID:           "@alice:hs1",
+		AccessToken:      "alice_token",
+		BaseURL:          srv.URL,
+		Client:           srv.Client(),
+		SyncUntilTimeout: 5 * time.Second,
+	}
+	return c, handshakes, srv.Close
+}
+
+// Test that the handshake is authenticated and has the query parameters from the RequestOpts, and that JSON
+// messages round trip.
+func TestOpenWebSocket(t *testing.T) {
+	c, handshakes, closeServer := newWebSocketEchoServer()
+	defer closeServer()
+
+	ws := c.OpenWebSocket(t, []string{"_matrix", "client", "unstable", "ws"}, WithQueries(url.Values{
+		"since": []string{"s123"},
+	}))
+	defer ws.Close()
+
+	handshake := <-handshakes
+	if got := handshake.Header.Get("Authorization"); got != "Bearer alice_token" {
+		t.Errorf("handshake has Authorization header %q, want %q", got, "Bearer alice_token")
+	}
+	if got := handshake.URL.Query().Get("since"); got != "s123" {
+		t.Errorf("handshake has since=%q, want %q", got, "s123")
+	}
+	if handshake.URL.Path != "/_matrix/client/unstable/ws" {
+		t.Errorf("handshake was for path %s, want /_matrix/client/unstable/ws", handshake.URL.Path)
+	}
+
+	ws.WriteJSON(t, map[string]interface{}{
+		"type": "ping",
+	})
+	if got := ws.ReadJSON(t).Get("type").Str; got != "ping" {
+		t.Errorf("read message with type %q, want the echoed %q", got, "ping")
+	}
+}
+
+// Test that ReadJSON fails the test when the message is not JSON. As failing the test stops it, this runs the
+// failing read in a subprocess and checks that it failed.
+func TestWebSocketReadJSONFailsOnNonJSON(t *testing.T) {
+	if os.Getenv("COMPLEMENT_TEST_WEBSOCKET_NON_JSON") == "1" {
+		c, _, closeServer := newWebSocketEchoServer()
+		defer closeServer()
+		ws := c.OpenWebSocket(t, []string{"ws"})
+		defer ws.Close()
+		if err := websocket.Message.Send(ws.conn, "not json"); err != nil {
+			t.Fatalf("failed to send message: %s", err)
+		}
+		ws.ReadJSON(t)
+		return
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestWebSocketReadJSONFailsOnNonJSON$")
+	cmd.Env = append(os.Environ(), "COMPLEMENT_TEST_WEBSOCKET_NON_JSON=1")
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		t.Fatalf("ReadJSON did not fail the test on a non-JSON message, output:\n%s", string(out))
+	}
+	if !strings.Contains(string(out), "WebSocket.ReadJSON message is not valid JSON: not json") {
+		t.Fatalf("ReadJSON failed without saying the message is not JSON, output:\n%s", string(out))
+	}
+}
@@ -0,0 +1,83 @@
+// +build msc2716
+
+package client
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/b"
+)
+
+// BatchSendInterval is the time between the timestamps of consecutive events imported by BatchSend.
+const BatchSendInterval = time.Millisecond
+
+// BatchSend imports historical events into the room after `prevEventID` with the MSC2716 /batch_send endpoint, else
+// fails the test. `stateEvents` are the state at the start of the batch, typically the joins of the events' senders.
+// `batchID` connects this batch to the previous one, using the next batch ID it returned, or is "" for the first
+// batch. The client must be an application service.
+//
+// The state events are timestamped `insertTime`, and the events `insertTime`, `insertTime` + BatchSendInterval and
+// so on. Batches in the same gap should be given their own, non-overlapping, time ranges.
+//
+// Returns the response body, which has the inserted `events` and the `next_chunk_id`.
+func (c *CSAPI) BatchSend(t *testing.T, roomID, prevEventID, batchID string, insertTime time.Time, events, stateEvents []b.Event) gjson.Result {
+	t.Helper()
+	res := c.MustDoFunc(t, "POST", batchSendPath(roomID), batchSendOpts(t, prevEventID, batchID, insertTime, events, stateEvents)...)
+	return gjson.ParseBytes(ParseJSON(t, res))
+}
+
+// DoBatchSend is like BatchSend but returns the response, rather than failing the test if the import fails.
+func (c *CSAPI) DoBatchSend(t *testing.T, roomID, prevEventID, batchID string, insertTime time.Time, events, stateEvents []b.Event) *http.Response {
+	t.Helper()
+	return c.DoFunc(t, "POST", batchSendPath(roomID), batchSendOpts(t, prevEventID, batchID, insertTime, events, stateEvents)...)
+}
+
+func batchSendPath(roomID string) []string {
+	return []string{"_matrix", "client", "unstable", "org.matrix.msc2716", "rooms", roomID, "batch_send"}
+}
+
+func batchSendOpts(t *testing.T, prevEventID, batchID string, insertTime time.Time, events, stateEvents []b.Event) []RequestOpt {
+	t.Helper()
+	insertTS := uint64(insertTime.UnixNano() / int64(time.Millisecond))
+	intervalMS := uint64(BatchSendInterval / time.Millisecond)
+
+	toJSON := func(e b.Event, ts uint64) map[string]interface{} {
+		ev := map[string]interface{}{
+			"type":             e.Type,
+			"sender":           e.Sender,
+			"origin_server_ts": ts,
+			"content":          e.Content,
+		}
+		if e.StateKey != nil {
+			ev["state_key"] = *e.StateKey
+		}
+		return ev
+	}
+	stateEvs := make([]map[string]interface{}, len(stateEvents))
+	for i, e := range stateEvents {
+		stateEvs[i] = toJSON(e, insertTS)
+	}
+	evs := make([]map[string]interface{}, len(events))
+	for i, e := range events {
+		evs[i] = toJSON(e, insertTS+intervalMS*uint64(i))
+	}
+
+	query := url.Values{
+		"prev_event": []string{prevEventID},
+	}
+	if batchID != "" {
+		query.Set("chunk_id", batchID)
+	}
+	return []RequestOpt{
+		WithJSONBody(t, map[string]interface{}{
+			"events":                evs,
+			"state_events_at_start": stateEvs,
+		}),
+		WithQueries(query),
+	}
+}
@@ -14,6 +14,15 @@ type Complement struct {
 	BestEffort             bool
 	VersionCheckIterations int
 	KeepBlueprints         []string
+	// The digest the base image must have e.g "sha256:5ae1...", or "" to allow any
+	BaseImageDigest string
+	// The name of the registered docker.HomeserverRuntime to run the base image with, or "" for the default
+	HomeserverRuntime string
+	// The optional image features from the README which the base image supports e.g [ "ConfigOverrides" ], when
+	// it is run with the default runtime
+	BaseImageFeatures []string
+	// The room version for CreateRoom to use when the request does not set one, or "" for the server's default
+	DefaultRoomVersion string
 	// The namespace for all complement created blueprints and deployments
 	PackageNamespace string
 }
@@ -22,12 +31,17 @@ func NewConfigFromEnvVars() *Complement {
 	cfg := &Complement{}
 	cfg.BaseImageURI = os.Getenv("COMPLEMENT_BASE_IMAGE")
 	cfg.BaseImageArgs = strings.Split(os.Getenv("COMPLEMENT_BASE_IMAGE_ARGS"), " ")
+	cfg.BaseImageDigest = os.Getenv("COMPLEMENT_BASE_IMAGE_DIGEST")
+	cfg.HomeserverRuntime = os.Getenv("COMPLEMENT_HOMESERVER_RUNTIME")
+	cfg.BaseImageFeatures = strings.Fields(os.Getenv("COMPLEMENT_BASE_IMAGE_FEATURES"))
+	cfg.DefaultRoomVersion = os.Getenv("COMPLEMENT_DEFAULT_ROOM_VERSION")
 	cfg.DebugLoggingEnabled = os.Getenv("COMPLEMENT_DEBUG") == "1"
 	cfg.AlwaysPrintServerLogs = os.Getenv("COMPLEMENT_ALWAYS_PRINT_SERVER_LOGS") == "1"
 	cfg.VersionCheckIterations = parseEnvWithDefault("COMPLEMENT_VERSION_CHECK_ITERATIONS", 100)
 	cfg.KeepBlueprints = strings.Split(os.Getenv("COMPLEMENT_KEEP_BLUEPRINTS"), " ")
-	if cfg.BaseImageURI == "" {
-		panic("COMPLEMENT_BASE_IMAGE must be set")
+	// The runtime provides a default base image, so only the default runtime needs COMPLEMENT_BASE_IMAGE.
+	if cfg.BaseImageURI == "" && cfg.HomeserverRuntime == "" {
+		panic("COMPLEMENT_BASE_IMAGE or COMPLEMENT_HOMESERVER_RUNTIME must be set")
 	}
 	cfg.PackageNamespace = "pkg"
 	return cfg
@@ -0,0 +1,118 @@
+package docker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// AppServiceInbox receives the transactions pushed by a homeserver to an application service.
+type AppServiceInbox struct {
+	srv *mockServer
+}
+
+// AppServiceInbox returns the inbox for the application service with the given ID. Inboxes are started when the
+// deployment is, for each application service whose URL host is HostnameRunningComplement, so the returned inbox
+// has every event pushed since the homeserver started. Fails the test if there is no such application service.
+func (d *Deployment) AppServiceInbox(t *testing.T, asID string) *AppServiceInbox {
+	t.Helper()
+	for _, dep := range d.HS {
+		if inbox, ok := dep.appServiceInboxes[asID]; ok {
+			return inbox
+		}
+	}
+	t.Fatalf("Deployment.AppServiceInbox - application service '%s' not found, or its URL host is not %s", asID, HostnameRunningComplement)
+	return nil
+}
+
+// Next blocks until the next event pushed to the application service is received, or fails the test
+// if no event is received before the timeout. Events are returned in the order they were pushed.
+func (i *AppServiceInbox) Next(t *testing.T, timeout time.Duration) gjson.Result {
+	t.Helper()
+	ev, ok := i.srv.next(timeout)
+	if !ok {
+		t.Fatalf("AppServiceInbox.Next: timed out after %f seconds waiting for an event", timeout.Seconds())
+	}
+	return ev
+}
+
+// Close stops listening for transactions. Deployment.Destroy closes every inbox, so this is only needed to stop
+// acknowledging transactions before then.
+func (i *AppServiceInbox) Close() {
+	i.srv.close()
+}
+
+// startAppServiceInboxes starts an inbox on a random port for each application service whose URL host is
+// HostnameRunningComplement, and updates its registration to use that port. This stops deployments which are
+// running at the same time from listening on the same port. Returns the inboxes by application service ID.
+func startAppServiceInboxes(asIDToRegistrationMap map[string]string) (map[string]*AppServiceInbox, error) {
+	inboxes := make(map[string]*AppServiceInbox)
+	for asID, registration := range asIDToRegistrationMap {
+		asURL, err := url.Parse(asRegistrationValue(registration, "url"))
+		if err != nil {
+			closeAppServiceInboxes(inboxes)
+			return nil, fmt.Errorf("application service '%s' has an invalid url: %w", asID, err)
+		}
+		if asURL.Hostname() != HostnameRunningComplement {
+			continue
+		}
+		inbox, err := newAppServiceInbox(asRegistrationValue(registration, "hs_token"))
+		if err != nil {
+			closeAppServiceInboxes(inboxes)
+			return nil, fmt.Errorf("application service '%s' inbox failed to listen: %w", asID, err)
+		}
+		asURL.Host = fmt.Sprintf("%s:%d", HostnameRunningComplement, inbox.srv.port)
+		asIDToRegistrationMap[asID] = withASRegistrationValue(registration, "url", asURL.String())
+		inboxes[asID] = inbox
+	}
+	return inboxes, nil
+}
+
+func closeAppServiceInboxes(inboxes map[string]*AppServiceInbox) {
+	for _, inbox := range inboxes {
+		inbox.Close()
+	}
+}
+
+// newAppServiceInbox starts an inbox which acknowledges every transaction authenticated with the hs_token.
+func newAppServiceInbox(hsToken string) (*AppServiceInbox, error) {
+	srv := newMockServer()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		// handle both the legacy and the /_matrix/app/v1 paths
+		if req.Method != "PUT" || !strings.Contains(req.URL.Path, "/transactions/") {
+			respondJSON(w, 404, `{"errcode":"M_UNRECOGNIZED","error":"complement: appservice inbox only handles transactions"}`)
+			return
+		}
+		// homeservers send the hs_token as a query parameter, or as a bearer token since v1.4 of the spec
+		token := req.URL.Query().Get("access_token")
+		if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			token = strings.TrimPrefix(auth, "Bearer ")
+		}
+		if token == "" {
+			respondJSON(w, 401, `{"errcode":"M_UNAUTHORIZED","error":"complement: missing hs_token"}`)
+			return
+		}
+		if token != hsToken {
+			respondJSON(w, 403, `{"errcode":"M_FORBIDDEN","error":"complement: wrong hs_token"}`)
+			return
+		}
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil || !gjson.ValidBytes(body) {
+			respondJSON(w, 400, `{"errcode":"M_NOT_JSON","error":"complement: transaction body is not valid JSON"}`)
+			return
+		}
+		srv.enqueue(gjson.GetBytes(body, "events").Array()...)
+		respondJSON(w, 200, `{}`)
+	})
+	if err := srv.listen(mux); err != nil {
+		return nil, err
+	}
+	return &AppServiceInbox{srv: srv}, nil
+}
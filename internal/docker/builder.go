@@ -17,6 +17,9 @@ import (
 	"archive/tar"
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -26,6 +29,8 @@ import (
 	"os"
 	"path"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -34,7 +39,6 @@ import (
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/api/types/network"
-	"github.com/docker/docker/api/types/volume"
 	client "github.com/docker/docker/client"
 	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/docker/go-connections/nat"
@@ -67,6 +71,7 @@ type Builder struct {
 	CSAPIPort      int
 	FederationPort int
 	Docker         *client.Client
+	runtime        HomeserverRuntime
 }
 
 func NewBuilder(cfg *config.Complement) (*Builder, error) {
@@ -74,11 +79,19 @@ func NewBuilder(cfg *config.Complement) (*Builder, error) {
 	if err != nil {
 		return nil, err
 	}
+	hsRuntime, err := homeserverRuntime(cfg.HomeserverRuntime, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.BaseImageURI == "" {
+		cfg.BaseImageURI = hsRuntime.DefaultBaseImage()
+	}
 	return &Builder{
 		Docker:         cli,
 		Config:         cfg,
 		CSAPIPort:      8008,
 		FederationPort: 8448,
+		runtime:        hsRuntime,
 	}, nil
 }
 
@@ -196,7 +209,14 @@ func (d *Builder) removeContainers() error {
 	return nil
 }
 
+// ConstructBlueprintsIfNotExist constructs the blueprints which do not have images yet. Images are reused
+// for as long as they were built from the same blueprint definition and base image: if either changes, the
+// stale images are removed and the blueprint is constructed again.
 func (d *Builder) ConstructBlueprintsIfNotExist(bs []b.Blueprint) error {
+	baseImage, err := d.resolveBaseImage()
+	if err != nil {
+		return fmt.Errorf("ConstructBlueprintsIfNotExist: %w", err)
+	}
 	var blueprintsToBuild []b.Blueprint
 	for _, bprint := range bs {
 		images, err := d.Docker.ImageList(context.Background(), types.ImageListOptions{
@@ -208,7 +228,29 @@ func (d *Builder) ConstructBlueprintsIfNotExist(bs []b.Blueprint) error {
 		if err != nil {
 			return fmt.Errorf("ConstructBlueprintsIfNotExist: failed to ImageList: %w", err)
 		}
-		if len(images) == 0 {
+		hash, err := blueprintHash(bprint, baseImage)
+		if err != nil {
+			return fmt.Errorf("ConstructBlueprintsIfNotExist: %w", err)
+		}
+		stale := false
+		for _, img := range images {
+			if img.Labels["complement_blueprint_hash"] != hash {
+				stale = true
+				break
+			}
+		}
+		if stale {
+			d.log("Blueprint %s has changed, rebuilding its images", bprint.Name)
+			for _, img := range images {
+				_, err = d.Docker.ImageRemove(context.Background(), img.ID, types.ImageRemoveOptions{
+					Force: true,
+				})
+				if err != nil {
+					return fmt.Errorf("ConstructBlueprintsIfNotExist: failed to remove stale image %s: %w", img.ID, err)
+				}
+			}
+		}
+		if len(images) == 0 || stale {
 			blueprintsToBuild = append(blueprintsToBuild, bprint)
 		}
 	}
@@ -270,12 +312,36 @@ func (d *Builder) ConstructBlueprints(bs []b.Blueprint) error {
 
 // construct all Homeservers sequentially then commits them
 func (d *Builder) construct(bprint b.Blueprint) (errs []error) {
-	networkID, err := createNetworkIfNotExists(d.Docker, d.Config.PackageNamespace, bprint.Name)
+	networkID, err := createNetworkIfNotExists(d.Docker, d.Config.PackageNamespace, bprint.Name, "")
 	if err != nil {
 		return []error{err}
 	}
 
-	runner := instruction.NewRunner(bprint.Name, d.Config.BestEffort, d.Config.DebugLoggingEnabled)
+	baseImage, err := d.resolveBaseImage()
+	if err != nil {
+		return []error{err}
+	}
+	hash, err := blueprintHash(bprint, baseImage)
+	if err != nil {
+		return []error{err}
+	}
+
+	for _, hs := range bprint.Homeservers {
+		if err = d.checkRuntimeSupports(hs); err != nil {
+			return []error{err}
+		}
+	}
+
+	registerAdmin := func(hsName, hsURL, localpart, password string) (string, error) {
+		for _, hs := range bprint.Homeservers {
+			if hs.Name == hsName {
+				_, hsRuntime, _ := d.runtimeFor(hs)
+				return hsRuntime.RegisterAdmin(hsURL, localpart, password)
+			}
+		}
+		return "", fmt.Errorf("unknown homeserver %s", hsName)
+	}
+	runner := instruction.NewRunner(bprint.Name, d.Config.BestEffort, d.Config.DebugLoggingEnabled, registerAdmin)
 	results := make([]result, len(bprint.Homeservers))
 	for i, hs := range bprint.Homeservers {
 		res := d.constructHomeserver(bprint.Name, runner, hs, networkID)
@@ -319,12 +385,54 @@ func (d *Builder) construct(bprint b.Blueprint) (errs []error) {
 			}
 		}
 
+		// store which users are admins as labels 'admin_$userid: true', so that AdminClient can find them
+		for _, user := range res.homeserver.Users {
+			userID := "@" + user.Localpart + ":" + res.homeserver.Name
+			if _, ok := labels["access_token_"+userID]; ok && user.IsAdmin {
+				labels["admin_"+userID] = "true"
+			}
+		}
+
+		// store the blueprint hash so images built from an older definition are not reused
+		labels["complement_blueprint_hash"] = hash
+		// store the base image so that failed tests can report exactly which image they ran against
+		labels["complement_base_image"] = baseImage
+		// store the runtime so the image is deployed with it
+		runtimeName, hsRuntime, _ := d.runtimeFor(res.homeserver)
+		labels["complement_runtime"] = runtimeName
+		if res.homeserver.Runtime != "" {
+			labels["complement_base_image"] = d.imageFor(res.homeserver)
+		}
+
 		// Combine the labels for tokens and application services
 		asLabels := labelsForApplicationServices(res.homeserver)
 		for k, v := range asLabels {
 			labels[k] = v
 		}
 
+		// store config overrides so they are re-applied when this image is deployed
+		configOverrides, err := configOverridesJSON(res.homeserver, hsRuntime)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s : %w", res.contextStr, err))
+			continue
+		}
+		if configOverrides != "" {
+			labels["complement_config_overrides"] = configOverrides
+		}
+		if res.homeserver.FederationDisabled {
+			labels["complement_federation_disabled"] = "true"
+		}
+		if res.homeserver.ClockOffsetEnabled {
+			labels["complement_clock_offset_enabled"] = "true"
+		}
+		// store resource limits so they are applied when this image is deployed
+		if res.homeserver.MemoryLimitBytes > 0 {
+			labels["complement_memory_limit"] = strconv.FormatInt(res.homeserver.MemoryLimitBytes, 10)
+		}
+		if res.homeserver.CPULimit > 0 {
+			labels["complement_cpu_limit"] = strconv.FormatFloat(res.homeserver.CPULimit, 'f', -1, 64)
+		}
+
 		// commit the container
 		commit, err := d.Docker.ContainerCommit(context.Background(), res.containerID, types.ContainerCommitOptions{
 			Author:    "Complement",
@@ -379,11 +487,19 @@ func (d *Builder) constructHomeserver(blueprintName string, runner *instruction.
 // deployBaseImage runs the base image and returns the baseURL, containerID or an error.
 func (d *Builder) deployBaseImage(blueprintName string, hs b.Homeserver, contextStr, networkID string) (*HomeserverDeployment, error) {
 	asIDToRegistrationMap := asIDToRegistrationFromLabels(labelsForApplicationServices(hs))
+	_, hsRuntime, err := d.runtimeFor(hs)
+	if err != nil {
+		return nil, err
+	}
+	configOverrides, err := configOverridesJSON(hs, hsRuntime)
+	if err != nil {
+		return nil, err
+	}
 
 	return deployImage(
-		d.Docker, d.Config.BaseImageURI, d.CSAPIPort, fmt.Sprintf("complement_%s", contextStr),
-		d.Config.PackageNamespace, blueprintName, hs.Name, asIDToRegistrationMap, contextStr,
-		networkID, d.Config.VersionCheckIterations,
+		context.Background(), d.Docker, d.imageFor(hs), d.CSAPIPort, fmt.Sprintf("complement_%s", contextStr),
+		d.Config.PackageNamespace, blueprintName, hs.Name, asIDToRegistrationMap, configOverrides, hs.FederationDisabled, hs.ClockOffsetEnabled, container.Resources{}, nil, contextStr,
+		networkID, hsRuntime, d.Config.VersionCheckIterations,
 	)
 }
 
@@ -455,26 +571,6 @@ func getCaVolume(ctx context.Context, docker *client.Client) (caMount mount.Moun
 	return caMount, nil
 }
 
-// getAppServiceVolume returns a volume mount for providing the `/appservice` directory to homeserver containers.
-// This directory will contain application service registration config files.
-// Returns an error if the volume failed to create
-func getAppServiceVolume(ctx context.Context, docker *client.Client) (asMount mount.Mount, err error) {
-	asVolume, err := docker.VolumeCreate(context.Background(), volume.VolumesCreateBody{
-		Name: "appservices",
-	})
-	if err != nil {
-		return asMount, err
-	}
-
-	asMount = mount.Mount{
-		Type:   mount.TypeVolume,
-		Source: asVolume.Name,
-		Target: "/appservices",
-	}
-
-	return asMount, err
-}
-
 func generateASRegistrationYaml(as b.ApplicationService) string {
 	return fmt.Sprintf("id: %s\n", as.ID) +
 		fmt.Sprintf("hs_token: %s\n", as.HSToken) +
@@ -483,17 +579,197 @@ func generateASRegistrationYaml(as b.ApplicationService) string {
 		fmt.Sprintf("sender_localpart: %s\n", as.SenderLocalpart) +
 		fmt.Sprintf("rate_limited: %v\n", as.RateLimited) +
 		"namespaces:\n" +
-		"  users:\n" +
-		"    - exclusive: false\n" +
-		"      regex: .*\n" +
-		"  rooms: []\n" +
-		"  aliases: []\n"
+		generateASNamespaceYaml("users", as.Namespaces.Users) +
+		generateASNamespaceYaml("rooms", as.Namespaces.Rooms) +
+		generateASNamespaceYaml("aliases", as.Namespaces.Aliases)
+}
+
+func generateASNamespaceYaml(name string, namespaces []b.Namespace) string {
+	if len(namespaces) == 0 {
+		return fmt.Sprintf("  %s: []\n", name)
+	}
+	yaml := fmt.Sprintf("  %s:\n", name)
+	for _, ns := range namespaces {
+		yaml += fmt.Sprintf("    - exclusive: %v\n", ns.Exclusive) +
+			fmt.Sprintf("      regex: '%s'\n", ns.Regex)
+	}
+	return yaml
+}
+
+// asRegistrationValue returns the value of a top-level key in an application service registration
+// generated by generateASRegistrationYaml, or "" if the key does not exist.
+func asRegistrationValue(registration, key string) string {
+	for _, line := range strings.Split(registration, "\n") {
+		if strings.HasPrefix(line, key+": ") {
+			return strings.Trim(strings.TrimPrefix(line, key+": "), "'")
+		}
+	}
+	return ""
+}
+
+// withASRegistrationValue returns the registration with the value of a top-level key replaced, quoted like
+// generateASRegistrationYaml quotes the URL.
+func withASRegistrationValue(registration, key, value string) string {
+	lines := strings.Split(registration, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, key+": ") {
+			lines[i] = fmt.Sprintf("%s: '%s'", key, value)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// runtimeFor returns the name of the runtime the homeserver runs with, along with the runtime itself.
+func (d *Builder) runtimeFor(hs b.Homeserver) (string, HomeserverRuntime, error) {
+	if hs.Runtime == "" {
+		return d.Config.HomeserverRuntime, d.runtime, nil
+	}
+	hsRuntime, err := homeserverRuntime(hs.Runtime, d.Config)
+	if err != nil {
+		return "", nil, fmt.Errorf("HS %s : %w", hs.Name, err)
+	}
+	return hs.Runtime, hsRuntime, nil
+}
+
+// imageFor returns the base image the homeserver runs from: the default image of its runtime if it selects one,
+// else the base image of the run.
+func (d *Builder) imageFor(hs b.Homeserver) string {
+	if hs.Runtime == "" || hs.Runtime == d.Config.HomeserverRuntime {
+		return d.Config.BaseImageURI
+	}
+	hsRuntime, err := homeserverRuntime(hs.Runtime, d.Config)
+	if err != nil {
+		return d.Config.BaseImageURI
+	}
+	return hsRuntime.DefaultBaseImage()
+}
+
+// checkRuntimeSupports returns an error if the homeserver uses image features which its runtime does not support,
+// which would otherwise be silently ignored by the image.
+func (d *Builder) checkRuntimeSupports(hs b.Homeserver) error {
+	runtimeName, hsRuntime, err := d.runtimeFor(hs)
+	if err != nil {
+		return err
+	}
+	for _, feature := range featuresUsed(hs) {
+		if !hsRuntime.Supports(feature) {
+			return fmt.Errorf("HS %s uses %s, which homeserver runtime '%s' does not support", hs.Name, feature, runtimeName)
+		}
+	}
+	return nil
+}
+
+// configOverridesJSON returns the JSON encoded config overrides for this homeserver, made of the overrides the
+// runtime needs for the blueprint overlaid with the blueprint's own, or "" if there are none.
+func configOverridesJSON(hs b.Homeserver, hsRuntime HomeserverRuntime) (string, error) {
+	merged := make(map[string]interface{})
+	for k, v := range hsRuntime.ConfigOverrides(hs) {
+		merged[k] = v
+	}
+	for k, v := range hs.ConfigOverrides {
+		merged[k] = v
+	}
+	if len(merged) == 0 {
+		return "", nil
+	}
+	overrides, err := json.Marshal(merged)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal config overrides for %s: %w", hs.Name, err)
+	}
+	return string(overrides), nil
+}
+
+// resolveBaseImage returns the base image URI along with the ID of the local image it refers to e.g
+// "complement-synapse@sha256:5ae1...". If COMPLEMENT_BASE_IMAGE_DIGEST is set, returns an error unless the
+// local image has that digest: Complement never pulls images, so the pinned image must already be present.
+func (d *Builder) resolveBaseImage() (string, error) {
+	inspect, _, err := d.Docker.ImageInspectWithRaw(context.Background(), d.Config.BaseImageURI)
+	if err != nil {
+		if d.Config.BaseImageDigest != "" {
+			return "", fmt.Errorf("base image %s is not present locally, and must be pulled to check it has the pinned digest %s: %w", d.Config.BaseImageURI, d.Config.BaseImageDigest, err)
+		}
+		// the image can't be resolved, e.g because it is only referred to by name in homerunner
+		return d.Config.BaseImageURI, nil
+	}
+	if d.Config.BaseImageDigest != "" {
+		pinned := inspect.ID == d.Config.BaseImageDigest
+		for _, repoDigest := range inspect.RepoDigests {
+			if strings.HasSuffix(repoDigest, "@"+d.Config.BaseImageDigest) {
+				pinned = true
+			}
+		}
+		if !pinned {
+			return "", fmt.Errorf("base image %s is %s (%v), not the pinned digest %s", d.Config.BaseImageURI, inspect.ID, inspect.RepoDigests, d.Config.BaseImageDigest)
+		}
+	}
+	return d.Config.BaseImageURI + "@" + inspect.ID, nil
+}
+
+// resourcesFromLabels returns the container resource limits stored in the image labels, which are unbounded if
+// the labels are missing.
+func resourcesFromLabels(labels map[string]string) (container.Resources, error) {
+	var resources container.Resources
+	if memory := labels["complement_memory_limit"]; memory != "" {
+		memoryBytes, err := strconv.ParseInt(memory, 10, 64)
+		if err != nil {
+			return resources, fmt.Errorf("invalid complement_memory_limit label '%s': %w", memory, err)
+		}
+		resources.Memory = memoryBytes
+	}
+	if cpus := labels["complement_cpu_limit"]; cpus != "" {
+		cpuLimit, err := strconv.ParseFloat(cpus, 64)
+		if err != nil {
+			return resources, fmt.Errorf("invalid complement_cpu_limit label '%s': %w", cpus, err)
+		}
+		resources.NanoCPUs = int64(cpuLimit * 1e9)
+	}
+	return resources, nil
+}
+
+// blueprintHash returns a hash of the blueprint definition and the base image it is built on.
+func blueprintHash(bprint b.Blueprint, baseImageURI string) (string, error) {
+	bprintJSON, err := json.Marshal(bprint)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal blueprint %s: %w", bprint.Name, err)
+	}
+	h := sha256.New()
+	h.Write([]byte(baseImageURI))
+	h.Write(bprintJSON)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// copyFileToContainer creates a file at `filePath` in the container with the given contents.
+func copyFileToContainer(docker *client.Client, containerID, filePath string, contents []byte) error {
+	// Create a fake/virtual file in memory that we can copy to the container
+	// via https://stackoverflow.com/a/52131297/796832
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	err := tw.WriteHeader(&tar.Header{
+		Name: filePath,
+		Mode: 0777,
+		Size: int64(len(contents)),
+	})
+	if err != nil {
+		return err
+	}
+	tw.Write(contents)
+	tw.Close()
+
+	// Put our new fake file in the container
+	return docker.CopyToContainer(context.Background(), containerID, "/", &buf, types.CopyToContainerOptions{
+		AllowOverwriteDirWithFile: false,
+	})
 }
 
 func deployImage(
-	docker *client.Client, imageID string, csPort int, containerName, pkgNamespace, blueprintName, hsName string, asIDToRegistrationMap map[string]string, contextStr, networkID string, versionCheckIterations int,
+	ctx context.Context, docker *client.Client, imageID string, csPort int, containerName, pkgNamespace, blueprintName, hsName string, asIDToRegistrationMap map[string]string, configOverrides string, federationDisabled, clockOffsetEnabled bool, resources container.Resources, tlsCert *TLSCert, contextStr, networkID string, hsRuntime HomeserverRuntime, versionCheckIterations int,
 ) (*HomeserverDeployment, error) {
-	ctx := context.Background()
+	// Cancelling ctx stops the health check, but not the docker operations, so a container is never left created
+	// but not returned for cleanup.
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	dockerCtx := context.Background()
 	var extraHosts []string
 	var mounts []mount.Mount
 	var err error
@@ -507,7 +783,7 @@ func deployImage(
 
 	if os.Getenv("COMPLEMENT_CA") == "true" {
 		var caMount mount.Mount
-		caMount, err = getCaVolume(ctx, docker)
+		caMount, err = getCaVolume(dockerCtx, docker)
 		if err != nil {
 			return nil, err
 		}
@@ -515,18 +791,19 @@ func deployImage(
 		mounts = append(mounts, caMount)
 	}
 
-	asMount, err := getAppServiceVolume(ctx, docker)
-	if err != nil {
-		return nil, err
-	}
-	mounts = append(mounts, asMount)
-
 	env := []string{
 		"SERVER_NAME=" + hsName,
 		"COMPLEMENT_CA=" + os.Getenv("COMPLEMENT_CA"),
 	}
+	if federationDisabled {
+		env = append(env, "COMPLEMENT_FEDERATION_DISABLED=1")
+	}
+	if clockOffsetEnabled {
+		env = append(env, "COMPLEMENT_CLOCK_OFFSET_ENABLED=1")
+	}
+	env = append(env, hsRuntime.Env(hsName)...)
 
-	body, err := docker.ContainerCreate(ctx, &container.Config{
+	body, err := docker.ContainerCreate(dockerCtx, &container.Config{
 		Image: imageID,
 		Env:   env,
 		//Cmd:   d.ImageArgs,
@@ -540,6 +817,7 @@ func deployImage(
 		PublishAllPorts: true,
 		ExtraHosts:      extraHosts,
 		Mounts:          mounts,
+		Resources:       resources,
 	}, &network.NetworkingConfig{
 		EndpointsConfig: map[string]*network.EndpointSettings{
 			hsName: {
@@ -554,37 +832,40 @@ func deployImage(
 
 	containerID := body.ID
 
-	// Create the application service files
+	// Create the application service files. These are copied into each container rather than shared, as their
+	// URLs differ between deployments.
 	for asID, registration := range asIDToRegistrationMap {
-		// Create a fake/virtual file in memory that we can copy to the container
-		// via https://stackoverflow.com/a/52131297/796832
-		var buf bytes.Buffer
-		tw := tar.NewWriter(&buf)
-		err = tw.WriteHeader(&tar.Header{
-			Name: fmt.Sprintf("/appservices/%s.yaml", url.PathEscape(asID)),
-			Mode: 0777,
-			Size: int64(len(registration)),
-		})
+		err = copyFileToContainer(docker, containerID, fmt.Sprintf("/appservices/%s.yaml", url.PathEscape(asID)), []byte(registration))
 		if err != nil {
 			return nil, fmt.Errorf("Failed to copy regstration to container: %v", err)
 		}
-		tw.Write([]byte(registration))
-		tw.Close()
+	}
 
-		// Put our new fake file in the container volume
-		err = docker.CopyToContainer(context.Background(), containerID, "/", &buf, types.CopyToContainerOptions{
-			AllowOverwriteDirWithFile: false,
-		})
+	// Create the config overrides file, which the homeserver merges into its config on startup
+	if configOverrides != "" {
+		err = copyFileToContainer(docker, containerID, "/complement/config_overrides.json", []byte(configOverrides))
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("Failed to copy config overrides to container: %v", err)
 		}
 	}
 
-	err = docker.ContainerStart(ctx, containerID, types.ContainerStartOptions{})
+	// Create the custom TLS cert files, which the homeserver serves federation traffic with instead of its own
+	if tlsCert != nil {
+		err = copyFileToContainer(docker, containerID, "/complement/tls/server.tls.crt", []byte(tlsCert.CertPEM))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to copy TLS cert to container: %v", err)
+		}
+		err = copyFileToContainer(docker, containerID, "/complement/tls/server.tls.key", []byte(tlsCert.KeyPEM))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to copy TLS key to container: %v", err)
+		}
+	}
+
+	err = docker.ContainerStart(dockerCtx, containerID, types.ContainerStartOptions{})
 	if err != nil {
 		return nil, err
 	}
-	inspect, err := docker.ContainerInspect(ctx, containerID)
+	inspect, err := docker.ContainerInspect(dockerCtx, containerID)
 	if err != nil {
 		return nil, err
 	}
@@ -592,11 +873,21 @@ func deployImage(
 	if err != nil {
 		return nil, fmt.Errorf("%s : image %s : %w", contextStr, imageID, err)
 	}
-	versionsURL := fmt.Sprintf("%s/_matrix/client/versions", baseURL)
-	// hit /versions to check it is up
+	versionsURL := baseURL + hsRuntime.HealthCheckPath()
+	// hit /versions, or the runtime's equivalent, to check it is up
 	var lastErr error
 	for i := 0; i < versionCheckIterations; i++ {
-		res, err := http.Get(versionsURL)
+		// stop early if another homeserver in the deployment failed
+		if ctx.Err() != nil {
+			lastErr = ctx.Err()
+			break
+		}
+		req, err := http.NewRequestWithContext(ctx, "GET", versionsURL, nil)
+		if err != nil {
+			lastErr = err
+			break
+		}
+		res, err := http.DefaultClient.Do(req)
 		if err != nil {
 			lastErr = fmt.Errorf("GET %s => error: %s", versionsURL, err)
 			time.Sleep(50 * time.Millisecond)
@@ -616,7 +907,9 @@ func deployImage(
 		FedBaseURL:          fedBaseURL,
 		ContainerID:         containerID,
 		AccessTokens:        tokensFromLabels(inspect.Config.Labels),
-		ApplicationServices: asIDToRegistrationFromLabels(inspect.Config.Labels),
+		AdminUserIDs:        adminsFromLabels(inspect.Config.Labels),
+		ApplicationServices: asIDToRegistrationMap,
+		ClockOffsetEnabled:  clockOffsetEnabled,
 	}
 	if lastErr != nil {
 		return d, fmt.Errorf("%s: failed to check server is up. %w", contextStr, lastErr)
@@ -626,7 +919,10 @@ func deployImage(
 
 // createNetworkIfNotExists creates a docker network and returns its id.
 // ID is guaranteed not to be empty when err == nil
-func createNetworkIfNotExists(docker *client.Client, pkgNamespace, blueprintName string) (networkID string, err error) {
+//
+// If deployNamespace is set, the network belongs to that deployment alone, so that deployments of the same
+// blueprint do not see each other's homeservers. Otherwise the network is shared by everything using the blueprint.
+func createNetworkIfNotExists(docker *client.Client, pkgNamespace, blueprintName, deployNamespace string) (networkID string, err error) {
 	// check if a network already exists for this blueprint
 	nws, err := docker.NetworkList(context.Background(), types.NetworkListOptions{
 		Filters: label(
@@ -638,16 +934,24 @@ func createNetworkIfNotExists(docker *client.Client, pkgNamespace, blueprintName
 		return "", fmt.Errorf("%s: failed to list networks. %w", blueprintName, err)
 	}
 	// return the existing network
-	if len(nws) > 0 {
-		return nws[0].ID, nil
+	for _, nw := range nws {
+		if nw.Labels["complement_deploy_namespace"] == deployNamespace {
+			return nw.ID, nil
+		}
+	}
+	networkName := "complement_" + pkgNamespace + "_" + blueprintName
+	labels := map[string]string{
+		complementLabel:        blueprintName,
+		"complement_blueprint": blueprintName,
+		"complement_pkg":       pkgNamespace,
+	}
+	if deployNamespace != "" {
+		networkName += "_" + deployNamespace
+		labels["complement_deploy_namespace"] = deployNamespace
 	}
 	// make a user-defined network so we get DNS based on the container name
-	nw, err := docker.NetworkCreate(context.Background(), "complement_"+pkgNamespace+"_"+blueprintName, types.NetworkCreate{
-		Labels: map[string]string{
-			complementLabel:        blueprintName,
-			"complement_blueprint": blueprintName,
-			"complement_pkg":       pkgNamespace,
-		},
+	nw, err := docker.NetworkCreate(context.Background(), networkName, types.NetworkCreate{
+		Labels: labels,
 	})
 	if err != nil {
 		return "", fmt.Errorf("%s: failed to create docker network. %w", blueprintName, err)
@@ -664,6 +968,33 @@ func createNetworkIfNotExists(docker *client.Client, pkgNamespace, blueprintName
 	return nw.ID, nil
 }
 
+// containerLogLines returns up to the last 50 lines of the container's logs which contain `substr`.
+func containerLogLines(docker *client.Client, containerID, substr string) ([]string, error) {
+	reader, err := docker.ContainerLogs(context.Background(), containerID, types.ContainerLogsOptions{
+		ShowStderr: true,
+		ShowStdout: true,
+		Follow:     false,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	var buf bytes.Buffer
+	if _, err = stdcopy.StdCopy(&buf, &buf, reader); err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.Contains(line, substr) {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) > 50 {
+		lines = lines[len(lines)-50:]
+	}
+	return lines, nil
+}
+
 func printLogs(docker *client.Client, containerID, contextStr string) {
 	reader, err := docker.ContainerLogs(context.Background(), containerID, types.ContainerLogsOptions{
 		ShowStderr: true,
@@ -701,6 +1032,18 @@ func tokensFromLabels(labels map[string]string) map[string]string {
 	return userIDToToken
 }
 
+// adminsFromLabels returns the sorted user IDs of the admins stored in the labels.
+func adminsFromLabels(labels map[string]string) []string {
+	var userIDs []string
+	for k := range labels {
+		if strings.HasPrefix(k, "admin_") {
+			userIDs = append(userIDs, strings.TrimPrefix(k, "admin_"))
+		}
+	}
+	sort.Strings(userIDs)
+	return userIDs
+}
+
 func asIDToRegistrationFromLabels(labels map[string]string) map[string]string {
 	asMap := make(map[string]string)
 	for k, v := range labels {
@@ -0,0 +1,54 @@
+package docker
+
+import (
+	"testing"
+
+	"github.com/matrix-org/complement/internal/b"
+)
+
+// Test that a blueprint hashes the same every time it is validated, so that images built from it in previous runs
+// are reused rather than rebuilt. Validating generates the tokens of application services which do not set them.
+func TestBlueprintHashIsStableAcrossValidations(t *testing.T) {
+	blueprint := func() b.Blueprint {
+		return b.MustValidate(b.Blueprint{
+			Name: "hash_test",
+			Homeservers: []b.Homeserver{
+				{
+					Name: "hs1",
+					Users: []b.User{
+						{
+							Localpart:   "@alice",
+							DisplayName: "Alice",
+						},
+					},
+					ApplicationServices: []b.ApplicationService{
+						{
+							ID:              "my_as_id",
+							URL:             "http://localhost:9000",
+							SenderLocalpart: "the-bot",
+						},
+					},
+				},
+			},
+		})
+	}
+	first, err := blueprintHash(blueprint(), "complement-synapse")
+	if err != nil {
+		t.Fatalf("failed to hash blueprint: %s", err)
+	}
+	second, err := blueprintHash(blueprint(), "complement-synapse")
+	if err != nil {
+		t.Fatalf("failed to hash blueprint: %s", err)
+	}
+	if first != second {
+		t.Fatalf("blueprint hashed to %s then %s, want the same hash", first, second)
+	}
+
+	other, err := blueprintHash(blueprint(), "complement-dendrite")
+	if err != nil {
+		t.Fatalf("failed to hash blueprint: %s", err)
+	}
+	if other == first {
+		t.Fatalf("blueprint hashed the same on different base images")
+	}
+}
@@ -16,12 +16,17 @@ package docker
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"net/url"
+	"sync"
+	"testing"
 
 	"github.com/docker/docker/client"
+	"golang.org/x/sync/errgroup"
 
 	"github.com/docker/docker/api/types"
 
@@ -32,9 +37,22 @@ type Deployer struct {
 	DeployNamespace string
 	Docker          *client.Client
 	Counter         int
-	networkID       string
-	debugLogging    bool
-	config          *config.Complement
+	// A map of HS name to the TLS cert it serves federation traffic with when deployed, instead of one signed by
+	// the Complement CA. Requires the homeserver image to use it, see the README.
+	TLSCerts map[string]TLSCert
+	// Logs a line for each request made by the deployment's clients, with the user, transaction ID and the
+	// response body of failed requests, see client.RequestLogger. If nil, these lines are only logged, with
+	// t.Logf, when COMPLEMENT_DEBUG is enabled.
+	RequestLogger func(t *testing.T, line string)
+	debugLogging  bool
+	config        *config.Complement
+	runtime       HomeserverRuntime
+}
+
+// TLSCert is a PEM encoded TLS certificate and RSA private key.
+type TLSCert struct {
+	CertPEM string
+	KeyPEM  string
 }
 
 func NewDeployer(deployNamespace string, cfg *config.Complement) (*Deployer, error) {
@@ -42,14 +60,33 @@ func NewDeployer(deployNamespace string, cfg *config.Complement) (*Deployer, err
 	if err != nil {
 		return nil, err
 	}
+	hsRuntime, err := homeserverRuntime(cfg.HomeserverRuntime, cfg)
+	if err != nil {
+		return nil, err
+	}
 	return &Deployer{
 		DeployNamespace: deployNamespace,
 		Docker:          cli,
 		debugLogging:    cfg.DebugLoggingEnabled,
 		config:          cfg,
+		runtime:         hsRuntime,
 	}, nil
 }
 
+// requestLogger returns the logger for the deployment's clients to log requests with, or nil to only log a summary
+// of each request.
+func (d *Deployer) requestLogger() func(t *testing.T, line string) {
+	if d.RequestLogger != nil {
+		return d.RequestLogger
+	}
+	if d.debugLogging {
+		return func(t *testing.T, line string) {
+			t.Logf("%s", line)
+		}
+	}
+	return nil
+}
+
 func (d *Deployer) log(str string, args ...interface{}) {
 	if !d.debugLogging {
 		return
@@ -61,7 +98,6 @@ func (d *Deployer) Deploy(ctx context.Context, blueprintName string) (*Deploymen
 	dep := &Deployment{
 		Deployer:      d,
 		BlueprintName: blueprintName,
-		HS:            make(map[string]HomeserverDeployment),
 	}
 	images, err := d.Docker.ImageList(ctx, types.ImageListOptions{
 		Filters: label(
@@ -75,37 +111,128 @@ func (d *Deployer) Deploy(ctx context.Context, blueprintName string) (*Deploymen
 	if len(images) == 0 {
 		return nil, fmt.Errorf("Deploy: No images have been built for blueprint %s", blueprintName)
 	}
-	networkID, err := createNetworkIfNotExists(d.Docker, d.config.PackageNamespace, blueprintName)
+	// each deployment gets its own network, so that several deployments of the same blueprint can run at once
+	// without their homeservers' hostnames clashing
+	networkID, err := createNetworkIfNotExists(d.Docker, d.config.PackageNamespace, blueprintName, d.DeployNamespace)
 	if err != nil {
 		return nil, fmt.Errorf("Deploy: %w", err)
 	}
-	d.networkID = networkID
+	dep.networkID = networkID
+
+	// Homeservers do not depend on each other until federation traffic begins, so start them all at once
+	// rather than waiting for each to become healthy in turn.
+	deploys := make(map[string]func(ctx context.Context) (*HomeserverDeployment, error), len(images))
 	for _, img := range images {
 		d.Counter++
-		contextStr := img.Labels["complement_context"]
-		hsName := img.Labels["complement_hs_name"]
-		asIDToRegistrationMap := asIDToRegistrationFromLabels(img.Labels)
-
-		// TODO: Make CSAPI port configurable
-		deployment, err := deployImage(
-			d.Docker, img.ID, 8008, fmt.Sprintf("complement_%s_%s_%s_%d", d.config.PackageNamespace, d.DeployNamespace, contextStr, d.Counter),
-			d.config.PackageNamespace, blueprintName, hsName, asIDToRegistrationMap, contextStr, networkID, d.config.VersionCheckIterations)
-		if err != nil {
-			if deployment != nil && deployment.ContainerID != "" {
-				// print logs to help debug
-				printLogs(d.Docker, deployment.ContainerID, contextStr)
+		imageID := img.ID
+		labels := img.Labels
+		contextStr := labels["complement_context"]
+		hsName := labels["complement_hs_name"]
+		asIDToRegistrationMap := asIDToRegistrationFromLabels(labels)
+		configOverrides := labels["complement_config_overrides"]
+		federationDisabled := labels["complement_federation_disabled"] == "true"
+		clockOffsetEnabled := labels["complement_clock_offset_enabled"] == "true"
+		var tlsCert *TLSCert
+		if cert, ok := d.TLSCerts[hsName]; ok {
+			tlsCert = &cert
+		}
+		baseImage := labels["complement_base_image"]
+		containerName := fmt.Sprintf("complement_%s_%s_%s_%d", d.config.PackageNamespace, d.DeployNamespace, contextStr, d.Counter)
+
+		deploys[hsName] = func(ctx context.Context) (*HomeserverDeployment, error) {
+			resources, err := resourcesFromLabels(labels)
+			if err != nil {
+				return nil, err
+			}
+			runtimeName, hsRuntime, err := d.runtimeFromLabels(labels)
+			if err != nil {
+				return nil, err
+			}
+			if tlsCert != nil && !hsRuntime.Supports(ImageFeatureTLSCerts) {
+				return nil, fmt.Errorf("HS %s uses %s, which homeserver runtime '%s' does not support", hsName, ImageFeatureTLSCerts, runtimeName)
+			}
+			appServiceInboxes, err := startAppServiceInboxes(asIDToRegistrationMap)
+			if err != nil {
+				return nil, err
+			}
+			// TODO: Make CSAPI port configurable
+			deployment, err := deployImage(
+				ctx, d.Docker, imageID, 8008, containerName,
+				d.config.PackageNamespace, blueprintName, hsName, asIDToRegistrationMap, configOverrides, federationDisabled, clockOffsetEnabled, resources, tlsCert, contextStr, networkID, hsRuntime, d.config.VersionCheckIterations)
+			if deployment == nil {
+				closeAppServiceInboxes(appServiceInboxes)
+				return nil, err
+			}
+			deployment.Runtime = runtimeName
+			deployment.BaseImage = baseImage
+			deployment.appServiceInboxes = appServiceInboxes
+			if err != nil {
+				// print logs to help debug, unless the homeserver was only stopped because another one failed
+				if deployment.ContainerID != "" && !errors.Is(err, context.Canceled) {
+					printLogs(d.Docker, deployment.ContainerID, contextStr)
+				}
+				return deployment, err
 			}
-			return nil, fmt.Errorf("Deploy: Failed to deploy image %+v : %w", img, err)
+			d.log("%s -> %s (%s)\n", contextStr, deployment.BaseURL, deployment.ContainerID)
+			return deployment, nil
 		}
-		d.log("%s -> %s (%s)\n", contextStr, deployment.BaseURL, deployment.ContainerID)
-		dep.HS[hsName] = *deployment
+	}
+	dep.HS, err = deployConcurrently(ctx, deploys)
+	if err != nil {
+		d.log("%s", err)
+		// don't leave the servers which did start running
+		d.Destroy(dep, false)
+		return nil, fmt.Errorf("Deploy: %w", err)
 	}
 	return dep, nil
 }
 
-// Destroy a deployment. This will kill all running containers.
+// deployConcurrently calls every deploy function, keyed by HS name, at once. If one fails, the context passed
+// to the others is cancelled so they stop waiting for their homeservers to become healthy, and the first error
+// is returned naming the HS which failed. The deployments which were returned are always returned, even on
+// failure, so that their containers can be cleaned up.
+func deployConcurrently(ctx context.Context, deploys map[string]func(ctx context.Context) (*HomeserverDeployment, error)) (map[string]HomeserverDeployment, error) {
+	g, ctx := errgroup.WithContext(ctx)
+	var mu sync.Mutex
+	hsDeployments := make(map[string]HomeserverDeployment, len(deploys))
+	for hsName, deploy := range deploys {
+		hsName, deploy := hsName, deploy
+		g.Go(func() error {
+			deployment, err := deploy(ctx)
+			if deployment != nil {
+				mu.Lock()
+				hsDeployments[hsName] = *deployment
+				mu.Unlock()
+			}
+			if err != nil {
+				return fmt.Errorf("failed to deploy %s: %w", hsName, err)
+			}
+			return nil
+		})
+	}
+	err := g.Wait()
+	return hsDeployments, err
+}
+
+// runtimeFromLabels returns the runtime an image was built with, along with its name. Images built before
+// runtimes were stored in labels use the runtime of this run.
+func (d *Deployer) runtimeFromLabels(labels map[string]string) (string, HomeserverRuntime, error) {
+	runtimeName, ok := labels["complement_runtime"]
+	if !ok {
+		return d.config.HomeserverRuntime, d.runtime, nil
+	}
+	hsRuntime, err := homeserverRuntime(runtimeName, d.config)
+	if err != nil {
+		return "", nil, err
+	}
+	return runtimeName, hsRuntime, nil
+}
+
+// Destroy a deployment. This will kill all running containers and remove the deployment's network. Other
+// deployments are not affected.
 func (d *Deployer) Destroy(dep *Deployment, printServerLogs bool) {
 	for _, hsDep := range dep.HS {
+		closeAppServiceInboxes(hsDep.appServiceInboxes)
 		if printServerLogs {
 			printLogs(d.Docker, hsDep.ContainerID, hsDep.ContainerID)
 		}
@@ -120,12 +247,20 @@ func (d *Deployer) Destroy(dep *Deployment, printServerLogs bool) {
 			log.Printf("Destroy: Failed to remove container %s : %s\n", hsDep.ContainerID, err)
 		}
 	}
+	if dep.networkID != "" {
+		err := d.Docker.NetworkRemove(context.Background(), dep.networkID)
+		if err != nil {
+			log.Printf("Destroy: Failed to remove network %s : %s\n", dep.networkID, err)
+		}
+	}
 }
 
 // RoundTripper is a round tripper that maps https://hs1 to the federation port of the container
 // e.g https://localhost:35352
 type RoundTripper struct {
 	Deployment *Deployment
+	// The CAs to verify the homeserver's TLS cert against. If nil, the cert is not verified.
+	RootCAs *x509.CertPool
 }
 
 func (t *RoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
@@ -144,7 +279,8 @@ func (t *RoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
 	transport := &http.Transport{
 		TLSClientConfig: &tls.Config{
 			ServerName:         hsName,
-			InsecureSkipVerify: true,
+			InsecureSkipVerify: t.RootCAs == nil,
+			RootCAs:            t.RootCAs,
 		},
 	}
 	return transport.RoundTrip(req)
@@ -0,0 +1,40 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test that when one homeserver fails to deploy, the others stop waiting to become healthy, the error names the
+// homeserver which failed, and the homeservers which were started are returned so they can be cleaned up.
+func TestDeployConcurrentlyCancelsOthersOnFailure(t *testing.T) {
+	errHealthCheck := errors.New("health check failed")
+	deployments, err := deployConcurrently(context.Background(), map[string]func(ctx context.Context) (*HomeserverDeployment, error){
+		"hs1": func(ctx context.Context) (*HomeserverDeployment, error) {
+			return &HomeserverDeployment{ContainerID: "container1"}, errHealthCheck
+		},
+		"hs2": func(ctx context.Context) (*HomeserverDeployment, error) {
+			select {
+			case <-ctx.Done():
+				return &HomeserverDeployment{ContainerID: "container2"}, ctx.Err()
+			case <-time.After(5 * time.Second):
+				t.Errorf("hs2 was not cancelled when hs1 failed to deploy")
+				return &HomeserverDeployment{ContainerID: "container2"}, nil
+			}
+		},
+	})
+	if !errors.Is(err, errHealthCheck) {
+		t.Fatalf("deployConcurrently returned %v, want hs1's error", err)
+	}
+	if !strings.Contains(err.Error(), "hs1") {
+		t.Errorf("error %q does not name the homeserver which failed", err)
+	}
+	for hsName, containerID := range map[string]string{"hs1": "container1", "hs2": "container2"} {
+		if got := deployments[hsName].ContainerID; got != containerID {
+			t.Errorf("deployConcurrently returned container %q for %s, want %q to clean up", got, hsName, containerID)
+		}
+	}
+}
@@ -1,9 +1,19 @@
 package docker
 
 import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/tidwall/gjson"
+
 	"github.com/matrix-org/complement/internal/client"
 )
 
@@ -16,6 +26,13 @@ type Deployment struct {
 	BlueprintName string
 	// A map of HS name to a HomeserverDeployment
 	HS map[string]HomeserverDeployment
+	// The ID of the docker network which only this deployment's containers are attached to
+	networkID string
+	// A map of HS name to the offset set by SetClockOffset
+	clockOffsets map[string]time.Duration
+	// A map of HS name to the transport shared by clients created WithPooledConnections
+	transportsMu sync.Mutex
+	transports   map[string]*http.Transport
 }
 
 // HomeserverDeployment represents a running homeserver in a container.
@@ -24,21 +41,237 @@ type HomeserverDeployment struct {
 	FedBaseURL          string            // e.g https://localhost:48373
 	ContainerID         string            // e.g 10de45efba
 	AccessTokens        map[string]string // e.g { "@alice:hs1": "myAcc3ssT0ken" }
+	AdminUserIDs        []string          // e.g [ "@admin:hs1" ]
 	ApplicationServices map[string]string // e.g { "my-as-id": "id: xxx\nas_token: xxx ..."} }
+	BaseImage           string            // e.g complement-synapse@sha256:5ae1...
+	ClockOffsetEnabled  bool              // e.g true if the homeserver runs under libfaketime
+	Runtime             string            // e.g "dendrite", or "" for the default runtime
+	appServiceInboxes   map[string]*AppServiceInbox
 }
 
 // Destroy the entire deployment. Destroys all running containers. If `printServerLogs` is true,
 // will print container logs before killing the container.
 func (d *Deployment) Destroy(t *testing.T) {
 	t.Helper()
+	// reset clocks so that nothing outlives the deployment with a skewed clock. The containers are about
+	// to be removed, so errors are ignored.
+	for hsName, offset := range d.clockOffsets {
+		if dep, ok := d.HS[hsName]; ok && offset != 0 {
+			_ = copyFileToContainer(d.Deployer.Docker, dep.ContainerID, "/complement/faketime", []byte("+0\n"))
+		}
+	}
+	d.transportsMu.Lock()
+	for _, transport := range d.transports {
+		transport.CloseIdleConnections()
+	}
+	d.transportsMu.Unlock()
+	if t.Failed() {
+		for _, hsName := range d.Servers() {
+			t.Logf("%s was built from base image %s", hsName, d.HS[hsName].BaseImage)
+		}
+	}
 	d.Deployer.Destroy(d, d.Deployer.config.AlwaysPrintServerLogs || t.Failed())
 }
 
+// NetworkID returns the ID of the docker network which only this deployment's containers are attached to.
+func (d *Deployment) NetworkID() string {
+	return d.networkID
+}
+
+// Servers returns the names of all the homeservers in the deployment, sorted by name.
+func (d *Deployment) Servers() []string {
+	hsNames := make([]string, 0, len(d.HS))
+	for hsName := range d.HS {
+		hsNames = append(hsNames, hsName)
+	}
+	sort.Strings(hsNames)
+	return hsNames
+}
+
+// ClientsFor returns a CSAPI client for every user with an access token on the given hsName, sorted by
+// user ID. This includes users created with RegisterUser. Fails the test if the hsName is not found.
+func (d *Deployment) ClientsFor(t *testing.T, hsName string) []*client.CSAPI {
+	t.Helper()
+	dep, ok := d.HS[hsName]
+	if !ok {
+		t.Fatalf("Deployment.ClientsFor - HS name '%s' not found", hsName)
+		return nil
+	}
+	userIDs := make([]string, 0, len(dep.AccessTokens))
+	for userID := range dep.AccessTokens {
+		userIDs = append(userIDs, userID)
+	}
+	sort.Strings(userIDs)
+	clients := make([]*client.CSAPI, len(userIDs))
+	for i, userID := range userIDs {
+		clients[i] = d.Client(t, hsName, userID)
+	}
+	return clients
+}
+
+// CreateRoomWithMembers creates a room as creatorUser on creatorHS with the given /createRoom body, then has
+// every member join it via creatorHS. Members are invited first unless the room uses the public_chat preset.
+// Blocks until the creator and every member see all the joins in the room state, so the room is fully
+// populated when this returns. Returns the room ID.
+func (d *Deployment) CreateRoomWithMembers(t *testing.T, creatorHS, creatorUser string, members []*client.CSAPI, createOpts map[string]interface{}) string {
+	t.Helper()
+	creator := d.Client(t, creatorHS, creatorUser)
+	if createOpts == nil {
+		createOpts = map[string]interface{}{}
+	}
+	roomID := creator.CreateRoom(t, createOpts)
+	for _, member := range members {
+		if createOpts["preset"] != "public_chat" {
+			creator.InviteRoom(t, roomID, member.UserID)
+		}
+		member.JoinRoom(t, roomID, []string{creatorHS})
+	}
+	for _, c := range append([]*client.CSAPI{creator}, members...) {
+		for _, member := range members {
+			c.SyncUntilHasState(t, roomID, "m.room.member", member.UserID, func(ev gjson.Result) bool {
+				return ev.Get("content.membership").Str == "join"
+			})
+		}
+	}
+	return roomID
+}
+
+// SetClockOffset shifts the time perceived by the homeserver by `offset`, which may be negative, relative to
+// the real time. This writes the offset to /complement/faketime in the container, in the format used by
+// libfaketime's FAKETIME_TIMESTAMP_FILE. Fails the test if the hsName is not found, or if the blueprint did not
+// set ClockOffsetEnabled on the homeserver.
+func (d *Deployment) SetClockOffset(t *testing.T, hsName string, offset time.Duration) {
+	t.Helper()
+	dep, ok := d.HS[hsName]
+	if !ok {
+		t.Fatalf("Deployment.SetClockOffset - HS name '%s' not found", hsName)
+	}
+	if !dep.ClockOffsetEnabled {
+		t.Fatalf("Deployment.SetClockOffset - HS '%s' was not deployed with ClockOffsetEnabled", hsName)
+	}
+	faketime := fmt.Sprintf("%+d\n", int64(offset/time.Second))
+	err := copyFileToContainer(d.Deployer.Docker, dep.ContainerID, "/complement/faketime", []byte(faketime))
+	if err != nil {
+		t.Fatalf("Deployment.SetClockOffset - failed to copy faketime file to container: %s", err)
+	}
+	if d.clockOffsets == nil {
+		d.clockOffsets = make(map[string]time.Duration)
+	}
+	d.clockOffsets[hsName] = offset
+}
+
+// WaitForFederatedEvent blocks until `receiver`, who is on another homeserver in the room, can fetch the event
+// which was sent on `fromHS`. Will time out after the receiver's SyncUntilTimeout. On timeout, the failure includes
+// the lines of the sending homeserver's logs which mention the receiving homeserver, to show whether the sender
+// attempted delivery or is backing off. There is no API to query outbound federation, so the logs are scraped on
+// a best-effort basis.
+func (d *Deployment) WaitForFederatedEvent(t *testing.T, fromHS string, receiver *client.CSAPI, roomID, eventID string) {
+	t.Helper()
+	dep, ok := d.HS[fromHS]
+	if !ok {
+		t.Fatalf("Deployment.WaitForFederatedEvent - HS name '%s' not found", fromHS)
+	}
+	start := time.Now()
+	for time.Since(start) < receiver.SyncUntilTimeout {
+		res := receiver.DoFunc(t, "GET", []string{"_matrix", "client", "r0", "rooms", roomID, "event", eventID})
+		res.Body.Close()
+		if res.StatusCode == 200 {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	lines, err := containerLogLines(d.Deployer.Docker, dep.ContainerID, receiver.HSName)
+	if err != nil {
+		t.Fatalf("Deployment.WaitForFederatedEvent - timed out waiting for %s to reach %s, and failed to read %s's logs: %s",
+			eventID, receiver.HSName, fromHS, err)
+	}
+	t.Fatalf("Deployment.WaitForFederatedEvent - timed out waiting for %s to reach %s: %s. Log lines from %s mentioning %s:\n%s",
+		eventID, receiver.HSName, federationDeliveryStatus(lines), fromHS, receiver.HSName, strings.Join(lines, "\n"))
+}
+
+// federationDeliveryStatus guesses what happened to outbound federation from the sending server's log lines which
+// mention the destination.
+func federationDeliveryStatus(lines []string) string {
+	if len(lines) == 0 {
+		return "the sender never logged the destination, so may not have attempted delivery"
+	}
+	for _, line := range lines {
+		lower := strings.ToLower(line)
+		if strings.Contains(lower, "backoff") || strings.Contains(lower, "backing off") {
+			return "the sender is backing off from the destination"
+		}
+	}
+	return "the sender logged the destination, so attempted delivery"
+}
+
+// AssertJoinViaServer checks that the current join of `joiner` to the room was completed with a /send_join to
+// `expectedResidentServer`, rather than just authorised by one of its users. The join event ID is looked up as the
+// joiner, then the logs of every other homeserver are searched for a /send_join of that event. This relies on the
+// homeservers logging the paths of incoming federation requests. Fails the test if the joiner is not joined, if
+// `expectedResidentServer` did not handle the join, or if another server did.
+func (d *Deployment) AssertJoinViaServer(t *testing.T, roomID string, joiner *client.CSAPI, expectedResidentServer string) {
+	t.Helper()
+	userID := joiner.UserID
+	res := joiner.MustDoFunc(t, "GET", []string{"_matrix", "client", "r0", "rooms", roomID, "state"})
+	var joinEventID string
+	for _, ev := range gjson.ParseBytes(client.ParseJSON(t, res)).Array() {
+		if ev.Get("type").Str == "m.room.member" && ev.Get("state_key").Str == userID && ev.Get("content.membership").Str == "join" {
+			joinEventID = ev.Get("event_id").Str
+		}
+	}
+	if joinEventID == "" {
+		t.Fatalf("Deployment.AssertJoinViaServer - %s is not joined to %s", userID, roomID)
+	}
+	// the event ID may or may not have been escaped by the joining server
+	escapedEventID := url.PathEscape(joinEventID)
+	var handledBy []string
+	for _, hsName := range d.Servers() {
+		if hsName == joiner.HSName {
+			continue
+		}
+		lines, err := containerLogLines(d.Deployer.Docker, d.HS[hsName].ContainerID, "send_join")
+		if err != nil {
+			t.Fatalf("Deployment.AssertJoinViaServer - failed to read %s's logs: %s", hsName, err)
+		}
+		for _, line := range lines {
+			if strings.Contains(line, joinEventID) || strings.Contains(line, escapedEventID) || strings.Contains(line, "%24"+joinEventID[1:]) {
+				handledBy = append(handledBy, hsName)
+				break
+			}
+		}
+	}
+	if len(handledBy) != 1 || handledBy[0] != expectedResidentServer {
+		t.Fatalf("Deployment.AssertJoinViaServer - join %s of %s to %s was handled by %v, want [%s]",
+			joinEventID, userID, roomID, handledBy, expectedResidentServer)
+	}
+}
+
+// ClientOpt configures the clients returned by Deployment.Client.
+type ClientOpt func(opts *clientOpts)
+
+type clientOpts struct {
+	pooled bool
+}
+
+// WithPooledConnections makes the client send requests over a connection pool which is shared with every other
+// client created with this option for the same hsName. The pool keeps up to 100 idle connections alive, rather
+// than the 2 per host of http.DefaultTransport, so suites which make many concurrent requests do not keep setting
+// up new connections. Only connections are shared: each client still has its own access token.
+func WithPooledConnections() ClientOpt {
+	return func(opts *clientOpts) {
+		opts.pooled = true
+	}
+}
+
 // Client returns a CSAPI client targeting the given hsName, using the access token for the given userID.
 // Fails the test if the hsName is not found. Returns an unauthenticated client if userID is "", fails the test
 // if the userID is otherwise not found.
-func (d *Deployment) Client(t *testing.T, hsName, userID string) *client.CSAPI {
+func (d *Deployment) Client(t *testing.T, hsName, userID string, opts ...ClientOpt) *client.CSAPI {
 	t.Helper()
+	var cfg clientOpts
+	for _, opt := range opts {
+		opt(&cfg)
+	}
 	dep, ok := d.HS[hsName]
 	if !ok {
 		t.Fatalf("Deployment.Client - HS name '%s' not found", hsName)
@@ -49,14 +282,96 @@ func (d *Deployment) Client(t *testing.T, hsName, userID string) *client.CSAPI {
 		t.Fatalf("Deployment.Client - HS name '%s' - user ID '%s' not found", hsName, userID)
 		return nil
 	}
+	var httpClient *http.Client
+	if cfg.pooled {
+		httpClient = &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: d.pooledTransport(hsName),
+		}
+	}
 	return &client.CSAPI{
-		UserID:           userID,
-		AccessToken:      token,
-		BaseURL:          dep.BaseURL,
-		Client:           client.NewLoggedClient(t, hsName, nil),
-		SyncUntilTimeout: 5 * time.Second,
-		Debug:            d.Deployer.debugLogging,
+		UserID:             userID,
+		AccessToken:        token,
+		BaseURL:            dep.BaseURL,
+		Client:             client.NewLoggedClient(t, hsName, httpClient, d.Deployer.requestLogger()),
+		SyncUntilTimeout:   5 * time.Second,
+		Debug:              d.Deployer.debugLogging,
+		HSName:             hsName,
+		DefaultRoomVersion: d.Deployer.config.DefaultRoomVersion,
+	}
+}
+
+// pooledTransport returns the transport shared by every client for the hsName created WithPooledConnections.
+func (d *Deployment) pooledTransport(hsName string) *http.Transport {
+	d.transportsMu.Lock()
+	defer d.transportsMu.Unlock()
+	if d.transports == nil {
+		d.transports = make(map[string]*http.Transport)
 	}
+	transport, ok := d.transports[hsName]
+	if !ok {
+		transport = &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			MaxIdleConns:        100,
+			MaxIdleConnsPerHost: 100,
+			IdleConnTimeout:     90 * time.Second,
+		}
+		d.transports[hsName] = transport
+	}
+	return transport
+}
+
+// AdminClient returns a CSAPI client targeting the given hsName, authenticated as a server admin declared with
+// b.User.IsAdmin. Its Admin... methods use the admin API of the homeserver runtime. Fails the test if the hsName
+// is not found or has no admin users.
+func (d *Deployment) AdminClient(t *testing.T, hsName string) *client.CSAPI {
+	t.Helper()
+	dep, ok := d.HS[hsName]
+	if !ok {
+		t.Fatalf("Deployment.AdminClient - HS name '%s' not found", hsName)
+		return nil
+	}
+	if len(dep.AdminUserIDs) == 0 {
+		t.Fatalf("Deployment.AdminClient - HS name '%s' has no admin users, set IsAdmin on a user in the blueprint", hsName)
+		return nil
+	}
+	hsRuntime, err := homeserverRuntime(dep.Runtime, d.Deployer.config)
+	if err != nil {
+		t.Fatalf("Deployment.AdminClient - %s", err)
+		return nil
+	}
+	c := d.Client(t, hsName, dep.AdminUserIDs[0])
+	c.AdminAPI = hsRuntime.AdminAPI()
+	return c
+}
+
+// AppServiceClient returns a CSAPI client authenticated with the as_token of the application service with the given
+// ID, acting as the application service's sender user. Set CSAPI.MasqueradeUserID to act as another user in the
+// application service's namespace. Fails the test if the application service is not found in any homeserver.
+func (d *Deployment) AppServiceClient(t *testing.T, asID string) *client.CSAPI {
+	t.Helper()
+	for hsName, dep := range d.HS {
+		registration, ok := dep.ApplicationServices[asID]
+		if !ok {
+			continue
+		}
+		return &client.CSAPI{
+			UserID:             "@" + asRegistrationValue(registration, "sender_localpart") + ":" + hsName,
+			AccessToken:        asRegistrationValue(registration, "as_token"),
+			BaseURL:            dep.BaseURL,
+			Client:             client.NewLoggedClient(t, hsName, nil, d.Deployer.requestLogger()),
+			SyncUntilTimeout:   5 * time.Second,
+			Debug:              d.Deployer.debugLogging,
+			HSName:             hsName,
+			DefaultRoomVersion: d.Deployer.config.DefaultRoomVersion,
+		}
+	}
+	t.Fatalf("Deployment.AppServiceClient - application service '%s' not found", asID)
+	return nil
 }
 
 // RegisterUser within a homeserver and return an authenticatedClient, Fails the test if the hsName is not found.
@@ -68,10 +383,12 @@ func (d *Deployment) RegisterUser(t *testing.T, hsName, localpart, password stri
 		return nil
 	}
 	client := &client.CSAPI{
-		BaseURL:          dep.BaseURL,
-		Client:           client.NewLoggedClient(t, hsName, nil),
-		SyncUntilTimeout: 5 * time.Second,
-		Debug:            d.Deployer.debugLogging,
+		BaseURL:            dep.BaseURL,
+		Client:             client.NewLoggedClient(t, hsName, nil, d.Deployer.requestLogger()),
+		SyncUntilTimeout:   5 * time.Second,
+		Debug:              d.Deployer.debugLogging,
+		HSName:             hsName,
+		DefaultRoomVersion: d.Deployer.config.DefaultRoomVersion,
 	}
 	userID, accessToken := client.RegisterUser(t, localpart, password)
 
@@ -82,3 +399,95 @@ func (d *Deployment) RegisterUser(t *testing.T, hsName, localpart, password stri
 	client.AccessToken = accessToken
 	return client
 }
+
+// RegisterGuest registers a guest user within a homeserver and returns an authenticated client.
+// Fails the test if the hsName is not found or if the homeserver does not allow guest access, which blueprints
+// can enable with ConfigOverrides e.g { "allow_guest_access": true }.
+func (d *Deployment) RegisterGuest(t *testing.T, hsName string) *client.CSAPI {
+	t.Helper()
+	dep, ok := d.HS[hsName]
+	if !ok {
+		t.Fatalf("Deployment.RegisterGuest - HS name '%s' not found", hsName)
+		return nil
+	}
+	client := &client.CSAPI{
+		BaseURL:            dep.BaseURL,
+		Client:             client.NewLoggedClient(t, hsName, nil, d.Deployer.requestLogger()),
+		SyncUntilTimeout:   5 * time.Second,
+		Debug:              d.Deployer.debugLogging,
+		HSName:             hsName,
+		DefaultRoomVersion: d.Deployer.config.DefaultRoomVersion,
+	}
+	client.UserID, client.AccessToken = client.RegisterGuest(t)
+	return client
+}
+
+// FederationGet makes an unsigned GET request to the federation API of the homeserver, trusting its self-signed
+// certificate, and returns the JSON response. This is only useful for endpoints which do not require
+// authentication, such as /_matrix/federation/v1/version. Complement does not hold the signing keys of the
+// homeservers it deploys, so cannot sign requests as one of them: use federation.Server.MustFederationGet to make
+// signed requests. Fails the test if the hsName is not found or if the response is not a 200 OK with a JSON body.
+func (d *Deployment) FederationGet(t *testing.T, hsName string, paths []string) gjson.Result {
+	t.Helper()
+	return d.federationGet(t, hsName, paths, nil)
+}
+
+// OpenIDUserInfo resolves an OpenID access token issued by the homeserver to the user ID it was issued for, by
+// calling /_matrix/federation/v1/openid/userinfo on the homeserver as another server would. Fails the test if the
+// token is not valid.
+func (d *Deployment) OpenIDUserInfo(t *testing.T, hsName, accessToken string) string {
+	t.Helper()
+	res := d.federationGet(t, hsName, []string{"_matrix", "federation", "v1", "openid", "userinfo"}, url.Values{
+		"access_token": []string{accessToken},
+	})
+	return res.Get("sub").Str
+}
+
+func (d *Deployment) federationGet(t *testing.T, hsName string, paths []string, query url.Values) gjson.Result {
+	t.Helper()
+	if _, ok := d.HS[hsName]; !ok {
+		t.Fatalf("Deployment.FederationGet - HS name '%s' not found", hsName)
+	}
+	escapedPaths := make([]string, len(paths))
+	for i := range paths {
+		escapedPaths[i] = url.PathEscape(paths[i])
+	}
+	fedClient := &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &RoundTripper{Deployment: d},
+	}
+	reqURL := "https://" + hsName + "/" + strings.Join(escapedPaths, "/")
+	if len(query) > 0 {
+		reqURL += "?" + query.Encode()
+	}
+	res, err := fedClient.Get(reqURL)
+	if err != nil {
+		t.Fatalf("Deployment.FederationGet - GET %s failed: %s", reqURL, err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("Deployment.FederationGet - GET %s failed to read response body: %s", reqURL, err)
+	}
+	if res.StatusCode != 200 || !gjson.ValidBytes(body) {
+		t.Fatalf("Deployment.FederationGet - GET %s returned HTTP %d: %s", reqURL, res.StatusCode, string(body))
+	}
+	return gjson.ParseBytes(body)
+}
+
+// GetServerKeys returns the signing keys of `toHS` as seen by `fromHS`, by asking `fromHS` for them with
+// /_matrix/key/v2/query/{toHS}. Unless they are the same server, `fromHS` fetches the keys from `toHS` over
+// federation, so this checks that the servers trust each other's TLS certs and agree on `toHS`'s keys. Use
+// FederationGet to fetch /_matrix/key/v2/server from a server directly. Fails the test if `fromHS` does not
+// return keys for `toHS`.
+func (d *Deployment) GetServerKeys(t *testing.T, fromHS, toHS string) gjson.Result {
+	t.Helper()
+	res := d.FederationGet(t, fromHS, []string{"_matrix", "key", "v2", "query", toHS})
+	for _, keys := range res.Get("server_keys").Array() {
+		if keys.Get("server_name").Str == toHS {
+			return keys
+		}
+	}
+	t.Fatalf("Deployment.GetServerKeys - %s returned no keys for %s: %s", fromHS, toHS, res.Raw)
+	return gjson.Result{}
+}
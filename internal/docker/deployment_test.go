@@ -0,0 +1,119 @@
+package docker
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement/internal/config"
+)
+
+// Test that clients created WithPooledConnections keep their connections alive for other clients to reuse, even
+// after more concurrent requests than http.DefaultTransport keeps idle connections for.
+func TestClientWithPooledConnectionsReusesConnections(t *testing.T) {
+	const numClients = 10
+	var (
+		mu       sync.Mutex
+		newConns int
+		arrived  sync.WaitGroup
+	)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// hold every request until all the clients have sent one, so that each needs its own connection
+		arrived.Done()
+		arrived.Wait()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{}`))
+	}))
+	srv.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mu.Lock()
+			newConns++
+			mu.Unlock()
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	d := &Deployment{
+		Deployer: &Deployer{config: &config.Complement{}},
+		HS: map[string]HomeserverDeployment{
+			"hs1": {BaseURL: srv.URL, AccessTokens: map[string]string{}},
+		},
+	}
+	sendConcurrently := func() {
+		arrived.Add(numClients)
+		var done sync.WaitGroup
+		for i := 0; i < numClients; i++ {
+			done.Add(1)
+			go func() {
+				defer done.Done()
+				c := d.Client(t, "hs1", "", WithPooledConnections())
+				res := c.DoFunc(t, "GET", []string{"_matrix", "client", "versions"})
+				res.Body.Close()
+			}()
+		}
+		done.Wait()
+	}
+
+	sendConcurrently()
+	// give the transport time to return the connections to its idle pool
+	time.Sleep(100 * time.Millisecond)
+	sendConcurrently()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if newConns != numClients {
+		t.Fatalf("clients opened %d connections for two rounds of %d concurrent requests, want %d", newConns, numClients, numClients)
+	}
+}
+
+// Test that clients only share a connection pool with other pooled clients for the same homeserver.
+func TestClientWithPooledConnectionsSharesTransportPerHomeserver(t *testing.T) {
+	d := &Deployment{}
+	if d.pooledTransport("hs1") != d.pooledTransport("hs1") {
+		t.Fatalf("pooled clients for the same homeserver do not share a transport")
+	}
+	if d.pooledTransport("hs1") == d.pooledTransport("hs2") {
+		t.Fatalf("pooled clients for different homeservers share a transport")
+	}
+}
+
+// Test that the homeservers and their clients are listed in a stable order, so tests iterating over them are
+// deterministic.
+func TestServersAndClientsForAreSorted(t *testing.T) {
+	d := &Deployment{
+		Deployer: &Deployer{config: &config.Complement{}},
+		HS: map[string]HomeserverDeployment{
+			"hs2": {BaseURL: "http://hs2", AccessTokens: map[string]string{}},
+			"hs1": {
+				BaseURL: "http://hs1",
+				AccessTokens: map[string]string{
+					"@charlie:hs1": "charlie_token",
+					"@alice:hs1":   "alice_token",
+				},
+			},
+		},
+	}
+	if got := strings.Join(d.Servers(), ","); got != "hs1,hs2" {
+		t.Fatalf("Servers returned %s, want hs1,hs2", got)
+	}
+	clients := d.ClientsFor(t, "hs1")
+	if len(clients) != 2 {
+		t.Fatalf("ClientsFor returned %d clients, want 2", len(clients))
+	}
+	for i, want := range []struct{ userID, accessToken string }{
+		{"@alice:hs1", "alice_token"},
+		{"@charlie:hs1", "charlie_token"},
+	} {
+		if clients[i].UserID != want.userID || clients[i].AccessToken != want.accessToken {
+			t.Errorf("client %d is %s with token %s, want %s with token %s", i, clients[i].UserID, clients[i].AccessToken, want.userID, want.accessToken)
+		}
+	}
+	if clients := d.ClientsFor(t, "hs2"); len(clients) != 0 {
+		t.Errorf("ClientsFor returned %d clients for a homeserver without users, want 0", len(clients))
+	}
+}
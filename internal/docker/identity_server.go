@@ -0,0 +1,214 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/gjson"
+)
+
+// IdentityServer is a mock identity server which stores third-party invites and can bind third-party
+// identifiers to Matrix user IDs. Its TLS certificate is self-signed, so homeservers must be configured to
+// talk to identity servers without verifying their certificates, which Synapse blueprints can do with
+// ConfigOverrides e.g { "use_insecure_ssl_client_just_for_testing_do_not_use": true }.
+type IdentityServer struct {
+	// The name of the identity server, to use as the `id_server` in requests to homeservers.
+	ServerName string
+	srv        *http.Server
+	deployment *Deployment
+	priv       ed25519.PrivateKey
+	mu         sync.Mutex
+	// medium + "/" + address => invites
+	invites map[string][]storedInvite
+}
+
+type storedInvite struct {
+	Token  string
+	RoomID string
+	Sender string
+}
+
+// IdentityServer starts a mock identity server on a random port, which is reachable by homeservers via
+// HostnameRunningComplement. Call Close when done. Fails the test if the server cannot be started.
+func (d *Deployment) IdentityServer(t *testing.T) *IdentityServer {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Deployment.IdentityServer - failed to generate signing key: %s", err)
+	}
+	tlsConfig, err := selfSignedTLSConfig(HostnameRunningComplement)
+	if err != nil {
+		t.Fatalf("Deployment.IdentityServer - failed to create TLS certificate: %s", err)
+	}
+	listener, err := tls.Listen("tcp", ":0", tlsConfig)
+	if err != nil {
+		t.Fatalf("Deployment.IdentityServer - failed to listen: %s", err)
+	}
+	is := &IdentityServer{
+		ServerName: fmt.Sprintf("%s:%d", HostnameRunningComplement, listener.Addr().(*net.TCPAddr).Port),
+		deployment: d,
+		priv:       priv,
+		invites:    make(map[string][]storedInvite),
+	}
+	publicKey := base64.RawStdEncoding.EncodeToString(priv.Public().(ed25519.PublicKey))
+
+	mux := http.NewServeMux()
+	writeJSON := func(w http.ResponseWriter, code int, body interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(body)
+	}
+	// homeservers must register with v2 identity servers before using them
+	mux.HandleFunc("/_matrix/identity/v2/account/register", func(w http.ResponseWriter, req *http.Request) {
+		writeJSON(w, 200, map[string]interface{}{"token": "complement_identity_token"})
+	})
+	mux.HandleFunc("/_matrix/identity/v2/pubkey/isvalid", func(w http.ResponseWriter, req *http.Request) {
+		writeJSON(w, 200, map[string]interface{}{"valid": req.URL.Query().Get("public_key") == publicKey})
+	})
+	mux.HandleFunc("/_matrix/identity/v2/pubkey/ed25519:0", func(w http.ResponseWriter, req *http.Request) {
+		writeJSON(w, 200, map[string]interface{}{"public_key": publicKey})
+	})
+	mux.HandleFunc("/_matrix/identity/v2/hash_details", func(w http.ResponseWriter, req *http.Request) {
+		writeJSON(w, 200, map[string]interface{}{
+			"algorithms":    []string{"none"},
+			"lookup_pepper": "complement",
+		})
+	})
+	// no third-party identifiers are bound until Bind is called, so lookups never find a user
+	mux.HandleFunc("/_matrix/identity/v2/lookup", func(w http.ResponseWriter, req *http.Request) {
+		writeJSON(w, 200, map[string]interface{}{"mappings": map[string]interface{}{}})
+	})
+	mux.HandleFunc("/_matrix/identity/v2/store-invite", func(w http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil || !gjson.ValidBytes(body) {
+			writeJSON(w, 400, map[string]interface{}{
+				"errcode": "M_NOT_JSON",
+				"error":   "complement: store-invite body is not valid JSON",
+			})
+			return
+		}
+		medium := gjson.GetBytes(body, "medium").Str
+		address := gjson.GetBytes(body, "address").Str
+		is.mu.Lock()
+		key := medium + "/" + address
+		token := fmt.Sprintf("complement_invite_token_%d", len(is.invites[key]))
+		is.invites[key] = append(is.invites[key], storedInvite{
+			Token:  token,
+			RoomID: gjson.GetBytes(body, "room_id").Str,
+			Sender: gjson.GetBytes(body, "sender").Str,
+		})
+		is.mu.Unlock()
+		writeJSON(w, 200, map[string]interface{}{
+			"token":        token,
+			"display_name": redactAddress(address),
+			"public_keys": []map[string]interface{}{
+				{
+					"public_key":       publicKey,
+					"key_validity_url": "https://" + is.ServerName + "/_matrix/identity/v2/pubkey/isvalid",
+				},
+			},
+		})
+	})
+	is.srv = &http.Server{Handler: mux}
+	go is.srv.Serve(listener)
+	return is
+}
+
+// Bind binds the third-party identifier to the Matrix user ID, by telling the user's homeserver about every
+// third-party invite stored for the identifier. The homeserver then turns the invites into real invites.
+// Fails the test if the homeserver rejects the request.
+func (is *IdentityServer) Bind(t *testing.T, hsName, medium, address, mxid string) {
+	t.Helper()
+	is.mu.Lock()
+	stored := is.invites[medium+"/"+address]
+	delete(is.invites, medium+"/"+address)
+	is.mu.Unlock()
+
+	invites := make([]map[string]interface{}, 0, len(stored))
+	for _, inv := range stored {
+		signed, err := json.Marshal(map[string]interface{}{
+			"mxid":  mxid,
+			"token": inv.Token,
+		})
+		if err != nil {
+			t.Fatalf("IdentityServer.Bind - failed to marshal signed invite: %s", err)
+		}
+		signed, err = gomatrixserverlib.SignJSON(is.ServerName, "ed25519:0", is.priv, signed)
+		if err != nil {
+			t.Fatalf("IdentityServer.Bind - failed to sign invite: %s", err)
+		}
+		invites = append(invites, map[string]interface{}{
+			"medium":  medium,
+			"address": address,
+			"mxid":    mxid,
+			"room_id": inv.RoomID,
+			"sender":  inv.Sender,
+			"signed":  json.RawMessage(signed),
+		})
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"medium":  medium,
+		"address": address,
+		"mxid":    mxid,
+		"invites": invites,
+	})
+	if err != nil {
+		t.Fatalf("IdentityServer.Bind - failed to marshal request: %s", err)
+	}
+	httpClient := &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &RoundTripper{Deployment: is.deployment},
+	}
+	res, err := httpClient.Post("https://"+hsName+"/_matrix/federation/v1/3pid/onbind", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("IdentityServer.Bind - failed to send onbind request: %s", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		resBody, _ := ioutil.ReadAll(res.Body)
+		t.Fatalf("IdentityServer.Bind - onbind returned %s - body: %s", res.Status, string(resBody))
+	}
+}
+
+// Close stops the identity server.
+func (is *IdentityServer) Close() {
+	is.srv.Shutdown(context.Background())
+}
+
+// redactAddress hides most of a third-party identifier, as identity servers do when returning a display
+// name for an invite, e.g "alice@example.com" becomes "a...@e...".
+func redactAddress(address string) string {
+	parts := strings.SplitN(address, "@", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return address
+	}
+	return parts[0][:1] + "...@" + parts[1][:1] + "..."
+}
+
+// selfSignedTLSConfig creates a TLS config with a self-signed certificate for the hostname.
+func selfSignedTLSConfig(hostname string) (*tls.Config, error) {
+	tlsCert, err := NewTLSCert(hostname, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair([]byte(tlsCert.CertPEM), []byte(tlsCert.KeyPEM))
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}, nil
+}
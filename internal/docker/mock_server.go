@@ -0,0 +1,84 @@
+package docker
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// mockServer is an HTTP server on a random port, which homeservers can reach via HostnameRunningComplement, for
+// mocking the services they push to e.g push gateways and application services. Handlers queue what they receive
+// with enqueue, which never blocks, and tests read it back in order with next.
+type mockServer struct {
+	port     int
+	srv      *http.Server
+	mu       sync.Mutex
+	queue    []gjson.Result
+	enqueued chan struct{}
+}
+
+func newMockServer() *mockServer {
+	return &mockServer{
+		enqueued: make(chan struct{}, 1),
+	}
+}
+
+// listen starts serving requests with the handler.
+func (s *mockServer) listen(handler http.Handler) error {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		return err
+	}
+	s.port = listener.Addr().(*net.TCPAddr).Port
+	s.srv = &http.Server{Handler: handler}
+	go s.srv.Serve(listener)
+	return nil
+}
+
+// enqueue adds the values to the back of the queue.
+func (s *mockServer) enqueue(values ...gjson.Result) {
+	s.mu.Lock()
+	s.queue = append(s.queue, values...)
+	s.mu.Unlock()
+	// wake up next, unless it has already been woken up
+	select {
+	case s.enqueued <- struct{}{}:
+	default:
+	}
+}
+
+// next removes the value at the front of the queue, waiting for one to be enqueued if the queue is empty. Returns
+// false if no value is enqueued before the timeout.
+func (s *mockServer) next(timeout time.Duration) (gjson.Result, bool) {
+	deadline := time.After(timeout)
+	for {
+		s.mu.Lock()
+		if len(s.queue) > 0 {
+			value := s.queue[0]
+			s.queue = s.queue[1:]
+			s.mu.Unlock()
+			return value, true
+		}
+		s.mu.Unlock()
+		select {
+		case <-s.enqueued:
+		case <-deadline:
+			return gjson.Result{}, false
+		}
+	}
+}
+
+func (s *mockServer) close() {
+	s.srv.Shutdown(context.Background())
+}
+
+// respondJSON writes a JSON response with the status code.
+func respondJSON(w http.ResponseWriter, code int, body string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write([]byte(body))
+}
@@ -0,0 +1,59 @@
+package docker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// PushGateway receives the push notifications sent by homeservers to a mock push gateway.
+type PushGateway struct {
+	// The URL which homeservers should send notifications to. Use this as the `data.url` of an HTTP pusher.
+	URL string
+	srv *mockServer
+}
+
+// PushGateway starts a mock push gateway on a random port, which is reachable by homeservers via
+// HostnameRunningComplement. Every notification is acknowledged with an empty `rejected` list.
+// Call Close when done. Fails the test if a port cannot be listened on.
+func (d *Deployment) PushGateway(t *testing.T) *PushGateway {
+	t.Helper()
+	srv := newMockServer()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/_matrix/push/v1/notify", func(w http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil || !gjson.ValidBytes(body) {
+			respondJSON(w, 400, `{"errcode":"M_NOT_JSON","error":"complement: notification body is not valid JSON"}`)
+			return
+		}
+		srv.enqueue(gjson.GetBytes(body, "notification"))
+		respondJSON(w, 200, `{"rejected":[]}`)
+	})
+	if err := srv.listen(mux); err != nil {
+		t.Fatalf("Deployment.PushGateway - failed to listen: %s", err)
+	}
+	return &PushGateway{
+		URL: fmt.Sprintf("http://%s:%d/_matrix/push/v1/notify", HostnameRunningComplement, srv.port),
+		srv: srv,
+	}
+}
+
+// Next blocks until the next notification is received, or fails the test if no notification is received
+// before the timeout. Notifications are returned in the order they were received.
+func (g *PushGateway) Next(t *testing.T, timeout time.Duration) gjson.Result {
+	t.Helper()
+	notification, ok := g.srv.next(timeout)
+	if !ok {
+		t.Fatalf("PushGateway.Next: timed out after %f seconds waiting for a notification", timeout.Seconds())
+	}
+	return notification
+}
+
+// Close stops the push gateway.
+func (g *PushGateway) Close() {
+	g.srv.close()
+}
@@ -0,0 +1,297 @@
+package docker
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/client"
+	"github.com/matrix-org/complement/internal/config"
+)
+
+// HomeserverRuntime describes how Complement runs a homeserver implementation's image: which image to run, how to
+// configure it for the features a blueprint uses and how to perform operations which are not part of the
+// client-server API. Runtimes are registered by name, and selected for a whole run with
+// COMPLEMENT_HOMESERVER_RUNTIME or for a single homeserver with b.Homeserver.Runtime.
+type HomeserverRuntime interface {
+	// DefaultBaseImage returns the image to run homeservers which select this runtime with b.Homeserver.Runtime,
+	// and homeservers in runs which do not set COMPLEMENT_BASE_IMAGE.
+	DefaultBaseImage() string
+	// Env returns extra environment variables to run the homeserver's container with, on top of those which
+	// Complement always sets such as SERVER_NAME.
+	Env(hsName string) []string
+	// HealthCheckPath returns the client-server API path which Complement polls until it returns 200 OK to
+	// decide that the homeserver is up.
+	HealthCheckPath() string
+	// Supports returns true if the homeserver image supports the feature. Complement refuses to build blueprints,
+	// or deploy homeservers, which use features their runtime does not support.
+	Supports(feature ImageFeature) bool
+	// AdminAPI returns how to perform server administration operations on the homeserver, for clients returned
+	// by Deployment.AdminClient.
+	AdminAPI() client.AdminAPI
+	// RegisterAdmin registers a server admin on the homeserver at hsURL while its blueprint is being built, for
+	// users with b.User.IsAdmin, and returns the admin's access token.
+	RegisterAdmin(hsURL, localpart, password string) (accessToken string, err error)
+	// ConfigOverrides returns config keys to deep-merge into the homeserver's config so that it supports the
+	// features the blueprint uses, in the same format as b.Homeserver.ConfigOverrides. Keys set by the blueprint
+	// take precedence. Returns nil if no keys are needed.
+	ConfigOverrides(hs b.Homeserver) map[string]interface{}
+}
+
+// ImageFeature is an optional image requirement from the README, which blueprints and deployments can use.
+type ImageFeature string
+
+const (
+	// ImageFeatureConfigOverrides is support for b.Homeserver.ConfigOverrides.
+	ImageFeatureConfigOverrides ImageFeature = "ConfigOverrides"
+	// ImageFeatureFederationDisabled is support for b.Homeserver.FederationDisabled.
+	ImageFeatureFederationDisabled ImageFeature = "FederationDisabled"
+	// ImageFeatureClockOffset is support for b.Homeserver.ClockOffsetEnabled.
+	ImageFeatureClockOffset ImageFeature = "ClockOffsetEnabled"
+	// ImageFeatureAdminUsers is support for b.User.IsAdmin.
+	ImageFeatureAdminUsers ImageFeature = "IsAdmin"
+	// ImageFeatureTLSCerts is support for Deployer.TLSCerts.
+	ImageFeatureTLSCerts ImageFeature = "TLSCerts"
+)
+
+// featuresUsed returns the image features which the homeserver in the blueprint uses.
+func featuresUsed(hs b.Homeserver) []ImageFeature {
+	var features []ImageFeature
+	if len(hs.ConfigOverrides) > 0 {
+		features = append(features, ImageFeatureConfigOverrides)
+	}
+	if hs.FederationDisabled {
+		features = append(features, ImageFeatureFederationDisabled)
+	}
+	if hs.ClockOffsetEnabled {
+		features = append(features, ImageFeatureClockOffset)
+	}
+	for _, user := range hs.Users {
+		if user.IsAdmin {
+			features = append(features, ImageFeatureAdminUsers)
+			break
+		}
+	}
+	return features
+}
+
+// genericRuntime is the default runtime, for base images which may be any homeserver implementation. It assumes
+// the image only meets the required image requirements in the README, unless the image opts in to optional image
+// features with COMPLEMENT_BASE_IMAGE_FEATURES, in which case it assumes the image meets the README's requirements
+// for those features.
+type genericRuntime struct {
+	features []string
+}
+
+func (genericRuntime) DefaultBaseImage() string {
+	return ""
+}
+
+func (genericRuntime) Env(hsName string) []string {
+	return nil
+}
+
+func (genericRuntime) HealthCheckPath() string {
+	return "/_matrix/client/versions"
+}
+
+func (r genericRuntime) Supports(feature ImageFeature) bool {
+	for _, f := range r.features {
+		if f == string(feature) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r genericRuntime) AdminAPI() client.AdminAPI {
+	if !r.Supports(ImageFeatureAdminUsers) {
+		return nil
+	}
+	return client.SynapseAdminAPI{}
+}
+
+func (r genericRuntime) RegisterAdmin(hsURL, localpart, password string) (string, error) {
+	if !r.Supports(ImageFeatureAdminUsers) {
+		return "", fmt.Errorf("base image does not support %s, add it to COMPLEMENT_BASE_IMAGE_FEATURES if it does", ImageFeatureAdminUsers)
+	}
+	return registerSharedSecretAdmin(hsURL, localpart, password)
+}
+
+func (r genericRuntime) ConfigOverrides(hs b.Homeserver) map[string]interface{} {
+	if r.Supports(ImageFeatureAdminUsers) {
+		return synapseRuntime{}.ConfigOverrides(hs)
+	}
+	return nil
+}
+
+// synapseRuntime is the runtime for the images built from dockerfiles/Synapse.Dockerfile and
+// dockerfiles/SynapseWorkers.Dockerfile. If workerTypes is set, the image runs Synapse with those workers.
+type synapseRuntime struct {
+	image       string
+	workerTypes []string
+}
+
+func (r synapseRuntime) DefaultBaseImage() string {
+	return r.image
+}
+
+func (r synapseRuntime) Env(hsName string) []string {
+	if len(r.workerTypes) == 0 {
+		return nil
+	}
+	return []string{"SYNAPSE_WORKER_TYPES=" + strings.Join(r.workerTypes, ", ")}
+}
+
+func (synapseRuntime) HealthCheckPath() string {
+	return "/_matrix/client/versions"
+}
+
+func (r synapseRuntime) Supports(feature ImageFeature) bool {
+	// the workers image generates its config with Synapse's worker scripts rather than dockerfiles/synapse/start.sh
+	return len(r.workerTypes) == 0
+}
+
+func (synapseRuntime) AdminAPI() client.AdminAPI {
+	return client.SynapseAdminAPI{}
+}
+
+func (synapseRuntime) RegisterAdmin(hsURL, localpart, password string) (string, error) {
+	return registerSharedSecretAdmin(hsURL, localpart, password)
+}
+
+func (synapseRuntime) ConfigOverrides(hs b.Homeserver) map[string]interface{} {
+	for _, user := range hs.Users {
+		if user.IsAdmin {
+			return map[string]interface{}{
+				"registration_shared_secret": registrationSharedSecret,
+			}
+		}
+	}
+	return nil
+}
+
+// dendriteRuntime is the runtime for the images built from dockerfiles/Dendrite.Dockerfile and
+// dockerfiles/DendritePostgres.Dockerfile, which support none of the optional image features.
+type dendriteRuntime struct{}
+
+func (dendriteRuntime) DefaultBaseImage() string {
+	return "complement-dendrite:latest"
+}
+
+func (dendriteRuntime) Env(hsName string) []string {
+	return nil
+}
+
+func (dendriteRuntime) HealthCheckPath() string {
+	return "/_matrix/client/versions"
+}
+
+func (dendriteRuntime) Supports(feature ImageFeature) bool {
+	return false
+}
+
+func (dendriteRuntime) AdminAPI() client.AdminAPI {
+	return nil
+}
+
+func (dendriteRuntime) RegisterAdmin(hsURL, localpart, password string) (string, error) {
+	return "", fmt.Errorf("dendrite runtime cannot register admins")
+}
+
+func (dendriteRuntime) ConfigOverrides(hs b.Homeserver) map[string]interface{} {
+	return nil
+}
+
+// registrationSharedSecret is the secret which runtimes using registerSharedSecretAdmin configure the homeserver
+// to accept.
+const registrationSharedSecret = "complement"
+
+// registerSharedSecretAdmin registers an admin with Synapse-style shared-secret registration at
+// /_synapse/admin/v1/register, and returns the admin's access token.
+func registerSharedSecretAdmin(hsURL, localpart, password string) (string, error) {
+	cli := http.Client{
+		Timeout: 30 * time.Second,
+	}
+	registerURL := hsURL + "/_synapse/admin/v1/register"
+	res, err := cli.Get(registerURL)
+	if err != nil {
+		return "", err
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return "", err
+	}
+	if res.StatusCode != 200 {
+		return "", fmt.Errorf("GET %s returned HTTP %s : %s", registerURL, res.Status, string(body))
+	}
+	nonce := gjson.GetBytes(body, "nonce").Str
+
+	mac := hmac.New(sha1.New, []byte(registrationSharedSecret))
+	mac.Write([]byte(nonce + "\x00" + localpart + "\x00" + password + "\x00admin"))
+	reqBody, err := json.Marshal(map[string]interface{}{
+		"nonce":    nonce,
+		"username": localpart,
+		"password": password,
+		"admin":    true,
+		"mac":      hex.EncodeToString(mac.Sum(nil)),
+	})
+	if err != nil {
+		return "", err
+	}
+	res, err = cli.Post(registerURL, "application/json", bytes.NewReader(reqBody))
+	if err != nil {
+		return "", err
+	}
+	body, err = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return "", err
+	}
+	if res.StatusCode != 200 {
+		return "", fmt.Errorf("POST %s returned HTTP %s : %s", registerURL, res.Status, string(body))
+	}
+	return gjson.GetBytes(body, "access_token").Str, nil
+}
+
+var runtimes = map[string]HomeserverRuntime{
+	"synapse": synapseRuntime{image: "complement-synapse:latest"},
+	"synapse_workers": synapseRuntime{
+		image: "complement-synapse-workers:latest",
+		workerTypes: []string{
+			"event_persister", "event_persister", "background_worker", "frontend_proxy", "event_creator", "user_dir",
+			"media_repository", "federation_inbound", "federation_reader", "federation_sender", "synchrotron",
+			"appservice", "pusher",
+		},
+	},
+	"dendrite": dendriteRuntime{},
+}
+
+// RegisterHomeserverRuntime makes the runtime selectable by setting COMPLEMENT_HOMESERVER_RUNTIME, or
+// b.Homeserver.Runtime, to `name`, which must not be "". This should be called from an init function.
+func RegisterHomeserverRuntime(name string, runtime HomeserverRuntime) {
+	runtimes[name] = runtime
+}
+
+// homeserverRuntime returns the runtime registered with the given name, or the default runtime if the name is "".
+func homeserverRuntime(name string, cfg *config.Complement) (HomeserverRuntime, error) {
+	if name == "" {
+		return genericRuntime{features: cfg.BaseImageFeatures}, nil
+	}
+	runtime, ok := runtimes[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown homeserver runtime '%s'", name)
+	}
+	return runtime, nil
+}
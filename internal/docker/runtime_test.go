@@ -0,0 +1,53 @@
+package docker
+
+import (
+	"testing"
+
+	"github.com/matrix-org/complement/internal/config"
+)
+
+// Test that the default runtime only supports the optional image features which the base image opts in to.
+func TestDefaultRuntimeSupportsOnlyOptedInFeatures(t *testing.T) {
+	allFeatures := []ImageFeature{
+		ImageFeatureConfigOverrides, ImageFeatureFederationDisabled, ImageFeatureClockOffset,
+		ImageFeatureAdminUsers, ImageFeatureTLSCerts,
+	}
+	hsRuntime, err := homeserverRuntime("", &config.Complement{})
+	if err != nil {
+		t.Fatalf("failed to get default runtime: %s", err)
+	}
+	for _, feature := range allFeatures {
+		if hsRuntime.Supports(feature) {
+			t.Errorf("default runtime supports %s without opting in", feature)
+		}
+	}
+	if hsRuntime.AdminAPI() != nil {
+		t.Errorf("default runtime has an admin API without opting in to %s", ImageFeatureAdminUsers)
+	}
+
+	hsRuntime, err = homeserverRuntime("", &config.Complement{
+		BaseImageFeatures: []string{string(ImageFeatureConfigOverrides), string(ImageFeatureAdminUsers)},
+	})
+	if err != nil {
+		t.Fatalf("failed to get default runtime: %s", err)
+	}
+	for _, feature := range allFeatures {
+		want := feature == ImageFeatureConfigOverrides || feature == ImageFeatureAdminUsers
+		if got := hsRuntime.Supports(feature); got != want {
+			t.Errorf("default runtime opted in to ConfigOverrides and IsAdmin: Supports(%s) = %v, want %v", feature, got, want)
+		}
+	}
+	if hsRuntime.AdminAPI() == nil {
+		t.Errorf("default runtime has no admin API after opting in to %s", ImageFeatureAdminUsers)
+	}
+
+	hsRuntime, err = homeserverRuntime("synapse", &config.Complement{})
+	if err != nil {
+		t.Fatalf("failed to get synapse runtime: %s", err)
+	}
+	for _, feature := range allFeatures {
+		if !hsRuntime.Supports(feature) {
+			t.Errorf("synapse runtime does not support %s", feature)
+		}
+	}
+}
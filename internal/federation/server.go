@@ -15,6 +15,7 @@ import (
 	"math/big"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"sync"
@@ -23,6 +24,7 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/gjson"
 
 	"github.com/matrix-org/complement/internal/b"
 	"github.com/matrix-org/complement/internal/docker"
@@ -240,6 +242,74 @@ func (s *Server) MustJoinRoom(t *testing.T, deployment *docker.Deployment, remot
 	return room
 }
 
+// MustGetEventAuthChain fetches the full auth chain of the event from the remote server, using
+// /_matrix/federation/v1/event_auth. This server must be in the room, as servers only return auth chains to servers
+// in the room. Homeservers only accept signed federation requests, so this cannot be a Deployment helper.
+// Returns the auth chain events in the order the remote server returned them, else fails the test.
+func (s *Server) MustGetEventAuthChain(t *testing.T, deployment *docker.Deployment, remoteServer gomatrixserverlib.ServerName, roomID, eventID string) []gjson.Result {
+	t.Helper()
+	res := s.MustFederationGet(t, deployment, remoteServer, "/_matrix/federation/v1/event_auth/"+url.PathEscape(roomID)+"/"+url.PathEscape(eventID))
+	authChain := res.Get("auth_chain")
+	if !authChain.IsArray() {
+		t.Fatalf("MustGetEventAuthChain: response has no auth_chain: %s", res.Raw)
+	}
+	return authChain.Array()
+}
+
+// MustGetRoomStateAtEvent fetches the state of the room at the event from the remote server, as a server
+// backfilling or joining the room would. This calls both /_matrix/federation/v1/state_ids and
+// /_matrix/federation/v1/state, and fails the test if they disagree on which events make up the state. This server
+// must be in the room. Returns the state events, else fails the test.
+func (s *Server) MustGetRoomStateAtEvent(t *testing.T, deployment *docker.Deployment, remoteServer gomatrixserverlib.ServerName, roomID, eventID string) []gjson.Result {
+	t.Helper()
+	room, ok := s.rooms[roomID]
+	if !ok {
+		t.Fatalf("MustGetRoomStateAtEvent: server is not in room %s", roomID)
+	}
+	query := "?event_id=" + url.QueryEscape(eventID)
+	stateIDs := s.MustFederationGet(t, deployment, remoteServer, "/_matrix/federation/v1/state_ids/"+url.PathEscape(roomID)+query)
+	state := s.MustFederationGet(t, deployment, remoteServer, "/_matrix/federation/v1/state/"+url.PathEscape(roomID)+query)
+
+	wantEventIDs := make(map[string]bool)
+	for _, id := range stateIDs.Get("pdu_ids").Array() {
+		wantEventIDs[id.Str] = true
+	}
+	pdus := state.Get("pdus").Array()
+	for _, pdu := range pdus {
+		// room versions 3 and above do not include the event ID in the event, so work it out from the event itself
+		id := pdu.Get("event_id").Str
+		if id == "" {
+			ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(pdu.Raw), false, room.Version)
+			if err != nil {
+				t.Fatalf("MustGetRoomStateAtEvent: failed to parse state event %s: %s", pdu.Raw, err)
+			}
+			id = ev.EventID()
+		}
+		if !wantEventIDs[id] {
+			t.Fatalf("MustGetRoomStateAtEvent: /state returned %s which is not in /state_ids: %s", id, stateIDs.Raw)
+		}
+		delete(wantEventIDs, id)
+	}
+	if len(wantEventIDs) > 0 {
+		t.Fatalf("MustGetRoomStateAtEvent: /state is missing events from /state_ids: %v", wantEventIDs)
+	}
+	return pdus
+}
+
+// MustFederationGet makes a GET request to the path on the remote server, signed with this server's key, and
+// returns the JSON response, else fails the test. The path may include a query string. Complement does not hold
+// the signing keys of the homeservers it deploys, so this is how to make signed requests: use
+// docker.Deployment.FederationGet for endpoints which do not need signing.
+func (s *Server) MustFederationGet(t *testing.T, deployment *docker.Deployment, remoteServer gomatrixserverlib.ServerName, path string) gjson.Result {
+	t.Helper()
+	req := gomatrixserverlib.NewFederationRequest("GET", remoteServer, path)
+	var resBody json.RawMessage
+	if err := s.SendFederationRequest(deployment, req, &resBody); err != nil {
+		t.Fatalf("GET %s from %s failed: %v", path, remoteServer, err)
+	}
+	return gjson.ParseBytes(resBody)
+}
+
 // Mux returns this server's router so you can attach additional paths
 func (s *Server) Mux() *mux.Router {
 	return s.mux
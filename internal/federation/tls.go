@@ -0,0 +1,33 @@
+package federation
+
+import (
+	"crypto/x509"
+
+	"github.com/matrix-org/gomatrixserverlib"
+
+	"github.com/matrix-org/complement/internal/docker"
+)
+
+// CACertPool returns a cert pool containing only the Complement CA, which signs the TLS certs of
+// homeservers and of this federation server when COMPLEMENT_CA is true.
+func CACertPool() (*x509.CertPool, error) {
+	ca, _, err := GetOrCreateCaCert()
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	return pool, nil
+}
+
+// FederationClientWithRootCAs returns a client which will sign requests using this server's key, like
+// FederationClient, but which only trusts homeservers whose TLS certs are signed by one of the roots.
+// Requests to a homeserver with an untrusted cert fail with an x509 error.
+//
+// The requests will be routed according to the deployment map in `deployment`.
+func (s *Server) FederationClientWithRootCAs(deployment *docker.Deployment, roots *x509.CertPool) *gomatrixserverlib.FederationClient {
+	return gomatrixserverlib.NewFederationClient(
+		gomatrixserverlib.ServerName(s.ServerName), s.KeyID, s.Priv,
+		gomatrixserverlib.WithTransport(&docker.RoundTripper{Deployment: deployment, RootCAs: roots}),
+	)
+}
@@ -35,9 +35,16 @@ type Runner struct {
 	bestEffort bool
 	// set to true if the runner should stop
 	terminate atomic.Value
+	// registers users with b.User.IsAdmin, or nil if admins cannot be registered
+	registerAdmin RegisterAdminFunc
 }
 
-func NewRunner(blueprintName string, bestEffort, debugLogging bool) *Runner {
+// RegisterAdminFunc registers a server admin on the homeserver `hsName` at hsURL with the given password, and
+// returns the admin's access token. Registering admins is not part of the client-server API, so each homeserver
+// implementation provides its own.
+type RegisterAdminFunc func(hsName, hsURL, localpart, password string) (accessToken string, err error)
+
+func NewRunner(blueprintName string, bestEffort, debugLogging bool, registerAdmin RegisterAdminFunc) *Runner {
 	var v atomic.Value
 	v.Store(false)
 	return &Runner{
@@ -48,6 +55,7 @@ func NewRunner(blueprintName string, bestEffort, debugLogging bool) *Runner {
 		roomConcurrency: 40,
 		terminate:       v,
 		bestEffort:      bestEffort,
+		registerAdmin:   registerAdmin,
 	}
 }
 
@@ -75,6 +83,11 @@ func (r *Runner) AccessTokens(hsDomain string) map[string]string {
 
 // Run all instructions until completion. Return an error if there was a problem executing any instruction.
 func (r *Runner) Run(hs b.Homeserver, hsURL string) (resErr error) {
+	// register admins first, so that other instructions can log in as them
+	if err := r.registerAdmins(hs, hsURL); err != nil {
+		r.log("Terminating: admin creation failed: %s", err)
+		return err
+	}
 	userInstrSets := calculateUserInstructionSets(r, hs)
 	var wg sync.WaitGroup
 	wg.Add(len(userInstrSets))
@@ -113,6 +126,26 @@ func (r *Runner) Run(hs b.Homeserver, hsURL string) (resErr error) {
 	return resErr
 }
 
+// registerAdmins registers the users in the homeserver with b.User.IsAdmin and stores their access tokens.
+func (r *Runner) registerAdmins(hs b.Homeserver, hsURL string) error {
+	registered := make(map[string]bool)
+	for _, user := range hs.Users {
+		if !user.IsAdmin || registered[user.Localpart] {
+			continue
+		}
+		if r.registerAdmin == nil {
+			return fmt.Errorf("%s.%s : user %s is an admin, but the homeserver runtime cannot register admins", r.blueprintName, hs.Name, user.Localpart)
+		}
+		accessToken, err := r.registerAdmin(hs.Name, hsURL, user.Localpart, "complement_meets_min_pasword_req_"+user.Localpart)
+		if err != nil {
+			return fmt.Errorf("%s.%s : failed to register admin %s: %w", r.blueprintName, hs.Name, user.Localpart, err)
+		}
+		r.lookup.Store("user_@"+user.Localpart+":"+hs.Name, accessToken)
+		registered[user.Localpart] = true
+	}
+	return nil
+}
+
 func (r *Runner) runInstructionSet(hs b.Homeserver, hsURL string, instrs []instruction) error {
 	contextStr := fmt.Sprintf("%s.%s", r.blueprintName, hs.Name)
 	i := 0
@@ -287,6 +320,10 @@ func calculateUserInstructionSets(r *Runner, hs b.Homeserver) [][]instruction {
 		if createdUsers[user.Localpart] {
 			// login instead as the device ID may be different
 			instrs = append(instrs, instructionLogin(hs, user))
+		} else if user.IsAdmin {
+			// registered by Run with registerAdmin, as this is not part of the client-server API
+			createdUsers[user.Localpart] = true
+			continue
 		} else {
 			instrs = append(instrs, instructionRegister(hs, user))
 		}
@@ -295,6 +332,9 @@ func calculateUserInstructionSets(r *Runner, hs b.Homeserver) [][]instruction {
 		if user.OneTimeKeys > 0 {
 			instrs = append(instrs, instructionOneTimeKeyUpload(hs, user))
 		}
+		if user.DeviceKeys != nil {
+			instrs = append(instrs, instructionDeviceKeysUpload(hs, user))
+		}
 		sets[i] = instrs
 	}
 	return sets
@@ -524,6 +564,29 @@ func instructionOneTimeKeyUpload(hs b.Homeserver, user b.User) instruction {
 	}
 }
 
+// instructionDeviceKeysUpload uploads the user's known device keys. Uploading the same keys again is a no-op, so
+// this is safe to repeat when the user logs in again.
+func instructionDeviceKeysUpload(hs b.Homeserver, user b.User) instruction {
+	userID := fmt.Sprintf("@%s:%s", user.Localpart, hs.Name)
+	body := map[string]interface{}{
+		"device_keys": map[string]interface{}{
+			"user_id":    userID,
+			"device_id":  *user.DeviceID,
+			"algorithms": []string{"m.olm.v1.curve25519-aes-sha2", "m.megolm.v1.aes-sha2"},
+			"keys":       user.DeviceKeys.Keys,
+		},
+	}
+	if len(user.DeviceKeys.OneTimeKeys) > 0 {
+		body["one_time_keys"] = user.DeviceKeys.OneTimeKeys
+	}
+	return instruction{
+		method:      "POST",
+		path:        "/_matrix/client/r0/keys/upload",
+		accessToken: fmt.Sprintf("user_@%s:%s", user.Localpart, hs.Name),
+		body:        body,
+	}
+}
+
 // indexFor hashes the input and returns a number % numEntries
 func indexFor(input string, numEntries int) int {
 	hh := fnv.New32a()
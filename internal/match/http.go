@@ -1,14 +1,64 @@
 package match
 
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/tidwall/gjson"
+)
+
 // HTTPResponse is the desired shape of the HTTP response. Can include any number of JSON matchers.
 type HTTPResponse struct {
 	StatusCode int
 	Headers    map[string]string
 	JSON       []JSON
+	// Matchers which need to look at both the response headers and the body
+	Response []Response
 }
 
+// Response will perform some matches on the HTTP response as a whole, returning an error on a mis-match.
+// The response body has already been read, so is given as `body`.
+type Response func(res *http.Response, body []byte) error
+
 // HTTPRequest is the desired shape of the HTTP request. Can include any number of JSON matchers.
 type HTTPRequest struct {
 	Headers map[string]string
 	JSON    []JSON
 }
+
+// MatrixError returns the desired shape of a Matrix error response: one with the given HTTP status code,
+// and the given `errcode` e.g "M_FORBIDDEN" in the body.
+func MatrixError(statusCode int, errcode string) HTTPResponse {
+	return HTTPResponse{
+		StatusCode: statusCode,
+		JSON: []JSON{
+			JSONKeyEqual("errcode", errcode),
+		},
+	}
+}
+
+// RetryAfterPresent returns a matcher which will check that the response tells the client how long to back off
+// for, either via `retry_after_ms` in the JSON body or via a Retry-After header with a number of seconds or an
+// HTTP date.
+func RetryAfterPresent() Response {
+	return func(res *http.Response, body []byte) error {
+		if retryAfterMs := gjson.GetBytes(body, "retry_after_ms"); retryAfterMs.Exists() {
+			if retryAfterMs.Type != gjson.Number {
+				return fmt.Errorf("retry_after_ms is not a number: %s", retryAfterMs.Raw)
+			}
+			return nil
+		}
+		header := res.Header.Get("Retry-After")
+		if header == "" {
+			return fmt.Errorf("no retry_after_ms or Retry-After header")
+		}
+		if _, err := strconv.Atoi(header); err == nil {
+			return nil
+		}
+		if _, err := http.ParseTime(header); err == nil {
+			return nil
+		}
+		return fmt.Errorf("Retry-After header is not a number of seconds or an HTTP date: %s", header)
+	}
+}
@@ -0,0 +1,38 @@
+package match
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRetryAfterPresent(t *testing.T) {
+	testCases := []struct {
+		name    string
+		header  string
+		body    string
+		wantErr bool
+	}{
+		{name: "retry_after_ms in the body", body: `{"retry_after_ms":1000}`},
+		{name: "Retry-After header in seconds", header: "10", body: `{}`},
+		{name: "Retry-After header as an HTTP date", header: time.Now().Add(time.Minute).UTC().Format(http.TimeFormat), body: `{}`},
+		{name: "non-numeric retry_after_ms", body: `{"retry_after_ms":"soon"}`, wantErr: true},
+		{name: "invalid Retry-After header", header: "soon", body: `{}`, wantErr: true},
+		{name: "no backoff hint", body: `{}`, wantErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res := &http.Response{Header: http.Header{}}
+			if tc.header != "" {
+				res.Header.Set("Retry-After", tc.header)
+			}
+			err := RetryAfterPresent()(res, []byte(tc.body))
+			if tc.wantErr && err == nil {
+				t.Fatalf("RetryAfterPresent accepted Retry-After %q and body %s", tc.header, tc.body)
+			}
+			if !tc.wantErr && err != nil {
+				t.Fatalf("RetryAfterPresent rejected Retry-After %q and body %s: %s", tc.header, tc.body, err)
+			}
+		})
+	}
+}
@@ -3,6 +3,7 @@ package match
 import (
 	"fmt"
 	"reflect"
+	"strings"
 
 	"github.com/tidwall/gjson"
 )
@@ -160,7 +161,8 @@ func JSONCheckOff(wantKey string, wantItems []interface{}, mapper func(gjson.Res
 }
 
 // JSONArrayEach returns a matcher which will check that `wantKey` is an array then loops over each
-// item calling `fn`. If `fn` returns an error, iterating stops and an error is returned.
+// item calling `fn`. Every item is checked: if `fn` returns an error for any of them, an error listing
+// each failure along with the index of the item is returned.
 func JSONArrayEach(wantKey string, fn func(gjson.Result) error) JSON {
 	return func(body []byte) error {
 		var res gjson.Result
@@ -176,31 +178,47 @@ func JSONArrayEach(wantKey string, fn func(gjson.Result) error) JSON {
 		if !res.IsArray() {
 			return fmt.Errorf("key '%s' is not an array", wantKey)
 		}
-		var err error
-		res.ForEach(func(_, val gjson.Result) bool {
-			err = fn(val)
-			return err == nil
-		})
-		return err
+		var failures []string
+		for i, val := range res.Array() {
+			if err := fn(val); err != nil {
+				failures = append(failures, fmt.Sprintf("[%d]: %s", i, err))
+			}
+		}
+		if len(failures) > 0 {
+			return fmt.Errorf("key '%s' has invalid items: %s", wantKey, strings.Join(failures, ", "))
+		}
+		return nil
 	}
 }
 
 // JSONMapEach returns a matcher which will check that `wantKey` is a map then loops over each
-// item calling `fn`. If `fn` returns an error, iterating stops and an error is returned.
+// item calling `fn`. Every item is checked: if `fn` returns an error for any of them, an error listing
+// each failure along with the key of the item is returned.
 func JSONMapEach(wantKey string, fn func(k, v gjson.Result) error) JSON {
 	return func(body []byte) error {
-		res := gjson.GetBytes(body, wantKey)
+		var res gjson.Result
+		if wantKey == "" {
+			res = gjson.ParseBytes(body)
+		} else {
+			res = gjson.GetBytes(body, wantKey)
+		}
+
 		if !res.Exists() {
 			return fmt.Errorf("missing key '%s'", wantKey)
 		}
 		if !res.IsObject() {
 			return fmt.Errorf("key '%s' is not an object", wantKey)
 		}
-		var err error
+		var failures []string
 		res.ForEach(func(key, val gjson.Result) bool {
-			err = fn(key, val)
-			return err == nil
+			if err := fn(key, val); err != nil {
+				failures = append(failures, fmt.Sprintf("'%s': %s", key.Str, err))
+			}
+			return true
 		})
-		return err
+		if len(failures) > 0 {
+			return fmt.Errorf("key '%s' has invalid items: %s", wantKey, strings.Join(failures, ", "))
+		}
+		return nil
 	}
 }
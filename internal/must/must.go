@@ -98,9 +98,24 @@ func MatchResponse(t *testing.T, res *http.Response, m match.HTTPResponse) []byt
 			}
 		}
 	}
+	for _, rm := range m.Response {
+		if err = rm(res, body); err != nil {
+			t.Fatalf("MatchResponse %s - %s", err, contextStr)
+		}
+	}
 	return body
 }
 
+// MatchGJSON performs JSON assertions on a gjson.Result, such as one returned by the client helpers.
+func MatchGJSON(t *testing.T, jsonResult gjson.Result, matchers ...match.JSON) {
+	t.Helper()
+	for _, jm := range matchers {
+		if err := jm([]byte(jsonResult.Raw)); err != nil {
+			t.Fatalf("MatchGJSON %s - %s", err, jsonResult.Raw)
+		}
+	}
+}
+
 // EqualStr ensures that got==want else logs an error.
 func EqualStr(t *testing.T, got, want, msg string) {
 	t.Helper()
@@ -0,0 +1,68 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/client"
+	"github.com/matrix-org/complement/internal/match"
+	"github.com/matrix-org/complement/internal/must"
+)
+
+// Test that an application service can register a user in its namespace and then
+// act as that user by masquerading with the `user_id` query parameter.
+func TestAppServiceMasquerade(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintHSWithApplicationService)
+	defer deployment.Destroy(t)
+
+	as := deployment.AppServiceClient(t, "my_as_id")
+	must.EqualStr(t, as.UserID, "@the-bridge-user:hs1", "AppServiceClient has the wrong sender user ID")
+
+	virtualUserID := "@bridged_user:hs1"
+	as.MustDoFunc(
+		t,
+		"POST",
+		[]string{"_matrix", "client", "r0", "register"},
+		client.WithJSONBody(t, map[string]interface{}{"type": "m.login.application_service", "username": "bridged_user"}),
+	)
+
+	as.MasqueradeUserID = virtualUserID
+	res := as.MustDoFunc(t, "GET", []string{"_matrix", "client", "r0", "account", "whoami"})
+	must.MatchResponse(t, res, match.HTTPResponse{
+		JSON: []match.JSON{
+			match.JSONKeyEqual("user_id", virtualUserID),
+		},
+	})
+}
+
+// Test that events from users in the application service's namespace are pushed
+// to the application service in transactions.
+func TestAppServiceReceivesTransactions(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintHSWithApplicationService)
+	defer deployment.Destroy(t)
+
+	inbox := deployment.AppServiceInbox(t, "my_as_id")
+	defer inbox.Close()
+
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	roomID := alice.CreateRoom(t, map[string]interface{}{
+		"preset": "public_chat",
+	})
+	eventID := alice.SendEventSynced(t, roomID, b.Event{
+		Type: "m.room.message",
+		Content: map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    "Hello appservice",
+		},
+	})
+
+	start := time.Now()
+	for {
+		ev := inbox.Next(t, 5*time.Second-time.Since(start))
+		if ev.Get("event_id").Str == eventID {
+			must.EqualStr(t, ev.Get("content.body").Str, "Hello appservice", "wrong event content pushed to appservice")
+			break
+		}
+	}
+}
@@ -0,0 +1,43 @@
+// +build !dendrite_blacklist
+
+// Rationale for being included in Dendrite's blacklist: the Dendrite image does not run under libfaketime.
+
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/b"
+)
+
+// Test that Deployment.SetClockOffset shifts the time used by the homeserver for new events.
+func TestClockOffset(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintAliceClockOffset)
+	defer deployment.Destroy(t)
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+
+	roomID := alice.CreateRoom(t, map[string]interface{}{})
+	offset := 24 * time.Hour
+	deployment.SetClockOffset(t, "hs1", offset)
+
+	eventID := alice.SendEventSynced(t, roomID, b.Event{
+		Type: "m.room.message",
+		Content: map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    "Hello from the future",
+		},
+	})
+	alice.SyncUntilTimelineHas(t, roomID, func(ev gjson.Result) bool {
+		if ev.Get("event_id").Str != eventID {
+			return false
+		}
+		sentAt := time.Unix(0, ev.Get("origin_server_ts").Int()*int64(time.Millisecond))
+		if skew := sentAt.Sub(time.Now()); skew < offset-time.Hour {
+			t.Fatalf("event origin_server_ts is %s ahead of now, want about %s", skew, offset)
+		}
+		return true
+	})
+}
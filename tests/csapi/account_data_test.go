@@ -0,0 +1,55 @@
+package csapi_tests
+
+import (
+	"testing"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/match"
+)
+
+func TestAccountData(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintAlice)
+	defer deployment.Destroy(t)
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+
+	roomID := alice.CreateRoom(t, map[string]interface{}{})
+
+	// sytest: Can add account data
+	// sytest: Can get account data without syncing
+	t.Run("Can add and get global account data", func(t *testing.T) {
+		alice.SetGlobalAccountData(t, "org.matrix.complement.global", map[string]interface{}{
+			"foo": "bar",
+		})
+		content := alice.GetGlobalAccountData(t, "org.matrix.complement.global")
+		if err := match.JSONKeyEqual("foo", "bar")([]byte(content.Raw)); err != nil {
+			t.Fatalf("GetGlobalAccountData: %s", err)
+		}
+	})
+
+	// sytest: Can add account data to room
+	// sytest: Can get room account data without syncing
+	t.Run("Can add and get room account data", func(t *testing.T) {
+		alice.SetRoomAccountData(t, roomID, "org.matrix.complement.room", map[string]interface{}{
+			"foo": "baz",
+		})
+		content := alice.GetRoomAccountData(t, roomID, "org.matrix.complement.room")
+		if err := match.JSONKeyEqual("foo", "baz")([]byte(content.Raw)); err != nil {
+			t.Fatalf("GetRoomAccountData: %s", err)
+		}
+	})
+
+	// sytest: Latest account data appears in v2 /sync
+	t.Run("Latest account data appears in /sync", func(t *testing.T) {
+		alice.SetGlobalAccountData(t, "org.matrix.complement.latest", map[string]interface{}{"n": 1})
+		alice.SetGlobalAccountData(t, "org.matrix.complement.latest", map[string]interface{}{"n": 2})
+		alice.SyncUntilAccountData(t, "org.matrix.complement.latest", func(ev gjson.Result) bool {
+			return ev.Get("content.n").Int() == 2
+		})
+		alice.SetRoomAccountData(t, roomID, "org.matrix.complement.latest", map[string]interface{}{"n": 3})
+		alice.SyncUntilRoomAccountData(t, roomID, "org.matrix.complement.latest", func(ev gjson.Result) bool {
+			return ev.Get("content.n").Int() == 3
+		})
+	})
+}
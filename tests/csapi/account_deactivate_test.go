@@ -1,7 +1,6 @@
 package csapi_tests
 
 import (
-	"net/http"
 	"testing"
 
 	"github.com/matrix-org/complement/internal/b"
@@ -18,7 +17,7 @@ func TestDeactivateAccount(t *testing.T) {
 	unauthedClient := deployment.Client(t, "hs1", "")
 	// sytest: Can't deactivate account with wrong password
 	t.Run("Can't deactivate account with wrong password", func(t *testing.T) {
-		res := deactivateAccount(t, authedClient, "wrong_password")
+		res := authedClient.DoDeactivateAccount(t, "wrong_password", false)
 		must.MatchResponse(t, res, match.HTTPResponse{
 			StatusCode: 401,
 			JSON: []match.JSON{
@@ -28,11 +27,7 @@ func TestDeactivateAccount(t *testing.T) {
 	})
 	// sytest: Can deactivate account
 	t.Run("Can deactivate account", func(t *testing.T) {
-
-		res := deactivateAccount(t, authedClient, password)
-		must.MatchResponse(t, res, match.HTTPResponse{
-			StatusCode: 200,
-		})
+		authedClient.DeactivateAccount(t, password, false)
 	})
 	// sytest: After deactivating account, can't log in with password
 	t.Run("After deactivating account, can't log in with password", func(t *testing.T) {
@@ -52,17 +47,41 @@ func TestDeactivateAccount(t *testing.T) {
 	})
 }
 
-func deactivateAccount(t *testing.T, authedClient *client.CSAPI, password string) *http.Response {
-	t.Helper()
-	reqBody := client.WithJSONBody(t, map[string]interface{}{
-		"auth": map[string]interface{}{
-			"type":     "m.login.password",
-			"user":     authedClient.UserID,
-			"password": password,
-		},
-	})
+func TestDeactivateAccountLeavesRooms(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintAlice)
+	defer deployment.Destroy(t)
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	password := "superuser"
+	bob := deployment.RegisterUser(t, "hs1", "test_deactivate_leaves_rooms", password)
+
+	var roomIDs []string
+	for i := 0; i < 2; i++ {
+		roomID := alice.CreateRoom(t, map[string]interface{}{
+			"preset": "public_chat",
+		})
+		bob.JoinRoom(t, roomID, nil)
+		roomIDs = append(roomIDs, roomID)
+	}
+
+	bob.DeactivateAccount(t, password, false)
+
+	// the access token no longer works
+	res := bob.DoFunc(t, "GET", []string{"_matrix", "client", "r0", "account", "whoami"})
+	must.MatchResponse(t, res, match.MatrixError(401, "M_UNKNOWN_TOKEN"))
+
+	// and the user has left every room they were in
+	alice.SyncUntilLeftRooms(t, bob.UserID, roomIDs)
+}
+
+func TestDeactivateAccountWithErase(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintAlice)
+	defer deployment.Destroy(t)
+	password := "superuser"
+	bob := deployment.RegisterUser(t, "hs1", "test_deactivate_erase", password)
 
-	res := authedClient.DoFunc(t, "POST", []string{"_matrix", "client", "r0", "account", "deactivate"}, reqBody)
+	bob.DeactivateAccount(t, password, true)
 
-	return res
+	// the access token no longer works
+	res := bob.DoFunc(t, "GET", []string{"_matrix", "client", "r0", "account", "whoami"})
+	must.MatchResponse(t, res, match.MatrixError(401, "M_UNKNOWN_TOKEN"))
 }
@@ -0,0 +1,49 @@
+package csapi_tests
+
+import (
+	"testing"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/match"
+	"github.com/matrix-org/complement/internal/must"
+)
+
+func TestLogout(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintAlice)
+	defer deployment.Destroy(t)
+	deployment.RegisterUser(t, "hs1", "test_logout_user", "superuser")
+
+	// sytest: Can logout current device
+	t.Run("Can logout current device", func(t *testing.T) {
+		session := createSession(t, deployment, "test_logout_user", "superuser")
+		otherSession := createSession(t, deployment, "test_logout_user", "superuser")
+		accessToken := session.AccessToken
+
+		session.Logout(t)
+
+		session.AccessToken = accessToken
+		must.MatchResponse(t, session.WhoAmIError(t), match.HTTPResponse{
+			StatusCode: 401,
+			JSON: []match.JSON{
+				match.JSONKeyEqual("errcode", "M_UNKNOWN_TOKEN"),
+			},
+		})
+		// other devices are unaffected
+		otherSession.WhoAmI(t)
+	})
+
+	// sytest: Can logout all devices
+	t.Run("Can logout all devices", func(t *testing.T) {
+		session := createSession(t, deployment, "test_logout_user", "superuser")
+		otherSession := createSession(t, deployment, "test_logout_user", "superuser")
+
+		session.LogoutAll(t)
+
+		must.MatchResponse(t, otherSession.WhoAmIError(t), match.HTTPResponse{
+			StatusCode: 401,
+			JSON: []match.JSON{
+				match.JSONKeyEqual("errcode", "M_UNKNOWN_TOKEN"),
+			},
+		})
+	})
+}
@@ -0,0 +1,37 @@
+package csapi_tests
+
+import (
+	"testing"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/match"
+	"github.com/matrix-org/complement/internal/must"
+)
+
+func TestWhoAmI(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintAlice)
+	defer deployment.Destroy(t)
+	deployment.RegisterUser(t, "hs1", "test_whoami_user", "superuser")
+	session := createSession(t, deployment, "test_whoami_user", "superuser")
+
+	t.Run("GET /account/whoami returns the user ID and device ID", func(t *testing.T) {
+		userID, deviceID := session.WhoAmI(t)
+		if userID != session.UserID {
+			t.Errorf("whoami returned user ID %s, want %s", userID, session.UserID)
+		}
+		if deviceID == "" {
+			t.Errorf("whoami returned no device ID")
+		}
+	})
+
+	t.Run("GET /account/whoami rejects an unknown access token", func(t *testing.T) {
+		unknown := deployment.Client(t, "hs1", "")
+		unknown.AccessToken = "not_a_real_token"
+		must.MatchResponse(t, unknown.WhoAmIError(t), match.HTTPResponse{
+			StatusCode: 401,
+			JSON: []match.JSON{
+				match.JSONKeyEqual("errcode", "M_UNKNOWN_TOKEN"),
+			},
+		})
+	})
+}
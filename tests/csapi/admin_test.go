@@ -0,0 +1,40 @@
+package csapi_tests
+
+import (
+	"testing"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/match"
+	"github.com/matrix-org/complement/internal/must"
+)
+
+func TestAdminAPI(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintAliceBobAndAdmin)
+	defer deployment.Destroy(t)
+	admin := deployment.AdminClient(t, "hs1")
+
+	t.Run("Admins can list the media in a room", func(t *testing.T) {
+		alice := deployment.Client(t, "hs1", "@alice:hs1")
+		roomID := alice.CreateRoom(t, map[string]interface{}{})
+		mxcURI := alice.UploadContent(t, []byte("room media"), "media.txt", "text/plain")
+		alice.SendEventSynced(t, roomID, b.Event{
+			Type: "m.room.message",
+			Content: map[string]interface{}{
+				"msgtype": "m.file",
+				"body":    "media.txt",
+				"url":     mxcURI,
+			},
+		})
+		media := admin.AdminListRoomMedia(t, roomID)
+		if len(media) != 1 || media[0] != mxcURI {
+			t.Errorf("AdminListRoomMedia: got %v want [%s]", media, mxcURI)
+		}
+	})
+
+	t.Run("Admins can deactivate users", func(t *testing.T) {
+		bob := deployment.Client(t, "hs1", "@bob:hs1")
+		admin.AdminDeactivateUser(t, bob.UserID)
+		res := bob.DoFunc(t, "GET", []string{"_matrix", "client", "r0", "account", "whoami"})
+		must.MatchResponse(t, res, match.MatrixError(401, "M_UNKNOWN_TOKEN"))
+	})
+}
@@ -120,4 +120,20 @@ func TestDeviceManagement(t *testing.T) {
 			StatusCode: 404,
 		})
 	})
+
+	// sytest: DELETE /device/{deviceId}
+	t.Run("DELETE /device/{deviceId}", func(t *testing.T) {
+		deviceID := "login_device_2"
+		authedClient.DeleteDevice(t, deviceID, "superuser")
+
+		res := authedClient.DoFunc(t, "GET", []string{"_matrix", "client", "r0", "devices", deviceID})
+		must.MatchResponse(t, res, match.HTTPResponse{
+			StatusCode: 404,
+		})
+		for _, device := range authedClient.GetDevices(t) {
+			if device.Get("device_id").Str == deviceID {
+				t.Errorf("/devices still returns deleted device %s", deviceID)
+			}
+		}
+	})
 }
@@ -76,5 +76,46 @@ func TestRoomAlias(t *testing.T) {
 				},
 			})
 		})
+		// sytest: DELETE /directory/room/:room_alias removes alias
+		t.Run("DELETE /directory/room/:room_alias removes alias", func(t *testing.T) {
+			t.Parallel()
+			roomID := authedClient.CreateRoom(t, map[string]interface{}{
+				"visibility": "public",
+				"preset":     "public_chat",
+			})
+
+			roomAlias := "#room_alias_delete:hs1"
+			authedClient.SetRoomAlias(t, roomAlias, roomID)
+			if gotRoomID, _ := authedClient.ResolveAlias(t, roomAlias); gotRoomID != roomID {
+				t.Fatalf("alias resolved to %s, want %s", gotRoomID, roomID)
+			}
+			authedClient.DeleteRoomAlias(t, roomAlias)
+
+			res := authedClient.DoFunc(t, "GET", []string{"_matrix", "client", "r0", "directory", "room", roomAlias})
+			must.MatchResponse(t, res, match.HTTPResponse{
+				StatusCode: 404,
+			})
+		})
+		t.Run("Canonical alias and alt aliases resolve to the room", func(t *testing.T) {
+			t.Parallel()
+			roomID := authedClient.CreateRoom(t, map[string]interface{}{
+				"preset": "public_chat",
+			})
+
+			roomAlias := "#room_alias_canonical:hs1"
+			altAlias := "#room_alias_canonical_alt:hs1"
+			authedClient.SetRoomAlias(t, roomAlias, roomID)
+			authedClient.SetRoomAlias(t, altAlias, roomID)
+			authedClient.SetCanonicalAlias(t, roomID, roomAlias, []string{altAlias})
+
+			res := authedClient.MustDoFunc(t, "GET", []string{"_matrix", "client", "r0", "rooms", roomID, "state", "m.room.canonical_alias"})
+			must.MatchResponse(t, res, match.HTTPResponse{
+				JSON: []match.JSON{
+					match.JSONKeyEqual("alias", roomAlias),
+					match.JSONKeyEqual("alt_aliases", []interface{}{altAlias}),
+				},
+			})
+			authedClient.AssertCanonicalAliasResolves(t, roomID)
+		})
 	})
 }
@@ -113,36 +113,22 @@ func TestRoomCreate(t *testing.T) {
 		// sytest: POST /createRoom rejects attempts to create rooms with numeric versions
 		t.Run("POST /createRoom rejects attempts to create rooms with numeric versions", func(t *testing.T) {
 			t.Parallel()
-			reqBody := client.WithJSONBody(t, map[string]interface{}{
+			res := authedClient.CreateRoomError(t, map[string]interface{}{
 				"visibility":   "private",
 				"room_version": 1,
 				"preset":       "public_chat",
 			})
-			res := authedClient.DoFunc(t, "POST", []string{"_matrix", "client", "r0", "createRoom"}, reqBody)
-			must.MatchResponse(t, res, match.HTTPResponse{
-				StatusCode: 400,
-				JSON: []match.JSON{
-					match.JSONKeyPresent("errcode"),
-					match.JSONKeyEqual("errcode", "M_BAD_JSON"),
-				},
-			})
+			must.MatchResponse(t, res, match.MatrixError(400, "M_BAD_JSON"))
 		})
 		// sytest: POST /createRoom rejects attempts to create rooms with unknown versions
 		t.Run("POST /createRoom rejects attempts to create rooms with unknown versions", func(t *testing.T) {
 			t.Parallel()
-			reqBody := client.WithJSONBody(t, map[string]interface{}{
+			res := authedClient.CreateRoomError(t, map[string]interface{}{
 				"visibility":   "private",
 				"room_version": "ahfgwjyerhgiuveisbruvybseyrugvi",
 				"preset":       "public_chat",
 			})
-			res := authedClient.DoFunc(t, "POST", []string{"_matrix", "client", "r0", "createRoom"}, reqBody)
-			must.MatchResponse(t, res, match.HTTPResponse{
-				StatusCode: 400,
-				JSON: []match.JSON{
-					match.JSONKeyPresent("errcode"),
-					match.JSONKeyEqual("errcode", "M_UNSUPPORTED_ROOM_VERSION"),
-				},
-			})
+			must.MatchResponse(t, res, match.MatrixError(400, "M_UNSUPPORTED_ROOM_VERSION"))
 		})
 	})
 }
@@ -262,6 +262,31 @@ func TestRoomState(t *testing.T) {
 				},
 			})
 		})
+		t.Run("Room name, topic and avatar can be set and read back", func(t *testing.T) {
+			t.Parallel()
+
+			roomID := authedClient.CreateRoom(t, map[string]interface{}{
+				"visibility": "public",
+				"preset":     "public_chat",
+			})
+			if got := authedClient.GetRoomAvatar(t, roomID); got != "" {
+				t.Errorf("GetRoomAvatar before it is set: got %q want \"\"", got)
+			}
+
+			authedClient.SetRoomName(t, roomID, "room_helper_name")
+			authedClient.SetRoomTopic(t, roomID, "room_helper_topic")
+			authedClient.SetRoomAvatar(t, roomID, "mxc://hs1/room_helper_avatar")
+
+			if got := authedClient.GetRoomName(t, roomID); got != "room_helper_name" {
+				t.Errorf("GetRoomName: got %q want %q", got, "room_helper_name")
+			}
+			if got := authedClient.GetRoomTopic(t, roomID); got != "room_helper_topic" {
+				t.Errorf("GetRoomTopic: got %q want %q", got, "room_helper_topic")
+			}
+			if got := authedClient.GetRoomAvatar(t, roomID); got != "mxc://hs1/room_helper_avatar" {
+				t.Errorf("GetRoomAvatar: got %q want %q", got, "mxc://hs1/room_helper_avatar")
+			}
+		})
 		// sytest: GET /rooms/:room_id/state fetches entire room state
 		t.Run("GET /rooms/:room_id/state fetches entire room state", func(t *testing.T) {
 			t.Parallel()
@@ -2,10 +2,9 @@ package csapi_tests
 
 import (
 	"fmt"
+	"net/url"
 	"testing"
 
-	"github.com/tidwall/gjson"
-
 	"github.com/matrix-org/complement/internal/b"
 	"github.com/matrix-org/complement/internal/client"
 	"github.com/matrix-org/complement/internal/match"
@@ -32,18 +31,9 @@ func TestE2EKeyBackupReplaceRoomKeyRules(t *testing.T) {
 	alice := deployment.Client(t, "hs1", userID)
 
 	// make a new key backup
-	res := alice.MustDoFunc(t, "POST", []string{"_matrix", "client", "r0", "room_keys", "version"}, client.WithJSONBody(t, map[string]interface{}{
-		"algorithm": "m.megolm_backup.v1",
-		"auth_data": map[string]interface{}{
-			"foo": "bar",
-		},
-	}))
-	defer res.Body.Close()
-	body := must.ParseJSON(t, res.Body)
-	backupVersion := gjson.GetBytes(body, "version").Str
-	if backupVersion == "" {
-		t.Fatalf("failed to get 'version' key from response: %s", string(body))
-	}
+	backupVersion := alice.CreateKeyBackupVersion(t, "m.megolm_backup.v1", map[string]interface{}{
+		"foo": "bar",
+	})
 
 	testCases := []struct {
 		sessionID           string      // change this for each test case to namespace tests correctly
@@ -123,37 +113,75 @@ func TestE2EKeyBackupReplaceRoomKeyRules(t *testing.T) {
 			t.Run(fmt.Sprintf("%+v", tc.input), func(t *testing.T) {
 				t.Parallel()
 				// insert the key that will be tested against
-				alice.MustDoFunc(t, "PUT", []string{"_matrix", "client", "r0", "room_keys", "keys", roomID, tc.sessionID},
-					client.WithQueries(map[string][]string{"version": {backupVersion}}), client.WithJSONBody(t, map[string]interface{}{
-						"first_message_index": tc.input.firstMessageIndex,
-						"forwarded_count":     tc.input.forwardedCount,
-						"is_verified":         tc.input.isVerified,
-						"session_data":        map[string]interface{}{"a": "b"},
-					}),
-				)
+				alice.PutBackupKeys(t, backupVersion, roomID, tc.sessionID, map[string]interface{}{
+					"first_message_index": tc.input.firstMessageIndex,
+					"forwarded_count":     tc.input.forwardedCount,
+					"is_verified":         tc.input.isVerified,
+					"session_data":        map[string]interface{}{"a": "b"},
+				})
 				// now check that each key in keysThatDontReplace do not replace this key
 				for _, testKey := range tc.keysThatDontReplace {
-					alice.MustDoFunc(t, "PUT", []string{"_matrix", "client", "r0", "room_keys", "keys", roomID, tc.sessionID},
-						client.WithQueries(map[string][]string{"version": {backupVersion}}), client.WithJSONBody(t, map[string]interface{}{
-							"first_message_index": testKey.firstMessageIndex,
-							"forwarded_count":     testKey.forwardedCount,
-							"is_verified":         testKey.isVerified,
-							"session_data":        map[string]interface{}{"a": "b"},
-						}),
-					)
-					checkResp := alice.MustDoFunc(t, "GET", []string{"_matrix", "client", "r0", "room_keys", "keys", roomID, tc.sessionID},
-						client.WithQueries(map[string][]string{"version": {backupVersion}}),
-					)
-					must.MatchResponse(t, checkResp, match.HTTPResponse{
-						StatusCode: 200,
-						JSON: []match.JSON{
-							match.JSONKeyEqual("first_message_index", tc.input.firstMessageIndex),
-							match.JSONKeyEqual("forwarded_count", tc.input.forwardedCount),
-							match.JSONKeyEqual("is_verified", tc.input.isVerified),
-						},
+					alice.PutBackupKeys(t, backupVersion, roomID, tc.sessionID, map[string]interface{}{
+						"first_message_index": testKey.firstMessageIndex,
+						"forwarded_count":     testKey.forwardedCount,
+						"is_verified":         testKey.isVerified,
+						"session_data":        map[string]interface{}{"a": "b"},
 					})
+					keys := alice.GetBackupKeys(t, backupVersion)
+					key := keys.Get("rooms." + client.GjsonEscape(roomID) + ".sessions." + client.GjsonEscape(tc.sessionID))
+					if key.Get("first_message_index").Num != tc.input.firstMessageIndex ||
+						key.Get("forwarded_count").Num != tc.input.forwardedCount ||
+						key.Get("is_verified").Bool() != tc.input.isVerified {
+						t.Fatalf("key %+v replaced key %+v, backed up key is now %s", testKey, tc.input, key.Raw)
+					}
 				}
 			})
 		}
 	})
 }
+
+func TestKeyBackup(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintAlice)
+	defer deployment.Destroy(t)
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+
+	algorithm := "m.megolm_backup.v1.curve25519-aes-sha2"
+	authData := map[string]interface{}{
+		"public_key": "abcdefg",
+	}
+	roomID := "!not_a_real_room:hs1"
+	sessionID := "session_id"
+	keyData := map[string]interface{}{
+		"first_message_index": 3,
+		"forwarded_count":     0,
+		"is_verified":         false,
+		"session_data": map[string]interface{}{
+			"ciphertext": "not+really+encrypted",
+		},
+	}
+
+	// sytest: Can backup keys
+	t.Run("Can backup keys", func(t *testing.T) {
+		version := alice.CreateKeyBackupVersion(t, algorithm, authData)
+		alice.PutBackupKeys(t, version, roomID, sessionID, keyData)
+
+		keys := alice.GetBackupKeys(t, version)
+		key := keys.Get("rooms." + client.GjsonEscape(roomID) + ".sessions." + client.GjsonEscape(sessionID))
+		if got := key.Get("first_message_index").Int(); got != 3 {
+			t.Fatalf("backed up key has first_message_index %d, want 3: %s", got, keys.Raw)
+		}
+	})
+
+	// sytest: Will not back up to an old backup version
+	t.Run("Will not back up to an old backup version", func(t *testing.T) {
+		oldVersion := alice.CreateKeyBackupVersion(t, algorithm, authData)
+		newVersion := alice.CreateKeyBackupVersion(t, algorithm, authData)
+		if oldVersion == newVersion {
+			t.Fatalf("creating a backup version returned the same version %s", newVersion)
+		}
+
+		res := alice.DoFunc(t, "PUT", []string{"_matrix", "client", "r0", "room_keys", "keys", roomID, sessionID},
+			client.WithQueries(url.Values{"version": []string{oldVersion}}), client.WithJSONBody(t, keyData))
+		must.MatchResponse(t, res, match.MatrixError(403, "M_WRONG_ROOM_KEYS_VERSION"))
+	})
+}
@@ -0,0 +1,39 @@
+package csapi_tests
+
+import (
+	"testing"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/client"
+)
+
+func TestE2EKeys(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintAliceWithDeviceKeys)
+	defer deployment.Destroy(t)
+	bob := deployment.Client(t, "hs1", "@bob:hs1")
+
+	// sytest: Can query device keys using POST
+	t.Run("Can query device keys using POST", func(t *testing.T) {
+		res := bob.QueryKeys(t, []string{"@alice:hs1"})
+		keys := res.Get("device_keys." + client.GjsonEscape("@alice:hs1") + ".ALICEDEVICE.keys")
+		if got := keys.Get(client.GjsonEscape("ed25519:ALICEDEVICE")).Str; got != "ed25519+key" {
+			t.Errorf("ed25519 key: got %q want %q in %s", got, "ed25519+key", res.Raw)
+		}
+		if got := keys.Get(client.GjsonEscape("curve25519:ALICEDEVICE")).Str; got != "curve25519+key" {
+			t.Errorf("curve25519 key: got %q want %q in %s", got, "curve25519+key", res.Raw)
+		}
+	})
+
+	// sytest: Can claim one time key using POST
+	t.Run("Can claim one time key using POST", func(t *testing.T) {
+		res := bob.ClaimKeys(t, map[string]map[string]string{
+			"@alice:hs1": {
+				"ALICEDEVICE": "signed_curve25519",
+			},
+		})
+		otk := res.Get("one_time_keys." + client.GjsonEscape("@alice:hs1") + ".ALICEDEVICE." + client.GjsonEscape("signed_curve25519:AAAAHQ"))
+		if got := otk.Get("key").Str; got != "one+time+key" {
+			t.Errorf("one-time key: got %q want %q in %s", got, "one+time+key", res.Raw)
+		}
+	})
+}
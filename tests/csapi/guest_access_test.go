@@ -0,0 +1,66 @@
+// +build !dendrite_blacklist
+
+// Rationale for being included in Dendrite's blacklist: Dendrite does not support guest access.
+
+package csapi_tests
+
+import (
+	"testing"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/match"
+	"github.com/matrix-org/complement/internal/must"
+)
+
+func TestGuestAccess(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintAliceGuestAccess)
+	defer deployment.Destroy(t)
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	guest := deployment.RegisterGuest(t, "hs1")
+
+	// sytest: Guest users can join guest_access rooms
+	// sytest: Guest users can send messages to guest_access rooms if joined
+	t.Run("Guest users can join and send messages to guest_access rooms", func(t *testing.T) {
+		roomID := alice.CreateRoom(t, map[string]interface{}{
+			"preset": "public_chat",
+			"initial_state": []map[string]interface{}{
+				{
+					"type":      "m.room.guest_access",
+					"state_key": "",
+					"content": map[string]interface{}{
+						"guest_access": "can_join",
+					},
+				},
+			},
+		})
+		guest.JoinRoom(t, roomID, nil)
+		guest.SendEventSynced(t, roomID, b.Event{
+			Type: "m.room.message",
+			Content: map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    "Hello from a guest",
+			},
+		})
+	})
+
+	t.Run("Guest users cannot join rooms which forbid guest access", func(t *testing.T) {
+		roomID := alice.CreateRoom(t, map[string]interface{}{
+			"preset": "public_chat",
+		})
+		res := guest.DoFunc(t, "POST", []string{"_matrix", "client", "r0", "join", roomID})
+		must.MatchResponse(t, res, match.HTTPResponse{
+			StatusCode: 403,
+			JSON: []match.JSON{
+				match.JSONKeyEqual("errcode", "M_FORBIDDEN"),
+			},
+		})
+	})
+
+	// sytest: Guest user can set display names
+	t.Run("Guest user can set display names", func(t *testing.T) {
+		guest.SetDisplayName(t, "Guest")
+		if got := guest.GetProfile(t, guest.UserID).Get("displayname").Str; got != "Guest" {
+			t.Errorf("guest display name is '%s', want 'Guest'", got)
+		}
+	})
+}
@@ -0,0 +1,104 @@
+package csapi_tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/client"
+	"github.com/matrix-org/complement/internal/match"
+)
+
+func TestPushNotifications(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintOneToOneRoom)
+	defer deployment.Destroy(t)
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	bob := deployment.Client(t, "hs1", "@bob:hs1")
+
+	gateway := deployment.PushGateway(t)
+	defer gateway.Close()
+
+	bob.SetPusher(t, map[string]interface{}{
+		"kind":                "http",
+		"app_id":              "org.matrix.complement",
+		"app_display_name":    "Complement",
+		"pushkey":             "complement_push_key",
+		"device_display_name": "Complement device",
+		"lang":                "en",
+		"data": map[string]interface{}{
+			"url": gateway.URL,
+		},
+	})
+
+	// sytest: Test that a message is pushed
+	t.Run("Test that a message is pushed", func(t *testing.T) {
+		roomID := alice.CreateRoom(t, map[string]interface{}{
+			"preset": "public_chat",
+		})
+		bob.JoinRoom(t, roomID, nil)
+		eventID := alice.SendEventSynced(t, roomID, b.Event{
+			Type: "m.room.message",
+			Content: map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    "Push me",
+			},
+		})
+
+		// skip notifications for earlier events such as the room creation
+		for {
+			notification := gateway.Next(t, 5*time.Second)
+			if notification.Get("event_id").Str != eventID {
+				continue
+			}
+			if notification.Get("room_id").Str != roomID {
+				t.Errorf("notification has room_id %s, want %s", notification.Get("room_id").Str, roomID)
+			}
+			if notification.Get("counts.unread").Int() < 1 {
+				t.Errorf("notification has no unread count: %s", notification.Raw)
+			}
+			if notification.Get("devices.0.pushkey").Str != "complement_push_key" {
+				t.Errorf("notification has wrong pushkey: %s", notification.Raw)
+			}
+			break
+		}
+	})
+
+	// sytest: Notifications can be viewed with GET /notifications
+	t.Run("Notifications can be viewed with GET /notifications", func(t *testing.T) {
+		roomID := alice.CreateRoom(t, map[string]interface{}{
+			"preset": "public_chat",
+		})
+		bob.JoinRoom(t, roomID, nil)
+		plainEventID := alice.SendEventSynced(t, roomID, b.Event{
+			Type: "m.room.message",
+			Content: map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    "Not a highlight",
+			},
+		})
+		// mentioning bob's display name highlights the message
+		highlightEventID := alice.SendEventSynced(t, roomID, b.Event{
+			Type: "m.room.message",
+			Content: map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    "Hello Bob",
+			},
+		})
+
+		res := bob.GetNotifications(t, client.NotificationsReq{Limit: 10})
+		if err := match.JSONCheckOffAllowUnwanted("notifications", []interface{}{plainEventID, highlightEventID}, func(r gjson.Result) interface{} {
+			return r.Get("event.event_id").Str
+		}, nil)([]byte(res.Raw)); err != nil {
+			t.Errorf("GET /notifications: %s", err)
+		}
+
+		res = bob.GetNotifications(t, client.NotificationsReq{Only: "highlight"})
+		if err := match.JSONCheckOff("notifications", []interface{}{highlightEventID}, func(r gjson.Result) interface{} {
+			return r.Get("event.event_id").Str
+		}, nil)([]byte(res.Raw)); err != nil {
+			t.Errorf("GET /notifications?only=highlight: %s", err)
+		}
+	})
+}
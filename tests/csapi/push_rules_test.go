@@ -0,0 +1,85 @@
+package csapi_tests
+
+import (
+	"testing"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/match"
+	"github.com/matrix-org/complement/internal/must"
+)
+
+func TestPushRules(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintAlice)
+	defer deployment.Destroy(t)
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+
+	t.Run("Default push rules exist", func(t *testing.T) {
+		rules := alice.GetPushRules(t)
+		if !hasPushRule(rules, "global.override", ".m.rule.master") {
+			t.Fatalf("default override rule .m.rule.master not found: %s", rules.Raw)
+		}
+	})
+
+	// sytest: Can add global push rule for room
+	t.Run("Can add global push rule for room", func(t *testing.T) {
+		roomID := alice.CreateRoom(t, map[string]interface{}{})
+		alice.SetPushRule(t, "global", "room", roomID, map[string]interface{}{
+			"actions": []interface{}{"dont_notify"},
+		})
+		if !hasPushRule(alice.GetPushRules(t), "global.room", roomID) {
+			t.Fatalf("room push rule %s not found", roomID)
+		}
+	})
+
+	// sytest: Can disable a push rule
+	t.Run("Can disable a push rule", func(t *testing.T) {
+		alice.SetPushRule(t, "global", "content", "complement_disable", map[string]interface{}{
+			"actions": []interface{}{"notify"},
+			"pattern": "complement",
+		})
+		alice.SetPushRuleEnabled(t, "global", "content", "complement_disable", false)
+		res := alice.MustDoFunc(t, "GET", []string{"_matrix", "client", "r0", "pushrules", "global", "content", "complement_disable", "enabled"})
+		must.MatchResponse(t, res, match.HTTPResponse{
+			JSON: []match.JSON{
+				match.JSONKeyEqual("enabled", false),
+			},
+		})
+	})
+
+	t.Run("Can set the actions of a push rule", func(t *testing.T) {
+		alice.SetPushRule(t, "global", "content", "complement_actions", map[string]interface{}{
+			"actions": []interface{}{"notify"},
+			"pattern": "complement",
+		})
+		alice.SetPushRuleActions(t, "global", "content", "complement_actions", []interface{}{"dont_notify"})
+		res := alice.MustDoFunc(t, "GET", []string{"_matrix", "client", "r0", "pushrules", "global", "content", "complement_actions", "actions"})
+		must.MatchResponse(t, res, match.HTTPResponse{
+			JSON: []match.JSON{
+				match.JSONKeyEqual("actions", []interface{}{"dont_notify"}),
+			},
+		})
+	})
+
+	// sytest: Can delete a push rule
+	t.Run("Can delete a push rule", func(t *testing.T) {
+		alice.SetPushRule(t, "global", "content", "complement_delete", map[string]interface{}{
+			"actions": []interface{}{"notify"},
+			"pattern": "complement",
+		})
+		alice.DeletePushRule(t, "global", "content", "complement_delete")
+		if hasPushRule(alice.GetPushRules(t), "global.content", "complement_delete") {
+			t.Fatalf("push rule complement_delete still exists after being deleted")
+		}
+	})
+}
+
+func hasPushRule(rules gjson.Result, kindKey, ruleID string) bool {
+	for _, rule := range rules.Get(kindKey).Array() {
+		if rule.Get("rule_id").Str == ruleID {
+			return true
+		}
+	}
+	return false
+}
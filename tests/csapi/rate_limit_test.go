@@ -0,0 +1,50 @@
+package csapi_tests
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/client"
+	"github.com/matrix-org/complement/internal/match"
+	"github.com/matrix-org/complement/internal/must"
+)
+
+// Test that a rate limited client is told how long to back off for.
+func TestRateLimitedSendHasRetryAfter(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintAliceRateLimited)
+	defer deployment.Destroy(t)
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	roomID := alice.CreateRoom(t, map[string]interface{}{})
+
+	sendPath := []string{"_matrix", "client", "r0", "rooms", roomID, "send", "m.room.message", "txn"}
+	message := client.WithJSONBody(t, map[string]interface{}{
+		"msgtype": "m.text",
+		"body":    "Rate limit me",
+	})
+	// the same transaction ID would be deduplicated rather than rate limited
+	txnCount := 0
+	newTxnID := func(req *http.Request) {
+		txnCount++
+		client.WithTxnID(fmt.Sprintf("ratelimit%d", txnCount))(req)
+	}
+
+	res := alice.DoUntilRateLimited(t, "PUT", sendPath, message, newTxnID)
+	must.MatchResponse(t, res, match.HTTPResponse{
+		StatusCode: http.StatusTooManyRequests,
+		JSON: []match.JSON{
+			match.JSONKeyEqual("errcode", "M_LIMIT_EXCEEDED"),
+		},
+		Response: []match.Response{
+			match.RetryAfterPresent(),
+		},
+	})
+
+	// the blueprint allows a message every 10 seconds
+	retryAfter := alice.MustGetRateLimited(t, "PUT", sendPath, message, newTxnID)
+	if retryAfter <= 0 || retryAfter > 10*time.Second {
+		t.Fatalf("rate limited client was told to retry after %s, want between 0 and 10s", retryAfter)
+	}
+}
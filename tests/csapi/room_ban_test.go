@@ -0,0 +1,46 @@
+package csapi_tests
+
+import (
+	"testing"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/match"
+	"github.com/matrix-org/complement/internal/must"
+)
+
+func TestRoomBanKick(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintOneToOneRoom)
+	defer deployment.Destroy(t)
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	bob := deployment.Client(t, "hs1", "@bob:hs1")
+
+	// sytest: Banned user is kicked and may not rejoin until unbanned
+	t.Run("Banned user is kicked and may not rejoin until unbanned", func(t *testing.T) {
+		roomID := alice.CreateRoom(t, map[string]interface{}{
+			"preset": "public_chat",
+		})
+		bob.JoinRoom(t, roomID, nil)
+
+		banEventID := alice.BanUser(t, roomID, bob.UserID, "Testing bans")
+		if banEventID == "" {
+			t.Fatalf("BanUser returned no event ID")
+		}
+		alice.SyncUntilMembership(t, roomID, bob.UserID, "ban")
+		res := bob.DoFunc(t, "POST", []string{"_matrix", "client", "r0", "join", roomID})
+		must.MatchResponse(t, res, match.MatrixError(403, "M_FORBIDDEN"))
+
+		alice.UnbanUser(t, roomID, bob.UserID, "")
+		bob.JoinRoom(t, roomID, nil)
+	})
+
+	t.Run("Kicked user may rejoin", func(t *testing.T) {
+		roomID := alice.CreateRoom(t, map[string]interface{}{
+			"preset": "public_chat",
+		})
+		bob.JoinRoom(t, roomID, nil)
+
+		alice.KickUser(t, roomID, bob.UserID, "Testing kicks")
+		alice.SyncUntilMembership(t, roomID, bob.UserID, "leave")
+		bob.JoinRoom(t, roomID, nil)
+	})
+}
@@ -0,0 +1,47 @@
+package csapi_tests
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/matrix-org/complement/internal/b"
+)
+
+func TestRoomContext(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintAlice)
+	defer deployment.Destroy(t)
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+
+	roomID := alice.CreateRoom(t, map[string]interface{}{})
+	var eventIDs []string
+	for i := 0; i < 5; i++ {
+		eventIDs = append(eventIDs, alice.SendEventSynced(t, roomID, b.Event{
+			Type: "m.room.message",
+			Content: map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    fmt.Sprintf("Message %d", i),
+			},
+		}))
+	}
+
+	// sytest: /context/ on joined room works
+	// sytest: /context/ returns correct number of events
+	t.Run("/context/ returns surrounding events in order", func(t *testing.T) {
+		res := alice.GetEventContext(t, roomID, eventIDs[2], 4)
+		if got := res.Get("event.event_id").Str; got != eventIDs[2] {
+			t.Fatalf("/context returned event %s, want %s", got, eventIDs[2])
+		}
+		before := res.Get("events_before").Array()
+		after := res.Get("events_after").Array()
+		if len(before) != 2 || len(after) != 2 {
+			t.Fatalf("/context returned %d events before and %d after, want 2 and 2", len(before), len(after))
+		}
+		// events_before is in reverse chronological order, events_after in chronological order
+		if before[0].Get("event_id").Str != eventIDs[1] || before[1].Get("event_id").Str != eventIDs[0] {
+			t.Errorf("/context events_before in wrong order: %s", res.Get("events_before").Raw)
+		}
+		if after[0].Get("event_id").Str != eventIDs[3] || after[1].Get("event_id").Str != eventIDs[4] {
+			t.Errorf("/context events_after in wrong order: %s", res.Get("events_after").Raw)
+		}
+	})
+}
@@ -0,0 +1,90 @@
+package csapi_tests
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/client"
+	"github.com/matrix-org/complement/internal/match"
+	"github.com/matrix-org/complement/internal/must"
+)
+
+// TestRoomCreatePresets checks that each /createRoom preset sets up the join rules, history visibility
+// and guest access mandated by the spec.
+func TestRoomCreatePresets(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintAlice)
+	defer deployment.Destroy(t)
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+
+	testCases := []struct {
+		preset            string
+		joinRule          string
+		historyVisibility string
+		guestAccess       string
+	}{
+		{
+			preset:            "private_chat",
+			joinRule:          "invite",
+			historyVisibility: "shared",
+			guestAccess:       "can_join",
+		},
+		{
+			preset:            "trusted_private_chat",
+			joinRule:          "invite",
+			historyVisibility: "shared",
+			guestAccess:       "can_join",
+		},
+		{
+			preset:            "public_chat",
+			joinRule:          "public",
+			historyVisibility: "shared",
+			guestAccess:       "forbidden",
+		},
+	}
+
+	t.Run("Parallel", func(t *testing.T) {
+		for _, tc := range testCases {
+			tc := tc
+			t.Run("POST /createRoom with preset "+tc.preset+" sets the right state", func(t *testing.T) {
+				t.Parallel()
+				roomID := alice.CreateRoom(t, map[string]interface{}{
+					"preset": tc.preset,
+				})
+
+				res := alice.MustDoFunc(t, "GET", []string{"_matrix", "client", "r0", "rooms", roomID, "state", "m.room.join_rules"})
+				must.MatchResponse(t, res, match.HTTPResponse{
+					JSON: []match.JSON{
+						match.JSONKeyEqual("join_rule", tc.joinRule),
+					},
+				})
+
+				res = alice.MustDoFunc(t, "GET", []string{"_matrix", "client", "r0", "rooms", roomID, "state", "m.room.history_visibility"})
+				must.MatchResponse(t, res, match.HTTPResponse{
+					JSON: []match.JSON{
+						match.JSONKeyEqual("history_visibility", tc.historyVisibility),
+					},
+				})
+
+				mustHaveGuestAccess(t, alice, roomID, tc.guestAccess)
+			})
+		}
+	})
+}
+
+// mustHaveGuestAccess checks the m.room.guest_access state of the room. The spec treats a missing
+// m.room.guest_access event as "forbidden", so servers may omit the event entirely in that case.
+func mustHaveGuestAccess(t *testing.T, c *client.CSAPI, roomID, wantGuestAccess string) {
+	t.Helper()
+	res := c.DoFunc(t, "GET", []string{"_matrix", "client", "r0", "rooms", roomID, "state", "m.room.guest_access"})
+	if wantGuestAccess == "forbidden" && res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
+		return
+	}
+	must.MatchResponse(t, res, match.HTTPResponse{
+		StatusCode: 200,
+		JSON: []match.JSON{
+			match.JSONKeyEqual("guest_access", wantGuestAccess),
+		},
+	})
+}
@@ -0,0 +1,40 @@
+package csapi_tests
+
+import (
+	"testing"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/match"
+	"github.com/matrix-org/complement/internal/must"
+)
+
+func TestRoomForget(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintOneToOneRoom)
+	defer deployment.Destroy(t)
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	bob := deployment.Client(t, "hs1", "@bob:hs1")
+
+	// sytest: Can't forget room you're still in
+	t.Run("Can't forget room you're still in", func(t *testing.T) {
+		roomID := alice.CreateRoom(t, map[string]interface{}{
+			"preset": "public_chat",
+		})
+		res := alice.DoFunc(t, "POST", []string{"_matrix", "client", "r0", "rooms", roomID, "forget"})
+		must.MatchResponse(t, res, match.MatrixError(400, "M_UNKNOWN"))
+	})
+
+	// sytest: Forgetting room does not show up in v2 /sync
+	t.Run("Forgetting room does not show up in v2 /sync", func(t *testing.T) {
+		roomID := alice.CreateRoom(t, map[string]interface{}{
+			"preset": "public_chat",
+		})
+		bob.JoinRoom(t, roomID, nil)
+		bob.LeaveRoom(t, roomID)
+		bob.ForgetRoom(t, roomID)
+		bob.MustHaveForgottenRoom(t, roomID)
+
+		// forgetting a room does not stop the user from joining it again
+		bob.JoinRoom(t, roomID, nil)
+		alice.SyncUntilMembership(t, roomID, bob.UserID, "join")
+	})
+}
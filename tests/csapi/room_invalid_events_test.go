@@ -0,0 +1,39 @@
+package csapi_tests
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/match"
+	"github.com/matrix-org/complement/internal/must"
+)
+
+func TestInvalidEventsAreRejected(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintAlice)
+	defer deployment.Destroy(t)
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	roomID := alice.CreateRoom(t, map[string]interface{}{})
+
+	t.Run("Events larger than 65536 bytes are rejected", func(t *testing.T) {
+		res := alice.SendEventError(t, roomID, b.Event{
+			Type: "m.room.message",
+			Content: map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    strings.Repeat("a", 65536),
+			},
+		})
+		must.MatchResponse(t, res, match.MatrixError(413, "M_TOO_LARGE"))
+	})
+
+	t.Run("Canonical aliases which do not point to the room are rejected", func(t *testing.T) {
+		res := alice.SendEventError(t, roomID, b.Event{
+			Type:     "m.room.canonical_alias",
+			StateKey: b.Ptr(""),
+			Content: map[string]interface{}{
+				"alias": "#not-this-room:hs1",
+			},
+		})
+		must.MatchResponse(t, res, match.MatrixError(400, "M_BAD_ALIAS"))
+	})
+}
@@ -0,0 +1,113 @@
+package csapi_tests
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/client"
+)
+
+func TestRoomMessagesTxnID(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintAlice)
+	defer deployment.Destroy(t)
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+
+	// sytest: PUT /rooms/:room_id/send/:event_type/:txn_id deduplicates the same txn id
+	t.Run("PUT /rooms/:room_id/send/:event_type/:txn_id deduplicates the same txn id", func(t *testing.T) {
+		roomID := alice.CreateRoom(t, map[string]interface{}{})
+		message := b.Event{
+			Type: "m.room.message",
+			Content: map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    "Retried message",
+			},
+		}
+		eventID := alice.SendEventSynced(t, roomID, message, client.WithTxnID("retried"))
+		retriedEventID := alice.SendEventSynced(t, roomID, message, client.WithTxnID("retried"))
+		if retriedEventID != eventID {
+			t.Fatalf("retrying with the same txn ID returned event %s, want %s", retriedEventID, eventID)
+		}
+		otherEventID := alice.SendEventSynced(t, roomID, message, client.WithTxnID("not-retried"))
+		if otherEventID == eventID {
+			t.Fatalf("a different txn ID returned the same event %s", eventID)
+		}
+	})
+	t.Run("Retried reactions with the same txn id are deduplicated", func(t *testing.T) {
+		roomID := alice.CreateRoom(t, map[string]interface{}{})
+		targetID := alice.SendEventSynced(t, roomID, b.Event{
+			Type: "m.room.message",
+			Content: map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    "React to me",
+			},
+		})
+		eventID := alice.SendReaction(t, roomID, targetID, "👍", client.WithTxnID("retried-reaction"))
+		retriedEventID := alice.SendReaction(t, roomID, targetID, "👍", client.WithTxnID("retried-reaction"))
+		if retriedEventID != eventID {
+			t.Fatalf("retrying a reaction with the same txn ID returned event %s, want %s", retriedEventID, eventID)
+		}
+	})
+}
+
+func TestRoomMessagesPagination(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintAlice)
+	defer deployment.Destroy(t)
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+
+	roomID := alice.CreateRoom(t, map[string]interface{}{})
+	var eventIDs []string
+	for i := 0; i < 10; i++ {
+		eventIDs = append(eventIDs, alice.SendEventSynced(t, roomID, b.Event{
+			Type: "m.room.message",
+			Content: map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    fmt.Sprintf("Message %d", i),
+			},
+		}))
+	}
+
+	t.Run("Paginating backwards returns every message in reverse order", func(t *testing.T) {
+		var messageIDs []string
+		it := alice.MustPaginateMessages(t, roomID, "b", 3)
+		for {
+			chunk, ok := it.Next(t)
+			if !ok {
+				break
+			}
+			if len(chunk) > 3 {
+				t.Fatalf("/messages returned %d events, want at most 3", len(chunk))
+			}
+			messageIDs = append(messageIDs, messageEventIDs(chunk)...)
+		}
+		assertReverseOrder(t, eventIDs, messageIDs)
+	})
+
+	t.Run("AllMessages returns every message in reverse order", func(t *testing.T) {
+		assertReverseOrder(t, eventIDs, messageEventIDs(alice.AllMessages(t, roomID, "b")))
+	})
+}
+
+func messageEventIDs(events []gjson.Result) []string {
+	var eventIDs []string
+	for _, ev := range events {
+		if ev.Get("type").Str == "m.room.message" {
+			eventIDs = append(eventIDs, ev.Get("event_id").Str)
+		}
+	}
+	return eventIDs
+}
+
+func assertReverseOrder(t *testing.T, sent, got []string) {
+	t.Helper()
+	if len(got) != len(sent) {
+		t.Fatalf("got %d messages, want %d: %v", len(got), len(sent), got)
+	}
+	for i := range sent {
+		if got[len(got)-1-i] != sent[i] {
+			t.Fatalf("messages out of order: got %v, sent %v", got, sent)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package csapi_tests
+
+import (
+	"testing"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/client"
+	"github.com/matrix-org/complement/internal/match"
+	"github.com/matrix-org/complement/internal/must"
+)
+
+func TestRoomPeek(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintOneToOneRoom)
+	defer deployment.Destroy(t)
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	bob := deployment.Client(t, "hs1", "@bob:hs1")
+
+	t.Run("Non-members can peek into world_readable rooms", func(t *testing.T) {
+		roomID := alice.CreateRoom(t, map[string]interface{}{
+			"preset": "public_chat",
+			"initial_state": []map[string]interface{}{
+				{
+					"type":      "m.room.history_visibility",
+					"state_key": "",
+					"content": map[string]interface{}{
+						"history_visibility": "world_readable",
+					},
+				},
+			},
+		})
+		eventID := alice.SendEventSynced(t, roomID, b.Event{
+			Type: "m.room.message",
+			Content: map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    "Peek at me",
+			},
+		})
+
+		found := false
+		for _, ev := range bob.Peek(t, roomID, client.PeekInitialSync) {
+			if ev.Get("event_id").Str == eventID {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("peeked timeline does not contain event %s", eventID)
+		}
+		bob.StopPeeking(t, roomID, client.PeekInitialSync)
+	})
+
+	t.Run("Non-members cannot peek into shared rooms", func(t *testing.T) {
+		roomID := alice.CreateRoom(t, map[string]interface{}{
+			"preset": "public_chat",
+		})
+		res := bob.DoFunc(t, "GET", []string{"_matrix", "client", "r0", "rooms", roomID, "initialSync"})
+		must.MatchResponse(t, res, match.HTTPResponse{
+			StatusCode: 403,
+		})
+	})
+}
@@ -0,0 +1,69 @@
+package csapi_tests
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/client"
+	"github.com/matrix-org/complement/internal/match"
+	"github.com/matrix-org/complement/internal/must"
+)
+
+func TestRoomPowerLevels(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintOneToOneRoom)
+	defer deployment.Destroy(t)
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	bob := deployment.Client(t, "hs1", "@bob:hs1")
+
+	t.Run("Changing power levels keeps the levels which are not changed", func(t *testing.T) {
+		roomID := alice.CreateRoom(t, map[string]interface{}{
+			"preset": "public_chat",
+		})
+		bob.JoinRoom(t, roomID, nil)
+
+		alice.SetPowerLevels(t, roomID, client.PowerLevelChanges{
+			Users:   map[string]int{bob.UserID: 50},
+			Events:  map[string]int{"m.room.topic": 75},
+			Actions: map[string]int{"invite": 100},
+		})
+
+		res := alice.MustDoFunc(t, "GET", []string{"_matrix", "client", "r0", "rooms", roomID, "state", "m.room.power_levels"})
+		must.MatchResponse(t, res, match.HTTPResponse{
+			JSON: []match.JSON{
+				match.JSONKeyEqual("invite", float64(100)),
+				match.JSONKeyEqual("users."+client.GjsonEscape(alice.UserID), float64(100)),
+				match.JSONKeyEqual("users."+client.GjsonEscape(bob.UserID), float64(50)),
+				match.JSONKeyEqual("events."+client.GjsonEscape("m.room.topic"), float64(75)),
+				match.JSONKeyEqual("events."+client.GjsonEscape("m.room.name"), float64(50)),
+				match.JSONMapEach("users", func(k, v gjson.Result) error {
+					if v.Type != gjson.Number {
+						return fmt.Errorf("power level is not a number: %s", v.Raw)
+					}
+					return nil
+				}),
+			},
+		})
+	})
+
+	t.Run("Users below the invite power level cannot invite", func(t *testing.T) {
+		charlie := deployment.RegisterUser(t, "hs1", "charlie", "superuser")
+		roomID := alice.CreateRoom(t, map[string]interface{}{
+			"preset": "public_chat",
+		})
+		bob.JoinRoom(t, roomID, nil)
+
+		alice.SetPowerLevels(t, roomID, client.PowerLevelChanges{
+			Actions: map[string]int{"invite": 50},
+		})
+		res := bob.InviteRoomError(t, roomID, charlie.UserID)
+		must.MatchResponse(t, res, match.MatrixError(403, "M_FORBIDDEN"))
+
+		alice.SetPowerLevels(t, roomID, client.PowerLevelChanges{
+			Users: map[string]int{bob.UserID: 50},
+		})
+		bob.InviteRoom(t, roomID, charlie.UserID)
+	})
+}
@@ -0,0 +1,71 @@
+package csapi_tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/client"
+)
+
+func TestReactions(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintOneToOneRoom)
+	defer deployment.Destroy(t)
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	bob := deployment.Client(t, "hs1", "@bob:hs1")
+
+	roomID := alice.CreateRoom(t, map[string]interface{}{
+		"preset": "public_chat",
+	})
+	bob.JoinRoom(t, roomID, nil)
+	targetID := alice.SendEventSynced(t, roomID, b.Event{
+		Type: "m.room.message",
+		Content: map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    "React to me",
+		},
+	})
+
+	t.Run("Reactions from different users are aggregated", func(t *testing.T) {
+		alice.SendReaction(t, roomID, targetID, "👍")
+		bob.SendReaction(t, roomID, targetID, "👍")
+		mustEventuallyHaveAnnotationCount(t, alice, roomID, targetID, "👍", 2)
+	})
+
+	t.Run("Duplicate reactions from the same user are not counted", func(t *testing.T) {
+		// servers may reject the duplicate outright, so don't check the response
+		alice.DoFunc(t, "PUT", []string{"_matrix", "client", "r0", "rooms", roomID, "send", "m.reaction", "duplicate_reaction"},
+			client.WithJSONBody(t, map[string]interface{}{
+				"m.relates_to": map[string]interface{}{
+					"rel_type": "m.annotation",
+					"event_id": targetID,
+					"key":      "👍",
+				},
+			}),
+		)
+		mustEventuallyHaveAnnotationCount(t, alice, roomID, targetID, "👍", 2)
+	})
+
+	t.Run("Redacting a reaction decrements the count", func(t *testing.T) {
+		reactionID := alice.SendReaction(t, roomID, targetID, "🎉")
+		mustEventuallyHaveAnnotationCount(t, alice, roomID, targetID, "🎉", 1)
+		alice.SendRedaction(t, roomID, reactionID, "")
+		mustEventuallyHaveAnnotationCount(t, alice, roomID, targetID, "🎉", 0)
+	})
+}
+
+// mustEventuallyHaveAnnotationCount fetches the event until its bundled aggregation has `want` reactions with
+// the key, as aggregations may be computed asynchronously.
+func mustEventuallyHaveAnnotationCount(t *testing.T, c *client.CSAPI, roomID, eventID, key string, want int64) {
+	t.Helper()
+	var got int64
+	start := time.Now()
+	for time.Since(start) < 5*time.Second {
+		got = client.AnnotationCount(c.GetEvent(t, roomID, eventID), key)
+		if got == want {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("event %s has %d '%s' reactions, want %d", eventID, got, key, want)
+}
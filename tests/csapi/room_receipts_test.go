@@ -0,0 +1,68 @@
+package csapi_tests
+
+import (
+	"testing"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/b"
+)
+
+func TestRoomReceipts(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintOneToOneRoom)
+	defer deployment.Destroy(t)
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	bob := deployment.Client(t, "hs1", "@bob:hs1")
+
+	roomID := alice.CreateRoom(t, map[string]interface{}{
+		"preset": "public_chat",
+	})
+	bob.JoinRoom(t, roomID, nil)
+	eventID := alice.SendEventSynced(t, roomID, b.Event{
+		Type: "m.room.message",
+		Content: map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    "Read me",
+		},
+	})
+
+	// sytest: Read receipts appear in initial v2 /sync
+	t.Run("Read receipts appear in /sync", func(t *testing.T) {
+		bob.SendReceipt(t, roomID, "m.read", eventID)
+		alice.SyncUntilReadReceipt(t, roomID, eventID, bob.UserID)
+	})
+
+	// sytest: Read markers appear in initial v2 /sync
+	t.Run("Read markers appear in room account data", func(t *testing.T) {
+		bob.SetReadMarker(t, roomID, eventID, "")
+		bob.SyncUntilRoomAccountData(t, roomID, "m.fully_read", func(ev gjson.Result) bool {
+			return ev.Get("content.event_id").Str == eventID
+		})
+	})
+
+	// sytest: Read markers can be updated
+	t.Run("Read markers can be updated", func(t *testing.T) {
+		firstEventID := alice.SendEventSynced(t, roomID, b.Event{
+			Type: "m.room.message",
+			Content: map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    "First",
+			},
+		})
+		secondEventID := alice.SendEventSynced(t, roomID, b.Event{
+			Type: "m.room.message",
+			Content: map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    "Second",
+			},
+		})
+		bob.SetReadMarker(t, roomID, firstEventID, "")
+		bob.SyncUntilRoomAccountData(t, roomID, "m.fully_read", func(ev gjson.Result) bool {
+			return ev.Get("content.event_id").Str == firstEventID
+		})
+		bob.SetReadMarker(t, roomID, secondEventID, "")
+		bob.SyncUntilRoomAccountData(t, roomID, "m.fully_read", func(ev gjson.Result) bool {
+			return ev.Get("content.event_id").Str == secondEventID
+		})
+	})
+}
@@ -0,0 +1,86 @@
+package csapi_tests
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/client"
+	"github.com/matrix-org/complement/internal/match"
+)
+
+func TestRelations(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintAlice)
+	defer deployment.Destroy(t)
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+
+	roomID := alice.CreateRoom(t, map[string]interface{}{})
+	parentID := alice.SendEventSynced(t, roomID, b.Event{
+		Type: "m.room.message",
+		Content: map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    "Parent",
+		},
+	})
+	reactionID := alice.SendEventSynced(t, roomID, b.Event{
+		Type: "m.reaction",
+		Content: map[string]interface{}{
+			"m.relates_to": map[string]interface{}{
+				"rel_type": "m.annotation",
+				"event_id": parentID,
+				"key":      "👍",
+			},
+		},
+	})
+	referenceID := alice.SendEventSynced(t, roomID, b.Event{
+		Type: "m.room.message",
+		Content: map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    "Reply",
+			"m.relates_to": map[string]interface{}{
+				"rel_type": "m.reference",
+				"event_id": parentID,
+			},
+		},
+	})
+	eventIDMapper := func(r gjson.Result) interface{} {
+		return r.Get("event_id").Str
+	}
+
+	t.Run("/relations returns all related events", func(t *testing.T) {
+		res := alice.GetRelations(t, roomID, parentID, "", "")
+		if err := match.JSONCheckOff("chunk", []interface{}{reactionID, referenceID}, eventIDMapper, nil)([]byte(res.Raw)); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("/relations filters by rel_type and event_type", func(t *testing.T) {
+		res := alice.GetRelations(t, roomID, parentID, "m.annotation", "m.reaction")
+		if err := match.JSONCheckOff("chunk", []interface{}{reactionID}, eventIDMapper, nil)([]byte(res.Raw)); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("/relations can be paginated", func(t *testing.T) {
+		var gotIDs []interface{}
+		res := alice.GetRelations(t, roomID, parentID, "", "", client.WithQueries(url.Values{"limit": []string{"1"}}))
+		for {
+			for _, ev := range res.Get("chunk").Array() {
+				gotIDs = append(gotIDs, ev.Get("event_id").Str)
+			}
+			nextBatch := res.Get("next_batch").Str
+			if nextBatch == "" {
+				break
+			}
+			res = alice.GetRelations(t, roomID, parentID, "", "", client.WithQueries(url.Values{
+				"limit": []string{"1"},
+				"from":  []string{nextBatch},
+			}))
+		}
+		if len(gotIDs) != 2 {
+			t.Errorf("paginated /relations returned %d events, want 2: %v", len(gotIDs), gotIDs)
+		}
+	})
+}
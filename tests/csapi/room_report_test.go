@@ -0,0 +1,37 @@
+package csapi_tests
+
+import (
+	"testing"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/match"
+	"github.com/matrix-org/complement/internal/must"
+)
+
+func TestReportEvent(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintOneToOneRoom)
+	defer deployment.Destroy(t)
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	bob := deployment.Client(t, "hs1", "@bob:hs1")
+
+	roomID := alice.CreateRoom(t, map[string]interface{}{
+		"preset": "public_chat",
+	})
+	bob.JoinRoom(t, roomID, nil)
+	eventID := alice.SendEventSynced(t, roomID, b.Event{
+		Type: "m.room.message",
+		Content: map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    "Report me",
+		},
+	})
+
+	t.Run("Room members can report events", func(t *testing.T) {
+		bob.ReportEvent(t, roomID, eventID, -100, "Offensive")
+	})
+
+	t.Run("Reporting an unknown event fails", func(t *testing.T) {
+		res := bob.ReportEventError(t, roomID, "$unknown:hs1", -100, "Offensive")
+		must.MatchResponse(t, res, match.MatrixError(404, "M_NOT_FOUND"))
+	})
+}
@@ -0,0 +1,57 @@
+package csapi_tests
+
+import (
+	"testing"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/client"
+	"github.com/matrix-org/complement/internal/match"
+	"github.com/matrix-org/complement/internal/must"
+)
+
+func TestRoomUpgrade(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintOneToOneRoom)
+	defer deployment.Destroy(t)
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	bob := deployment.Client(t, "hs1", "@bob:hs1")
+
+	// sytest: /upgrade creates a new room
+	t.Run("/upgrade creates a new room", func(t *testing.T) {
+		roomID := alice.CreateRoom(t, map[string]interface{}{
+			"preset":       "public_chat",
+			"room_version": "6",
+		})
+		bob.JoinRoom(t, roomID, nil)
+
+		newRoomID := alice.UpgradeRoom(t, roomID, "9")
+		if got := bob.FollowTombstone(t, roomID); got != newRoomID {
+			t.Fatalf("tombstone points to %s, want %s", got, newRoomID)
+		}
+
+		res := alice.MustDoFunc(t, "GET", []string{"_matrix", "client", "r0", "rooms", newRoomID, "state", "m.room.create"})
+		must.MatchResponse(t, res, match.HTTPResponse{
+			JSON: []match.JSON{
+				match.JSONKeyEqual("room_version", "9"),
+				match.JSONKeyEqual("predecessor.room_id", roomID),
+			},
+		})
+
+		// bob can follow the tombstone into the public replacement room
+		bob.JoinRoom(t, newRoomID, nil)
+	})
+
+	// sytest: /upgrade is rejected if the user can't send state events
+	t.Run("/upgrade is rejected if the user can't send state events", func(t *testing.T) {
+		roomID := alice.CreateRoom(t, map[string]interface{}{
+			"preset": "public_chat",
+		})
+		bob.JoinRoom(t, roomID, nil)
+
+		res := bob.DoFunc(t, "POST", []string{"_matrix", "client", "r0", "rooms", roomID, "upgrade"}, client.WithJSONBody(t, map[string]interface{}{
+			"new_version": "9",
+		}))
+		must.MatchResponse(t, res, match.HTTPResponse{
+			StatusCode: 403,
+		})
+	})
+}
@@ -1,9 +1,8 @@
 package csapi_tests
 
 import (
-	"encoding/json"
-	"io/ioutil"
 	"testing"
+	"time"
 
 	"github.com/tidwall/gjson"
 
@@ -19,31 +18,23 @@ func TestSyncFilter(t *testing.T) {
 	authedClient := deployment.Client(t, "hs1", "@alice:hs1")
 	// sytest: Can create filter
 	t.Run("Can create filter", func(t *testing.T) {
-		reqBody, err := json.Marshal(map[string]interface{}{
+		authedClient.CreateFilter(t, map[string]interface{}{
 			"room": map[string]interface{}{
 				"timeline": map[string]int{
 					"limit": 10,
 				},
 			},
 		})
-		if err != nil {
-			t.Fatalf("failed to marshal JSON request body: %s", err)
-		}
-		createFilter(t, authedClient, reqBody, "@alice:hs1")
 	})
 	// sytest: Can download filter
 	t.Run("Can download filter", func(t *testing.T) {
-		reqBody, err := json.Marshal(map[string]interface{}{
+		filterID := authedClient.CreateFilter(t, map[string]interface{}{
 			"room": map[string]interface{}{
 				"timeline": map[string]int{
 					"limit": 10,
 				},
 			},
 		})
-		if err != nil {
-			t.Fatalf("failed to marshal JSON request body: %s", err)
-		}
-		filterID := createFilter(t, authedClient, reqBody, "@alice:hs1")
 		res := authedClient.MustDo(t, "GET", []string{"_matrix", "client", "r0", "user", "@alice:hs1", "filter", filterID}, nil)
 		must.MatchResponse(t, res, match.HTTPResponse{
 			JSON: []match.JSON{
@@ -53,21 +44,33 @@ func TestSyncFilter(t *testing.T) {
 		})
 
 	})
-}
-
-func createFilter(t *testing.T, authedClient *client.CSAPI, reqBody []byte, userID string) string {
-	t.Helper()
-	res := authedClient.MustDo(t, "POST", []string{"_matrix", "client", "r0", "user", userID, "filter"}, json.RawMessage(reqBody))
-	if res.StatusCode != 200 {
-		t.Fatalf("MatchResponse got status %d want 200", res.StatusCode)
-	}
-	body, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		t.Fatalf("unable to read response body: %v", err)
-	}
-
-	filterID := gjson.GetBytes(body, "filter_id").Str
-
-	return filterID
-
+	t.Run("Filtered sync only includes the filtered rooms", func(t *testing.T) {
+		wantRoomID := authedClient.CreateRoom(t, map[string]interface{}{})
+		otherRoomID := authedClient.CreateRoom(t, map[string]interface{}{})
+		filterID := authedClient.CreateFilter(t, map[string]interface{}{
+			"room": map[string]interface{}{
+				"rooms": []string{wantRoomID},
+			},
+		})
+		for _, filter := range []string{filterID, `{"room":{"rooms":["` + wantRoomID + `"]}}`} {
+			res, _ := authedClient.MustSync(t, client.SyncReq{Filter: filter})
+			if !res.Get("rooms.join." + client.GjsonEscape(wantRoomID)).Exists() {
+				t.Errorf("filter %s: sync did not include room %s: %s", filter, wantRoomID, res.Raw)
+			}
+			if res.Get("rooms.join." + client.GjsonEscape(otherRoomID)).Exists() {
+				t.Errorf("filter %s: sync included filtered out room %s: %s", filter, otherRoomID, res.Raw)
+			}
+		}
+		// the filtered out room never shows up in a filtered sync, even once it has new events
+		authedClient.SendEventSynced(t, otherRoomID, b.Event{
+			Type: "m.room.message",
+			Content: map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    "Filtered out",
+			},
+		})
+		authedClient.MustNotSyncUntil(t, time.Second, filterID, func(res gjson.Result) bool {
+			return res.Get("rooms.join." + client.GjsonEscape(otherRoomID)).Exists()
+		})
+	})
 }
@@ -0,0 +1,57 @@
+package csapi_tests
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/client"
+)
+
+func TestSyncTimelineContinuity(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintAlice)
+	defer deployment.Destroy(t)
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	filterID := alice.CreateFilter(t, map[string]interface{}{
+		"room": map[string]interface{}{
+			"timeline": map[string]interface{}{
+				"limit": 3,
+			},
+		},
+	})
+
+	sendMessages := func(t *testing.T, roomID string, count int) {
+		t.Helper()
+		for i := 0; i < count; i++ {
+			alice.SendEventSynced(t, roomID, b.Event{
+				Type: "m.room.message",
+				Content: map[string]interface{}{
+					"msgtype": "m.text",
+					"body":    fmt.Sprintf("Message %d", i),
+				},
+			})
+		}
+	}
+
+	t.Run("Incremental sync without a gap continues the timeline", func(t *testing.T) {
+		roomID := alice.CreateRoom(t, map[string]interface{}{})
+		sendMessages(t, roomID, 1)
+		first, since := alice.MustSync(t, client.SyncReq{Filter: filterID})
+		sendMessages(t, roomID, 2)
+		second, _ := alice.MustSync(t, client.SyncReq{Filter: filterID, Since: since})
+		alice.AssertSyncTimelineContinues(t, roomID, first, second)
+	})
+
+	// sytest: A prev_batch token can be used in the v1 messages API
+	t.Run("A prev_batch token can be used in the v1 messages API", func(t *testing.T) {
+		roomID := alice.CreateRoom(t, map[string]interface{}{})
+		sendMessages(t, roomID, 1)
+		first, since := alice.MustSync(t, client.SyncReq{Filter: filterID})
+		sendMessages(t, roomID, 10)
+		second, _ := alice.MustSync(t, client.SyncReq{Filter: filterID, Since: since})
+		if !second.Get("rooms.join." + client.GjsonEscape(roomID) + ".timeline.limited").Bool() {
+			t.Errorf("gapped sync is not limited: %s", second.Raw)
+		}
+		alice.AssertSyncTimelineContinues(t, roomID, first, second)
+	})
+}
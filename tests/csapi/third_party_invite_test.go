@@ -0,0 +1,45 @@
+// +build !dendrite_blacklist
+
+// Rationale for being included in Dendrite's blacklist: the Dendrite image cannot be configured to trust the
+// self-signed certificate of the mock identity server.
+
+package csapi_tests
+
+import (
+	"testing"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/client"
+)
+
+func TestThirdPartyInvite(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintAliceBobInsecureIdentityServer)
+	defer deployment.Destroy(t)
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	bob := deployment.Client(t, "hs1", "@bob:hs1")
+
+	is := deployment.IdentityServer(t)
+	defer is.Close()
+
+	// sytest: Can invite unbound 3pid
+	t.Run("Can invite unbound 3pid", func(t *testing.T) {
+		roomID := alice.CreateRoom(t, map[string]interface{}{
+			"preset": "private_chat",
+		})
+		alice.InviteByThreePID(t, roomID, is.ServerName, "email", "bob@example.com")
+		alice.SyncUntilTimelineHas(t, roomID, func(ev gjson.Result) bool {
+			return ev.Get("type").Str == "m.room.third_party_invite"
+		})
+
+		// binding the email address to bob turns the third-party invite into a real invite
+		is.Bind(t, "hs1", "email", "bob@example.com", bob.UserID)
+		bob.SyncUntil(t, "", "", "rooms.invite."+client.GjsonEscape(roomID)+".invite_state.events", func(ev gjson.Result) bool {
+			return ev.Get("type").Str == "m.room.member" &&
+				ev.Get("state_key").Str == bob.UserID &&
+				ev.Get("content.membership").Str == "invite"
+		})
+		bob.JoinRoom(t, roomID, nil)
+	})
+}
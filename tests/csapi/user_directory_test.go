@@ -0,0 +1,48 @@
+package csapi_tests
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/client"
+	"github.com/matrix-org/complement/internal/match"
+)
+
+func TestUserDirectory(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintOneToOneRoom)
+	defer deployment.Destroy(t)
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	bob := deployment.Client(t, "hs1", "@bob:hs1")
+
+	// sytest: User in shared private room does appear in user directory
+	t.Run("User in shared room appears in user directory", func(t *testing.T) {
+		roomID := alice.CreateRoom(t, map[string]interface{}{
+			"preset": "private_chat",
+			"invite": []string{bob.UserID},
+		})
+		bob.JoinRoom(t, roomID, nil)
+		alice.SetDisplayName(t, "Alice Directory")
+		mustEventuallyFindUser(t, bob, "Alice Directory", alice.UserID)
+	})
+}
+
+// mustEventuallyFindUser searches the user directory until `userID` appears in the results, as the user
+// directory is updated asynchronously.
+func mustEventuallyFindUser(t *testing.T, c *client.CSAPI, searchTerm, userID string) {
+	t.Helper()
+	c.DoRetryUntil(t, 5*time.Second, "POST", []string{"_matrix", "client", "r0", "user_directory", "search"}, func(res *http.Response) bool {
+		body, _ := ioutil.ReadAll(res.Body)
+		err := match.JSONCheckOffAllowUnwanted("results", []interface{}{userID}, func(r gjson.Result) interface{} {
+			return r.Get("user_id").Str
+		}, nil)(body)
+		return res.StatusCode == 200 && err == nil
+	}, client.WithJSONBody(t, map[string]interface{}{
+		"search_term": searchTerm,
+		"limit":       10,
+	}))
+}
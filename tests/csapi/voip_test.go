@@ -0,0 +1,34 @@
+package csapi_tests
+
+import (
+	"testing"
+
+	"github.com/matrix-org/complement/internal/b"
+)
+
+func TestTurnServer(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintAliceAndBobWithTURN)
+	defer deployment.Destroy(t)
+
+	t.Run("Servers without TURN return no credentials", func(t *testing.T) {
+		alice := deployment.Client(t, "hs1", "@alice:hs1")
+		if turnServer, ok := alice.GetTurnServerOptional(t); ok {
+			t.Errorf("got TURN credentials from a server without TURN configured: %s", turnServer.Raw)
+		}
+	})
+
+	t.Run("Servers with TURN return time-limited credentials", func(t *testing.T) {
+		bob := deployment.Client(t, "hs2", "@bob:hs2")
+		turnServer := bob.GetTurnServer(t)
+		if uri := turnServer.Get("uris.0").Str; uri != "turn:turn.hs2:3478?transport=udp" {
+			t.Errorf("got TURN URI %q", uri)
+		}
+		if turnServer.Get("username").Str == "" || turnServer.Get("password").Str == "" {
+			t.Errorf("TURN credentials are missing a username or password: %s", turnServer.Raw)
+		}
+		// the credentials are only valid for the configured lifetime
+		if ttl := turnServer.Get("ttl").Int(); ttl <= 0 || ttl > 3600 {
+			t.Errorf("got TURN ttl %d, want between 1 and 3600", ttl)
+		}
+	})
+}
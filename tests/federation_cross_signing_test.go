@@ -0,0 +1,107 @@
+package tests
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/client"
+)
+
+func TestRemoteCrossSigningKeys(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintFederationOneToOneRoom)
+	defer deployment.Destroy(t)
+	alice := deployment.RegisterUser(t, "hs1", "alice_cross_signing", "superuser")
+	bob := deployment.Client(t, "hs2", "@bob:hs2")
+
+	_, aliceDeviceID := alice.WhoAmI(t)
+	deviceKeys := map[string]interface{}{
+		"user_id":    alice.UserID,
+		"device_id":  aliceDeviceID,
+		"algorithms": []string{"m.olm.v1.curve25519-aes-sha2", "m.megolm.v1.aes-sha2"},
+		"keys": map[string]interface{}{
+			"curve25519:" + aliceDeviceID: "curve25519+key",
+			"ed25519:" + aliceDeviceID:    "ed25519+key",
+		},
+	}
+	alice.UploadKeys(t, deviceKeys, nil)
+
+	masterKeyID, masterPriv, master := mustCrossSigningKey(t, alice.UserID, "master", "", nil)
+	selfSigningKeyID, selfSigningPriv, selfSigning := mustCrossSigningKey(t, alice.UserID, "self_signing", masterKeyID, masterPriv)
+	alice.UploadCrossSigningKeys(t, master, selfSigning, nil, map[string]interface{}{
+		"type": "m.login.password",
+		"identifier": map[string]interface{}{
+			"type": "m.id.user",
+			"user": alice.UserID,
+		},
+		"password": "superuser",
+	})
+
+	// sytest: can fetch self-signing keys over federation
+	t.Run("can fetch self-signing keys over federation", func(t *testing.T) {
+		userKey := client.GjsonEscape(alice.UserID)
+		bob.QueryKeysUntilCrossSigning(t, alice.UserID, func(res gjson.Result) bool {
+			return res.Get("master_keys."+userKey+".keys."+client.GjsonEscape(masterKeyID)).Exists() &&
+				res.Get("self_signing_keys."+userKey+".keys."+client.GjsonEscape(selfSigningKeyID)).Exists()
+		})
+	})
+
+	// sytest: uploading signed devices gets propagated over federation
+	t.Run("uploading signed devices gets propagated over federation", func(t *testing.T) {
+		deviceKeysJSON, err := json.Marshal(deviceKeys)
+		if err != nil {
+			t.Fatalf("failed to marshal device keys: %s", err)
+		}
+		signedDeviceKeys, err := gomatrixserverlib.SignJSON(alice.UserID, gomatrixserverlib.KeyID(selfSigningKeyID), selfSigningPriv, deviceKeysJSON)
+		if err != nil {
+			t.Fatalf("failed to sign device keys: %s", err)
+		}
+		res := alice.UploadSignatures(t, map[string]interface{}{
+			alice.UserID: map[string]interface{}{
+				aliceDeviceID: json.RawMessage(signedDeviceKeys),
+			},
+		})
+		if len(res.Get("failures").Map()) != 0 {
+			t.Fatalf("failed to upload signatures: %s", res.Raw)
+		}
+
+		userKey := client.GjsonEscape(alice.UserID)
+		bob.QueryKeysUntilCrossSigning(t, alice.UserID, func(res gjson.Result) bool {
+			return res.Get("device_keys." + userKey + "." + client.GjsonEscape(aliceDeviceID) + ".signatures." + userKey + "." + client.GjsonEscape(selfSigningKeyID)).Exists()
+		})
+	})
+}
+
+// mustCrossSigningKey generates a cross-signing key with the given usage, signed by `signingKeyID` if it is set.
+// Returns the key ID, the private key and the key itself, ready to upload.
+func mustCrossSigningKey(t *testing.T, userID, usage, signingKeyID string, signingKey ed25519.PrivateKey) (string, ed25519.PrivateKey, json.RawMessage) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate %s key: %s", usage, err)
+	}
+	pubBase64 := base64.RawStdEncoding.EncodeToString(pub)
+	keyID := "ed25519:" + pubBase64
+	key, err := json.Marshal(map[string]interface{}{
+		"user_id": userID,
+		"usage":   []string{usage},
+		"keys": map[string]string{
+			keyID: pubBase64,
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal %s key: %s", usage, err)
+	}
+	if signingKeyID != "" {
+		key, err = gomatrixserverlib.SignJSON(userID, gomatrixserverlib.KeyID(signingKeyID), signingKey, key)
+		if err != nil {
+			t.Fatalf("failed to sign %s key: %s", usage, err)
+		}
+	}
+	return keyID, priv, key
+}
@@ -0,0 +1,43 @@
+// +build !dendrite_blacklist
+
+// Rationale for being included in Dendrite's blacklist: the Dendrite image ignores COMPLEMENT_FEDERATION_DISABLED.
+
+package tests
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/client"
+	"github.com/matrix-org/complement/internal/match"
+	"github.com/matrix-org/complement/internal/must"
+)
+
+// Test that a homeserver with federation disabled cannot join rooms on other servers, but local joins still work.
+func TestFederationDisabled(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintFederationDisabled)
+	defer deployment.Destroy(t)
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	charlie := deployment.Client(t, "hs1", "@charlie:hs1")
+	bob := deployment.Client(t, "hs2", "@bob:hs2")
+
+	t.Run("Remote joins fail", func(t *testing.T) {
+		roomID := bob.CreateRoom(t, map[string]interface{}{
+			"preset": "public_chat",
+		})
+		res := alice.DoFunc(t, "POST", []string{"_matrix", "client", "r0", "join", roomID}, client.WithQueries(url.Values{
+			"server_name": []string{"hs2"},
+		}))
+		// hs1 refuses to make the join request to hs2, so it fails like a join via an unreachable server.
+		must.MatchResponse(t, res, match.MatrixError(502, "M_UNKNOWN"))
+	})
+
+	t.Run("Local joins succeed", func(t *testing.T) {
+		roomID := alice.CreateRoom(t, map[string]interface{}{
+			"preset": "public_chat",
+		})
+		charlie.JoinRoom(t, roomID, nil)
+		alice.SyncUntilMembership(t, roomID, charlie.UserID, "join")
+	})
+}
@@ -0,0 +1,71 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/client"
+)
+
+func TestRemoteE2EKeys(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintFederationOneToOneRoom)
+	defer deployment.Destroy(t)
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	bob := deployment.Client(t, "hs2", "@bob:hs2")
+
+	_, aliceDeviceID := alice.WhoAmI(t)
+	// the keys are opaque to the server so don't need to be real olm keys
+	alice.UploadKeys(t, map[string]interface{}{
+		"user_id":    alice.UserID,
+		"device_id":  aliceDeviceID,
+		"algorithms": []string{"m.olm.v1.curve25519-aes-sha2", "m.megolm.v1.aes-sha2"},
+		"keys": map[string]interface{}{
+			"curve25519:" + aliceDeviceID: "curve25519+key",
+			"ed25519:" + aliceDeviceID:    "ed25519+key",
+		},
+		"signatures": map[string]interface{}{
+			alice.UserID: map[string]interface{}{
+				"ed25519:" + aliceDeviceID: "self+signature",
+			},
+		},
+	}, map[string]interface{}{
+		"signed_curve25519:AAAAHQ": map[string]interface{}{
+			"key": "one+time+key",
+			"signatures": map[string]interface{}{
+				alice.UserID: map[string]interface{}{
+					"ed25519:" + aliceDeviceID: "otk+signature",
+				},
+			},
+		},
+	})
+
+	// sytest: Can query remote device keys using POST
+	t.Run("Can query remote device keys using POST", func(t *testing.T) {
+		res := bob.QueryKeys(t, []string{alice.UserID})
+		deviceKeys := res.Get("device_keys." + client.GjsonEscape(alice.UserID) + "." + client.GjsonEscape(aliceDeviceID))
+		if got := deviceKeys.Get("keys." + client.GjsonEscape("ed25519:"+aliceDeviceID)).Str; got != "ed25519+key" {
+			t.Fatalf("remote /keys/query returned wrong ed25519 key '%s': %s", got, res.Raw)
+		}
+	})
+
+	// sytest: Can claim remote one time key using POST
+	t.Run("Can claim remote one time key using POST", func(t *testing.T) {
+		res := bob.ClaimKeys(t, map[string]map[string]string{
+			alice.UserID: {
+				aliceDeviceID: "signed_curve25519",
+			},
+		})
+		otk := res.Get("one_time_keys." + client.GjsonEscape(alice.UserID) + "." + client.GjsonEscape(aliceDeviceID) + "." + client.GjsonEscape("signed_curve25519:AAAAHQ"))
+		if got := otk.Get("key").Str; got != "one+time+key" {
+			t.Fatalf("remote /keys/claim returned wrong one-time key '%s': %s", got, res.Raw)
+		}
+	})
+
+	// sytest: Local device key changes get to remote servers
+	t.Run("Local device key changes get to remote servers", func(t *testing.T) {
+		_, since := bob.MustSync(t, client.SyncReq{})
+		// bob shares a room with alice so is told about changes to alice's devices
+		alice.UpdateDevice(t, aliceDeviceID, "Alice's renamed device")
+		bob.SyncUntilDeviceListChanged(t, since, alice.UserID)
+	})
+}
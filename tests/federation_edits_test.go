@@ -0,0 +1,65 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/client"
+)
+
+// Test that edits federate and are bundled with the original event, and that only the original sender's
+// edits are applied.
+func TestFederatedEdits(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintFederationOneToOneRoom)
+	defer deployment.Destroy(t)
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	bob := deployment.Client(t, "hs2", "@bob:hs2")
+
+	roomID := deployment.CreateRoomWithMembers(t, "hs1", alice.UserID, []*client.CSAPI{bob}, map[string]interface{}{
+		"preset": "public_chat",
+	})
+	originalID := alice.SendEventSynced(t, roomID, b.Event{
+		Type: "m.room.message",
+		Content: map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    "Original",
+		},
+	})
+	editID := alice.EditMessage(t, roomID, originalID, "Edited")
+	bob.SyncUntilTimelineHas(t, roomID, func(ev gjson.Result) bool {
+		return ev.Get("event_id").Str == editID
+	})
+
+	t.Run("Edits are bundled with the original event over federation", func(t *testing.T) {
+		mustEventuallyHaveLatestEdit(t, bob, roomID, originalID, editID)
+	})
+
+	t.Run("Edits from other users are not applied", func(t *testing.T) {
+		bobEditID := bob.EditMessage(t, roomID, originalID, "Edited by bob")
+		alice.SyncUntilTimelineHas(t, roomID, func(ev gjson.Result) bool {
+			return ev.Get("event_id").Str == bobEditID
+		})
+		if got := client.LatestEdit(alice.GetEvent(t, roomID, originalID)).Get("event_id").Str; got != editID {
+			t.Errorf("latest edit is %s, want %s", got, editID)
+		}
+	})
+}
+
+// mustEventuallyHaveLatestEdit fetches the event until its bundled m.replace aggregation is the given edit,
+// as aggregations may be computed asynchronously.
+func mustEventuallyHaveLatestEdit(t *testing.T, c *client.CSAPI, roomID, eventID, wantEditID string) {
+	t.Helper()
+	var got string
+	start := time.Now()
+	for time.Since(start) < 5*time.Second {
+		got = client.LatestEdit(c.GetEvent(t, roomID, eventID)).Get("event_id").Str
+		if got == wantEditID {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("latest edit of %s is '%s', want %s", eventID, got, wantEditID)
+}
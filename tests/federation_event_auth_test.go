@@ -0,0 +1,57 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/federation"
+)
+
+// Test that the auth chain of an event returned over federation contains the events which authorise it.
+func TestEventAuthChain(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintAlice)
+	defer deployment.Destroy(t)
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+
+	srv := federation.NewServer(t, deployment,
+		federation.HandleKeyRequests(),
+		federation.HandleMakeSendJoinRequests(),
+		federation.HandleTransactionRequests(nil, nil),
+	)
+	srv.UnexpectedRequestsAreErrors = false
+	cancel := srv.Listen()
+	defer cancel()
+	charlie := srv.UserID("charlie")
+
+	roomID := alice.CreateRoom(t, map[string]interface{}{
+		"preset": "public_chat",
+	})
+	srv.MustJoinRoom(t, deployment, "hs1", roomID, charlie)
+	alice.SyncUntilMembership(t, roomID, charlie, "join")
+
+	eventID := alice.SendEventSynced(t, roomID, b.Event{
+		Type: "m.room.message",
+		Content: map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    "Authorised by the auth chain",
+		},
+	})
+
+	authChain := srv.MustGetEventAuthChain(t, deployment, "hs1", roomID, eventID)
+	want := map[string]bool{
+		"m.room.create|":                false,
+		"m.room.power_levels|":          false,
+		"m.room.member|" + alice.UserID: false,
+	}
+	for _, ev := range authChain {
+		key := ev.Get("type").Str + "|" + ev.Get("state_key").Str
+		if _, ok := want[key]; ok {
+			want[key] = true
+		}
+	}
+	for key, found := range want {
+		if !found {
+			t.Errorf("auth chain of %s is missing %s", eventID, key)
+		}
+	}
+}
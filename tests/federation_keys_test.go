@@ -5,6 +5,7 @@ import (
 	"encoding/base64"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strings"
 	"testing"
 	"time"
@@ -14,6 +15,7 @@ import (
 
 	"github.com/matrix-org/complement/internal/b"
 	"github.com/matrix-org/complement/internal/docker"
+	"github.com/matrix-org/complement/internal/federation"
 	"github.com/matrix-org/complement/internal/match"
 	"github.com/matrix-org/complement/internal/must"
 )
@@ -86,3 +88,49 @@ func TestInboundFederationKeys(t *testing.T) {
 		t.Fatalf("message was not signed by server: %s", string(bodyWithoutSig))
 	}
 }
+
+// Test that every server in a deployment serves its own keys and version over federation, and that the servers
+// agree on each other's keys.
+func TestFederationServerKeysAndVersion(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintFederationOneToOneRoom)
+	defer deployment.Destroy(t)
+	for _, hsName := range deployment.Servers() {
+		ownKeys := deployment.FederationGet(t, hsName, []string{"_matrix", "key", "v2", "server"})
+		if ownKeys.Get("server_name").Str != hsName {
+			t.Errorf("%s: /key/v2/server returned server_name '%s'", hsName, ownKeys.Get("server_name").Str)
+		}
+		if len(ownKeys.Get("verify_keys").Map()) == 0 {
+			t.Errorf("%s: /key/v2/server returned no verify_keys: %s", hsName, ownKeys.Raw)
+		}
+		version := deployment.FederationGet(t, hsName, []string{"_matrix", "federation", "v1", "version"})
+		if version.Get("server.name").Str == "" {
+			t.Errorf("%s: /version returned no server name: %s", hsName, version.Raw)
+		}
+		// the other servers fetch the keys over federation, so they only get them if they trust hsName's cert
+		for _, fromHS := range deployment.Servers() {
+			keys := deployment.GetServerKeys(t, fromHS, hsName)
+			for keyID, key := range ownKeys.Get("verify_keys").Map() {
+				if got := keys.Get("verify_keys." + keyID + ".key").Str; got != key.Get("key").Str {
+					t.Errorf("%s: has key %s of %s as '%s', want '%s'", fromHS, keyID, hsName, got, key.Get("key").Str)
+				}
+			}
+		}
+	}
+}
+
+// Test that signed federation requests from a federation.Server are accepted.
+func TestFederationSignedRequests(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintAlice)
+	defer deployment.Destroy(t)
+	srv := federation.NewServer(t, deployment,
+		federation.HandleKeyRequests(),
+	)
+	cancel := srv.Listen()
+	defer cancel()
+
+	// profile queries must be signed
+	profile := srv.MustFederationGet(t, deployment, "hs1", "/_matrix/federation/v1/query/profile?user_id="+url.QueryEscape("@alice:hs1"))
+	if got := profile.Get("displayname").Str; got != "Alice" {
+		t.Fatalf("signed profile query returned displayname '%s', want 'Alice': %s", got, profile.Raw)
+	}
+}
@@ -0,0 +1,38 @@
+package tests
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/docker"
+	"github.com/matrix-org/complement/internal/match"
+	"github.com/matrix-org/complement/internal/must"
+)
+
+func TestOpenIDToken(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintAlice)
+	defer deployment.Destroy(t)
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+
+	// sytest: Can generate a openid access_token that can be exchanged for information about a user
+	t.Run("Can generate a openid access_token that can be exchanged for information about a user", func(t *testing.T) {
+		token := alice.RequestOpenIDToken(t)
+		must.EqualStr(t, token.Get("token_type").Str, "Bearer", "wrong token_type")
+		must.EqualStr(t, token.Get("matrix_server_name").Str, "hs1", "wrong matrix_server_name")
+		userID := deployment.OpenIDUserInfo(t, "hs1", token.Get("access_token").Str)
+		must.EqualStr(t, userID, alice.UserID, "userinfo returned the wrong user")
+	})
+
+	// sytest: Invalid openid access tokens are rejected
+	t.Run("Invalid openid access tokens are rejected", func(t *testing.T) {
+		fedClient := &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &docker.RoundTripper{Deployment: deployment},
+		}
+		res, err := fedClient.Get("https://hs1/_matrix/federation/v1/openid/userinfo?access_token=invalid_token")
+		must.NotError(t, "failed to GET /openid/userinfo", err)
+		must.MatchResponse(t, res, match.MatrixError(401, "M_UNKNOWN_TOKEN"))
+	})
+}
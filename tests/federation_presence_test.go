@@ -0,0 +1,40 @@
+// +build !dendrite_blacklist
+
+// Rationale for being included in Dendrite's blacklist: https://github.com/matrix-org/complement/pull/104#discussion_r617646624
+
+package tests
+
+import (
+	"testing"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/b"
+)
+
+func TestRemotePresence(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintFederationOneToOneRoom)
+	defer deployment.Destroy(t)
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	bob := deployment.Client(t, "hs2", "@bob:hs2")
+
+	// sytest: Presence changes are also reported to remote room members
+	t.Run("Presence changes are also reported to remote room members", func(t *testing.T) {
+		statusMsg := "Testing something"
+		alice.SetPresence(t, "online", statusMsg)
+		bob.SyncUntilPresence(t, alice.UserID, func(ev gjson.Result) bool {
+			return ev.Get("content.presence").Str == "online" && ev.Get("content.status_msg").Str == statusMsg
+		})
+	})
+
+	// sytest: Presence changes to UNAVAILABLE are reported to remote room members
+	t.Run("Presence changes to UNAVAILABLE are reported to remote room members", func(t *testing.T) {
+		alice.SetPresence(t, "unavailable", "")
+		bob.SyncUntilPresence(t, alice.UserID, func(ev gjson.Result) bool {
+			return ev.Get("content.presence").Str == "unavailable"
+		})
+		if got := bob.GetPresence(t, alice.UserID).Get("presence").Str; got != "unavailable" {
+			t.Errorf("GET /presence returned %s, want unavailable", got)
+		}
+	})
+}
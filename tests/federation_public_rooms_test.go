@@ -0,0 +1,62 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/client"
+)
+
+func TestPublicRooms(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintFederationOneToOneRoom)
+	defer deployment.Destroy(t)
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	bob := deployment.Client(t, "hs2", "@bob:hs2")
+
+	roomID := alice.CreateRoom(t, map[string]interface{}{
+		"preset": "public_chat",
+		"name":   "Complement public room",
+	})
+	alice.SetRoomDirectoryVisibility(t, roomID, "public")
+
+	// sytest: Can search public room list
+	t.Run("Can search public room list", func(t *testing.T) {
+		res := alice.PublicRooms(t, client.PublicRoomsReq{
+			Filter: map[string]interface{}{
+				"generic_search_term": "Complement public",
+			},
+		})
+		if !hasPublicRoom(res, roomID) {
+			t.Fatalf("room %s not found in search results: %s", roomID, res.Raw)
+		}
+	})
+
+	// sytest: Can get remote public room list
+	t.Run("Can get remote public room list", func(t *testing.T) {
+		res := bob.PublicRooms(t, client.PublicRoomsReq{
+			Server: "hs1",
+		})
+		if !hasPublicRoom(res, roomID) {
+			t.Fatalf("room %s not found in remote public rooms: %s", roomID, res.Raw)
+		}
+	})
+
+	t.Run("Unpublished rooms are removed from the public room list", func(t *testing.T) {
+		alice.SetRoomDirectoryVisibility(t, roomID, "private")
+		res := alice.PublicRooms(t, client.PublicRoomsReq{})
+		if hasPublicRoom(res, roomID) {
+			t.Fatalf("room %s still in public rooms after being unpublished: %s", roomID, res.Raw)
+		}
+	})
+}
+
+func hasPublicRoom(res gjson.Result, roomID string) bool {
+	for _, room := range res.Get("chunk").Array() {
+		if room.Get("room_id").Str == roomID {
+			return true
+		}
+	}
+	return false
+}
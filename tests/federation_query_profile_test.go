@@ -6,15 +6,13 @@ import (
 	"testing"
 
 	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/client"
 	"github.com/matrix-org/complement/internal/docker"
 	"github.com/matrix-org/complement/internal/federation"
 	"github.com/matrix-org/complement/internal/match"
 	"github.com/matrix-org/complement/internal/must"
 )
 
-// TODO:
-// Inbound federation can query profile data
-
 // Test that the server can make outbound federation profile requests
 // https://matrix.org/docs/spec/server_server/latest#get-matrix-federation-v1-query-profile
 func TestOutboundFederationProfile(t *testing.T) {
@@ -64,3 +62,48 @@ func TestOutboundFederationProfile(t *testing.T) {
 		})
 	})
 }
+
+// Test that the server can answer inbound federation profile requests
+// https://matrix.org/docs/spec/server_server/latest#get-matrix-federation-v1-query-profile
+func TestInboundFederationProfile(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintFederationOneToOneRoom)
+	defer deployment.Destroy(t)
+
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	bob := deployment.Client(t, "hs2", "@bob:hs2")
+
+	// sytest: Inbound federation can query profile data
+	t.Run("Inbound federation can query profile data", func(t *testing.T) {
+		alice.SetDisplayName(t, "alice remote display name")
+		alice.SetAvatarURL(t, "mxc://hs1/alice_avatar")
+
+		// bob's server has to ask alice's server over federation
+		profile := bob.GetProfile(t, alice.UserID)
+		must.EqualStr(t, profile.Get("displayname").Str, "alice remote display name", "wrong remote display name")
+		must.EqualStr(t, profile.Get("avatar_url").Str, "mxc://hs1/alice_avatar", "wrong remote avatar URL")
+	})
+}
+
+// Test that profile changes update the user's member events, which then federate to other servers in the room.
+func TestProfileChangesFederateToRoomMembers(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintFederationOneToOneRoom)
+	defer deployment.Destroy(t)
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	bob := deployment.Client(t, "hs2", "@bob:hs2")
+
+	roomID := deployment.CreateRoomWithMembers(t, "hs1", alice.UserID, []*client.CSAPI{bob}, map[string]interface{}{
+		"preset": "public_chat",
+	})
+
+	t.Run("displayname updates affect room member events", func(t *testing.T) {
+		alice.SetDisplayName(t, "Alice the Federated")
+		alice.SyncUntilMemberHasField(t, roomID, alice.UserID, "displayname", "Alice the Federated")
+		bob.SyncUntilMemberHasField(t, roomID, alice.UserID, "displayname", "Alice the Federated")
+	})
+
+	t.Run("avatar_url updates affect room member events", func(t *testing.T) {
+		alice.SetAvatarURL(t, "mxc://hs1/federated_avatar")
+		alice.SyncUntilMemberHasField(t, roomID, alice.UserID, "avatar_url", "mxc://hs1/federated_avatar")
+		bob.SyncUntilMemberHasField(t, roomID, alice.UserID, "avatar_url", "mxc://hs1/federated_avatar")
+	})
+}
@@ -0,0 +1,43 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/matrix-org/complement/internal/b"
+)
+
+func TestRemoteAliasRequests(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintFederationOneToOneRoom)
+	defer deployment.Destroy(t)
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	bob := deployment.Client(t, "hs2", "@bob:hs2")
+
+	roomID := alice.CreateRoom(t, map[string]interface{}{
+		"preset": "public_chat",
+	})
+	roomAlias := "#remote_alias:hs1"
+	alice.SetRoomAlias(t, roomAlias, roomID)
+
+	// sytest: Outbound federation can query room alias directory
+	t.Run("Remote alias resolves to the room with via servers", func(t *testing.T) {
+		gotRoomID, servers := bob.ResolveAlias(t, roomAlias)
+		if gotRoomID != roomID {
+			t.Fatalf("alias resolved to %s, want %s", gotRoomID, roomID)
+		}
+		found := false
+		for _, server := range servers {
+			if server == "hs1" {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("alias servers %v do not include hs1", servers)
+		}
+	})
+
+	// sytest: Remote users can join room by alias
+	t.Run("Remote users can join room by alias", func(t *testing.T) {
+		bob.JoinRoom(t, roomAlias, nil)
+		alice.SyncUntilMembership(t, roomID, bob.UserID, "join")
+	})
+}
@@ -0,0 +1,96 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/client"
+	"github.com/matrix-org/complement/internal/federation"
+)
+
+// Test that two servers which make concurrent changes to the same state agree on the resolved state.
+func TestConcurrentStateChangesConverge(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintFederationOneToOneRoom)
+	defer deployment.Destroy(t)
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	bob := deployment.Client(t, "hs2", "@bob:hs2")
+
+	roomID := alice.CreateRoom(t, map[string]interface{}{
+		"preset": "public_chat",
+	})
+	bob.JoinRoom(t, roomID, []string{"hs1"})
+	powerLevelsEventID := alice.SetPowerLevels(t, roomID, client.PowerLevelChanges{
+		Users: map[string]int{bob.UserID: 100},
+	})
+	deployment.WaitForFederatedEvent(t, "hs1", bob, roomID, powerLevelsEventID)
+
+	// Send both topics without waiting for either to federate, so that each server sees the other's topic
+	// arrive after its own.
+	alice.SetRoomTopic(t, roomID, "Alice's topic")
+	bob.SetRoomTopic(t, roomID, "Bob's topic")
+
+	// every user in the deployment is in the room, so check the topic as each of them
+	var everyone []*client.CSAPI
+	for _, hsName := range deployment.Servers() {
+		everyone = append(everyone, deployment.ClientsFor(t, hsName)...)
+	}
+	client.AssertStateConverged(t, roomID, everyone, "m.room.topic", "")
+}
+
+// Test that the state at an event fetched over federation reflects the state changes before that event.
+func TestRoomStateAtEventOverFederation(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintAlice)
+	defer deployment.Destroy(t)
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+
+	srv := federation.NewServer(t, deployment,
+		federation.HandleKeyRequests(),
+		federation.HandleMakeSendJoinRequests(),
+		federation.HandleTransactionRequests(nil, nil),
+	)
+	srv.UnexpectedRequestsAreErrors = false
+	cancel := srv.Listen()
+	defer cancel()
+	charlie := srv.UserID("charlie")
+
+	roomID := alice.CreateRoom(t, map[string]interface{}{
+		"preset": "public_chat",
+		"topic":  "Before the message",
+	})
+	srv.MustJoinRoom(t, deployment, "hs1", roomID, charlie)
+	alice.SyncUntilMembership(t, roomID, charlie, "join")
+
+	eventID := alice.SendEventSynced(t, roomID, b.Event{
+		Type: "m.room.message",
+		Content: map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    "Hello",
+		},
+	})
+	// change the topic after the message, which must not be in the state at the message
+	alice.SendEventSynced(t, roomID, b.Event{
+		Type:     "m.room.topic",
+		StateKey: b.Ptr(""),
+		Content: map[string]interface{}{
+			"topic": "After the message",
+		},
+	})
+
+	state := srv.MustGetRoomStateAtEvent(t, deployment, "hs1", roomID, eventID)
+	var topic string
+	var hasJoinRules bool
+	for _, ev := range state {
+		switch ev.Get("type").Str {
+		case "m.room.topic":
+			topic = ev.Get("content.topic").Str
+		case "m.room.join_rules":
+			hasJoinRules = ev.Get("content.join_rule").Str == "public"
+		}
+	}
+	if topic != "Before the message" {
+		t.Errorf("got topic %q in the state at %s, want %q", topic, eventID, "Before the message")
+	}
+	if !hasJoinRules {
+		t.Errorf("state at %s has no public join rules", eventID)
+	}
+}
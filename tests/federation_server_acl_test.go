@@ -0,0 +1,93 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/docker"
+	"github.com/matrix-org/complement/internal/federation"
+)
+
+// Test that events sent over federation by a server which is denied by the room's server ACLs are rejected.
+func TestServerACLDeniesFederation(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintAlice)
+	defer deployment.Destroy(t)
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+
+	srv := federation.NewServer(t, deployment,
+		federation.HandleKeyRequests(),
+		federation.HandleMakeSendJoinRequests(),
+		federation.HandleTransactionRequests(nil, nil),
+	)
+	srv.UnexpectedRequestsAreErrors = false
+	cancel := srv.Listen()
+	defer cancel()
+	charlie := srv.UserID("charlie")
+
+	roomID := alice.CreateRoom(t, map[string]interface{}{
+		"preset": "public_chat",
+	})
+	room := srv.MustJoinRoom(t, deployment, "hs1", roomID, charlie)
+	alice.SyncUntilMembership(t, roomID, charlie, "join")
+
+	// events from the Complement server are accepted before it is denied
+	allowedEvent := srv.MustCreateEvent(t, room, b.Event{
+		Type:   "m.room.message",
+		Sender: charlie,
+		Content: map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    "Before the ACL",
+		},
+	})
+	room.AddEvent(allowedEvent)
+	mustSendPDU(t, srv, deployment, "hs1", allowedEvent, false)
+	alice.SyncUntilTimelineHas(t, roomID, func(ev gjson.Result) bool {
+		return ev.Get("event_id").Str == allowedEvent.EventID()
+	})
+
+	// ACLs match on the server's hostname, ignoring the port
+	alice.SetServerACL(t, roomID, []string{"*"}, []string{docker.HostnameRunningComplement}, true)
+
+	deniedEvent := srv.MustCreateEvent(t, room, b.Event{
+		Type:   "m.room.message",
+		Sender: charlie,
+		Content: map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    "After the ACL",
+		},
+	})
+	room.AddEvent(deniedEvent)
+	mustSendPDU(t, srv, deployment, "hs1", deniedEvent, true)
+}
+
+// mustSendPDU sends the event to hs1 in a transaction. If wantRejected is true, fails the test unless the
+// transaction or the event is rejected, otherwise fails the test if either is rejected.
+func mustSendPDU(t *testing.T, srv *federation.Server, deployment *docker.Deployment, destination string, ev *gomatrixserverlib.Event, wantRejected bool) {
+	t.Helper()
+	fedClient := srv.FederationClient(deployment)
+	resp, err := fedClient.SendTransaction(context.Background(), gomatrixserverlib.Transaction{
+		TransactionID: gomatrixserverlib.TransactionID("txn_" + ev.EventID()),
+		Origin:        gomatrixserverlib.ServerName(srv.ServerName),
+		Destination:   gomatrixserverlib.ServerName(destination),
+		PDUs: []json.RawMessage{
+			ev.JSON(),
+		},
+	})
+	rejected := err != nil
+	if !rejected {
+		if pduResult, ok := resp.PDUs[ev.EventID()]; ok && pduResult.Error != "" {
+			rejected = true
+		}
+	}
+	if rejected && !wantRejected {
+		t.Fatalf("event %s was rejected: err=%v resp=%+v", ev.EventID(), err, resp)
+	}
+	if !rejected && wantRejected {
+		t.Fatalf("event %s was accepted, want it to be rejected", ev.EventID())
+	}
+}
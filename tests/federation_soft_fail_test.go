@@ -0,0 +1,148 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/client"
+	"github.com/matrix-org/complement/internal/federation"
+)
+
+// Test that an event which is allowed by the state before it, but not by the room's current state, is soft-failed.
+func TestEventAllowedByPriorStateIsSoftFailed(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintAlice)
+	defer deployment.Destroy(t)
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+
+	srv := federation.NewServer(t, deployment,
+		federation.HandleKeyRequests(),
+		federation.HandleMakeSendJoinRequests(),
+		federation.HandleTransactionRequests(nil, nil),
+	)
+	srv.UnexpectedRequestsAreErrors = false
+	cancel := srv.Listen()
+	defer cancel()
+	charlie := srv.UserID("charlie")
+
+	roomID := alice.CreateRoom(t, map[string]interface{}{
+		"preset": "public_chat",
+	})
+	room := srv.MustJoinRoom(t, deployment, "hs1", roomID, charlie)
+	alice.SyncUntilMembership(t, roomID, charlie, "join")
+
+	acceptedEvent := srv.MustCreateEvent(t, room, b.Event{
+		Type:   "m.room.message",
+		Sender: charlie,
+		Content: map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    "Before the ban",
+		},
+	})
+	room.AddEvent(acceptedEvent)
+	mustSendPDU(t, srv, deployment, "hs1", acceptedEvent, false)
+	alice.SyncUntilTimelineHas(t, roomID, func(ev gjson.Result) bool {
+		return ev.Get("event_id").Str == acceptedEvent.EventID()
+	})
+
+	// Create the event while charlie is still joined, so it passes auth against the state before it.
+	softFailedEvent := srv.MustCreateEvent(t, room, b.Event{
+		Type:   "m.room.message",
+		Sender: charlie,
+		Content: map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    "After the ban",
+		},
+	})
+	alice.BanUser(t, roomID, charlie, "")
+	mustSendPDU(t, srv, deployment, "hs1", softFailedEvent, false)
+
+	if outcome := alice.GetEventOutcome(t, roomID, acceptedEvent.EventID()); outcome != client.EventAccepted {
+		t.Errorf("event sent before the ban was %s, want %s", outcome, client.EventAccepted)
+	}
+	if outcome := alice.GetEventOutcome(t, roomID, softFailedEvent.EventID()); outcome != client.EventSoftFailed {
+		t.Errorf("event sent after the ban was %s, want %s", outcome, client.EventSoftFailed)
+	}
+}
+
+// Test that an event sent by a server after its last user has left the room is soft-failed, even though the event
+// was created while the server was still resident.
+func TestEventFromNonResidentServerIsSoftFailed(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintFederationOneToOneRoom)
+	defer deployment.Destroy(t)
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	bob := deployment.Client(t, "hs2", "@bob:hs2")
+
+	srv := federation.NewServer(t, deployment,
+		federation.HandleKeyRequests(),
+		federation.HandleMakeSendJoinRequests(),
+		federation.HandleTransactionRequests(nil, nil),
+	)
+	srv.UnexpectedRequestsAreErrors = false
+	cancel := srv.Listen()
+	defer cancel()
+	charlie := srv.UserID("charlie")
+
+	roomID := alice.CreateRoom(t, map[string]interface{}{
+		"preset": "public_chat",
+	})
+	bob.JoinRoom(t, roomID, []string{"hs1"})
+	room := srv.MustJoinRoom(t, deployment, "hs1", roomID, charlie)
+	alice.SyncUntilMembership(t, roomID, charlie, "join")
+	bob.SyncUntilMembership(t, roomID, charlie, "join")
+
+	// Create the event while charlie, the server's only user, is still joined...
+	staleEvent := srv.MustCreateEvent(t, room, b.Event{
+		Type:   "m.room.message",
+		Sender: charlie,
+		Content: map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    "Sent from a stale server",
+		},
+	})
+	// ...then have charlie leave, so the server is no longer in the room...
+	leaveEvent := srv.MustCreateEvent(t, room, b.Event{
+		Type:     "m.room.member",
+		Sender:   charlie,
+		StateKey: b.Ptr(charlie),
+		Content: map[string]interface{}{
+			"membership": "leave",
+		},
+	})
+	room.AddEvent(leaveEvent)
+	mustSendPDU(t, srv, deployment, "hs1", leaveEvent, false)
+	mustSendPDU(t, srv, deployment, "hs2", leaveEvent, false)
+	alice.SyncUntilMembership(t, roomID, charlie, "leave")
+	bob.SyncUntilMembership(t, roomID, charlie, "leave")
+
+	// ...before sending the event to both servers.
+	mustSendPDU(t, srv, deployment, "hs1", staleEvent, false)
+	mustSendPDU(t, srv, deployment, "hs2", staleEvent, false)
+	mustBeSoftFailed(t, roomID, staleEvent.EventID(), alice, bob)
+}
+
+// mustBeSoftFailed checks that each client's homeserver has soft-failed the event: it must be served by /event, but
+// kept out of /sync and /messages. The first client sends a message after the event, so that the event would have
+// come down /sync before it if it had not been soft-failed.
+func mustBeSoftFailed(t *testing.T, roomID, eventID string, clients ...*client.CSAPI) {
+	t.Helper()
+	sentinelEventID := clients[0].SendEventSynced(t, roomID, b.Event{
+		Type: "m.room.message",
+		Content: map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    "After the soft-failed event",
+		},
+	})
+	for _, c := range clients {
+		c.SyncUntilTimelineHas(t, roomID, func(ev gjson.Result) bool {
+			if ev.Get("event_id").Str == eventID {
+				t.Errorf("%s was sent the soft-failed event %s down /sync", c.UserID, eventID)
+			}
+			return ev.Get("event_id").Str == sentinelEventID
+		})
+		if outcome := c.GetEventOutcome(t, roomID, eventID); outcome != client.EventSoftFailed {
+			t.Errorf("event %s was %s for %s, want %s", eventID, outcome, c.UserID, client.EventSoftFailed)
+		}
+	}
+}
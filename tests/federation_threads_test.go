@@ -0,0 +1,66 @@
+// +build !dendrite_blacklist
+
+// Rationale for being included in Dendrite's blacklist: Dendrite does not implement threads or the /threads endpoint.
+
+package tests
+
+import (
+	"testing"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/client"
+)
+
+// Test that thread summaries are computed for threads with replies from local and remote users.
+func TestThreadSummaries(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintFederationOneToOneRoom)
+	defer deployment.Destroy(t)
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	bob := deployment.Client(t, "hs2", "@bob:hs2")
+
+	roomID := deployment.CreateRoomWithMembers(t, "hs1", alice.UserID, []*client.CSAPI{bob}, map[string]interface{}{
+		"preset": "public_chat",
+	})
+	rootID := alice.SendEventSynced(t, roomID, b.Event{
+		Type: "m.room.message",
+		Content: map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    "Thread root",
+		},
+	})
+	bob.SyncUntilTimelineHas(t, roomID, func(ev gjson.Result) bool {
+		return ev.Get("event_id").Str == rootID
+	})
+
+	alice.SendThreadedMessage(t, roomID, rootID, "First reply")
+	latestID := bob.SendThreadedMessage(t, roomID, rootID, "Second reply")
+
+	t.Run("Thread summary is bundled with the thread root", func(t *testing.T) {
+		alice.SyncUntilThreadSummary(t, roomID, rootID, func(summary gjson.Result) bool {
+			return summary.Get("count").Int() == 2 &&
+				summary.Get("latest_event.event_id").Str == latestID &&
+				summary.Get("current_user_participated").Bool()
+		})
+	})
+
+	t.Run("Remote users see the thread summary", func(t *testing.T) {
+		bob.SyncUntilThreadSummary(t, roomID, rootID, func(summary gjson.Result) bool {
+			return summary.Get("count").Int() == 2 && summary.Get("latest_event.event_id").Str == latestID
+		})
+	})
+
+	t.Run("/threads lists the thread root", func(t *testing.T) {
+		res := alice.GetThreads(t, roomID)
+		found := false
+		for _, ev := range res.Get("chunk").Array() {
+			if ev.Get("event_id").Str == rootID {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("/threads does not contain thread root %s: %s", rootID, res.Raw)
+		}
+	})
+}
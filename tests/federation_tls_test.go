@@ -0,0 +1,59 @@
+// +build !dendrite_blacklist
+
+// Rationale for being included in Dendrite's blacklist: the Dendrite image does not serve the TLS cert at
+// /complement/tls.
+
+package tests
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"testing"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/docker"
+	"github.com/matrix-org/complement/internal/federation"
+)
+
+// Test that federation requests to a homeserver only succeed if its TLS cert is trusted.
+func TestFederationRequiresTrustedTLSCert(t *testing.T) {
+	// The cert is self-signed, so it is not trusted by anything which only trusts the Complement CA.
+	tlsCert, err := docker.NewTLSCert("hs1", nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create TLS cert: %s", err)
+	}
+	deployment := DeployWithTLSCerts(t, b.BlueprintAlice, map[string]docker.TLSCert{
+		"hs1": *tlsCert,
+	})
+	defer deployment.Destroy(t)
+
+	srv := federation.NewServer(t, deployment)
+
+	t.Run("Federation to a server with an untrusted cert fails", func(t *testing.T) {
+		caPool, err := federation.CACertPool()
+		if err != nil {
+			t.Fatalf("failed to load the Complement CA: %s", err)
+		}
+		fedClient := srv.FederationClientWithRootCAs(deployment, caPool)
+		_, err = fedClient.GetVersion(context.Background(), "hs1")
+		var unknownAuthority x509.UnknownAuthorityError
+		if !errors.As(err, &unknownAuthority) {
+			t.Fatalf("GET /version against a server with an untrusted TLS cert returned %v, want an unknown authority error", err)
+		}
+	})
+	t.Run("Federation to a server with a trusted cert succeeds", func(t *testing.T) {
+		block, _ := pem.Decode([]byte(tlsCert.CertPEM))
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatalf("failed to parse TLS cert: %s", err)
+		}
+		pool := x509.NewCertPool()
+		pool.AddCert(cert)
+		fedClient := srv.FederationClientWithRootCAs(deployment, pool)
+		if _, err := fedClient.GetVersion(context.Background(), "hs1"); err != nil {
+			t.Fatalf("GET /version failed against a server with a trusted TLS cert: %s", err)
+		}
+	})
+}
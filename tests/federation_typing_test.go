@@ -0,0 +1,52 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/b"
+)
+
+// Test that typing notifications are sent to remote servers in the room.
+func TestRemoteTyping(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintFederationOneToOneRoom)
+	defer deployment.Destroy(t)
+
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	bob := deployment.Client(t, "hs2", "@bob:hs2")
+
+	roomID := alice.CreateRoom(t, map[string]interface{}{
+		"preset": "public_chat",
+	})
+	bob.JoinRoom(t, roomID, []string{"hs1"})
+	alice.SyncUntilMembership(t, roomID, bob.UserID, "join")
+
+	// sytest: Typing notifications also sent to remote room members
+	alice.SendTyping(t, roomID, true, 10000)
+	bob.SyncUntilTypingHas(t, roomID, func(ev gjson.Result) bool {
+		if ev.Get("type").Str != "m.typing" {
+			return false
+		}
+		for _, userID := range ev.Get("content.user_ids").Array() {
+			if userID.Str == alice.UserID {
+				return true
+			}
+		}
+		return false
+	})
+
+	// sytest: Typing can be explicitly stopped
+	alice.SendTyping(t, roomID, false, 0)
+	bob.SyncUntilTypingHas(t, roomID, func(ev gjson.Result) bool {
+		if ev.Get("type").Str != "m.typing" {
+			return false
+		}
+		for _, userID := range ev.Get("content.user_ids").Array() {
+			if userID.Str == alice.UserID {
+				return false
+			}
+		}
+		return true
+	})
+}
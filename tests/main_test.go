@@ -62,6 +62,14 @@ func TestMain(m *testing.M) {
 // This function is the main setup function for all tests as it provides a deployment with
 // which tests can interact with.
 func Deploy(t *testing.T, blueprint b.Blueprint) *docker.Deployment {
+	t.Helper()
+	return DeployWithTLSCerts(t, blueprint, nil)
+}
+
+// DeployWithTLSCerts is like Deploy, but the homeservers named in `tlsCerts` serve federation traffic with the
+// given TLS certs instead of ones signed by the Complement CA. The certs are not part of the blueprint, so
+// changing them does not rebuild it.
+func DeployWithTLSCerts(t *testing.T, blueprint b.Blueprint, tlsCerts map[string]docker.TLSCert) *docker.Deployment {
 	t.Helper()
 	timeStartBlueprint := time.Now()
 	if complementBuilder == nil {
@@ -75,6 +83,7 @@ func Deploy(t *testing.T, blueprint b.Blueprint) *docker.Deployment {
 	if err != nil {
 		t.Fatalf("Deploy: NewDeployer returned error %s", err)
 	}
+	d.TLSCerts = tlsCerts
 	timeStartDeploy := time.Now()
 	dep, err := d.Deploy(context.Background(), blueprint.Name)
 	if err != nil {
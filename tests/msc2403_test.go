@@ -6,7 +6,6 @@
 package tests
 
 import (
-	"encoding/json"
 	"fmt"
 	"net/url"
 	"testing"
@@ -308,54 +307,19 @@ func knockingBetweenTwoUsersTest(t *testing.T, roomID string, inRoomUser, knocki
 // serverNames should be populated if knocking on a room that the user's homeserver isn't currently a part of.
 // Fails the test if the knock response does not return a 200 status code.
 func knockOnRoomSynced(t *testing.T, c *client.CSAPI, roomID, reason string, serverNames []string) {
-	knockOnRoomWithStatus(t, c, roomID, reason, serverNames, 200)
+	c.Knock(t, roomID, serverNames, reason)
 
 	// The knock should have succeeded. Block until we see the knock appear down sync
-	c.SyncUntil(
-		t,
-		"",
-		"",
-		"rooms.knock."+client.GjsonEscape(roomID)+".knock_state.events",
-		func(ev gjson.Result) bool {
-			// We don't currently define any required state event types to be sent.
-			// If we've reached this point, then an entry for this room was found
-			return true
-		},
-	)
+	c.SyncUntilKnock(t, roomID)
 }
 
 // knockOnRoomWithStatus will knock on a given room on the behalf of a user.
 // serverNames should be populated if knocking on a room that the user's homeserver isn't currently a part of.
 // expectedStatus allows setting an expected status code. If the response code differs, the test will fail.
 func knockOnRoomWithStatus(t *testing.T, c *client.CSAPI, roomID, reason string, serverNames []string, expectedStatus int) {
-	b := []byte("{}")
-	var err error
-	if reason != "" {
-		// Add the reason to the request body
-		requestBody := struct {
-			Reason string `json:"reason"`
-		}{
-			// We specify a reason here instead of using the same one each time as implementations can
-			// cache responses to identical requests
-			reason,
-		}
-		b, err = json.Marshal(requestBody)
-		must.NotError(t, "knockOnRoomWithStatus failed to marshal JSON body", err)
-	}
-
-	// Add any server names to the query parameters
-	query := url.Values{
-		"server_name": serverNames,
-	}
-
-	// Knock on the room
-	res := c.DoFunc(
-		t,
-		"POST",
-		[]string{"_matrix", "client", "r0", "knock", roomID},
-		client.WithQueries(query),
-		client.WithRawBody(b),
-	)
+	// We specify a reason each time instead of using the same one as implementations can
+	// cache responses to identical requests
+	res := c.KnockError(t, roomID, serverNames, reason)
 	must.MatchResponse(t, res, match.HTTPResponse{
 		StatusCode: expectedStatus,
 	})
@@ -10,7 +10,6 @@ import (
 	"bytes"
 	"fmt"
 	"io/ioutil"
-	"net/http"
 	"net/url"
 	"testing"
 	"time"
@@ -32,10 +31,6 @@ type event struct {
 	Content        map[string]interface{}
 }
 
-// This is configurable because it can be nice to change it to `time.Second` while
-// checking out the test result in a Synapse instance
-const timeBetweenMessages = time.Millisecond
-
 var (
 	insertionEventType = "org.matrix.msc2716.insertion"
 	chunkEventType     = "org.matrix.msc2716.chunk"
@@ -98,46 +93,28 @@ func TestBackfillingHistory(t *testing.T) {
 			// wait X number of ms to ensure that the timestamp changes enough for
 			// each of the messages we try to backfill later
 			numHistoricalMessages := 6
-			time.Sleep(time.Duration(numHistoricalMessages) * timeBetweenMessages)
+			time.Sleep(time.Duration(numHistoricalMessages) * client.BatchSendInterval)
 
 			// Create the second batch of events.
 			// This will also fill up the buffer so we have to scrollback to the
 			// inserted history later.
 			eventIDsAfter := createMessagesInRoom(t, alice, roomID, 2)
 
-			// Insert the most recent chunk of backfilled history
-			batchSendRes := batchSendHistoricalMessages(
-				t,
-				as,
-				[]string{virtualUserID},
-				roomID,
-				eventIdBefore,
-				timeAfterEventBefore.Add(timeBetweenMessages*3),
-				"",
-				3,
-				// Status
-				200,
+			// Insert the most recent chunk of backfilled history, in the later half of the gap
+			batchSendRes := as.BatchSend(
+				t, roomID, eventIdBefore, "", timeAfterEventBefore.Add(client.BatchSendInterval*3),
+				historicalMessages([]string{virtualUserID}, 3), virtualUserJoins([]string{virtualUserID}),
 			)
-			batchSendResBody := client.ParseJSON(t, batchSendRes)
-			historicalEventIDs := getEventsFromBatchSendResponseBody(t, batchSendResBody)
-			nextChunkID := getNextChunkIdFromBatchSendResponseBody(t, batchSendResBody)
+			historicalEventIDs := eventIDs(batchSendRes.Get("events"))
+			nextChunkID := batchSendRes.Get("next_chunk_id").Str
 
-			// Insert another older chunk of backfilled history from the same user.
+			// Insert another older chunk of backfilled history from the same user, in the earlier half of the gap.
 			// Make sure the meta data and joins still work on the subsequent chunk
-			batchSendRes2 := batchSendHistoricalMessages(
-				t,
-				as,
-				[]string{virtualUserID},
-				roomID,
-				eventIdBefore,
-				timeAfterEventBefore,
-				nextChunkID,
-				3,
-				// Status
-				200,
+			batchSendRes2 := as.BatchSend(
+				t, roomID, eventIdBefore, nextChunkID, timeAfterEventBefore,
+				historicalMessages([]string{virtualUserID}, 3), virtualUserJoins([]string{virtualUserID}),
 			)
-			batchSendResBody2 := client.ParseJSON(t, batchSendRes2)
-			historicalEventIDs2 := getEventsFromBatchSendResponseBody(t, batchSendResBody2)
+			historicalEventIDs2 := eventIDs(batchSendRes2.Get("events"))
 
 			var expectedEventIDOrder []string
 			expectedEventIDOrder = append(expectedEventIDOrder, eventIDsBefore...)
@@ -171,6 +148,9 @@ func TestBackfillingHistory(t *testing.T) {
 					match.JSONArrayEach("chunk", func(r gjson.Result) error {
 						// Find all events in order
 						if isRelevantEvent(r) {
+							if len(workingExpectedEventIDOrder) == 0 {
+								return fmt.Errorf("Unexpected event %s found after all expected events", r.Get("event_id").Str)
+							}
 							// Pop the next message off the expected list
 							nextEventIdInOrder := workingExpectedEventIDOrder[0]
 							workingExpectedEventIDOrder = workingExpectedEventIDOrder[1:]
@@ -208,20 +188,12 @@ func TestBackfillingHistory(t *testing.T) {
 			ensureVirtualUserRegistered(t, as, "carol")
 
 			// Insert a backfilled event
-			batchSendRes := batchSendHistoricalMessages(
-				t,
-				as,
-				[]string{virtualUserID, virtualUserID2, virtualUserID3},
-				roomID,
-				eventIdBefore,
-				timeAfterEventBefore,
-				"",
-				3,
-				// Status
-				200,
+			virtualUserIDs := []string{virtualUserID, virtualUserID2, virtualUserID3}
+			batchSendRes := as.BatchSend(
+				t, roomID, eventIdBefore, "", timeAfterEventBefore,
+				historicalMessages(virtualUserIDs, 3), virtualUserJoins(virtualUserIDs),
 			)
-			batchSendResBody := client.ParseJSON(t, batchSendRes)
-			historicalEventIDs := getEventsFromBatchSendResponseBody(t, batchSendResBody)
+			historicalEventIDs := eventIDs(batchSendRes.Get("events"))
 
 			messagesRes := alice.MustDoFunc(t, "GET", []string{"_matrix", "client", "r0", "rooms", roomID, "messages"}, client.WithContentType("application/json"), client.WithQueries(url.Values{
 				"dir":   []string{"b"},
@@ -237,6 +209,62 @@ func TestBackfillingHistory(t *testing.T) {
 			})
 		})
 
+		t.Run("Historical events imported with BatchSend are returned by /messages in order", func(t *testing.T) {
+			t.Parallel()
+
+			roomID := as.CreateRoom(t, createRoomOpts)
+			alice.JoinRoom(t, roomID, nil)
+			eventIDsBefore := createMessagesInRoom(t, alice, roomID, 1)
+			timeAfterEventBefore := time.Now()
+			// Leave a gap in the timestamps for both batches
+			time.Sleep(4 * client.BatchSendInterval)
+			eventIDsAfter := createMessagesInRoom(t, alice, roomID, 1)
+
+			messagesWithBodies := func(bodies ...string) []b.Event {
+				evs := make([]b.Event, len(bodies))
+				for i, body := range bodies {
+					evs[i] = b.Event{
+						Type:   "m.room.message",
+						Sender: virtualUserID,
+						Content: map[string]interface{}{
+							"msgtype":              "m.text",
+							"body":                 body,
+							historicalContentField: true,
+						},
+					}
+				}
+				return evs
+			}
+			stateEvents := virtualUserJoins([]string{virtualUserID})
+
+			// the newer batch is imported first, then the older batch is connected to it. Each batch has its own
+			// time range in the gap.
+			newerBatch := as.BatchSend(t, roomID, eventIDsBefore[0], "", timeAfterEventBefore.Add(2*client.BatchSendInterval), messagesWithBodies("c", "d"), stateEvents)
+			olderBatch := as.BatchSend(t, roomID, eventIDsBefore[0], newerBatch.Get("next_chunk_id").Str, timeAfterEventBefore, messagesWithBodies("a", "b"), stateEvents)
+
+			if len(newerBatch.Get("events").Array()) == 0 || len(olderBatch.Get("events").Array()) == 0 {
+				t.Fatalf("BatchSend returned no events: %s %s", newerBatch.Raw, olderBatch.Raw)
+			}
+
+			// Paginating backwards, then reversing, the messages are the live event before, then the older
+			// batch, then the newer batch, then the live event after.
+			var got []string
+			for _, ev := range alice.AllMessages(t, roomID, "b") {
+				if ev.Get("type").Str != "m.room.message" {
+					continue
+				}
+				switch ev.Get("event_id").Str {
+				case eventIDsBefore[0]:
+					got = append(got, "before")
+				case eventIDsAfter[0]:
+					got = append(got, "after")
+				default:
+					got = append(got, ev.Get("content.body").Str)
+				}
+			}
+			must.HaveInOrder(t, reversed(got), []string{"before", "a", "b", "c", "d", "after"})
+		})
+
 		t.Run("Backfilled historical events with m.historical do not come down in an incremental sync", func(t *testing.T) {
 			t.Parallel()
 
@@ -252,20 +280,11 @@ func TestBackfillingHistory(t *testing.T) {
 			createMessagesInRoom(t, alice, roomID, 5)
 
 			// Insert a backfilled event
-			batchSendRes := batchSendHistoricalMessages(
-				t,
-				as,
-				[]string{virtualUserID},
-				roomID,
-				eventIdBefore,
-				timeAfterEventBefore,
-				"",
-				1,
-				// Status
-				200,
+			batchSendRes := as.BatchSend(
+				t, roomID, eventIdBefore, "", timeAfterEventBefore,
+				historicalMessages([]string{virtualUserID}, 1), virtualUserJoins([]string{virtualUserID}),
 			)
-			batchSendResBody := client.ParseJSON(t, batchSendRes)
-			historicalEventIDs := getEventsFromBatchSendResponseBody(t, batchSendResBody)
+			historicalEventIDs := eventIDs(batchSendRes.Get("events"))
 			backfilledEventId := historicalEventIDs[0]
 
 			// This is just a dummy event we search for after the backfilledEventId
@@ -289,21 +308,16 @@ func TestBackfillingHistory(t *testing.T) {
 
 			roomID := as.CreateRoom(t, createRoomOpts)
 
-			batchSendHistoricalMessages(
-				t,
-				as,
-				[]string{virtualUserID},
-				roomID,
-				"$some-non-existant-event-id",
-				time.Now(),
-				"",
-				1,
-				// Status
-				// TODO: Seems like this makes more sense as a 404
-				// But the current Synapse code around unknown prev events will throw ->
-				// `403: No create event in auth events`
-				403,
+			res := as.DoBatchSend(
+				t, roomID, "$some-non-existant-event-id", "", time.Now(),
+				historicalMessages([]string{virtualUserID}, 1), virtualUserJoins([]string{virtualUserID}),
 			)
+			// TODO: Seems like this makes more sense as a 404
+			// But the current Synapse code around unknown prev events will throw ->
+			// `403: No create event in auth events`
+			must.MatchResponse(t, res, match.HTTPResponse{
+				StatusCode: 403,
+			})
 		})
 
 		t.Run("Normal users aren't allowed to backfill messages", func(t *testing.T) {
@@ -316,19 +330,14 @@ func TestBackfillingHistory(t *testing.T) {
 			eventIdBefore := eventIDsBefore[0]
 			timeAfterEventBefore := time.Now()
 
-			batchSendHistoricalMessages(
-				t,
-				alice,
-				[]string{virtualUserID},
-				roomID,
-				eventIdBefore,
-				timeAfterEventBefore,
-				"",
-				1,
-				// Status
-				// Normal user alice should not be able to backfill messages
-				403,
+			res := alice.DoBatchSend(
+				t, roomID, eventIdBefore, "", timeAfterEventBefore,
+				historicalMessages([]string{virtualUserID}, 1), virtualUserJoins([]string{virtualUserID}),
 			)
+			// Normal user alice should not be able to backfill messages
+			must.MatchResponse(t, res, match.HTTPResponse{
+				StatusCode: 403,
+			})
 		})
 
 		t.Run("TODO: Test if historical avatar/display name set back in time are picked up on historical messages", func(t *testing.T) {
@@ -350,20 +359,11 @@ func TestBackfillingHistory(t *testing.T) {
 			// eventIDsAfter
 			createMessagesInRoom(t, alice, roomID, 3)
 
-			batchSendRes := batchSendHistoricalMessages(
-				t,
-				as,
-				[]string{virtualUserID},
-				roomID,
-				eventIdBefore,
-				timeAfterEventBefore,
-				"",
-				2,
-				// Status
-				200,
+			batchSendRes := as.BatchSend(
+				t, roomID, eventIdBefore, "", timeAfterEventBefore,
+				historicalMessages([]string{virtualUserID}, 2), virtualUserJoins([]string{virtualUserID}),
 			)
-			batchSendResBody := client.ParseJSON(t, batchSendRes)
-			historicalEventIDs := getEventsFromBatchSendResponseBody(t, batchSendResBody)
+			historicalEventIDs := eventIDs(batchSendRes.Get("events"))
 
 			// Join the room from a remote homeserver after the backfilled messages were sent
 			remoteCharlie.JoinRoom(t, roomID, []string{"hs1"})
@@ -423,20 +423,11 @@ func TestBackfillingHistory(t *testing.T) {
 			// eventIDsAfter
 			createMessagesInRoom(t, alice, roomID, 3)
 
-			batchSendRes := batchSendHistoricalMessages(
-				t,
-				as,
-				[]string{virtualUserID},
-				roomID,
-				eventIdBefore,
-				timeAfterEventBefore,
-				chunkId,
-				2,
-				// Status
-				200,
+			batchSendRes := as.BatchSend(
+				t, roomID, eventIdBefore, chunkId, timeAfterEventBefore,
+				historicalMessages([]string{virtualUserID}, 2), virtualUserJoins([]string{virtualUserID}),
 			)
-			batchSendResBody := client.ParseJSON(t, batchSendRes)
-			historicalEventIDs := getEventsFromBatchSendResponseBody(t, batchSendResBody)
+			historicalEventIDs := eventIDs(batchSendRes.Get("events"))
 
 			// Join the room from a remote homeserver after the backfilled messages were sent
 			remoteCharlie.JoinRoom(t, roomID, []string{"hs1"})
@@ -488,20 +479,11 @@ func TestBackfillingHistory(t *testing.T) {
 				"limit": []string{"5"},
 			}))
 
-			batchSendRes := batchSendHistoricalMessages(
-				t,
-				as,
-				[]string{virtualUserID},
-				roomID,
-				eventIdBefore,
-				timeAfterEventBefore,
-				"",
-				2,
-				// Status
-				200,
+			batchSendRes := as.BatchSend(
+				t, roomID, eventIdBefore, "", timeAfterEventBefore,
+				historicalMessages([]string{virtualUserID}, 2), virtualUserJoins([]string{virtualUserID}),
 			)
-			batchSendResBody := client.ParseJSON(t, batchSendRes)
-			historicalEventIDs := getEventsFromBatchSendResponseBody(t, batchSendResBody)
+			historicalEventIDs := eventIDs(batchSendRes.Get("events"))
 			baseInsertionEventID := historicalEventIDs[len(historicalEventIDs)-1]
 
 			// [1 insertion event + 2 historical events + 1 chunk event + 1 insertion event]
@@ -593,20 +575,11 @@ func TestBackfillingHistory(t *testing.T) {
 			}))
 
 			// Historical messages are inserted where we have already scrolled back to
-			batchSendRes := batchSendHistoricalMessages(
-				t,
-				as,
-				[]string{virtualUserID},
-				roomID,
-				eventIdBefore,
-				timeAfterEventBefore,
-				"",
-				2,
-				// Status
-				200,
+			batchSendRes := as.BatchSend(
+				t, roomID, eventIdBefore, "", timeAfterEventBefore,
+				historicalMessages([]string{virtualUserID}, 2), virtualUserJoins([]string{virtualUserID}),
 			)
-			batchSendResBody := client.ParseJSON(t, batchSendRes)
-			historicalEventIDs := getEventsFromBatchSendResponseBody(t, batchSendResBody)
+			historicalEventIDs := eventIDs(batchSendRes.Get("events"))
 
 			// TODO: Send marker event
 
@@ -751,93 +724,45 @@ func createMessagesInRoom(t *testing.T, c *client.CSAPI, roomID string, count in
 	return eventIDs
 }
 
-var chunkCount int64 = 0
-
-func batchSendHistoricalMessages(
-	t *testing.T,
-	c *client.CSAPI,
-	virtualUserIDs []string,
-	roomID string,
-	insertAfterEventId string,
-	insertTime time.Time,
-	chunkID string,
-	count int,
-	expectedStatus int,
-) (res *http.Response) {
-	// Timestamp in milliseconds
-	insertOriginServerTs := uint64(insertTime.UnixNano() / int64(time.Millisecond))
-
-	timeBetweenMessagesMS := uint64(timeBetweenMessages / time.Millisecond)
-
-	evs := make([]map[string]interface{}, count)
-	for i := 0; i < len(evs); i++ {
-		virtualUserID := virtualUserIDs[i%len(virtualUserIDs)]
-
-		newEvent := map[string]interface{}{
-			"type":             "m.room.message",
-			"sender":           virtualUserID,
-			"origin_server_ts": insertOriginServerTs + (timeBetweenMessagesMS * uint64(i)),
-			"content": map[string]interface{}{
+// historicalMessages returns `count` historical messages to import with CSAPI.BatchSend, sent by each of the
+// virtual users in turn.
+func historicalMessages(virtualUserIDs []string, count int) []b.Event {
+	evs := make([]b.Event, count)
+	for i := range evs {
+		evs[i] = b.Event{
+			Type:   "m.room.message",
+			Sender: virtualUserIDs[i%len(virtualUserIDs)],
+			Content: map[string]interface{}{
 				"msgtype":              "m.text",
-				"body":                 fmt.Sprintf("Historical %d (chunk=%d)", i, chunkCount),
+				"body":                 fmt.Sprintf("Historical %d", i),
 				historicalContentField: true,
 			},
 		}
-
-		evs[i] = newEvent
 	}
+	return evs
+}
 
-	state_evs := make([]map[string]interface{}, len(virtualUserIDs))
+// virtualUserJoins returns the joins of the virtual users, for the state at the start of a batch imported with
+// CSAPI.BatchSend.
+func virtualUserJoins(virtualUserIDs []string) []b.Event {
+	evs := make([]b.Event, len(virtualUserIDs))
 	for i, virtualUserID := range virtualUserIDs {
-		joinEvent := map[string]interface{}{
-			"type":             "m.room.member",
-			"sender":           virtualUserID,
-			"origin_server_ts": insertOriginServerTs,
-			"content": map[string]interface{}{
+		evs[i] = b.Event{
+			Type:     "m.room.member",
+			Sender:   virtualUserID,
+			StateKey: b.Ptr(virtualUserID),
+			Content: map[string]interface{}{
 				"membership": "join",
 			},
-			"state_key": virtualUserID,
 		}
-
-		state_evs[i] = joinEvent
-	}
-
-	query := make(url.Values, 2)
-	query.Add("prev_event", insertAfterEventId)
-	// If provided, connect the chunk to the last insertion point
-	if chunkID != "" {
-		query.Add("chunk_id", chunkID)
 	}
-
-	res = c.DoFunc(
-		t,
-		"POST",
-		[]string{"_matrix", "client", "unstable", "org.matrix.msc2716", "rooms", roomID, "batch_send"},
-		client.WithJSONBody(t, map[string]interface{}{
-			"events":                evs,
-			"state_events_at_start": state_evs,
-		}),
-		client.WithContentType("application/json"),
-		client.WithQueries(query),
-	)
-
-	if res.StatusCode != expectedStatus {
-		t.Fatalf("msc2716.batchSendHistoricalMessages got %d HTTP status code from batch send response but want %d", res.StatusCode, expectedStatus)
-	}
-
-	chunkCount++
-
-	return res
-}
-
-func getEventsFromBatchSendResponseBody(t *testing.T, body []byte) (eventIDs []string) {
-	eventIDs = client.GetJSONFieldStringArray(t, body, "events")
-
-	return eventIDs
+	return evs
 }
 
-func getNextChunkIdFromBatchSendResponseBody(t *testing.T, body []byte) (nextChunkID string) {
-	nextChunkID = client.GetJSONFieldStr(t, body, "next_chunk_id")
-
-	return nextChunkID
+func eventIDs(events gjson.Result) []string {
+	var ids []string
+	for _, ev := range events.Array() {
+		ids = append(ids, ev.Str)
+	}
+	return ids
 }
@@ -6,7 +6,9 @@
 // compatibility:
 //
 // * The /spaces endpoint, which was the original version.
-// * The /hierarchy endpoint, which is an updated version.
+// * The /hierarchy endpoint, which is an updated version. This is requested
+//   with CSAPI.SpaceHierarchy, which prefers the stable endpoint if the server
+//   supports it.
 //
 // Both endpoints return data from the same set of rooms / spaces, but have
 // different API shapes.
@@ -18,6 +20,8 @@ package tests
 import (
 	"fmt"
 	"net/url"
+	"sort"
+	"strings"
 	"testing"
 
 	"github.com/tidwall/gjson"
@@ -39,6 +43,59 @@ func eventKey(srcRoomID, dstRoomID, evType string) string {
 	return srcRoomID + "|" + dstRoomID + "|" + evType
 }
 
+// spaceGraph is the set of m.space.child links in a /spaces or /hierarchy response, keyed by the parent room ID
+// and then the child room ID, with the content of the link as the value.
+type spaceGraph map[string]map[string]gjson.Result
+
+// parseSpaceGraph parses the links in a /spaces response, which lists them under `events`, or a /hierarchy
+// response, which lists them under the `children_state` of each room.
+func parseSpaceGraph(body []byte) spaceGraph {
+	g := make(spaceGraph)
+	add := func(parentRoomID string, ev gjson.Result) {
+		if ev.Get("type").Str != spaceChildEventType {
+			return
+		}
+		if ev.Get("room_id").Exists() {
+			parentRoomID = ev.Get("room_id").Str
+		}
+		if g[parentRoomID] == nil {
+			g[parentRoomID] = make(map[string]gjson.Result)
+		}
+		g[parentRoomID][ev.Get("state_key").Str] = ev.Get("content")
+	}
+	gjson.GetBytes(body, "events").ForEach(func(_, ev gjson.Result) bool {
+		add("", ev)
+		return true
+	})
+	gjson.GetBytes(body, "rooms").ForEach(func(_, room gjson.Result) bool {
+		room.Get("children_state").ForEach(func(_, ev gjson.Result) bool {
+			add(room.Get("room_id").Str, ev)
+			return true
+		})
+		return true
+	})
+	return g
+}
+
+// matchSpaceEdge returns a matcher which checks that a /spaces or /hierarchy response has a link from the
+// space `parent` to `child` with exactly the servers in `via`, in order.
+func matchSpaceEdge(parent, child string, via []string) match.JSON {
+	return func(body []byte) error {
+		content, ok := parseSpaceGraph(body)[parent][child]
+		if !ok {
+			return fmt.Errorf("matchSpaceEdge: no link from %s to %s", parent, child)
+		}
+		var gotVia []string
+		for _, v := range content.Get("via").Array() {
+			gotVia = append(gotVia, v.Str)
+		}
+		if strings.Join(gotVia, ",") != strings.Join(via, ",") {
+			return fmt.Errorf("matchSpaceEdge: link from %s to %s got via %v want %v", parent, child, gotVia, via)
+		}
+		return nil
+	}
+}
+
 // Tests that the CS API for MSC2946 works correctly. Creates a space directory like:
 //     Root
 //      |
@@ -135,29 +192,31 @@ func TestClientSpacesSummary(t *testing.T) {
 
 	// create the links
 	rootToR1 := eventKey(root, r1, spaceChildEventType)
-	alice.SendEventSynced(t, root, b.Event{
-		Type:     spaceChildEventType,
-		StateKey: &r1,
-		Content: map[string]interface{}{
-			"via":       []string{"hs1"},
-			"suggested": true,
-		},
-	})
 	rootToSS1 := eventKey(root, ss1, spaceChildEventType)
-	alice.SendEventSynced(t, root, b.Event{
-		Type:     spaceChildEventType,
-		StateKey: &ss1,
-		Content: map[string]interface{}{
-			"via": []string{"hs1"},
-		},
-	})
 	rootToR2 := eventKey(root, r2, spaceChildEventType)
-	alice.SendEventSynced(t, root, b.Event{
-		Type:     spaceChildEventType,
-		StateKey: &r2,
-		Content: map[string]interface{}{
-			"via":       []string{"hs1"},
-			"suggested": true,
+	alice.SendEventsSynced(t, root, []b.Event{
+		{
+			Type:     spaceChildEventType,
+			StateKey: &r1,
+			Content: map[string]interface{}{
+				"via":       []string{"hs1"},
+				"suggested": true,
+			},
+		},
+		{
+			Type:     spaceChildEventType,
+			StateKey: &ss1,
+			Content: map[string]interface{}{
+				"via": []string{"hs1"},
+			},
+		},
+		{
+			Type:     spaceChildEventType,
+			StateKey: &r2,
+			Content: map[string]interface{}{
+				"via":       []string{"hs1"},
+				"suggested": true,
+			},
 		},
 	})
 	// Note that this link gets ignored since R2 is not a space.
@@ -234,41 +293,55 @@ func TestClientSpacesSummary(t *testing.T) {
 				}, func(r gjson.Result) interface{} {
 					return eventKey(r.Get("room_id").Str, r.Get("state_key").Str, r.Get("type").Str)
 				}, nil),
+				matchSpaceEdge(root, r1, []string{"hs1"}),
+				matchSpaceEdge(root, r2, []string{"hs1"}),
+				matchSpaceEdge(ss1, ss2, []string{"hs1"}),
+				matchSpaceEdge(ss2, r4, []string{"hs1"}),
 			},
 		})
 
-		res = alice.MustDo(t, "GET", []string{"_matrix", "client", "unstable", "org.matrix.msc2946", "rooms", root, "hierarchy"}, nil)
-		must.MatchResponse(t, res, match.HTTPResponse{
-			JSON: []match.JSON{
-				match.JSONCheckOff("rooms", []interface{}{
-					root, r1, r2, r3, r4, ss1, ss2,
-				}, func(r gjson.Result) interface{} {
-					return r.Get("room_id").Str
-				}, func(roomInt interface{}, data gjson.Result) error {
-					roomID := roomInt.(string)
-					// check fields
-					if name, ok := roomNames[roomID]; ok {
-						if data.Get("name").Str != name {
-							return fmt.Errorf("room %s got name %s want %s", roomID, data.Get("name").Str, name)
-						}
+		must.MatchGJSON(t, alice.SpaceHierarchy(t, root, client.SpaceHierarchyReq{}),
+			match.JSONArrayEach("rooms", func(r gjson.Result) error {
+				if !strings.HasPrefix(r.Get("room_id").Str, "!") {
+					return fmt.Errorf("invalid room_id '%s'", r.Get("room_id").Raw)
+				}
+				if r.Get("num_joined_members").Type != gjson.Number {
+					return fmt.Errorf("room %s has no num_joined_members", r.Get("room_id").Str)
+				}
+				return nil
+			}),
+			match.JSONCheckOff("rooms", []interface{}{
+				root, r1, r2, r3, r4, ss1, ss2,
+			}, func(r gjson.Result) interface{} {
+				return r.Get("room_id").Str
+			}, func(roomInt interface{}, data gjson.Result) error {
+				roomID := roomInt.(string)
+				// check fields
+				if name, ok := roomNames[roomID]; ok {
+					if data.Get("name").Str != name {
+						return fmt.Errorf("room %s got name %s want %s", roomID, data.Get("name").Str, name)
 					}
-					if roomID == ss1 {
-						wantType := "m.space"
-						if data.Get("room_type").Str != wantType {
-							return fmt.Errorf("room %s got type %s want %s", roomID, data.Get("room_type").Str, wantType)
-						}
+				}
+				if roomID == ss1 {
+					wantType := "m.space"
+					if data.Get("room_type").Str != wantType {
+						return fmt.Errorf("room %s got type %s want %s", roomID, data.Get("room_type").Str, wantType)
 					}
-					return nil
-				}),
-				// Check that the links from Root down to other rooms and spaces exist.
-				match.JSONCheckOff("rooms.#.children_state|@flatten", []interface{}{
-					rootToR1, rootToR2, rootToSS1,
-					ss1ToSS2, ss2ToR3, ss2ToR4,
-				}, func(r gjson.Result) interface{} {
-					return eventKey(r.Get("room_id").Str, r.Get("state_key").Str, r.Get("type").Str)
-				}, nil),
-			},
-		})
+				}
+				return nil
+			}),
+			// Check that the links from Root down to other rooms and spaces exist.
+			match.JSONCheckOff("rooms.#.children_state|@flatten", []interface{}{
+				rootToR1, rootToR2, rootToSS1,
+				ss1ToSS2, ss2ToR3, ss2ToR4,
+			}, func(r gjson.Result) interface{} {
+				return eventKey(r.Get("room_id").Str, r.Get("state_key").Str, r.Get("type").Str)
+			}, nil),
+			matchSpaceEdge(root, r1, []string{"hs1"}),
+			matchSpaceEdge(root, r2, []string{"hs1"}),
+			matchSpaceEdge(ss1, ss2, []string{"hs1"}),
+			matchSpaceEdge(ss2, r4, []string{"hs1"}),
+		)
 	})
 
 	// - Setting max_rooms_per_space works correctly
@@ -303,98 +376,59 @@ func TestClientSpacesSummary(t *testing.T) {
 	// - Setting max_depth works correctly
 	t.Run("max_depth", func(t *testing.T) {
 		// Should only include R1, SS1, and R2.
-		query := make(url.Values, 1)
-		query.Set("max_depth", "1")
-		res := alice.MustDoFunc(
-			t,
-			"GET",
-			[]string{"_matrix", "client", "unstable", "org.matrix.msc2946", "rooms", root, "hierarchy"},
-			client.WithQueries(query),
+		must.MatchGJSON(t, alice.SpaceHierarchy(t, root, client.SpaceHierarchyReq{MaxDepth: 1}),
+			match.JSONCheckOff("rooms", []interface{}{
+				root, r1, r2, ss1,
+			}, func(r gjson.Result) interface{} {
+				return r.Get("room_id").Str
+			}, nil),
+			// All of the links are still there.
+			match.JSONCheckOff("rooms.#.children_state|@flatten", []interface{}{
+				rootToR1, rootToR2, rootToSS1, ss1ToSS2,
+			}, func(r gjson.Result) interface{} {
+				return eventKey(r.Get("room_id").Str, r.Get("state_key").Str, r.Get("type").Str)
+			}, nil),
 		)
-		must.MatchResponse(t, res, match.HTTPResponse{
-			JSON: []match.JSON{
-				match.JSONCheckOff("rooms", []interface{}{
-					root, r1, r2, ss1,
-				}, func(r gjson.Result) interface{} {
-					return r.Get("room_id").Str
-				}, nil),
-				// All of the links are still there.
-				match.JSONCheckOff("rooms.#.children_state|@flatten", []interface{}{
-					rootToR1, rootToR2, rootToSS1, ss1ToSS2,
-				}, func(r gjson.Result) interface{} {
-					return eventKey(r.Get("room_id").Str, r.Get("state_key").Str, r.Get("type").Str)
-				}, nil),
-			},
-		})
 	})
 
 	// - Setting suggested_only works correctly
 	t.Run("suggested_only", func(t *testing.T) {
 		// Should only include R1, SS1, and R2.
-		query := make(url.Values, 1)
-		query.Set("suggested_only", "true")
-		res := alice.MustDoFunc(
-			t,
-			"GET",
-			[]string{"_matrix", "client", "unstable", "org.matrix.msc2946", "rooms", root, "hierarchy"},
-			client.WithQueries(query),
+		must.MatchGJSON(t, alice.SpaceHierarchy(t, root, client.SpaceHierarchyReq{SuggestedOnly: true}),
+			match.JSONCheckOff("rooms", []interface{}{
+				root, r1, r2,
+			}, func(r gjson.Result) interface{} {
+				return r.Get("room_id").Str
+			}, nil),
+			// All of the links are still there.
+			match.JSONCheckOff("rooms.#.children_state|@flatten", []interface{}{
+				rootToR1, rootToR2,
+			}, func(r gjson.Result) interface{} {
+				return eventKey(r.Get("room_id").Str, r.Get("state_key").Str, r.Get("type").Str)
+			}, nil),
 		)
-		must.MatchResponse(t, res, match.HTTPResponse{
-			JSON: []match.JSON{
-				match.JSONCheckOff("rooms", []interface{}{
-					root, r1, r2,
-				}, func(r gjson.Result) interface{} {
-					return r.Get("room_id").Str
-				}, nil),
-				// All of the links are still there.
-				match.JSONCheckOff("rooms.#.children_state|@flatten", []interface{}{
-					rootToR1, rootToR2,
-				}, func(r gjson.Result) interface{} {
-					return eventKey(r.Get("room_id").Str, r.Get("state_key").Str, r.Get("type").Str)
-				}, nil),
-			},
-		})
 	})
 
 	// - Setting max_depth works correctly
 	t.Run("pagination", func(t *testing.T) {
 		// The initial page should only include Root, R1, SS1, and SS2.
-		query := make(url.Values, 1)
-		query.Set("limit", "4")
-		res := alice.MustDoFunc(
-			t,
-			"GET",
-			[]string{"_matrix", "client", "unstable", "org.matrix.msc2946", "rooms", root, "hierarchy"},
-			client.WithQueries(query),
+		res := alice.SpaceHierarchy(t, root, client.SpaceHierarchyReq{Limit: 4})
+		must.MatchGJSON(t, res,
+			match.JSONCheckOff("rooms", []interface{}{
+				root, r1, ss1, ss2,
+			}, func(r gjson.Result) interface{} {
+				return r.Get("room_id").Str
+			}, nil),
 		)
-		body := must.MatchResponse(t, res, match.HTTPResponse{
-			JSON: []match.JSON{
-				match.JSONCheckOff("rooms", []interface{}{
-					root, r1, ss1, ss2,
-				}, func(r gjson.Result) interface{} {
-					return r.Get("room_id").Str
-				}, nil),
-			},
-		})
 
 		// The following page should include R3, R4, and R2.
-		query = make(url.Values, 1)
-		query.Set("from", client.GetJSONFieldStr(t, body, "next_batch"))
-		res = alice.MustDoFunc(
-			t,
-			"GET",
-			[]string{"_matrix", "client", "unstable", "org.matrix.msc2946", "rooms", root, "hierarchy"},
-			client.WithQueries(query),
+		must.MatchGJSON(t, alice.SpaceHierarchy(t, root, client.SpaceHierarchyReq{From: res.Get("next_batch").Str}),
+			match.JSONCheckOff("rooms", []interface{}{
+				r3, r4, r2,
+			}, func(r gjson.Result) interface{} {
+				return r.Get("room_id").Str
+			}, nil),
 		)
-		must.MatchResponse(t, res, match.HTTPResponse{
-			JSON: []match.JSON{
-				match.JSONCheckOff("rooms", []interface{}{
-					r3, r4, r2,
-				}, func(r gjson.Result) interface{} {
-					return r.Get("room_id").Str
-				}, nil),
-			},
-		})
 	})
 
 	t.Run("redact link", func(t *testing.T) {
@@ -420,21 +454,18 @@ func TestClientSpacesSummary(t *testing.T) {
 			},
 		})
 
-		res = alice.MustDo(t, "GET", []string{"_matrix", "client", "unstable", "org.matrix.msc2946", "rooms", root, "hierarchy"}, nil)
-		must.MatchResponse(t, res, match.HTTPResponse{
-			JSON: []match.JSON{
-				match.JSONCheckOff("rooms", []interface{}{
-					root, r1, r2,
-				}, func(r gjson.Result) interface{} {
-					return r.Get("room_id").Str
-				}, nil),
-				match.JSONCheckOff("rooms.#.children_state|@flatten", []interface{}{
-					rootToR1, rootToR2,
-				}, func(r gjson.Result) interface{} {
-					return eventKey(r.Get("room_id").Str, r.Get("state_key").Str, r.Get("type").Str)
-				}, nil),
-			},
-		})
+		must.MatchGJSON(t, alice.SpaceHierarchy(t, root, client.SpaceHierarchyReq{}),
+			match.JSONCheckOff("rooms", []interface{}{
+				root, r1, r2,
+			}, func(r gjson.Result) interface{} {
+				return r.Get("room_id").Str
+			}, nil),
+			match.JSONCheckOff("rooms.#.children_state|@flatten", []interface{}{
+				rootToR1, rootToR2,
+			}, func(r gjson.Result) interface{} {
+				return eventKey(r.Get("room_id").Str, r.Get("state_key").Str, r.Get("type").Str)
+			}, nil),
+		)
 	})
 }
 
@@ -549,21 +580,18 @@ func TestClientSpacesSummaryJoinRules(t *testing.T) {
 			}, nil),
 		},
 	})
-	res = bob.MustDo(t, "GET", []string{"_matrix", "client", "unstable", "org.matrix.msc2946", "rooms", root, "hierarchy"}, nil)
-	must.MatchResponse(t, res, match.HTTPResponse{
-		JSON: []match.JSON{
-			match.JSONCheckOff("rooms", []interface{}{
-				root,
-			}, func(r gjson.Result) interface{} {
-				return r.Get("room_id").Str
-			}, nil),
-			match.JSONCheckOff("rooms.#.children_state|@flatten", []interface{}{
-				rootToR1, rootToSS1,
-			}, func(r gjson.Result) interface{} {
-				return eventKey(r.Get("room_id").Str, r.Get("state_key").Str, r.Get("type").Str)
-			}, nil),
-		},
-	})
+	must.MatchGJSON(t, bob.SpaceHierarchy(t, root, client.SpaceHierarchyReq{}),
+		match.JSONCheckOff("rooms", []interface{}{
+			root,
+		}, func(r gjson.Result) interface{} {
+			return r.Get("room_id").Str
+		}, nil),
+		match.JSONCheckOff("rooms.#.children_state|@flatten", []interface{}{
+			rootToR1, rootToSS1,
+		}, func(r gjson.Result) interface{} {
+			return eventKey(r.Get("room_id").Str, r.Get("state_key").Str, r.Get("type").Str)
+		}, nil),
+	)
 
 	// Invite to R1 and R3, querying again should only show R1 (since SS1 is not visible).
 	alice.InviteRoom(t, r1, bob.UserID)
@@ -584,21 +612,18 @@ func TestClientSpacesSummaryJoinRules(t *testing.T) {
 			}, nil),
 		},
 	})
-	res = bob.MustDo(t, "GET", []string{"_matrix", "client", "unstable", "org.matrix.msc2946", "rooms", root, "hierarchy"}, nil)
-	must.MatchResponse(t, res, match.HTTPResponse{
-		JSON: []match.JSON{
-			match.JSONCheckOff("rooms", []interface{}{
-				root, r1,
-			}, func(r gjson.Result) interface{} {
-				return r.Get("room_id").Str
-			}, nil),
-			match.JSONCheckOff("rooms.#.children_state|@flatten", []interface{}{
-				rootToR1, rootToSS1,
-			}, func(r gjson.Result) interface{} {
-				return eventKey(r.Get("room_id").Str, r.Get("state_key").Str, r.Get("type").Str)
-			}, nil),
-		},
-	})
+	must.MatchGJSON(t, bob.SpaceHierarchy(t, root, client.SpaceHierarchyReq{}),
+		match.JSONCheckOff("rooms", []interface{}{
+			root, r1,
+		}, func(r gjson.Result) interface{} {
+			return r.Get("room_id").Str
+		}, nil),
+		match.JSONCheckOff("rooms.#.children_state|@flatten", []interface{}{
+			rootToR1, rootToSS1,
+		}, func(r gjson.Result) interface{} {
+			return eventKey(r.Get("room_id").Str, r.Get("state_key").Str, r.Get("type").Str)
+		}, nil),
+	)
 
 	// Invite to SS1 and it now appears, as well as the rooms under it.
 	alice.InviteRoom(t, ss1, bob.UserID)
@@ -618,21 +643,18 @@ func TestClientSpacesSummaryJoinRules(t *testing.T) {
 			}, nil),
 		},
 	})
-	res = bob.MustDo(t, "GET", []string{"_matrix", "client", "unstable", "org.matrix.msc2946", "rooms", root, "hierarchy"}, nil)
-	must.MatchResponse(t, res, match.HTTPResponse{
-		JSON: []match.JSON{
-			match.JSONCheckOff("rooms", []interface{}{
-				root, r1, ss1, r2, r3,
-			}, func(r gjson.Result) interface{} {
-				return r.Get("room_id").Str
-			}, nil),
-			match.JSONCheckOff("rooms.#.children_state|@flatten", []interface{}{
-				rootToR1, rootToSS1, ss1ToR2, ss1ToR3,
-			}, func(r gjson.Result) interface{} {
-				return eventKey(r.Get("room_id").Str, r.Get("state_key").Str, r.Get("type").Str)
-			}, nil),
-		},
-	})
+	must.MatchGJSON(t, bob.SpaceHierarchy(t, root, client.SpaceHierarchyReq{}),
+		match.JSONCheckOff("rooms", []interface{}{
+			root, r1, ss1, r2, r3,
+		}, func(r gjson.Result) interface{} {
+			return r.Get("room_id").Str
+		}, nil),
+		match.JSONCheckOff("rooms.#.children_state|@flatten", []interface{}{
+			rootToR1, rootToSS1, ss1ToR2, ss1ToR3,
+		}, func(r gjson.Result) interface{} {
+			return eventKey(r.Get("room_id").Str, r.Get("state_key").Str, r.Get("type").Str)
+		}, nil),
+	)
 }
 
 // Tests that MSC2946 works over federation. Creates a space directory like:
@@ -758,14 +780,119 @@ func TestFederatedClientSpaces(t *testing.T) {
 			}, nil),
 		},
 	})
-	res = alice.MustDo(t, "GET", []string{"_matrix", "client", "unstable", "org.matrix.msc2946", "rooms", root, "hierarchy"}, nil)
-	must.MatchResponse(t, res, match.HTTPResponse{
-		JSON: []match.JSON{
-			match.JSONCheckOff("rooms", []interface{}{
-				root, r1, r2, r3, r4, ss1, ss2,
-			}, func(r gjson.Result) interface{} {
-				return r.Get("room_id").Str
-			}, nil),
+	must.MatchGJSON(t, alice.SpaceHierarchy(t, root, client.SpaceHierarchyReq{}),
+		match.JSONCheckOff("rooms", []interface{}{
+			root, r1, r2, r3, r4, ss1, ss2,
+		}, func(r gjson.Result) interface{} {
+			return r.Get("room_id").Str
+		}, nil),
+	)
+}
+
+// Tests that the children of a space are returned in the order defined by the
+// `order` field of their m.space.child events. Creates a space like:
+//     Root
+//      |
+// _____|_____________________________
+// |        |       |        |        |
+// R1 (b)   R2 (a)  R3 (-)  R4 (long) R5 (\x01)
+//
+// Tests that:
+// - Children with a valid `order` are returned first, sorted lexicographically by `order`.
+// - Children without an `order` are returned afterwards, sorted by room ID.
+// - Children with an invalid `order` (too long or non-printable) are treated as if
+//   they had no `order`.
+func TestClientSpacesSummaryOrdering(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintOneToOneRoom)
+	defer deployment.Destroy(t)
+
+	// create the rooms
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	root := alice.CreateRoom(t, map[string]interface{}{
+		"preset": "public_chat",
+		"name":   "Root",
+		"creation_content": map[string]interface{}{
+			"type": "m.space",
 		},
 	})
+	r1 := alice.CreateRoom(t, map[string]interface{}{
+		"preset": "public_chat",
+		"name":   "R1",
+	})
+	r2 := alice.CreateRoom(t, map[string]interface{}{
+		"preset": "public_chat",
+		"name":   "R2",
+	})
+	r3 := alice.CreateRoom(t, map[string]interface{}{
+		"preset": "public_chat",
+		"name":   "R3",
+	})
+	r4 := alice.CreateRoom(t, map[string]interface{}{
+		"preset": "public_chat",
+		"name":   "R4",
+	})
+	r5 := alice.CreateRoom(t, map[string]interface{}{
+		"preset": "public_chat",
+		"name":   "R5",
+	})
+
+	// create the links
+	alice.AddSpaceChildWithOptions(t, root, r1, []string{"hs1"}, false, "b")
+	alice.AddSpaceChildWithOptions(t, root, r2, []string{"hs1"}, true, "a")
+	// the options round-trip through the room state
+	r2Link := alice.GetSpaceChild(t, root, r2)
+	must.EqualStr(t, r2Link.Get("order").Str, "a", "R2 order")
+	if !r2Link.Get("suggested").Bool() {
+		t.Errorf("R2 link is not suggested: %s", r2Link.Raw)
+	}
+	// The unordered children are linked in room ID order so that the result is
+	// the same if the server falls back to the timestamp of the link.
+	invalidOrders := map[string]interface{}{
+		r4: strings.Repeat("a", 51),
+		r5: "\x01",
+	}
+	unordered := []string{r3, r4, r5}
+	sort.Strings(unordered)
+	for _, roomID := range unordered {
+		roomID := roomID
+		content := map[string]interface{}{
+			"via": []string{"hs1"},
+		}
+		if order, ok := invalidOrders[roomID]; ok {
+			content["order"] = order
+		}
+		alice.SendEventSynced(t, root, b.Event{
+			Type:     spaceChildEventType,
+			StateKey: &roomID,
+			Content:  content,
+		})
+	}
+
+	res := alice.SpaceHierarchy(t, root, client.SpaceHierarchyReq{})
+	var gotRooms []string
+	res.Get("rooms").ForEach(func(_, val gjson.Result) bool {
+		gotRooms = append(gotRooms, val.Get("room_id").Str)
+		return true
+	})
+	must.HaveInOrder(t, gotRooms, append([]string{root, r2, r1}, unordered...))
+
+	// the links in the hierarchy carry the options
+	rootChildren := res.Get("rooms.0.children_state")
+	if len(rootChildren.Array()) != 5 {
+		t.Fatalf("got %d links from the root, want 5: %s", len(rootChildren.Array()), rootChildren.Raw)
+	}
+	for _, link := range rootChildren.Array() {
+		switch link.Get("state_key").Str {
+		case r1:
+			must.EqualStr(t, link.Get("content.order").Str, "b", "R1 order in hierarchy")
+			if link.Get("content.suggested").Bool() {
+				t.Errorf("R1 link is suggested in hierarchy: %s", link.Raw)
+			}
+		case r2:
+			must.EqualStr(t, link.Get("content.order").Str, "a", "R2 order in hierarchy")
+			if !link.Get("content.suggested").Bool() {
+				t.Errorf("R2 link is not suggested in hierarchy: %s", link.Raw)
+			}
+		}
+	}
 }
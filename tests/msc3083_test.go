@@ -6,19 +6,25 @@
 package tests
 
 import (
+	"context"
+	"fmt"
 	"net/url"
 	"testing"
+	"time"
 
+	"github.com/matrix-org/gomatrix"
+	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/tidwall/gjson"
 
 	"github.com/matrix-org/complement/internal/b"
 	"github.com/matrix-org/complement/internal/client"
 	"github.com/matrix-org/complement/internal/docker"
+	"github.com/matrix-org/complement/internal/federation"
 	"github.com/matrix-org/complement/internal/match"
 	"github.com/matrix-org/complement/internal/must"
 )
 
-func failJoinRoom(t *testing.T, c *client.CSAPI, roomIDOrAlias string, serverName string, expectedErrorCode int) {
+func failJoinRoom(t *testing.T, c *client.CSAPI, roomIDOrAlias string, serverName string, expectedErrorCode int, expectedErrcode string) {
 	t.Helper()
 
 	// This is copied from Client.JoinRoom to test a join failure.
@@ -30,9 +36,7 @@ func failJoinRoom(t *testing.T, c *client.CSAPI, roomIDOrAlias string, serverNam
 		[]string{"_matrix", "client", "r0", "join", roomIDOrAlias},
 		client.WithQueries(query),
 	)
-	must.MatchResponse(t, res, match.HTTPResponse{
-		StatusCode: expectedErrorCode,
-	})
+	must.MatchResponse(t, res, match.MatrixError(expectedErrorCode, expectedErrcode))
 }
 
 // Create a space and put a room in it which is set to:
@@ -49,11 +53,11 @@ func setupRestrictedRoom(t *testing.T, deployment *docker.Deployment) (*client.C
 			"type": "m.space",
 		},
 	})
-	// The room is an unstable room version which supports the restricted join_rule.
+	// The room is a room version which supports the restricted join_rule.
 	room := alice.CreateRoom(t, map[string]interface{}{
 		"preset":       "public_chat",
 		"name":         "Room",
-		"room_version": "8",
+		"room_version": alice.GetRoomVersionCapability(t, "restricted"),
 		"initial_state": []map[string]interface{}{
 			{
 				"type":      "m.room.join_rules",
@@ -85,7 +89,14 @@ func setupRestrictedRoom(t *testing.T, deployment *docker.Deployment) (*client.C
 func checkRestrictedRoom(t *testing.T, alice *client.CSAPI, bob *client.CSAPI, space string, room string) {
 	t.Helper()
 
-	failJoinRoom(t, bob, room, "hs1", 403)
+	failJoinRoom(t, bob, room, "hs1", 403, "M_FORBIDDEN")
+
+	// The failed join must not leak the room to bob.
+	filter := `{"room":{"rooms":["` + room + `"],"include_leave":true}}`
+	bob.MustNotSyncUntil(t, time.Second, filter, func(res gjson.Result) bool {
+		roomKey := client.GjsonEscape(room)
+		return res.Get("rooms.join."+roomKey).Exists() || res.Get("rooms.invite."+roomKey).Exists() || res.Get("rooms.leave."+roomKey).Exists()
+	})
 
 	// Join the space, attempt to join the room again, which now should succeed.
 	bob.JoinRoom(t, space, []string{"hs1"})
@@ -109,11 +120,8 @@ func checkRestrictedRoom(t *testing.T, alice *client.CSAPI, bob *client.CSAPI, s
 		return ev.Get("content").Get("membership").Str == "leave"
 	})
 
-	failJoinRoom(t, bob, room, "hs1", 403)
-
 	// Invite the user and joining should work.
-	alice.InviteRoom(t, room, bob.UserID)
-	bob.JoinRoom(t, room, []string{"hs1"})
+	MustAllowInviteBypassInRestrictedRoom(t, alice, bob, room, "hs1")
 
 	// Leave the room again, and join the space.
 	bob.LeaveRoom(t, room)
@@ -136,7 +144,7 @@ func checkRestrictedRoom(t *testing.T, alice *client.CSAPI, bob *client.CSAPI, s
 		},
 	)
 	// Fails since invalid values get filtered out of allow.
-	failJoinRoom(t, bob, room, "hs1", 403)
+	failJoinRoom(t, bob, room, "hs1", 403, "M_FORBIDDEN")
 
 	alice.SendEventSynced(
 		t,
@@ -152,7 +160,38 @@ func checkRestrictedRoom(t *testing.T, alice *client.CSAPI, bob *client.CSAPI, s
 		},
 	)
 	// Fails since a fully invalid allow key requires an invite.
-	failJoinRoom(t, bob, room, "hs1", 403)
+	failJoinRoom(t, bob, room, "hs1", 403, "M_FORBIDDEN")
+}
+
+// MustAllowInviteBypassInRestrictedRoom checks that `invitee`, who must not be a member of any
+// room in the allow list, is unable to join the restricted room until `inviter` invites them,
+// after which the join must succeed as invites always grant access.
+func MustAllowInviteBypassInRestrictedRoom(t *testing.T, inviter *client.CSAPI, invitee *client.CSAPI, room string, serverName string) {
+	t.Helper()
+
+	failJoinRoom(t, invitee, room, serverName, 403, "M_FORBIDDEN")
+
+	inviter.InviteRoom(t, room, invitee.UserID)
+
+	// The invitee is shown the restricted join rules as stripped state, without the
+	// full events.
+	invitee.SyncUntilInviteState(t, room, func(events []gjson.Result) bool {
+		var hasJoinRules bool
+		for _, ev := range events {
+			if ev.Get("type").Str == "m.room.member" && ev.Get("state_key").Str == invitee.UserID {
+				continue
+			}
+			if ev.Get("event_id").Exists() {
+				t.Errorf("invite state includes a full event rather than stripped state: %s", ev.Raw)
+			}
+			if ev.Get("type").Str == "m.room.join_rules" {
+				hasJoinRules = ev.Get("content.join_rule").Str == "restricted"
+			}
+		}
+		return hasJoinRules
+	})
+
+	invitee.JoinRoom(t, room, []string{serverName})
 }
 
 // Test joining a room with join rules restricted to membership in a space.
@@ -185,6 +224,219 @@ func TestRestrictedRoomsRemoteJoin(t *testing.T) {
 	checkRestrictedRoom(t, alice, bob, space, room)
 }
 
+// Test that an invite to a restricted room grants access without membership in the space.
+func TestRestrictedRoomsLocalInviteBypass(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintOneToOneRoom)
+	defer deployment.Destroy(t)
+
+	// Setup the user, space, and restricted room.
+	alice, _, room := setupRestrictedRoom(t, deployment)
+
+	// Create a second user on the same homeserver, who never joins the space.
+	bob := deployment.Client(t, "hs1", "@bob:hs1")
+
+	MustAllowInviteBypassInRestrictedRoom(t, alice, bob, room, "hs1")
+}
+
+// Test that an invite to a restricted room grants access without membership in
+// the space, when the invited user is on a different homeserver.
+func TestRestrictedRoomsRemoteInviteBypass(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintFederationOneToOneRoom)
+	defer deployment.Destroy(t)
+
+	// Setup the user, space, and restricted room.
+	alice, _, room := setupRestrictedRoom(t, deployment)
+
+	// Create a second user on a different homeserver, who never joins the space.
+	bob := deployment.Client(t, "hs2", "@bob:hs2")
+
+	MustAllowInviteBypassInRestrictedRoom(t, alice, bob, room, "hs1")
+}
+
+// Test that a user banned from a restricted room cannot rejoin it via the space, but can once unbanned.
+func TestRestrictedRoomsBannedUserCannotJoin(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintOneToOneRoom)
+	defer deployment.Destroy(t)
+
+	// Setup the user, space, and restricted room.
+	alice, space, room := setupRestrictedRoom(t, deployment)
+
+	// Bob joins the space and the room, and is then banned from the room.
+	bob := deployment.Client(t, "hs1", "@bob:hs1")
+	bob.JoinRoom(t, space, []string{"hs1"})
+	bob.JoinRoom(t, room, []string{"hs1"})
+	alice.BanUser(t, room, bob.UserID, "Banned from the room, not the space")
+
+	// Membership of the space does not override the ban.
+	failJoinRoom(t, bob, room, "hs1", 403, "M_FORBIDDEN")
+
+	alice.UnbanUser(t, room, bob.UserID, "")
+	bob.JoinRoom(t, room, []string{"hs1"})
+}
+
+// Test that guest users cannot join a restricted room, as they cannot be members of the space.
+func TestRestrictedRoomsGuestCannotJoin(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintAliceGuestAccess)
+	defer deployment.Destroy(t)
+
+	// Setup the user, space, and restricted room.
+	alice, _, room := setupRestrictedRoom(t, deployment)
+
+	// Allow guests to join, so that it is the restricted join rule which rejects the guest.
+	alice.SendEventSynced(t, room, b.Event{
+		Type:     "m.room.guest_access",
+		StateKey: b.Ptr(""),
+		Content: map[string]interface{}{
+			"guest_access": "can_join",
+		},
+	})
+
+	guest := deployment.RegisterGuest(t, "hs1")
+	failJoinRoom(t, guest, room, "hs1", 403, "M_FORBIDDEN")
+}
+
+// joinRoomConcurrently makes every client join the room at the same time, failing
+// the test if any of the joins fail.
+func joinRoomConcurrently(t *testing.T, clients []*client.CSAPI, roomID string, serverNames []string) {
+	t.Helper()
+
+	t.Run("Parallel", func(t *testing.T) {
+		for _, c := range clients {
+			c := c
+			t.Run(c.UserID, func(t *testing.T) {
+				t.Parallel()
+				c.JoinRoom(t, roomID, serverNames)
+			})
+		}
+	})
+}
+
+// checkConcurrentRestrictedJoins registers several users on the given
+// homeserver, joins them all to the space and then has them join the restricted
+// room concurrently. Every join must be authorised by alice and the room must end
+// up with exactly one membership per user.
+func checkConcurrentRestrictedJoins(t *testing.T, deployment *docker.Deployment, alice *client.CSAPI, space string, room string, hsName string) {
+	t.Helper()
+
+	const numUsers = 5
+	users := make([]*client.CSAPI, numUsers)
+	wantJoined := []interface{}{alice.UserID}
+	for i := range users {
+		users[i] = deployment.RegisterUser(t, hsName, fmt.Sprintf("concurrent_joiner_%d", i), "password")
+		users[i].JoinRoom(t, space, []string{"hs1"})
+		wantJoined = append(wantJoined, users[i].UserID)
+	}
+
+	joinRoomConcurrently(t, users, room, []string{"hs1"})
+
+	// Wait until alice has seen every join, checking each was authorised by her.
+	waitingFor := make(map[string]bool, numUsers)
+	for _, u := range users {
+		waitingFor[u.UserID] = true
+	}
+	alice.SyncUntilTimelineHas(t, room, func(ev gjson.Result) bool {
+		if ev.Get("type").Str != "m.room.member" || !waitingFor[ev.Get("state_key").Str] {
+			return false
+		}
+		must.EqualStr(t, ev.Get("content").Get("membership").Str, "join", "User failed to join the room")
+		must.EqualStr(t, ev.Get("content").Get("join_authorised_via_users_server").Str, alice.UserID, "Join authorised via incorrect user")
+		delete(waitingFor, ev.Get("state_key").Str)
+		return len(waitingFor) == 0
+	})
+
+	// The room should have exactly one membership per user.
+	res := alice.MustDoFunc(t, "GET", []string{"_matrix", "client", "r0", "rooms", room, "joined_members"})
+	must.MatchResponse(t, res, match.HTTPResponse{
+		JSON: []match.JSON{
+			match.JSONCheckOff("joined", wantJoined, func(r gjson.Result) interface{} {
+				return r.Str
+			}, nil),
+		},
+	})
+}
+
+// Test many users in the space joining a restricted room at the same time.
+func TestRestrictedRoomsLocalConcurrentJoins(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintOneToOneRoom)
+	defer deployment.Destroy(t)
+
+	// Setup the user, space, and restricted room.
+	alice, space, room := setupRestrictedRoom(t, deployment)
+
+	checkConcurrentRestrictedJoins(t, deployment, alice, space, room, "hs1")
+}
+
+// Test many users in the space on a different homeserver joining a restricted
+// room at the same time.
+func TestRestrictedRoomsRemoteConcurrentJoins(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintFederationOneToOneRoom)
+	defer deployment.Destroy(t)
+
+	// Setup the user, space, and restricted room.
+	alice, space, room := setupRestrictedRoom(t, deployment)
+
+	checkConcurrentRestrictedJoins(t, deployment, alice, space, room, "hs2")
+}
+
+// checkSpaceLeaveRevokesAccess checks that as soon as the authorising server has
+// seen bob leave the space, bob can no longer join the restricted room, and that
+// access is restored as soon as it has seen bob rejoin the space.
+func checkSpaceLeaveRevokesAccess(t *testing.T, alice *client.CSAPI, bob *client.CSAPI, space string, room string) {
+	t.Helper()
+
+	bob.JoinRoom(t, space, []string{"hs1"})
+	bob.JoinRoom(t, room, []string{"hs1"})
+	bob.LeaveRoom(t, room)
+
+	// Leave the space and attempt to join as soon as the leave has been seen.
+	bob.LeaveRoom(t, space)
+	alice.SyncUntilMembership(t, space, bob.UserID, "leave")
+	leaveSeen := time.Now()
+	failJoinRoom(t, bob, room, "hs1", 403, "M_FORBIDDEN")
+	t.Logf("Join was rejected %s after the space leave was seen", time.Since(leaveSeen))
+
+	// Rejoin the space and attempt to join as soon as the join has been seen. Sync from after the leave so
+	// that bob's first join of the space does not match.
+	_, since := alice.MustSync(t, client.SyncReq{})
+	bob.JoinRoom(t, space, []string{"hs1"})
+	alice.SyncUntil(t, since, "", "rooms.join."+client.GjsonEscape(space)+".timeline.events", func(ev gjson.Result) bool {
+		return ev.Get("type").Str == "m.room.member" && ev.Get("state_key").Str == bob.UserID && ev.Get("content.membership").Str == "join"
+	})
+	joinSeen := time.Now()
+	bob.JoinRoom(t, room, []string{"hs1"})
+	t.Logf("Join was accepted %s after the space rejoin was seen", time.Since(joinSeen))
+}
+
+// Test that leaving a space promptly revokes access to a restricted room, and
+// rejoining promptly restores it.
+func TestRestrictedRoomsLocalSpaceLeaveRevokesAccess(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintOneToOneRoom)
+	defer deployment.Destroy(t)
+
+	// Setup the user, space, and restricted room.
+	alice, space, room := setupRestrictedRoom(t, deployment)
+
+	// Create a second user on the same homeserver.
+	bob := deployment.Client(t, "hs1", "@bob:hs1")
+
+	checkSpaceLeaveRevokesAccess(t, alice, bob, space, room)
+}
+
+// Test that leaving a space promptly revokes access to a restricted room, and
+// rejoining promptly restores it, when the user is on a different homeserver.
+func TestRestrictedRoomsRemoteSpaceLeaveRevokesAccess(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintFederationOneToOneRoom)
+	defer deployment.Destroy(t)
+
+	// Setup the user, space, and restricted room.
+	alice, space, room := setupRestrictedRoom(t, deployment)
+
+	// Create a second user on a different homeserver.
+	bob := deployment.Client(t, "hs2", "@bob:hs2")
+
+	checkSpaceLeaveRevokesAccess(t, alice, bob, space, room)
+}
+
 // A server will do a remote join for a local user if it is unable to to issue
 // joins in a restricted room it is already participating in.
 func TestRestrictedRoomsRemoteJoinLocalUser(t *testing.T) {
@@ -200,11 +452,11 @@ func TestRestrictedRoomsRemoteJoinLocalUser(t *testing.T) {
 			"type": "m.space",
 		},
 	})
-	// The room is an unstable room version which supports the restricted join_rule.
+	// The room is a room version which supports the restricted join_rule.
 	room := charlie.CreateRoom(t, map[string]interface{}{
 		"preset":       "public_chat",
 		"name":         "Room",
-		"room_version": "8",
+		"room_version": charlie.GetRoomVersionCapability(t, "restricted"),
 		"initial_state": []map[string]interface{}{
 			{
 				"type":      "m.room.join_rules",
@@ -237,21 +489,11 @@ func TestRestrictedRoomsRemoteJoinLocalUser(t *testing.T) {
 
 	// Confirm that Alice cannot issue invites (due to the default power levels).
 	bob := deployment.Client(t, "hs1", "@bob:hs1")
-	body := map[string]interface{}{
-		"user_id": bob.UserID,
-	}
-	res := alice.DoFunc(
-		t,
-		"POST",
-		[]string{"_matrix", "client", "r0", "rooms", room, "invite"},
-		client.WithJSONBody(t, body),
-	)
-	must.MatchResponse(t, res, match.HTTPResponse{
-		StatusCode: 403,
-	})
+	res := alice.InviteRoomError(t, room, bob.UserID)
+	must.MatchResponse(t, res, match.MatrixError(403, "M_FORBIDDEN"))
 
 	// Bob cannot join the room.
-	failJoinRoom(t, bob, room, "hs1", 403)
+	failJoinRoom(t, bob, room, "hs1", 403, "M_FORBIDDEN")
 
 	// Join the space via hs2.
 	bob.JoinRoom(t, space, []string{"hs2"})
@@ -310,6 +552,61 @@ func TestRestrictedRoomsRemoteJoinLocalUser(t *testing.T) {
 	bob.JoinRoom(t, room, []string{"hs1"})
 }
 
+// A server must reject a /send_join for a user who claims to have been authorised
+// to join a restricted room when no resident user authorised it.
+func TestRestrictedRoomsRejectsForgedSendJoin(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintAlice)
+	defer deployment.Destroy(t)
+
+	srv := federation.NewServer(t, deployment,
+		federation.HandleKeyRequests(),
+		federation.HandleTransactionRequests(nil, nil),
+	)
+	cancel := srv.Listen()
+	defer cancel()
+
+	fedClient := srv.FederationClient(deployment)
+
+	// Setup the user, space, and restricted room.
+	alice, space, room := setupRestrictedRoom(t, deployment)
+
+	// charlie joins the space, so is allowed to join the room.
+	charlie := srv.UserID("charlie")
+	srv.MustJoinRoom(t, deployment, "hs1", space, charlie)
+
+	// charlie sends a make_join, which hs1 authorises via one of its users...
+	makeJoinResp, err := fedClient.MakeJoin(context.Background(), "hs1", room, charlie, federation.SupportedRoomVersions())
+	must.NotError(t, "MakeJoin", err)
+
+	// ... and does a switcheroo to turn it into a join for mallory, who is not in
+	// the space, while keeping the claim that the join was authorised.
+	mallory := srv.UserID("mallory")
+	makeJoinResp.JoinEvent.Sender = mallory
+	makeJoinResp.JoinEvent.StateKey = &mallory
+	joinEvent, err := makeJoinResp.JoinEvent.Build(time.Now(), gomatrixserverlib.ServerName(srv.ServerName), srv.KeyID, srv.Priv, makeJoinResp.RoomVersion)
+	must.NotError(t, "JoinEvent.Build", err)
+	t.Logf("Forged join event: %s", string(joinEvent.JSON()))
+
+	// SendJoin should return a 403.
+	_, err = fedClient.SendJoin(context.Background(), "hs1", joinEvent, makeJoinResp.RoomVersion)
+	if err == nil {
+		t.Errorf("SendJoin returned 200, want 403")
+	} else if httpError, ok := err.(gomatrix.HTTPError); ok {
+		t.Logf("SendJoin => %d/%s", httpError.Code, string(httpError.Contents))
+		if httpError.Code != 403 {
+			t.Errorf("expected 403, got %d", httpError.Code)
+		}
+	} else {
+		t.Errorf("SendJoin: non-HTTPError: %v", err)
+	}
+
+	// Alice checks the room state to check that mallory isn't a member.
+	res := alice.DoFunc(t, "GET", []string{"_matrix", "client", "r0", "rooms", room, "state", "m.room.member", mallory})
+	must.MatchResponse(t, res, match.HTTPResponse{
+		StatusCode: 404,
+	})
+}
+
 // A server will request a failover if asked to /make_join and it does not have
 // the appropriate authorisation to complete the request.
 //
@@ -356,16 +653,8 @@ func TestRestrictedRoomsRemoteJoinFailOver(t *testing.T) {
 	alice, space, room := setupRestrictedRoom(t, deployment)
 
 	// Raise the power level so that only alice can invite.
-	state_key := ""
-	alice.SendEventSynced(t, room, b.Event{
-		Type:     "m.room.power_levels",
-		StateKey: &state_key,
-		Content: map[string]interface{}{
-			"invite": 100,
-			"users": map[string]interface{}{
-				alice.UserID: 100,
-			},
-		},
+	alice.SetPowerLevels(t, room, client.PowerLevelChanges{
+		Actions: map[string]int{"invite": 100},
 	})
 
 	// Create a second user on a different homeserver.
@@ -375,12 +664,17 @@ func TestRestrictedRoomsRemoteJoinFailOver(t *testing.T) {
 	bob.JoinRoom(t, space, []string{"hs1"})
 	bob.JoinRoom(t, room, []string{"hs1"})
 
+	// Wait for hs2 to have the restricted join rules, as it will be asked to authorise joins.
+	bob.SyncUntilHasState(t, room, "m.room.join_rules", "", func(ev gjson.Result) bool {
+		return ev.Get("content.join_rule").Str == "restricted"
+	})
+
 	// Charlie should join the space (which gives access to the room).
 	charlie := deployment.Client(t, "hs3", "@charlie:hs3")
 	charlie.JoinRoom(t, space, []string{"hs1"})
 
 	// hs2 doesn't have anyone to invite from, so the join fails.
-	failJoinRoom(t, charlie, room, "hs2", 502)
+	failJoinRoom(t, charlie, room, "hs2", 502, "M_UNKNOWN")
 
 	// Including hs1 (and failing over to it) allows the join to succeed.
 	charlie.JoinRoom(t, room, []string{"hs2", "hs1"})
@@ -399,18 +693,11 @@ func TestRestrictedRoomsRemoteJoinFailOver(t *testing.T) {
 			return true
 		},
 	)
+	deployment.AssertJoinViaServer(t, room, charlie, "hs1")
 
 	// Bump the power-level of bob.
-	alice.SendEventSynced(t, room, b.Event{
-		Type:     "m.room.power_levels",
-		StateKey: &state_key,
-		Content: map[string]interface{}{
-			"invite": 100,
-			"users": map[string]interface{}{
-				alice.UserID: 100,
-				bob.UserID:   100,
-			},
-		},
+	alice.SetPowerLevels(t, room, client.PowerLevelChanges{
+		Users: map[string]int{bob.UserID: 100},
 	})
 
 	// Charlie leaves the room (so they can rejoin).
@@ -433,7 +720,7 @@ func TestRestrictedRoomsRemoteJoinFailOver(t *testing.T) {
 
 	// hs2 cannot complete the join since they do not know if Charlie meets the
 	// requirements (since it is no longer in the space).
-	failJoinRoom(t, charlie, room, "hs2", 502)
+	failJoinRoom(t, charlie, room, "hs2", 502, "M_UNKNOWN")
 
 	// Including hs1 (and failing over to it) allows the join to succeed.
 	charlie.JoinRoom(t, room, []string{"hs2", "hs1"})
@@ -452,6 +739,21 @@ func TestRestrictedRoomsRemoteJoinFailOver(t *testing.T) {
 			return true
 		},
 	)
+	deployment.AssertJoinViaServer(t, room, charlie, "hs1")
+
+	// Every server agrees that charlie is joined.
+	client.AssertStateConverged(t, room, []*client.CSAPI{alice, bob, charlie}, "m.room.member", charlie.UserID)
+
+	// Bob leaving the space did not remove anyone from the room.
+	members := charlie.JoinedMembers(t, room)
+	for _, userID := range []string{alice.UserID, bob.UserID, charlie.UserID} {
+		if _, ok := members[userID]; !ok {
+			t.Errorf("%s is not joined to the room, joined members: %v", userID, members)
+		}
+	}
+	if len(members) != 3 {
+		t.Errorf("got %d joined members, want 3: %v", len(members), members)
+	}
 }
 
 // Request the room summary and ensure the expected rooms are in the response.
@@ -498,11 +800,11 @@ func TestRestrictedRoomsSpacesSummary(t *testing.T) {
 			},
 		},
 	})
-	// The room is an unstable room version which supports the restricted join_rule.
+	// The room is a room version which supports the restricted join_rule.
 	room := alice.CreateRoom(t, map[string]interface{}{
 		"preset":       "public_chat",
 		"name":         "Room",
-		"room_version": "8",
+		"room_version": alice.GetRoomVersionCapability(t, "restricted"),
 		"initial_state": []map[string]interface{}{
 			{
 				"type":      "m.room.join_rules",
@@ -542,6 +844,108 @@ func TestRestrictedRoomsSpacesSummary(t *testing.T) {
 	requestAndAssertSummary(t, bob, space, []interface{}{space, room})
 }
 
+// Request the room hierarchy and ensure the expected rooms are in the response.
+func requestAndAssertHierarchy(t *testing.T, user *client.CSAPI, space string, expected_rooms []interface{}) {
+	t.Helper()
+
+	must.MatchGJSON(t, user.SpaceHierarchy(t, space, client.SpaceHierarchyReq{}),
+		match.JSONCheckOff("rooms", expected_rooms, func(r gjson.Result) interface{} {
+			return r.Get("room_id").Str
+		}, nil),
+	)
+}
+
+// Tests that MSC2946 works for a restricted room whose allowed space is nested
+// under another space.
+//
+// Create a parent space containing a child space, which contains a room that has
+// join rules restricted to membership in the child space.
+//
+// Membership of the parent space alone must not make the room visible, only
+// membership of the child space does.
+func TestRestrictedRoomsSpacesSummaryNested(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintOneToOneRoom)
+	defer deployment.Destroy(t)
+
+	worldReadableSpace := func(name string) map[string]interface{} {
+		return map[string]interface{}{
+			"preset": "public_chat",
+			"name":   name,
+			"creation_content": map[string]interface{}{
+				"type": "m.space",
+			},
+			"initial_state": []map[string]interface{}{
+				{
+					"type":      "m.room.history_visibility",
+					"state_key": "",
+					"content": map[string]interface{}{
+						"history_visibility": "world_readable",
+					},
+				},
+			},
+		}
+	}
+
+	// Create the rooms
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	parentSpace := alice.CreateRoom(t, worldReadableSpace("Parent Space"))
+	childSpace := alice.CreateRoom(t, worldReadableSpace("Child Space"))
+	// The room is a room version which supports the restricted join_rule.
+	room := alice.CreateRoom(t, map[string]interface{}{
+		"preset":       "public_chat",
+		"name":         "Room",
+		"room_version": alice.GetRoomVersionCapability(t, "restricted"),
+		"initial_state": []map[string]interface{}{
+			{
+				"type":      "m.room.join_rules",
+				"state_key": "",
+				"content": map[string]interface{}{
+					"join_rule": "restricted",
+					"allow": []map[string]interface{}{
+						{
+							"type":    "m.room_membership",
+							"room_id": &childSpace,
+							"via":     []string{"hs1"},
+						},
+					},
+				},
+			},
+		},
+	})
+	alice.SendEventSynced(t, parentSpace, b.Event{
+		Type:     spaceChildEventType,
+		StateKey: &childSpace,
+		Content: map[string]interface{}{
+			"via": []string{"hs1"},
+		},
+	})
+	alice.SendEventSynced(t, childSpace, b.Event{
+		Type:     spaceChildEventType,
+		StateKey: &room,
+		Content: map[string]interface{}{
+			"via": []string{"hs1"},
+		},
+	})
+
+	// Create a second user on the same homeserver.
+	bob := deployment.Client(t, "hs1", "@bob:hs1")
+
+	// Querying the parent space returns only the spaces, as the room is restricted.
+	requestAndAssertSummary(t, bob, parentSpace, []interface{}{parentSpace, childSpace})
+	requestAndAssertHierarchy(t, bob, parentSpace, []interface{}{parentSpace, childSpace})
+
+	// Joining the parent space does not grant access to the room.
+	bob.JoinRoom(t, parentSpace, []string{"hs1"})
+	requestAndAssertSummary(t, bob, parentSpace, []interface{}{parentSpace, childSpace})
+	requestAndAssertHierarchy(t, bob, parentSpace, []interface{}{parentSpace, childSpace})
+	failJoinRoom(t, bob, room, "hs1", 403, "M_FORBIDDEN")
+
+	// Joining the child space does, so now the restricted room should appear.
+	bob.JoinRoom(t, childSpace, []string{"hs1"})
+	requestAndAssertSummary(t, bob, parentSpace, []interface{}{parentSpace, childSpace, room})
+	requestAndAssertHierarchy(t, bob, parentSpace, []interface{}{parentSpace, childSpace, room})
+}
+
 // Tests that MSC2946 works over federation for a restricted room.
 //
 // Create a space with a room in it that has join rules restricted to membership
@@ -579,13 +983,13 @@ func TestRestrictedRoomsSpacesSummaryFederation(t *testing.T) {
 		},
 	})
 
-	// The room is an unstable room version which supports the restricted join_rule
+	// The room is a room version which supports the restricted join_rule
 	// and is created on hs2.
 	charlie := deployment.Client(t, "hs2", "@charlie:hs2")
 	room := charlie.CreateRoom(t, map[string]interface{}{
 		"preset":       "public_chat",
 		"name":         "Room",
-		"room_version": "8",
+		"room_version": charlie.GetRoomVersionCapability(t, "restricted"),
 		"initial_state": []map[string]interface{}{
 			{
 				"type":      "m.room.join_rules",
@@ -0,0 +1,84 @@
+package tests
+
+import (
+	"context"
+	"testing"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/docker"
+)
+
+// Test that two deployments of the same blueprint can run at once without seeing each other, and that destroying
+// one leaves the other running.
+func TestMultipleDeployments(t *testing.T) {
+	deployment1 := Deploy(t, b.BlueprintAlice)
+	destroyed1 := false
+	defer func() {
+		if !destroyed1 {
+			deployment1.Destroy(t)
+		}
+	}()
+	deployment2 := Deploy(t, b.BlueprintAlice)
+	defer deployment2.Destroy(t)
+
+	alice1 := deployment1.Client(t, "hs1", "@alice:hs1")
+	alice2 := deployment2.Client(t, "hs1", "@alice:hs1")
+
+	t.Run("Deployments have their own containers and networks", func(t *testing.T) {
+		name1 := mustContainerNameOnNetwork(t, deployment1)
+		name2 := mustContainerNameOnNetwork(t, deployment2)
+		if name1 == name2 {
+			t.Errorf("both deployments' hs1 containers are named %s", name1)
+		}
+		if deployment1.NetworkID() == deployment2.NetworkID() {
+			t.Errorf("both deployments are on network %s", deployment1.NetworkID())
+		}
+	})
+
+	t.Run("A room made on one deployment does not exist on the other", func(t *testing.T) {
+		roomID := alice1.CreateRoom(t, map[string]interface{}{
+			"preset": "public_chat",
+		})
+		for _, roomID2 := range alice2.JoinedRooms(t) {
+			if roomID2 == roomID {
+				t.Fatalf("room %s made on the first deployment is joined on the second deployment", roomID)
+			}
+		}
+	})
+
+	t.Run("Destroying one deployment leaves the other running", func(t *testing.T) {
+		network1 := deployment1.NetworkID()
+		deployment1.Destroy(t)
+		destroyed1 = true
+
+		dockerClient := deployment2.Deployer.Docker
+		if _, err := dockerClient.NetworkInspect(context.Background(), network1); err == nil {
+			t.Errorf("network %s of the destroyed deployment still exists", network1)
+		}
+		if _, err := dockerClient.NetworkInspect(context.Background(), deployment2.NetworkID()); err != nil {
+			t.Fatalf("network %s of the remaining deployment was removed: %s", deployment2.NetworkID(), err)
+		}
+		mustContainerNameOnNetwork(t, deployment2)
+		alice2.CreateRoom(t, map[string]interface{}{})
+	})
+}
+
+// mustContainerNameOnNetwork returns the name of the deployment's hs1 container, failing the test if the container
+// is not running on the deployment's network.
+func mustContainerNameOnNetwork(t *testing.T, deployment *docker.Deployment) string {
+	t.Helper()
+	inspect, err := deployment.Deployer.Docker.ContainerInspect(context.Background(), deployment.HS["hs1"].ContainerID)
+	if err != nil {
+		t.Fatalf("failed to inspect the hs1 container: %s", err)
+	}
+	if !inspect.State.Running {
+		t.Fatalf("hs1 container %s is not running", inspect.Name)
+	}
+	for _, nw := range inspect.NetworkSettings.Networks {
+		if nw.NetworkID == deployment.NetworkID() {
+			return inspect.Name
+		}
+	}
+	t.Fatalf("hs1 container %s is not on the deployment's network %s", inspect.Name, deployment.NetworkID())
+	return ""
+}
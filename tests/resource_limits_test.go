@@ -0,0 +1,36 @@
+package tests
+
+import (
+	"context"
+	"testing"
+
+	"github.com/matrix-org/complement/internal/b"
+)
+
+// Test that a homeserver is deployed with the resource limits in its blueprint, and still serves requests.
+func TestResourceLimitedHomeserver(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintAliceResourceLimited)
+	defer deployment.Destroy(t)
+
+	inspect, err := deployment.Deployer.Docker.ContainerInspect(context.Background(), deployment.HS["hs1"].ContainerID)
+	if err != nil {
+		t.Fatalf("failed to inspect the hs1 container: %s", err)
+	}
+	if inspect.HostConfig.Memory != 1024*1024*1024 {
+		t.Errorf("hs1 container has a memory limit of %d bytes, want %d", inspect.HostConfig.Memory, 1024*1024*1024)
+	}
+	if inspect.HostConfig.NanoCPUs != 500000000 {
+		t.Errorf("hs1 container has a CPU limit of %d nano CPUs, want %d", inspect.HostConfig.NanoCPUs, 500000000)
+	}
+
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+
+	roomID := alice.CreateRoom(t, map[string]interface{}{})
+	alice.SendEventSynced(t, roomID, b.Event{
+		Type: "m.room.message",
+		Content: map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    "Hello from a constrained homeserver",
+		},
+	})
+}